@@ -0,0 +1,365 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+const DefaultMaxGroups = 10000
+
+var ErrTooManyGroups = errors.New("too many aggregation groups")
+
+const (
+	AccCount    = "count"
+	AccSum      = "sum"
+	AccMin      = "min"
+	AccMax      = "max"
+	AccDistinct = "distinct"
+)
+
+// Accumulator folds Field over every document of a group. Count ignores
+// Field; Distinct is an estimate with about 3% standard error.
+type Accumulator struct {
+	Name  string
+	Kind  string
+	Field string
+}
+
+// GroupKey groups by Field. A non-zero Bucket truncates time values, so
+// 24*time.Hour groups by UTC day.
+type GroupKey struct {
+	Field  string
+	Bucket time.Duration
+}
+
+// Pipeline describes an Aggregate. Filters run in Firestore and only the
+// fields the pipeline reads are fetched. Groups are sorted by SortBy, an
+// accumulator name or group field, or by group key when it is empty.
+type Pipeline struct {
+	Filters      []Filter
+	GroupBy      []GroupKey
+	Accumulators []Accumulator
+	SortBy       string
+	Desc         bool
+	Limit        int
+	MaxGroups    int
+}
+
+type AggGroup struct {
+	Key    []interface{}
+	Values map[string]interface{}
+}
+
+// AggResult reports Scanned, the number of documents read, which is what
+// the aggregation is billed for.
+type AggResult struct {
+	Groups  []AggGroup
+	Scanned int
+}
+
+const hll_precision = 10
+
+type hllSketch [1 << hll_precision]uint8
+
+func (s *hllSketch) add(value interface{}) {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%T:%v", value, value)
+	// FNV spreads short inputs poorly over the high bits that pick the
+	// register, so they are mixed first.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	i := x >> (64 - hll_precision)
+	w := x<<hll_precision | 1<<(hll_precision-1)
+	rank := uint8(bits.LeadingZeros64(w) + 1)
+	if rank > s[i] {
+		s[i] = rank
+	}
+}
+
+func (s *hllSketch) estimate() int64 {
+	m := float64(len(s))
+	sum := 0.0
+	zeros := 0
+	for _, rank := range s {
+		sum += math.Pow(2, -float64(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(estimate))
+}
+
+type aggState struct {
+	key      []interface{}
+	count    int64
+	sums     map[string]float64
+	extremes map[string]interface{}
+	sketches map[string]*hllSketch
+}
+
+func (p *Pipeline) validate(collection_path string) error {
+	names := map[string]bool{}
+	for _, acc := range p.Accumulators {
+		if acc.Name == "" || names[acc.Name] {
+			return fmt.Errorf("%s:Aggregate - missing or duplicate name %q: %w",
+				collection_path, acc.Name, ErrInvalidQuery)
+		}
+		names[acc.Name] = true
+		switch acc.Kind {
+		case AccCount:
+		case AccSum, AccMin, AccMax, AccDistinct:
+			if acc.Field == "" {
+				return fmt.Errorf("%s:Aggregate - %s needs a field: %w",
+					collection_path, acc.Name, ErrInvalidQuery)
+			}
+		default:
+			return fmt.Errorf("%s:Aggregate - unknown accumulator %q: %w",
+				collection_path, acc.Kind, ErrInvalidQuery)
+		}
+	}
+	for _, key := range p.GroupBy {
+		if key.Field == "" {
+			return fmt.Errorf("%s:Aggregate - group key with empty field: %w",
+				collection_path, ErrInvalidQuery)
+		}
+	}
+	return (&ListQuery{Filters: p.Filters}).validate(collection_path)
+}
+
+func (p *Pipeline) fields() []string {
+	seen := map[string]bool{}
+	var fields []string
+	add := func(field string) {
+		if field != "" && !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+	for _, key := range p.GroupBy {
+		add(key.Field)
+	}
+	for _, acc := range p.Accumulators {
+		if acc.Kind != AccCount {
+			add(acc.Field)
+		}
+	}
+	return fields
+}
+
+// checkFields fails when a field the pipeline reads is not stored by the
+// model of obj. Models that are not plain structs, such as RawObject or
+// structs embedding others, are not checked.
+func (p *Pipeline) checkFields(collection_path string, obj ObjectV2) error {
+	model := reflect.ValueOf(storedValue(obj))
+	for model.Kind() == reflect.Ptr && !model.IsNil() {
+		model = model.Elem()
+	}
+	if model.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i < model.NumField(); i++ {
+		if model.Type().Field(i).Anonymous {
+			return nil
+		}
+	}
+	for _, field := range p.fields() {
+		name := strings.SplitN(field, ".", 2)[0]
+		if _, ok := storedField(model.Interface(), name); !ok {
+			return fmt.Errorf("%s:Aggregate - %T stores no field %q: %w",
+				collection_path, model.Interface(), name, ErrInvalidQuery)
+		}
+	}
+	return nil
+}
+
+func (p *Pipeline) groupKey(doc *firestore.DocumentSnapshot) (
+	[]interface{}, string) {
+	key := make([]interface{}, len(p.GroupBy))
+	parts := make([]string, len(p.GroupBy))
+	for i, group := range p.GroupBy {
+		value, _ := doc.DataAt(group.Field)
+		if t, ok := value.(time.Time); ok && group.Bucket > 0 {
+			value = t.UTC().Truncate(group.Bucket)
+		}
+		key[i] = value
+		parts[i] = fmt.Sprintf("%T:%v", value, value)
+	}
+	return key, strings.Join(parts, "\x00")
+}
+
+func (p *Pipeline) fold(state *aggState, doc *firestore.DocumentSnapshot) {
+	state.count++
+	for _, acc := range p.Accumulators {
+		if acc.Kind == AccCount {
+			continue
+		}
+		value, err := doc.DataAt(acc.Field)
+		if err != nil || value == nil {
+			continue
+		}
+		switch acc.Kind {
+		case AccSum:
+			if v := reflect.ValueOf(value); isNumberValue(v) {
+				state.sums[acc.Name] += numberValue(v)
+			}
+		case AccMin, AccMax:
+			current, ok := state.extremes[acc.Name]
+			if !ok {
+				state.extremes[acc.Name] = value
+				continue
+			}
+			result, comparable := compareValues(value, current)
+			if comparable && (acc.Kind == AccMin && result < 0 ||
+				acc.Kind == AccMax && result > 0) {
+				state.extremes[acc.Name] = value
+			}
+		case AccDistinct:
+			sketch := state.sketches[acc.Name]
+			if sketch == nil {
+				sketch = &hllSketch{}
+				state.sketches[acc.Name] = sketch
+			}
+			sketch.add(value)
+		}
+	}
+}
+
+func (p *Pipeline) result(state *aggState) AggGroup {
+	values := map[string]interface{}{}
+	for _, acc := range p.Accumulators {
+		switch acc.Kind {
+		case AccCount:
+			values[acc.Name] = state.count
+		case AccSum:
+			values[acc.Name] = state.sums[acc.Name]
+		case AccMin, AccMax:
+			values[acc.Name] = state.extremes[acc.Name]
+		case AccDistinct:
+			var estimate int64
+			if sketch := state.sketches[acc.Name]; sketch != nil {
+				estimate = sketch.estimate()
+			}
+			values[acc.Name] = estimate
+		}
+	}
+	return AggGroup{Key: state.key, Values: values}
+}
+
+func (p *Pipeline) sortValue(group AggGroup) ([]interface{}, bool) {
+	if value, ok := group.Values[p.SortBy]; ok {
+		return []interface{}{value}, true
+	}
+	for i, key := range p.GroupBy {
+		if key.Field == p.SortBy {
+			return []interface{}{group.Key[i]}, true
+		}
+	}
+	return group.Key, p.SortBy == ""
+}
+
+// Aggregate streams the documents of collection through p, holding one
+// accumulator state per group and nothing per document. The fields p reads
+// must be stored by obj's model. It fails with ErrTooManyGroups once more
+// than p.MaxGroups groups appear.
+func (db *FirestoreDb) Aggregate(ctx context.Context, obj Object,
+	collection []string, p Pipeline) (AggResult, error) {
+	collection_path, err := getCollectionPath(collection, db.allow_reserved)
+	if err != nil {
+		return AggResult{}, err
+	}
+	if err := p.validate(collection_path); err != nil {
+		return AggResult{}, err
+	}
+	if err := p.checkFields(collection_path, AdaptLegacy(obj)); err != nil {
+		return AggResult{}, err
+	}
+	if p.SortBy != "" {
+		if _, ok := p.sortValue(AggGroup{
+			Key:    make([]interface{}, len(p.GroupBy)),
+			Values: p.result(&aggState{}).Values,
+		}); !ok {
+			return AggResult{}, fmt.Errorf(
+				"%s:Aggregate - cannot sort by %q: %w",
+				collection_path, p.SortBy, ErrInvalidQuery)
+		}
+	}
+	max_groups := p.MaxGroups
+	if max_groups <= 0 {
+		max_groups = DefaultMaxGroups
+	}
+	query := db.nextClient().Collection(collection_path).Select(p.fields()...)
+	for _, filter := range p.Filters {
+		query = query.Where(filter.Path, filter.Op, filter.Value)
+	}
+	docs := query.Documents(ctx)
+	defer docs.Stop()
+	groups := map[string]*aggState{}
+	var order []string
+	var result AggResult
+	for {
+		doc, err := docs.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return result, dbError(
+				"Aggregate", collection_path, "could not scan", err)
+		}
+		result.Scanned++
+		key, id := p.groupKey(doc)
+		state, ok := groups[id]
+		if !ok {
+			if len(groups) >= max_groups {
+				return result, fmt.Errorf(
+					"%s:Aggregate - more than %d groups: %w",
+					collection_path, max_groups, ErrTooManyGroups)
+			}
+			state = &aggState{
+				key:      key,
+				sums:     map[string]float64{},
+				extremes: map[string]interface{}{},
+				sketches: map[string]*hllSketch{},
+			}
+			groups[id] = state
+			order = append(order, id)
+		}
+		p.fold(state, doc)
+	}
+	for _, id := range order {
+		result.Groups = append(result.Groups, p.result(groups[id]))
+	}
+	sort.SliceStable(result.Groups, func(i, j int) bool {
+		a, _ := p.sortValue(result.Groups[i])
+		b, _ := p.sortValue(result.Groups[j])
+		for k := range a {
+			c, _ := compareValues(a[k], b[k])
+			if c != 0 {
+				return (c < 0) != p.Desc
+			}
+		}
+		return false
+	})
+	if p.Limit > 0 && len(result.Groups) > p.Limit {
+		result.Groups = result.Groups[:p.Limit]
+	}
+	return result, nil
+}
@@ -0,0 +1,165 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+type testEvent struct {
+	Type   string    `firestore:"type"`
+	At     time.Time `firestore:"at"`
+	Amount float64   `firestore:"amount"`
+	User   string    `firestore:"user"`
+}
+
+func (e *testEvent) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	result := &testEvent{}
+	return result, doc.DataTo(result)
+}
+
+func (e *testEvent) Serialize() {
+}
+
+func testEvents() []*testEvent {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	types := []string{"click", "view", "buy"}
+	var events []*testEvent
+	for i := 0; i < 60; i++ {
+		events = append(events, &testEvent{
+			Type:   types[i%len(types)],
+			At:     start.Add(time.Duration(i*7) * time.Hour),
+			Amount: float64(i%11) + 0.5,
+			User:   "u" + strconv.Itoa(i%13),
+		})
+	}
+	return events
+}
+
+var eventPipeline = Pipeline{
+	GroupBy: []GroupKey{
+		{Field: "type"}, {Field: "at", Bucket: 24 * time.Hour}},
+	Accumulators: []Accumulator{
+		{Name: "n", Kind: AccCount},
+		{Name: "total", Kind: AccSum, Field: "amount"},
+		{Name: "low", Kind: AccMin, Field: "amount"},
+		{Name: "high", Kind: AccMax, Field: "amount"},
+		{Name: "users", Kind: AccDistinct, Field: "user"},
+	},
+}
+
+type bruteGroup struct {
+	n         int64
+	total     float64
+	low, high float64
+	users     map[string]bool
+}
+
+func bruteForce(events []*testEvent) map[string]*bruteGroup {
+	groups := map[string]*bruteGroup{}
+	for _, e := range events {
+		day := e.At.UTC().Truncate(24 * time.Hour)
+		id := e.Type + "/" + day.Format(time.RFC3339)
+		g := groups[id]
+		if g == nil {
+			g = &bruteGroup{users: map[string]bool{},
+				low: math.Inf(1), high: math.Inf(-1)}
+			groups[id] = g
+		}
+		g.n++
+		g.total += e.Amount
+		g.low = math.Min(g.low, e.Amount)
+		g.high = math.Max(g.high, e.Amount)
+		g.users[e.User] = true
+	}
+	return groups
+}
+
+func TestAggregateMatchesBruteForce(t *testing.T) {
+	db := emulatorDb(t)
+	collection := testCollection("events")
+	events := testEvents()
+	for i, e := range events {
+		_, err := db.Put(context.Background(), AdaptV2(e),
+			append(collection, "e"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err := db.Aggregate(context.Background(),
+		AdaptV2(&testEvent{}), collection, eventPipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Scanned != len(events) {
+		t.Errorf("scanned %d documents, want %d", result.Scanned, len(events))
+	}
+	want := bruteForce(events)
+	if len(result.Groups) != len(want) {
+		t.Fatalf("%d groups, want %d", len(result.Groups), len(want))
+	}
+	for _, group := range result.Groups {
+		day, _ := group.Key[1].(time.Time)
+		id := fmt.Sprint(group.Key[0]) + "/" + day.UTC().Format(time.RFC3339)
+		w := want[id]
+		if w == nil {
+			t.Errorf("unexpected group %v", group.Key)
+			continue
+		}
+		users, _ := group.Values["users"].(int64)
+		if group.Values["n"] != w.n || group.Values["total"] != w.total ||
+			group.Values["low"] != w.low || group.Values["high"] != w.high ||
+			math.Abs(float64(users-int64(len(w.users)))) > 1 {
+			t.Errorf("group %s: %v, want n=%d total=%v low=%v high=%v users=%d",
+				id, group.Values, w.n, w.total, w.low, w.high, len(w.users))
+		}
+	}
+
+	capped := eventPipeline
+	capped.MaxGroups = 2
+	_, err = db.Aggregate(context.Background(), AdaptV2(&testEvent{}),
+		collection, capped)
+	if !errors.Is(err, ErrTooManyGroups) {
+		t.Errorf("Aggregate over the group cap: %v, want ErrTooManyGroups", err)
+	}
+}
+
+func TestAggregateChecksFields(t *testing.T) {
+	db := NewFirestoreDb(offlineClients(t, 1)[0])
+	p := Pipeline{Accumulators: []Accumulator{
+		{Name: "total", Kind: AccSum, Field: "amuont"}}}
+	_, err := db.Aggregate(context.Background(), AdaptV2(&testEvent{}),
+		[]string{"events"}, p)
+	if !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("Aggregate of a field the model lacks: %v, want ErrInvalidQuery",
+			err)
+	}
+	p.GroupBy = []GroupKey{{Field: ""}}
+	_, err = db.Aggregate(context.Background(), NewRawObject(nil),
+		[]string{"events"}, p)
+	if !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("Aggregate with an empty group key: %v, want ErrInvalidQuery",
+			err)
+	}
+}
+
+func TestDistinctEstimate(t *testing.T) {
+	for _, n := range []int{10, 1000, 50000} {
+		var sketch hllSketch
+		for i := 0; i < n; i++ {
+			sketch.add("user" + strconv.Itoa(i))
+			sketch.add("user" + strconv.Itoa(i))
+		}
+		estimate := float64(sketch.estimate())
+		if math.Abs(estimate-float64(n)) > 0.1*float64(n)+1 {
+			t.Errorf("estimate of %d distinct values: %v", n, estimate)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package rest2firestore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// AncestorKey copies the ID of an ancestor document into a field of every
+// document written below it. Level 0 is the top-level document, so for
+// orgs/{org}/posts/{post}/comments/{comment} the post ID is Level 1.
+type AncestorKey struct {
+	Field string
+	Level int
+}
+
+type ancestorSpec struct {
+	keys  []AncestorKey
+	force bool
+}
+
+// DeclareAncestorKeys makes Post, Put and Merge into collections with the
+// given collection ID fill keys from the path. Unless force is set, a
+// caller supplied value that disagrees with the path is an error.
+func (db *FirestoreDb) DeclareAncestorKeys(
+	collection_id string, force bool, keys ...AncestorKey) {
+	if db.ancestors == nil {
+		db.ancestors = map[string]ancestorSpec{}
+	}
+	db.ancestors[collection_id] = ancestorSpec{keys: keys, force: force}
+}
+
+func ancestorValues(collection []string, keys []AncestorKey) (
+	map[string]string, error) {
+	values := map[string]string{}
+	for _, key := range keys {
+		i := 2*key.Level + 1
+		if key.Level < 0 || i >= len(collection) {
+			return nil, fmt.Errorf("%s: no ancestor at level %d for %s",
+				path.Join(collection...), key.Level, key.Field)
+		}
+		values[key.Field] = collection[i]
+	}
+	return values, nil
+}
+
+func storedField(obj interface{}, name string) (reflect.Value, bool) {
+	v := reflect.ValueOf(obj)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		stored := strings.Split(field.Tag.Get("firestore"), ",")[0]
+		if stored == "" {
+			stored = field.Name
+		}
+		if field.PkgPath == "" && stored == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func (db *FirestoreDb) injectAncestorKeys(
+	obj ObjectV2, collection []string) error {
+	if len(collection) == 0 {
+		return nil
+	}
+	spec, ok := db.ancestors[collection[len(collection)-1]]
+	if !ok {
+		return nil
+	}
+	collection_path := path.Join(collection...)
+	values, err := ancestorValues(collection, spec.keys)
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		field, ok := storedField(storedValue(obj), name)
+		if !ok || !field.CanSet() || field.Kind() != reflect.String {
+			return fmt.Errorf(
+				"%s: ancestor key %s is not a settable string field",
+				collection_path, name)
+		}
+		if current := field.String(); current != "" && current != value &&
+			!spec.force {
+			return fmt.Errorf("%s: ancestor key %s is %q but the path says %q",
+				collection_path, name, current, value)
+		}
+		field.SetString(value)
+	}
+	return nil
+}
+
+// BackfillAncestorKeys writes the declared ancestor keys into every
+// existing document of the collection group collection_id and returns how
+// many documents were updated.
+func (db *FirestoreDb) BackfillAncestorKeys(
+	ctx context.Context, collection_id string) (int, error) {
+	spec, ok := db.ancestors[collection_id]
+	if !ok {
+		return 0, fmt.Errorf(
+			"%s:BackfillAncestorKeys - no ancestor keys declared", collection_id)
+	}
+	updated := 0
+	docs := db.nextClient().CollectionGroup(collection_id).Documents(ctx)
+	defer docs.Stop()
+	for {
+		doc, err := docs.Next()
+		if err == iterator.Done {
+			return updated, nil
+		}
+		if err != nil {
+			return updated, fmt.Errorf(
+				"%s:BackfillAncestorKeys - could not scan: %w", collection_id, err)
+		}
+		segments := strings.Split(documentRefPath(doc.Ref), "/")
+		values, err := ancestorValues(segments[:len(segments)-1], spec.keys)
+		if err != nil {
+			return updated, err
+		}
+		var updates []firestore.Update
+		data := doc.Data()
+		for name, value := range values {
+			current, present := data[name]
+			if current != value && (!present || current == "" || spec.force) {
+				updates = append(updates, firestore.Update{Path: name, Value: value})
+			}
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		if _, err := doc.Ref.Update(ctx, updates); err != nil {
+			return updated, fmt.Errorf(
+				"%s:BackfillAncestorKeys - could not update: %w",
+				documentRefPath(doc.Ref), err)
+		}
+		updated++
+	}
+}
@@ -0,0 +1,205 @@
+package rest2firestore
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+type ancestorComment struct {
+	Org  string `firestore:"org"`
+	Post string `firestore:"post"`
+	Text string `firestore:"text"`
+}
+
+func (c *ancestorComment) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	result := &ancestorComment{}
+	return result, doc.DataTo(result)
+}
+
+func (c *ancestorComment) Serialize() {
+}
+
+func commentsDb(force bool) *FirestoreDb {
+	db := NewFirestoreDb(nil)
+	db.DeclareAncestorKeys("comments", force,
+		AncestorKey{Field: "org", Level: 0},
+		AncestorKey{Field: "post", Level: 1})
+	return db
+}
+
+func TestInjectAncestorKeys(t *testing.T) {
+	collection := strings.Split("orgs/o1/posts/p1/comments", "/")
+	comment := &ancestorComment{Text: "hi"}
+	if err := commentsDb(false).injectAncestorKeys(
+		comment, collection); err != nil {
+		t.Fatal(err)
+	}
+	if comment.Org != "o1" || comment.Post != "p1" {
+		t.Errorf("injected org %q, post %q, want o1, p1",
+			comment.Org, comment.Post)
+	}
+	// Adapted legacy objects are set through their stored value.
+	user := &testUser{}
+	db := NewFirestoreDb(nil)
+	db.DeclareAncestorKeys("users", false, AncestorKey{Field: "name"})
+	err := db.injectAncestorKeys(AdaptLegacy(AdaptV2(user)),
+		[]string{"orgs", "o1", "users"})
+	if err != nil || user.Name != "o1" {
+		t.Errorf("injected name %q, %v, want o1", user.Name, err)
+	}
+	// Collections without a declaration are left alone.
+	other := &ancestorComment{}
+	if err := commentsDb(false).injectAncestorKeys(
+		other, []string{"orgs", "o1", "notes"}); err != nil || other.Org != "" {
+		t.Errorf("undeclared collection: org %q, %v", other.Org, err)
+	}
+}
+
+func TestInjectAncestorKeysConflict(t *testing.T) {
+	collection := strings.Split("orgs/o1/posts/p1/comments", "/")
+	for _, test := range []struct {
+		name    string
+		force   bool
+		post    string
+		wantErr bool
+	}{
+		{name: "agrees", post: "p1"},
+		{name: "conflict", post: "p2", wantErr: true},
+		{name: "forced", force: true, post: "p2"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			comment := &ancestorComment{Post: test.post}
+			err := commentsDb(test.force).injectAncestorKeys(comment, collection)
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), `"p2"`) {
+					t.Errorf("got %v, want the conflict on p2", err)
+				}
+				if comment.Post != "p2" {
+					t.Errorf("conflict overwrote post with %q", comment.Post)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if comment.Org != "o1" || comment.Post != "p1" {
+				t.Errorf("got org %q, post %q, want o1, p1",
+					comment.Org, comment.Post)
+			}
+		})
+	}
+}
+
+func TestInjectAncestorKeysErrors(t *testing.T) {
+	db := NewFirestoreDb(nil)
+	db.DeclareAncestorKeys("comments", false,
+		AncestorKey{Field: "org", Level: 2})
+	err := db.injectAncestorKeys(&ancestorComment{},
+		strings.Split("orgs/o1/posts/p1/comments", "/"))
+	if err == nil || !strings.Contains(err.Error(), "level 2") {
+		t.Errorf("missing level: got %v", err)
+	}
+	db.DeclareAncestorKeys("comments", false,
+		AncestorKey{Field: "missing", Level: 0})
+	err = db.injectAncestorKeys(&ancestorComment{},
+		strings.Split("orgs/o1/comments", "/"))
+	if err == nil || !strings.Contains(err.Error(), "settable string") {
+		t.Errorf("missing field: got %v", err)
+	}
+}
+
+func TestBackfillAncestorKeysUsesPool(t *testing.T) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 200*time.Millisecond)
+	defer cancel()
+	db := NewPooledFirestoreDb(offlineClients(t, 2))
+	db.DeclareAncestorKeys("comments", false, AncestorKey{Field: "org"})
+	if _, err := db.BackfillAncestorKeys(ctx, "comments"); err == nil {
+		t.Errorf("BackfillAncestorKeys of unreachable clients succeeded")
+	}
+	var total int64
+	for _, count := range db.PoolStats() {
+		total += count
+	}
+	if total != 1 {
+		t.Errorf("the backfill ran %d pooled operations, want 1", total)
+	}
+}
+
+// groupPaths runs a collection group query for post and returns the
+// matching document paths.
+func groupPaths(t *testing.T, db *FirestoreDb,
+	collection_id, post string) []string {
+	t.Helper()
+	docs := db.Client().CollectionGroup(collection_id).
+		Where("post", "==", post).Documents(context.Background())
+	defer docs.Stop()
+	var paths []string
+	for {
+		doc, err := docs.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, documentRefPath(doc.Ref))
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestAncestorKeysCollectionGroup(t *testing.T) {
+	db := emulatorDb(t)
+	ctx := context.Background()
+	orgs := testCollection("orgs")
+	// Collection group queries span the emulator, so the group is unique.
+	collection_id := testCollection("comments")[0]
+	db.DeclareAncestorKeys(collection_id, false,
+		AncestorKey{Field: "org", Level: 0},
+		AncestorKey{Field: "post", Level: 1})
+	var want []string
+	for _, org := range []string{"o1", "o2"} {
+		collection := append(orgs, org, "posts", "p1", collection_id)
+		_, document, _, err := db.FindOrCreatePath(ctx,
+			AdaptV2(&ancestorComment{Text: org}), collection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, path.Join(document...))
+	}
+	if _, err := db.Put(ctx, AdaptV2(&ancestorComment{}),
+		append(orgs, "o1", "posts", "p2", collection_id, "c")); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(want)
+	if got := groupPaths(t, db, collection_id, "p1"); strings.Join(got, " ") !=
+		strings.Join(want, " ") {
+		t.Errorf("group query for p1 = %v, want %v", got, want)
+	}
+
+	// Documents written without the keys are found after a backfill.
+	legacy := path.Join(append(orgs, "o3", "posts", "p1", collection_id)...)
+	if _, err := db.Client().Collection(legacy).Doc("old").Set(ctx,
+		map[string]interface{}{"text": "old"}); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := db.BackfillAncestorKeys(ctx, collection_id)
+	if err != nil || updated != 1 {
+		t.Fatalf("BackfillAncestorKeys = %d, %v, want 1", updated, err)
+	}
+	want = append(want, legacy+"/old")
+	sort.Strings(want)
+	if got := groupPaths(t, db, collection_id, "p1"); strings.Join(got, " ") !=
+		strings.Join(want, " ") {
+		t.Errorf("group query after the backfill = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,335 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+)
+
+var ErrFrozen = errors.New("collection is frozen")
+
+type AnomalyEvent struct {
+	Collection string
+	Deletes    int
+	Overwrites int
+	Window     time.Duration
+	Frozen     bool
+}
+
+type AnomalyHandler func(event AnomalyEvent)
+
+// AnomalyRule sets when mutation volume on a top-level collection counts
+// as anomalous: more than MaxMutations deletes plus overwrites inside the
+// window, or more than MaxFraction of the collection's last known size.
+// Zero disables a limit. In HardMode the collection is frozen as well.
+type AnomalyRule struct {
+	MaxMutations int
+	MaxFraction  float64
+	HardMode     bool
+}
+
+type AnomalyRate struct {
+	Deletes    int
+	Overwrites int
+	Frozen     bool
+}
+
+// mutation is n deletes or overwrites made by one call.
+type mutation struct {
+	at     time.Time
+	delete bool
+	n      int
+}
+
+// AnomalyDb wraps a Db and watches the rate of deletes and overwrites per
+// top-level collection.
+type AnomalyDb struct {
+	db      Db
+	window  time.Duration
+	rule    AnomalyRule
+	handler AnomalyHandler
+	now     func() time.Time
+
+	mu        sync.Mutex
+	mutations map[string][]mutation
+	known     map[string]int
+	frozen    map[string]bool
+	tripped   map[string]bool
+}
+
+var _ Db = &AnomalyDb{}
+
+func NewAnomalyDb(db Db, window time.Duration, rule AnomalyRule,
+	handler AnomalyHandler) *AnomalyDb {
+	return &AnomalyDb{
+		db:        db,
+		window:    window,
+		rule:      rule,
+		handler:   handler,
+		now:       time.Now,
+		mutations: map[string][]mutation{},
+		known:     map[string]int{},
+		frozen:    map[string]bool{},
+		tripped:   map[string]bool{},
+	}
+}
+
+func (a *AnomalyDb) SetKnownCount(collection string, n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.known[collection] = n
+}
+
+func (a *AnomalyDb) Freeze(collection string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.frozen[collection] = true
+}
+
+func (a *AnomalyDb) Unfreeze(collection string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.frozen, collection)
+	delete(a.tripped, collection)
+}
+
+func (a *AnomalyDb) Rates() map[string]AnomalyRate {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rates := map[string]AnomalyRate{}
+	for collection := range a.mutations {
+		rates[collection] = a.rate(collection)
+	}
+	for collection := range a.frozen {
+		rate := rates[collection]
+		rate.Frozen = true
+		rates[collection] = rate
+	}
+	return rates
+}
+
+func (a *AnomalyDb) rate(collection string) AnomalyRate {
+	cutoff := a.now().Add(-a.window)
+	recent := a.mutations[collection][:0]
+	rate := AnomalyRate{Frozen: a.frozen[collection]}
+	for _, m := range a.mutations[collection] {
+		if m.at.Before(cutoff) {
+			continue
+		}
+		recent = append(recent, m)
+		if m.delete {
+			rate.Deletes += m.n
+		} else {
+			rate.Overwrites += m.n
+		}
+	}
+	a.mutations[collection] = recent
+	return rate
+}
+
+func (a *AnomalyDb) exceeded(collection string, total int) bool {
+	if a.rule.MaxMutations > 0 && total > a.rule.MaxMutations {
+		return true
+	}
+	known := a.known[collection]
+	return a.rule.MaxFraction > 0 && known > 0 &&
+		float64(total) > a.rule.MaxFraction*float64(known)
+}
+
+// record accounts for n upcoming mutations and reports ErrFrozen if the
+// collection is, or just became, frozen.
+func (a *AnomalyDb) record(document []string, n int, is_delete bool) error {
+	if len(document) == 0 {
+		return nil
+	}
+	collection := document[0]
+	a.mu.Lock()
+	if a.frozen[collection] {
+		a.mu.Unlock()
+		return fmt.Errorf("%s: %w", collection, ErrFrozen)
+	}
+	a.mutations[collection] = append(a.mutations[collection],
+		mutation{at: a.now(), delete: is_delete, n: n})
+	rate := a.rate(collection)
+	var event *AnomalyEvent
+	if a.exceeded(collection, rate.Deletes+rate.Overwrites) {
+		if !a.tripped[collection] {
+			a.tripped[collection] = true
+			if a.rule.HardMode {
+				a.frozen[collection] = true
+			}
+			event = &AnomalyEvent{
+				Collection: collection,
+				Deletes:    rate.Deletes,
+				Overwrites: rate.Overwrites,
+				Window:     a.window,
+				Frozen:     a.rule.HardMode,
+			}
+		}
+	} else {
+		delete(a.tripped, collection)
+	}
+	frozen := a.frozen[collection]
+	a.mu.Unlock()
+	if event != nil && a.handler != nil {
+		a.handler(*event)
+	}
+	if frozen {
+		return fmt.Errorf("%s: %w", collection, ErrFrozen)
+	}
+	return nil
+}
+
+func (a *AnomalyDb) isFrozen(collection []string) error {
+	if len(collection) == 0 {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.frozen[collection[0]] {
+		return fmt.Errorf("%s: %w", collection[0], ErrFrozen)
+	}
+	return nil
+}
+
+func (a *AnomalyDb) List(
+	ctx context.Context, obj Object, collection []string) ([]Object, error) {
+	return a.db.List(ctx, obj, collection)
+}
+
+func (a *AnomalyDb) ListWithQuery(ctx context.Context, obj Object,
+	collection []string, q *ListQuery) ([]Object, string, error) {
+	return a.db.ListWithQuery(ctx, obj, collection, q)
+}
+
+func (a *AnomalyDb) ListGroup(ctx context.Context, obj Object,
+	collection_id string) ([]Object, error) {
+	return a.db.ListGroup(ctx, obj, collection_id)
+}
+
+// count is the number of documents a Clear of collection removes: the
+// whole tree when the Db is a TreePlanner, and otherwise the documents of
+// collection alone, from the Db's Count when it is a Counter and by
+// listing them otherwise.
+func (a *AnomalyDb) count(
+	ctx context.Context, dummy Object, collection []string) (int, error) {
+	if planner, ok := a.db.(TreePlanner); ok {
+		stats, err := planner.PlanClear(ctx, dummy, collection)
+		return stats.Documents, err
+	}
+	if counter, ok := a.db.(Counter); ok {
+		n, err := counter.Count(ctx, collection)
+		if !errors.Is(err, ErrUnsupportedByBackend) {
+			return int(n), err
+		}
+	}
+	objs, err := a.db.List(ctx, dummy, collection)
+	return len(objs), err
+}
+
+// Clear counts every document it is about to delete, as count does, so a
+// Clear of a large collection trips the rule before anything is deleted.
+func (a *AnomalyDb) Clear(
+	ctx context.Context, dummy Object, collection []string) error {
+	if err := a.isFrozen(collection); err != nil {
+		return err
+	}
+	n, err := a.count(ctx, dummy, collection)
+	if err != nil {
+		return err
+	}
+	if err := a.record(collection, n, true); err != nil {
+		return err
+	}
+	return a.db.Clear(ctx, dummy, collection)
+}
+
+// ClearAcknowledged clears a collection the caller expects to hold about
+// expected documents, counted as Clear counts them, without feeding the
+// tripwire.
+func (a *AnomalyDb) ClearAcknowledged(ctx context.Context,
+	dummy Object, collection []string, expected int) error {
+	if err := a.isFrozen(collection); err != nil {
+		return err
+	}
+	n, err := a.count(ctx, dummy, collection)
+	if err != nil {
+		return err
+	}
+	if n > expected {
+		return fmt.Errorf("%s:Clear - %d documents, acknowledged %d",
+			path.Join(collection...), n, expected)
+	}
+	return a.db.Clear(ctx, dummy, collection)
+}
+
+func (a *AnomalyDb) Post(
+	ctx context.Context, obj Object, collection []string) (Object, error) {
+	return a.db.Post(ctx, obj, collection)
+}
+
+func (a *AnomalyDb) FindOrCreate(
+	ctx context.Context, obj Object, collection []string) (
+	Object, bool, error) {
+	return a.db.FindOrCreate(ctx, obj, collection)
+}
+
+func (a *AnomalyDb) Put(
+	ctx context.Context, obj Object, collection []string) (Object, error) {
+	if err := a.record(collection, 1, false); err != nil {
+		return nil, err
+	}
+	return a.db.Put(ctx, obj, collection)
+}
+
+// Patch counts as an overwrite when the Db is a Locator, which finds the
+// document before it is written. Otherwise it is not counted.
+func (a *AnomalyDb) Patch(ctx context.Context, obj Object) (Object, error) {
+	if locator, ok := a.db.(Locator); ok {
+		document, err := locator.Locate(ctx, obj)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.record(document, 1, false); err != nil {
+			return nil, err
+		}
+	}
+	return a.db.Patch(ctx, obj)
+}
+
+func (a *AnomalyDb) PatchFields(ctx context.Context, dummy Object,
+	document []string, fields map[string]interface{}) (Object, error) {
+	if err := a.record(document, 1, false); err != nil {
+		return nil, err
+	}
+	return a.db.PatchFields(ctx, dummy, document, fields)
+}
+
+func (a *AnomalyDb) Get(
+	ctx context.Context, dummy Object, document []string) (Object, error) {
+	return a.db.Get(ctx, dummy, document)
+}
+
+// Delete counts the documents of its subcollections too when the Db is a
+// TreePlanner. Otherwise a recursive Delete counts as one mutation.
+func (a *AnomalyDb) Delete(
+	ctx context.Context, dummy Object, document []string) error {
+	if err := a.isFrozen(document); err != nil {
+		return err
+	}
+	n := 1
+	if planner, ok := a.db.(TreePlanner); ok {
+		stats, err := planner.PlanDelete(ctx, dummy, document)
+		if err != nil {
+			return err
+		}
+		n = stats.Documents
+	}
+	if err := a.record(document, n, true); err != nil {
+		return err
+	}
+	return a.db.Delete(ctx, dummy, document)
+}
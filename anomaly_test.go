@@ -0,0 +1,144 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// plannedDb reports a fixed tree size for every Delete and Clear.
+type plannedDb struct {
+	*MemoryDb
+	documents int
+}
+
+func (p *plannedDb) PlanDelete(ctx context.Context, dummy Object,
+	document []string) (TreeStats, error) {
+	return TreeStats{Documents: p.documents}, nil
+}
+
+func (p *plannedDb) PlanClear(ctx context.Context, dummy Object,
+	collection []string) (TreeStats, error) {
+	return TreeStats{Documents: p.documents}, nil
+}
+
+func newTestAnomalyDb(db Db, rule AnomalyRule) (
+	*AnomalyDb, *[]AnomalyEvent, *time.Time) {
+	var events []AnomalyEvent
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := NewAnomalyDb(db, time.Minute, rule, func(event AnomalyEvent) {
+		events = append(events, event)
+	})
+	a.now = func() time.Time { return now }
+	return a, &events, &now
+}
+
+func putUsers(t *testing.T, db Db, n int) []error {
+	t.Helper()
+	errs := make([]error, n)
+	for i := range errs {
+		_, errs[i] = db.Put(context.Background(),
+			AdaptV2(&testUser{Email: strconv.Itoa(i) + "@example.com"}),
+			[]string{"users", "u" + strconv.Itoa(i)})
+	}
+	return errs
+}
+
+func TestAnomalyHandlerFiresOnce(t *testing.T) {
+	a, events, now := newTestAnomalyDb(NewMemoryDb(),
+		AnomalyRule{MaxMutations: 2})
+	for i, err := range putUsers(t, a, 5) {
+		if err != nil {
+			t.Errorf("Put %d in soft mode: %v", i, err)
+		}
+	}
+	if len(*events) != 1 {
+		t.Fatalf("handler ran %d times, want 1", len(*events))
+	}
+	event := (*events)[0]
+	if event.Collection != "users" || event.Overwrites != 3 || event.Frozen {
+		t.Errorf("event %+v, want 3 overwrites on users, not frozen", event)
+	}
+	// Once the window has passed the rule can trip again.
+	*now = now.Add(2 * time.Minute)
+	putUsers(t, a, 3)
+	if len(*events) != 2 {
+		t.Errorf("handler ran %d times after a second burst, want 2",
+			len(*events))
+	}
+}
+
+func TestAnomalyHardModeFreezes(t *testing.T) {
+	a, events, now := newTestAnomalyDb(NewMemoryDb(),
+		AnomalyRule{MaxMutations: 2, HardMode: true})
+	errs := putUsers(t, a, 3)
+	if errs[0] != nil || errs[1] != nil || !errors.Is(errs[2], ErrFrozen) {
+		t.Fatalf("Puts: %v, want the third to fail with ErrFrozen", errs)
+	}
+	if len(*events) != 1 || !(*events)[0].Frozen {
+		t.Errorf("events %+v, want one frozen event", *events)
+	}
+	ctx, user := context.Background(), AdaptV2(&testUser{})
+	if err := a.Delete(ctx, user, []string{"users", "u0"}); !errors.Is(
+		err, ErrFrozen) {
+		t.Errorf("Delete while frozen: %v, want ErrFrozen", err)
+	}
+	if err := a.Clear(ctx, user, []string{"users"}); !errors.Is(
+		err, ErrFrozen) {
+		t.Errorf("Clear while frozen: %v, want ErrFrozen", err)
+	}
+	if !a.Rates()["users"].Frozen {
+		t.Errorf("Rates %+v, want users frozen", a.Rates())
+	}
+	if _, err := a.Get(ctx, user, []string{"users", "u0"}); err != nil {
+		t.Errorf("Get while frozen: %v", err)
+	}
+	// Within the window the next mutation would trip the rule again.
+	*now = now.Add(2 * time.Minute)
+	a.Unfreeze("users")
+	if err := a.Delete(ctx, user, []string{"users", "u0"}); err != nil {
+		t.Errorf("Delete after Unfreeze: %v", err)
+	}
+}
+
+func TestAnomalyAcknowledgedClear(t *testing.T) {
+	db := NewMemoryDb()
+	putUsers(t, db, 5)
+	a, events, _ := newTestAnomalyDb(db,
+		AnomalyRule{MaxMutations: 2, HardMode: true})
+	ctx, user := context.Background(), AdaptV2(&testUser{})
+	if err := a.ClearAcknowledged(ctx, user, []string{"users"}, 3); err == nil {
+		t.Error("ClearAcknowledged of more than acknowledged succeeded")
+	}
+	if err := a.ClearAcknowledged(ctx, user, []string{"users"}, 5); err != nil {
+		t.Fatalf("ClearAcknowledged: %v", err)
+	}
+	if len(*events) != 0 || a.Rates()["users"].Deletes != 0 {
+		t.Errorf("events %+v, rates %+v after an acknowledged Clear, want none",
+			*events, a.Rates())
+	}
+	for i, err := range putUsers(t, a, 2) {
+		if err != nil {
+			t.Errorf("Put %d after an acknowledged Clear: %v", i, err)
+		}
+	}
+}
+
+func TestAnomalyDeleteCountsSubtree(t *testing.T) {
+	db := &plannedDb{MemoryDb: NewMemoryDb(), documents: 3}
+	a, events, _ := newTestAnomalyDb(db, AnomalyRule{MaxMutations: 2})
+	ctx, author := context.Background(), AdaptV2(&testAuthor{})
+	if err := a.Delete(ctx, author, []string{"users", "a1"}); err != nil &&
+		!errors.Is(err, ErrNotFound) {
+		t.Fatal(err)
+	}
+	if rate := a.Rates()["users"]; rate.Deletes != 3 {
+		t.Errorf("Delete counted %d deletes, want the subtree's 3",
+			rate.Deletes)
+	}
+	if len(*events) != 1 {
+		t.Errorf("handler ran %d times, want 1", len(*events))
+	}
+}
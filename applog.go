@@ -0,0 +1,304 @@
+package rest2firestore
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var ErrAppendOnly = errors.New("collection is append-only")
+
+// logSequenceWidth zero-pads sequence IDs so they sort lexicographically.
+const logSequenceWidth = 20
+
+// DeclareAppendOnly makes Put, PutIf, Merge, Patch, PatchFields and Delete
+// fail with ErrAppendOnly for documents in collections with the given
+// collection ID. Collections used with an AppendLog should be declared.
+func (db *FirestoreDb) DeclareAppendOnly(collection_id string) {
+	if db.append_only == nil {
+		db.append_only = map[string]bool{}
+	}
+	db.append_only[collection_id] = true
+}
+
+func (db *FirestoreDb) checkAppendOnly(op string, document []string) error {
+	if len(document) < 2 || !db.append_only[document[len(document)-2]] {
+		return nil
+	}
+	return fmt.Errorf("%s:%s - %w", path.Join(document...), op, ErrAppendOnly)
+}
+
+func logSequenceID(seq int64) string {
+	return fmt.Sprintf("%0*d", logSequenceWidth, seq)
+}
+
+type logBlock struct {
+	next  int64
+	limit int64
+}
+
+// logBlocks are the sequences of one log reserved by this process and not
+// handed out yet, lowest first. mu is never held across an allocation.
+type logBlocks struct {
+	mu     sync.Mutex
+	blocks []logBlock
+}
+
+func (b *logBlocks) take() (int64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.blocks) > 0 {
+		if block := &b.blocks[0]; block.next < block.limit {
+			block.next++
+			return block.next - 1, true
+		}
+		b.blocks = b.blocks[1:]
+	}
+	return 0, false
+}
+
+func (b *logBlocks) add(block logBlock) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := sort.Search(len(b.blocks), func(i int) bool {
+		return b.blocks[i].next > block.next
+	})
+	b.blocks = append(b.blocks, logBlock{})
+	copy(b.blocks[i+1:], b.blocks[i:])
+	b.blocks[i] = block
+}
+
+// AppendLog writes entries to log collections under sequence numbers
+// starting at 1. With Block of 0 or 1 the counter and the entry are written
+// in one transaction, so sequences are gapless and an entry is only visible
+// once all before it are. A larger Block reserves that many sequences per
+// allocation for this process; sequences left unused when the process
+// stops become gaps, and entries of concurrent writers commit out of
+// order, so a ReadFrom after the last sequence a reader saw can miss an
+// entry with a lower one still being written. Readers that must see every
+// entry should use a Block of 0 or 1.
+type AppendLog struct {
+	db    *FirestoreDb
+	Block int64
+
+	mu     sync.Mutex
+	blocks map[string]*logBlocks
+	// allocate_block reserves Block sequences of a log and returns the
+	// first.
+	allocate_block func(ctx context.Context, log_path string) (int64, error)
+}
+
+func NewAppendLog(db *FirestoreDb, block int64) *AppendLog {
+	l := &AppendLog{db: db, Block: block, blocks: map[string]*logBlocks{}}
+	l.allocate_block = l.allocateBlock
+	return l
+}
+
+// client is the one client every write to log_path goes through, so its
+// counter and entries share it.
+func (l *AppendLog) client(log_path string) *firestore.Client {
+	return l.db.clientFor(log_path)
+}
+
+func (l *AppendLog) counterDoc(log_path string) *firestore.DocumentRef {
+	id := base64.RawURLEncoding.EncodeToString([]byte(log_path))
+	return l.client(log_path).Collection(
+		InternalCollection("sequences")).Doc(id)
+}
+
+// allocate advances the counter of log_path by n inside tx and returns the
+// first sequence of the allocated range.
+func (l *AppendLog) allocate(
+	tx *firestore.Transaction, log_path string, n int64) (int64, error) {
+	counter := l.counterDoc(log_path)
+	var last int64
+	doc, err := tx.Get(counter)
+	if err == nil {
+		last, _ = doc.Data()[ReservedPrefix+"last"].(int64)
+	} else if status.Code(err) != codes.NotFound {
+		return 0, err
+	}
+	return last + 1, tx.Set(counter,
+		map[string]interface{}{ReservedPrefix + "last": last + n})
+}
+
+func (l *AppendLog) allocateBlock(
+	ctx context.Context, log_path string) (int64, error) {
+	var first int64
+	err := l.client(log_path).RunTransaction(ctx,
+		func(ctx context.Context, tx *firestore.Transaction) error {
+			var err error
+			first, err = l.allocate(tx, log_path, l.Block)
+			return err
+		})
+	return first, err
+}
+
+// reserve hands out the next sequence this process holds for log_path,
+// allocating a block when it holds none. Concurrent callers that all find
+// none allocate a block each, and keep the spare sequences for later.
+func (l *AppendLog) reserve(ctx context.Context, log_path string) (
+	int64, error) {
+	l.mu.Lock()
+	blocks := l.blocks[log_path]
+	if blocks == nil {
+		blocks = &logBlocks{}
+		l.blocks[log_path] = blocks
+	}
+	l.mu.Unlock()
+	if seq, ok := blocks.take(); ok {
+		return seq, nil
+	}
+	first, err := l.allocate_block(ctx, log_path)
+	if err != nil {
+		return 0, err
+	}
+	blocks.add(logBlock{next: first + 1, limit: first + l.Block})
+	return first, nil
+}
+
+// Append writes obj as the next entry of log and returns its sequence.
+func (l *AppendLog) Append(
+	ctx context.Context, log []string, obj Object) (int64, error) {
+	o := AdaptLegacy(obj)
+	log_path, err := getCollectionPath(log, l.db.allow_reserved)
+	if err != nil {
+		return 0, err
+	}
+	if err := l.db.injectAncestorKeys(o, log); err != nil {
+		return 0, err
+	}
+	if err := safeValidate("Append", log_path, o); err != nil {
+		return 0, err
+	}
+	if err := safeSerialize("Append", log_path, o); err != nil {
+		return 0, err
+	}
+	client := l.client(log_path)
+	collection := client.Collection(log_path)
+	if l.Block > 1 {
+		seq, err := l.reserve(ctx, log_path)
+		if err != nil {
+			return 0, fmt.Errorf(
+				"%s:Append - could not allocate sequence: %w", log_path, err)
+		}
+		_, err = collection.Doc(logSequenceID(seq)).Create(ctx, storedValue(o))
+		if err != nil {
+			return 0, fmt.Errorf(
+				"%s:Append - could not write entry %d: %w", log_path, seq, err)
+		}
+		return seq, nil
+	}
+	var seq int64
+	err = client.RunTransaction(ctx,
+		func(ctx context.Context, tx *firestore.Transaction) error {
+			var err error
+			seq, err = l.allocate(tx, log_path, 1)
+			if err != nil {
+				return err
+			}
+			return tx.Create(collection.Doc(logSequenceID(seq)), storedValue(o))
+		})
+	if err != nil {
+		return 0, fmt.Errorf(
+			"%s:Append - could not append entry: %w", log_path, err)
+	}
+	return seq, nil
+}
+
+// ReadFrom returns up to limit entries of log with a sequence greater than
+// after_seq, in sequence order, and the sequence of the last one returned.
+func (l *AppendLog) ReadFrom(ctx context.Context, dummy Object,
+	log []string, after_seq int64, limit int) ([]Object, int64, error) {
+	obj := AdaptLegacy(dummy)
+	log_path, err := getCollectionPath(log, l.db.allow_reserved)
+	if err != nil {
+		return nil, after_seq, err
+	}
+	if limit <= 0 {
+		return nil, after_seq, fmt.Errorf("%s:ReadFrom - limit %d: %w",
+			log_path, limit, ErrInvalidQuery)
+	}
+	docs, err := l.db.nextClient().Collection(log_path).
+		OrderBy(firestore.DocumentID, firestore.Asc).
+		StartAfter(logSequenceID(after_seq)).Limit(limit).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, after_seq, fmt.Errorf(
+			"%s:ReadFrom - could not read entries: %w", log_path, err)
+	}
+	last := after_seq
+	objs := make([]ObjectV2, 0, len(docs))
+	for _, doc := range docs {
+		seq, err := strconv.ParseInt(doc.Ref.ID, 10, 64)
+		if err != nil {
+			return nil, after_seq, fmt.Errorf(
+				"%s:ReadFrom - not a sequence ID: %s", log_path, doc.Ref.ID)
+		}
+		result, err := safeDeserialize("ReadFrom", log_path, obj, doc)
+		if err != nil {
+			return nil, after_seq, err
+		}
+		objs = append(objs, result)
+		last = seq
+	}
+	return adaptV2List(objs), last, nil
+}
+
+// Compact hands every entry of log with a sequence below before to
+// archive, in order, and deletes them once archive returns without error.
+// It bypasses DeclareAppendOnly and returns how many entries were removed.
+func (l *AppendLog) Compact(ctx context.Context, dummy Object,
+	log []string, before int64, archive func(entries []Object) error) (
+	int, error) {
+	obj := AdaptLegacy(dummy)
+	log_path, err := getCollectionPath(log, l.db.allow_reserved)
+	if err != nil {
+		return 0, err
+	}
+	docs := l.db.nextClient().Collection(log_path).
+		OrderBy(firestore.DocumentID, firestore.Asc).
+		EndBefore(logSequenceID(before)).Documents(ctx)
+	defer docs.Stop()
+	var refs []*firestore.DocumentRef
+	var entries []ObjectV2
+	for {
+		doc, err := docs.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf(
+				"%s:Compact - could not read entries: %w", log_path, err)
+		}
+		result, err := safeDeserialize("Compact", log_path, obj, doc)
+		if err != nil {
+			return 0, err
+		}
+		refs = append(refs, doc.Ref)
+		entries = append(entries, result)
+	}
+	if archive != nil {
+		if err := archive(adaptV2List(entries)); err != nil {
+			return 0, fmt.Errorf(
+				"%s:Compact - could not archive entries: %w", log_path, err)
+		}
+	}
+	for i, ref := range refs {
+		if _, err := ref.Delete(ctx); err != nil {
+			return i, fmt.Errorf("%s:Compact - could not delete entry: %w",
+				documentRefPath(ref), err)
+		}
+	}
+	return len(refs), nil
+}
@@ -0,0 +1,132 @@
+package rest2firestore
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// counterLog is an AppendLog whose blocks come from an in-process counter.
+func counterLog(block int64, allocations *atomic.Int64) *AppendLog {
+	l := NewAppendLog(nil, block)
+	var last atomic.Int64
+	l.allocate_block = func(ctx context.Context, log_path string) (
+		int64, error) {
+		allocations.Add(1)
+		time.Sleep(time.Millisecond)
+		return last.Add(block) - block + 1, nil
+	}
+	return l
+}
+
+func TestAppendLogReserveConcurrent(t *testing.T) {
+	const writers, appends, block = 8, 50, 7
+	var allocations atomic.Int64
+	l := counterLog(block, &allocations)
+	var mu sync.Mutex
+	var seqs []int64
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < appends; j++ {
+				seq, err := l.reserve(context.Background(), "log")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				seqs = append(seqs, seq)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for i := 1; i < len(seqs); i++ {
+		if seqs[i] == seqs[i-1] {
+			t.Fatalf("sequence %d reserved twice", seqs[i])
+		}
+	}
+	// Spare sequences are kept, so at most one block per writer is left.
+	if unused := allocations.Load()*block - int64(len(seqs)); unused < 0 ||
+		unused >= writers*block {
+		t.Errorf("%d allocations for %d sequences", allocations.Load(),
+			len(seqs))
+	}
+}
+
+func TestAppendLogReserveDoesNotBlockOtherLogs(t *testing.T) {
+	l := NewAppendLog(nil, 10)
+	release := make(chan struct{})
+	l.allocate_block = func(ctx context.Context, log_path string) (
+		int64, error) {
+		if log_path == "slow" {
+			<-release
+		}
+		return 1, nil
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.reserve(context.Background(), "slow")
+	}()
+	reserved := make(chan int64)
+	go func() {
+		seq, _ := l.reserve(context.Background(), "fast")
+		reserved <- seq
+	}()
+	select {
+	case seq := <-reserved:
+		if seq != 1 {
+			t.Errorf("reserved %d, want 1", seq)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("reserve on one log waited for another log's allocation")
+	}
+	close(release)
+	<-done
+}
+
+func TestAppendLogConcurrentAppends(t *testing.T) {
+	db := emulatorDb(t)
+	const writers, appends = 4, 10
+	for _, block := range []int64{1, 5} {
+		log := testCollection("events")
+		l := NewAppendLog(db, block)
+		var mu sync.Mutex
+		seqs := map[int64]bool{}
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < appends; j++ {
+					seq, err := l.Append(context.Background(), log,
+						AdaptV2(&testUser{Email: "a@example.com"}))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					seqs[seq] = true
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		entries, _, err := l.ReadFrom(context.Background(),
+			AdaptV2(&testUser{}), log, 0, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seqs) != writers*appends || len(entries) != len(seqs) {
+			t.Errorf("block %d: %d sequences and %d entries, want %d",
+				block, len(seqs), len(entries), writers*appends)
+		}
+	}
+}
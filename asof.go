@@ -0,0 +1,182 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultPITRWindow is how long Firestore keeps old versions readable
+// when point-in-time recovery is not enabled on the database.
+const DefaultPITRWindow = time.Hour
+
+var ErrOutsideRetention = errors.New(
+	"requested time is outside the point-in-time window")
+
+const (
+	SourceLive     = "live-pit"
+	SourceRevision = "revision"
+	SourceExport   = "export"
+)
+
+// AsOf describes where a GetAt result came from. Time is when the returned
+// version was written, which may be well before the requested time.
+type AsOf struct {
+	Obj    Object
+	Source string
+	Time   time.Time
+}
+
+// HistorySource keeps old versions of documents outside Firestore's own
+// retention, such as stored revisions or export records. Nearest returns
+// the latest version of document written at or before t, or nil if it has
+// none.
+type HistorySource interface {
+	Nearest(ctx context.Context, dummy Object, document []string,
+		t time.Time) (*AsOf, error)
+}
+
+// PointInTimeDb is the optional capability of a Db to read documents as
+// they were at an earlier time. Router serves it on the :asOf endpoint.
+type PointInTimeDb interface {
+	GetAt(ctx context.Context, dummy Object, document []string,
+		t time.Time) (*AsOf, error)
+}
+
+var _ PointInTimeDb = &FirestoreDb{}
+
+// AddHistorySource lets GetAt fall back to source for documents in every
+// collection with the given collection ID.
+func (db *FirestoreDb) AddHistorySource(
+	collection_id string, source HistorySource) {
+	if db.history == nil {
+		db.history = map[string][]HistorySource{}
+	}
+	db.history[collection_id] = append(db.history[collection_id], source)
+}
+
+func (db *FirestoreDb) pitrWindow() time.Duration {
+	if db.PITRWindow <= 0 {
+		return DefaultPITRWindow
+	}
+	return db.PITRWindow
+}
+
+// GetAt reads document as it was at t. Inside the PITR window this is a
+// Firestore read at t. Further back, the nearest earlier version from the
+// collection's history sources is returned, or ErrOutsideRetention if
+// there is none. Backends without point-in-time reads, like the emulator,
+// only get the history sources.
+func (db *FirestoreDb) GetAt(ctx context.Context, dummy Object,
+	document []string, t time.Time) (*AsOf, error) {
+	collection_path, document_id, err :=
+		getDocumentPath(document, db.allow_reserved)
+	if err != nil {
+		return nil, err
+	}
+	document_path := path.Join(collection_path, document_id)
+	age := db.now().Sub(t)
+	var unsupported error
+	if age > 0 && age <= db.pitrWindow() &&
+		!db.Backend().Has(CapPointInTime) {
+		unsupported = &UnsupportedError{Op: "GetAt",
+			Capability: CapPointInTime, Emulator: db.Backend().Emulator}
+	} else if age <= db.pitrWindow() {
+		as_of, err := db.getLiveAt(ctx, dummy, document_path, t, age)
+		if status.Code(err) != codes.FailedPrecondition &&
+			status.Code(err) != codes.InvalidArgument {
+			return as_of, err
+		}
+	}
+	var nearest *AsOf
+	for _, source := range db.history[document[len(document)-2]] {
+		as_of, err := source.Nearest(ctx, dummy, document, t)
+		if err != nil {
+			return nil, dbError("GetAt", document_path,
+				"could not read history", err)
+		}
+		if as_of != nil && !as_of.Time.After(t) &&
+			(nearest == nil || as_of.Time.After(nearest.Time)) {
+			nearest = as_of
+		}
+	}
+	if nearest == nil && unsupported != nil {
+		return nil, unsupported
+	}
+	if nearest == nil {
+		return nil, fmt.Errorf("%s:GetAt - %s: %w", document_path,
+			t.Format(time.RFC3339), ErrOutsideRetention)
+	}
+	return nearest, nil
+}
+
+// getLiveAt reads at t. Reads older than an hour must be at a whole
+// minute, so t is rounded down, which still gives a version from before t.
+func (db *FirestoreDb) getLiveAt(ctx context.Context, dummy Object,
+	document_path string, t time.Time, age time.Duration) (*AsOf, error) {
+	ref := db.clientFor(document_path).Doc(document_path)
+	if age > 0 {
+		if age > time.Hour {
+			t = t.Truncate(time.Minute)
+		}
+		ref = ref.WithReadOptions(firestore.ReadTime(t))
+	}
+	doc, err := ref.Get(ctx)
+	if err != nil {
+		return nil, dbError("GetAt", document_path, "could not get object", err)
+	}
+	obj, err := safeDeserialize(
+		"GetAt", document_path, AdaptLegacy(dummy), doc)
+	if err != nil {
+		return nil, err
+	}
+	as_of := &AsOf{Obj: AdaptV2(obj), Source: SourceLive, Time: doc.UpdateTime}
+	return as_of, nil
+}
+
+// serveAsOf answers GET /{collection}/{id}:asOf?time=<RFC3339> with the
+// source, time and object of GetAt.
+func (r *Router) serveAsOf(w http.ResponseWriter, req *http.Request,
+	rt route, document []string) {
+	if r.Admin == nil {
+		writeError(w, http.StatusNotFound, "no resource at "+req.URL.Path)
+		return
+	}
+	if err := r.Admin(req); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, req.Method+" not allowed")
+		return
+	}
+	db, ok := r.Db.(PointInTimeDb)
+	if !ok {
+		writeDbError(w, fmt.Errorf("%T: %w", r.Db, ErrUnsupportedByBackend))
+		return
+	}
+	t, err := time.Parse(time.RFC3339Nano, req.URL.Query().Get("time"))
+	if err != nil {
+		writeDbError(w, fmt.Errorf("time=%s: %w",
+			req.URL.Query().Get("time"), ErrInvalidQuery))
+		return
+	}
+	as_of, err := db.GetAt(req.Context(), rt.proto, document, t)
+	if err != nil {
+		writeDbError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"source": as_of.Source,
+		"time":   as_of.Time.UTC().Format(time.RFC3339Nano),
+		"object": rt.view(as_of.Obj),
+	})
+}
@@ -0,0 +1,140 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fixedHistory is a HistorySource holding versions of every document.
+type fixedHistory []*AsOf
+
+func (h fixedHistory) Nearest(ctx context.Context, dummy Object,
+	document []string, t time.Time) (*AsOf, error) {
+	var nearest *AsOf
+	for _, version := range h {
+		if !version.Time.After(t) {
+			nearest = version
+		}
+	}
+	return nearest, nil
+}
+
+func TestGetAtHistory(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	db := NewFirestoreDb(nil)
+	db.Now = func() time.Time { return now }
+	old := &AsOf{Obj: AdaptV2(&testUser{Name: "old"}), Source: SourceRevision,
+		Time: now.Add(-48 * time.Hour)}
+	newer := &AsOf{Obj: AdaptV2(&testUser{Name: "newer"}),
+		Source: SourceRevision, Time: now.Add(-24 * time.Hour)}
+	db.AddHistorySource("users", fixedHistory{old, newer})
+	dummy := AdaptV2(&testUser{})
+	document := []string{"users", "u1"}
+
+	as_of, err := db.GetAt(ctx, dummy, document, now.Add(-30*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if as_of != old {
+		t.Errorf("GetAt 30h ago returned %+v, want the 48h old revision",
+			as_of)
+	}
+	as_of, err = db.GetAt(ctx, dummy, document, now.Add(-2*time.Hour))
+	if err != nil || as_of != newer {
+		t.Errorf("GetAt 2h ago returned %+v, %v, want the 24h old revision",
+			as_of, err)
+	}
+	_, err = db.GetAt(ctx, dummy, document, now.Add(-72*time.Hour))
+	if !errors.Is(err, ErrOutsideRetention) {
+		t.Errorf("GetAt before any revision: %v, want ErrOutsideRetention",
+			err)
+	}
+	_, err = db.GetAt(ctx, dummy, []string{"posts", "p1"},
+		now.Add(-2*time.Hour))
+	if !errors.Is(err, ErrOutsideRetention) {
+		t.Errorf("GetAt without history: %v, want ErrOutsideRetention", err)
+	}
+}
+
+// historyDb is a MemoryDb that answers GetAt from a fixed history.
+type historyDb struct {
+	*MemoryDb
+	history fixedHistory
+}
+
+func (h *historyDb) GetAt(ctx context.Context, dummy Object,
+	document []string, t time.Time) (*AsOf, error) {
+	as_of, _ := h.history.Nearest(ctx, dummy, document, t)
+	if as_of == nil {
+		return nil, ErrOutsideRetention
+	}
+	return as_of, nil
+}
+
+func TestRouterAsOf(t *testing.T) {
+	written := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	db := &historyDb{MemoryDb: NewMemoryDb(), history: fixedHistory{{
+		Obj: &RawObject{ID: "t1", Data: map[string]interface{}{
+			"name": "thing", "secret": "hidden"}},
+		Source: SourceRevision, Time: written}}}
+	router := NewRouter(db).RegisterRawResource("things",
+		RawOptions{Redact: []string{"secret"}})
+	target := "/things/t1:asOf?time=2024-05-02T00:00:00Z"
+
+	if w, _ := serve(router, http.MethodGet, target, ""); w.Code !=
+		http.StatusNotFound {
+		t.Errorf("without Admin: status %d, want 404", w.Code)
+	}
+	router.Admin = func(req *http.Request) error {
+		return errors.New("admins only")
+	}
+	if w, _ := serve(router, http.MethodGet, target, ""); w.Code !=
+		http.StatusForbidden {
+		t.Errorf("rejected by Admin: status %d, want 403", w.Code)
+	}
+	router.Admin = func(req *http.Request) error { return nil }
+
+	w, body := serve(router, http.MethodGet, target, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, body)
+	}
+	got := decodeJSON(t, body).(map[string]interface{})
+	object, _ := got["object"].(map[string]interface{})
+	if got["source"] != SourceRevision ||
+		got["time"] != "2024-05-01T12:00:00Z" ||
+		object["name"] != "thing" || object["secret"] != nil {
+		t.Errorf("got %s", body)
+	}
+
+	w, body = serve(router, http.MethodGet,
+		"/things/t1:asOf?time=2024-04-01T00:00:00Z", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("before any version: status %d, want 404: %s", w.Code, body)
+	}
+	w, body = serve(router, http.MethodGet, "/things/t1:asOf?time=noon", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid time: status %d, want 400: %s", w.Code, body)
+	}
+}
+
+func TestGetAtLive(t *testing.T) {
+	db := emulatorDb(t)
+	ctx := context.Background()
+	document := append(testCollection("users"), "u1")
+	user := AdaptV2(&testUser{Name: "live"})
+	if _, err := db.Put(ctx, user, document); err != nil {
+		t.Fatal(err)
+	}
+	as_of, err := db.GetAt(ctx, AdaptV2(&testUser{}), document, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := Underlying(as_of.Obj).(*testUser)
+	if as_of.Source != SourceLive || got == nil || got.Name != "live" {
+		t.Errorf("GetAt now returned %+v", as_of)
+	}
+}
@@ -0,0 +1,261 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var ErrUnsupportedByBackend = errors.New("not supported by this backend")
+
+// Capability is a backend feature that the emulator and production do not
+// agree on.
+type Capability string
+
+const (
+	CapAggregation  Capability = "aggregation"
+	CapPointInTime  Capability = "point-in-time"
+	CapOrFilters    Capability = "or-filters"
+	CapVectorSearch Capability = "vector-search"
+)
+
+// UnsupportedError is returned by features that need a capability the
+// backend lacks, in place of whatever error the backend would give.
+type UnsupportedError struct {
+	Op         string
+	Capability Capability
+	Emulator   bool
+}
+
+func (e *UnsupportedError) Error() string {
+	backend := "production"
+	if e.Emulator {
+		backend = "emulator"
+	}
+	return fmt.Sprintf("%s - %s is not supported by the %s backend",
+		e.Op, e.Capability, backend)
+}
+
+func (e *UnsupportedError) Unwrap() error {
+	return ErrUnsupportedByBackend
+}
+
+// BackendCapabilities is what the Db knows about its backend.
+type BackendCapabilities struct {
+	Emulator bool
+	// Probed is false when only the environment was looked at.
+	Probed      bool
+	Unsupported map[Capability]bool
+}
+
+func (c BackendCapabilities) Has(capability Capability) bool {
+	return !c.Unsupported[capability]
+}
+
+func (c BackendCapabilities) String() string {
+	backend := "production"
+	if c.Emulator {
+		backend = "emulator"
+	}
+	var missing []string
+	for capability, unsupported := range c.Unsupported {
+		if unsupported {
+			missing = append(missing, string(capability))
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) == 0 {
+		return backend
+	}
+	return backend + " without " + strings.Join(missing, ", ")
+}
+
+// detectBackend looks at the environment only. The emulator keeps no old
+// versions and has no vector indexes.
+func detectBackend() BackendCapabilities {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		return BackendCapabilities{Unsupported: map[Capability]bool{}}
+	}
+	return BackendCapabilities{
+		Emulator: true,
+		Unsupported: map[Capability]bool{
+			CapPointInTime:  true,
+			CapVectorSearch: true,
+		},
+	}
+}
+
+// backend_mu guards the backend field of every FirestoreDb, which
+// ProbeBackend may set while the Db is in use.
+var backend_mu sync.RWMutex
+
+// Backend returns the capabilities found by ProbeBackend, or those implied
+// by the environment if it has not run.
+func (db *FirestoreDb) Backend() BackendCapabilities {
+	backend_mu.RLock()
+	backend := db.backend
+	backend_mu.RUnlock()
+	if backend != nil {
+		return *backend
+	}
+	return detectBackend()
+}
+
+func isUnsupportedCode(err error) bool {
+	switch status.Code(err) {
+	case codes.Unimplemented, codes.InvalidArgument, codes.FailedPrecondition:
+		return true
+	}
+	return false
+}
+
+// ProbeBackend refines Backend by issuing one small query per capability
+// against an empty reserved collection. Capabilities that cannot be probed
+// cheaply keep what the environment implies. It may run while the Db is
+// in use; operations see either the old capabilities or the new ones.
+func (db *FirestoreDb) ProbeBackend(ctx context.Context) (
+	BackendCapabilities, error) {
+	capabilities := detectBackend()
+	probe := db.nextClient().Collection(InternalCollection("probe"))
+	probes := map[Capability]func() error{
+		CapAggregation: func() error {
+			_, err := probe.NewAggregationQuery().WithCount("count").Get(ctx)
+			return err
+		},
+		CapOrFilters: func() error {
+			_, err := probe.WhereEntity(firestore.OrFilter{
+				Filters: []firestore.EntityFilter{
+					firestore.PropertyFilter{
+						Path: "a", Operator: "==", Value: 1},
+					firestore.PropertyFilter{
+						Path: "b", Operator: "==", Value: 1},
+				}}).Limit(1).Documents(ctx).GetAll()
+			return err
+		},
+	}
+	if !capabilities.Emulator {
+		probes[CapPointInTime] = func() error {
+			_, err := probe.Doc("probe").WithReadOptions(
+				firestore.ReadTime(db.now().Add(-time.Minute))).Get(ctx)
+			if status.Code(err) == codes.NotFound {
+				return nil
+			}
+			return err
+		}
+	}
+	for capability, run := range probes {
+		err := run()
+		if isUnsupportedCode(err) {
+			capabilities.Unsupported[capability] = true
+		} else if err != nil {
+			return db.Backend(), fmt.Errorf(
+				"ProbeBackend - could not probe %s: %w", capability, err)
+		}
+	}
+	capabilities.Probed = true
+	backend_mu.Lock()
+	db.backend = &capabilities
+	backend_mu.Unlock()
+	return capabilities, nil
+}
+
+var fallback_notices sync.Map
+
+// EnableFallback lets features that need capability degrade to a slower
+// equivalent instead of failing with ErrUnsupportedByBackend, for example
+// Count scanning keys when aggregation queries are missing.
+func (db *FirestoreDb) EnableFallback(capability Capability) {
+	if db.fallbacks == nil {
+		db.fallbacks = map[Capability]bool{}
+	}
+	db.fallbacks[capability] = true
+}
+
+// requireCapability reports whether op should take its fallback path, or
+// fails op when the backend lacks capability and no fallback is enabled.
+func (db *FirestoreDb) requireCapability(
+	op string, capability Capability) (fallback bool, err error) {
+	backend := db.Backend()
+	if backend.Has(capability) {
+		return false, nil
+	}
+	if !db.fallbacks[capability] {
+		return false, &UnsupportedError{
+			Op: op, Capability: capability, Emulator: backend.Emulator}
+	}
+	if _, seen := fallback_notices.LoadOrStore(op, true); !seen {
+		log.Printf("%s: %s unsupported by %v backend, using fallback",
+			op, capability, backend)
+	}
+	return true, nil
+}
+
+// Counter is the optional capability of a Db to count the documents of a
+// collection without reading them.
+type Counter interface {
+	Count(ctx context.Context, collection []string) (int64, error)
+}
+
+var (
+	_ Counter = &FirestoreDb{}
+	_ Counter = &MemoryDb{}
+)
+
+// Count returns how many documents collection holds, with an aggregation
+// query or, as a fallback, a keys-only scan.
+func (db *FirestoreDb) Count(
+	ctx context.Context, collection []string) (int64, error) {
+	collection_path, err := getCollectionPath(collection, db.allow_reserved)
+	if err != nil {
+		return 0, err
+	}
+	fallback, err := db.requireCapability("Count", CapAggregation)
+	if err != nil {
+		return 0, err
+	}
+	query := db.nextClient().Collection(collection_path).Query
+	if fallback {
+		var n int64
+		docs := query.Select().Documents(ctx)
+		defer docs.Stop()
+		for {
+			_, err := docs.Next()
+			if err == iterator.Done {
+				return n, nil
+			}
+			if err != nil {
+				return 0, dbError(
+					"Count", collection_path, "could not list objects", err)
+			}
+			n++
+		}
+	}
+	result, err := query.NewAggregationQuery().WithCount("count").Get(ctx)
+	if status.Code(err) == codes.Unimplemented {
+		return 0, &UnsupportedError{Op: "Count", Capability: CapAggregation,
+			Emulator: db.Backend().Emulator}
+	}
+	if err != nil {
+		return 0, dbError(
+			"Count", collection_path, "could not count objects", err)
+	}
+	var counted struct {
+		Count int64 `firestore:"count"`
+	}
+	if err := result.DataTo(&counted); err != nil {
+		return 0, dbError(
+			"Count", collection_path, "could not read count", err)
+	}
+	return counted.Count, nil
+}
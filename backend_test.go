@@ -0,0 +1,87 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRequireCapabilityAndFallback(t *testing.T) {
+	db := NewFirestoreDb(offlineClients(t, 1)[0])
+	db.backend = &BackendCapabilities{Probed: true,
+		Unsupported: map[Capability]bool{CapAggregation: true}}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		200*time.Millisecond)
+	defer cancel()
+	_, err := db.Count(ctx, []string{"users"})
+	var unsupported *UnsupportedError
+	if !errors.As(err, &unsupported) || unsupported.Op != "Count" ||
+		unsupported.Capability != CapAggregation || unsupported.Emulator {
+		t.Fatalf("Count without aggregation: %v, want an UnsupportedError", err)
+	}
+	if !errors.Is(err, ErrUnsupportedByBackend) ||
+		HTTPStatus(err) != http.StatusNotImplemented {
+		t.Errorf("%v does not map to ErrUnsupportedByBackend and 501", err)
+	}
+
+	// With the fallback the scan is attempted, and fails offline instead.
+	db.EnableFallback(CapAggregation)
+	_, err = db.Count(ctx, []string{"users"})
+	if err == nil || errors.Is(err, ErrUnsupportedByBackend) {
+		t.Errorf("Count with the fallback: %v, want a scan error", err)
+	}
+}
+
+func TestProbeBackendOffline(t *testing.T) {
+	db := NewFirestoreDb(offlineClients(t, 1)[0])
+	ctx, cancel := context.WithTimeout(context.Background(),
+		200*time.Millisecond)
+	defer cancel()
+	if _, err := db.ProbeBackend(ctx); err == nil {
+		t.Fatal("ProbeBackend succeeded offline")
+	}
+	if db.Backend().Probed {
+		t.Error("a failed probe replaced the environment's capabilities")
+	}
+}
+
+func TestProbeBackend(t *testing.T) {
+	db := emulatorDb(t)
+	if db.Backend().Probed {
+		t.Fatal("Backend probed before ProbeBackend")
+	}
+	// Readers may run while the probe stores its result.
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					db.Backend()
+				}
+			}
+		}()
+	}
+	capabilities, err := db.ProbeBackend(context.Background())
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !capabilities.Probed || !capabilities.Emulator ||
+		capabilities.Has(CapPointInTime) {
+		t.Errorf("ProbeBackend = %v, want a probed emulator without %s",
+			capabilities, CapPointInTime)
+	}
+	if got := db.Backend(); !got.Probed {
+		t.Errorf("Backend after ProbeBackend = %+v, want it probed", got)
+	}
+}
@@ -0,0 +1,249 @@
+package rest2firestore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+
+	"cloud.google.com/go/firestore"
+)
+
+const DefaultSearchWorkers = 16
+
+// BatchResult reports on one object of a BatchPost.
+type BatchResult struct {
+	Obj     Object
+	Created bool
+	Err     error
+}
+
+type batchItem struct {
+	obj      ObjectV2
+	document []string
+	created  bool
+}
+
+func (db *FirestoreDb) searchWorkers() int {
+	if db.SearchWorkers <= 0 {
+		return DefaultSearchWorkers
+	}
+	return db.SearchWorkers
+}
+
+// BatchPost is Post for many objects into one collection. Existing
+// documents are looked up for the whole batch first, with SearchAll when
+// the objects are BulkSearchers and otherwise with up to SearchWorkers
+// concurrent Searches. The rest are created concurrently: QuerySearchers
+// each in its own transaction, BatchKeyers once per key, with later items
+// of the key getting the same document. Other objects are created one at a
+// time, each searched for again first. Either way duplicates within the
+// batch end up as one document. results[i] reports on objs[i]; err is only
+// returned when the batch as a whole failed.
+func (db *FirestoreDb) BatchPost(ctx context.Context, objs []Object,
+	collection []string) (results []BatchResult, err error) {
+	collection_path, err := getCollectionPath(collection, db.allow_reserved)
+	if err != nil || len(objs) == 0 {
+		return nil, err
+	}
+	items := adaptLegacyList(objs)
+	results = make([]BatchResult, len(objs))
+	for i, obj := range items {
+		results[i].Err = db.injectAncestorKeys(obj, collection)
+	}
+	client := db.nextClient()
+	found, err := db.searchAll(ctx, client, collection_path, items, results)
+	if err != nil {
+		return nil, err
+	}
+	transactional := db.flag(ctx, FlagTransactionalWrites, true)
+	g := NewQueryGroup()
+	g.Workers = db.searchWorkers()
+	var serial []int
+	// leaders maps each batch key to the item creating its document, and
+	// followers the later items of a key to that item.
+	leaders := map[string]int{}
+	followers := map[int]int{}
+	for i, obj := range items {
+		if results[i].Err != nil {
+			continue
+		}
+		i, obj, name := i, obj, strconv.Itoa(i)
+		if document, ok := found[i]; ok {
+			g.Add(name, func(ctx context.Context) (interface{}, error) {
+				result, err := db.get(ctx, obj, document)
+				return batchItem{obj: result, document: document}, err
+			})
+			continue
+		}
+		query, ok, err :=
+			safeSearchQuery("BatchPost", collection_path, obj, client)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if ok && transactional {
+			g.Add(name, func(ctx context.Context) (interface{}, error) {
+				result, document, created, err :=
+					db.findOrCreateTx(ctx, client, query, obj, collection)
+				return batchItem{obj: result, document: document,
+					created: created}, err
+			})
+			continue
+		}
+		key, ok, err := safeBatchKey("BatchPost", collection_path, obj)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if !ok || key == "" {
+			serial = append(serial, i)
+			continue
+		}
+		if leader, ok := leaders[key]; ok {
+			followers[i] = leader
+			continue
+		}
+		leaders[key] = i
+		g.Add(name, func(ctx context.Context) (interface{}, error) {
+			result, document, err := db.create(ctx, client, obj, collection)
+			return batchItem{obj: result, document: document,
+				created: true}, err
+		})
+	}
+	executed, err := g.Execute(ctx)
+	if err != nil {
+		return nil, err
+	}
+	written := map[int]batchItem{}
+	for name, result := range executed {
+		i, _ := strconv.Atoi(name)
+		if result.Err != nil {
+			results[i].Err = result.Err
+			continue
+		}
+		written[i] = result.Value.(batchItem)
+		results[i] = db.batchResult(ctx, written[i])
+	}
+	for i, leader := range followers {
+		item, ok := written[leader]
+		if !ok {
+			results[i].Err = results[leader].Err
+			continue
+		}
+		item.created = false
+		results[i] = db.batchResult(ctx, item)
+	}
+	for n, i := range serial {
+		item, err := db.postSerial(ctx, client, items[i], collection, n > 0)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i] = db.batchResult(ctx, item)
+	}
+	return results, nil
+}
+
+// batchResult runs the AfterPost hooks on item.
+func (db *FirestoreDb) batchResult(
+	ctx context.Context, item batchItem) BatchResult {
+	err := db.afterPost(ctx, "BatchPost", item.document, item.obj, item.created)
+	if err != nil {
+		return BatchResult{Err: err}
+	}
+	return BatchResult{Obj: AdaptV2(item.obj), Created: item.created}
+}
+
+// postSerial creates obj unless, when search is set, a document created
+// earlier in the batch now matches it.
+func (db *FirestoreDb) postSerial(ctx context.Context,
+	client *firestore.Client, obj ObjectV2, collection []string,
+	search bool) (batchItem, error) {
+	collection_path := path.Join(collection...)
+	if err := ctx.Err(); err != nil {
+		return batchItem{}, dbError(
+			"BatchPost", collection_path, "interrupted", err)
+	}
+	if search {
+		document, err := db.searchOne(ctx, client, collection_path, obj)
+		if err != nil {
+			return batchItem{}, err
+		}
+		if len(document) > 0 {
+			result, err := db.get(ctx, obj, document)
+			return batchItem{obj: result, document: document}, err
+		}
+	}
+	result, document, err := db.create(ctx, client, obj, collection)
+	return batchItem{obj: result, document: document, created: true}, err
+}
+
+// searchOne is searchAll for a single object.
+func (db *FirestoreDb) searchOne(ctx context.Context,
+	client *firestore.Client, collection_path string, obj ObjectV2) (
+	[]string, error) {
+	if searcher, ok := bulkSearcher(obj); ok {
+		found, err := safeSearchAll(ctx, "BatchPost", collection_path,
+			searcher, []ObjectV2{obj}, client)
+		if err != nil {
+			return nil, dbError(
+				"BatchPost", collection_path, "could not search objects", err)
+		}
+		return found[0], nil
+	}
+	return safeSearch(ctx, "BatchPost", collection_path, obj, client)
+}
+
+// searchAll maps indices of items to their existing documents. Failed
+// Searches are recorded in results; a failed SearchAll fails the batch.
+func (db *FirestoreDb) searchAll(ctx context.Context,
+	client *firestore.Client, collection_path string, items []ObjectV2,
+	results []BatchResult) (map[int][]string, error) {
+	if searcher, ok := bulkSearcher(items[0]); ok {
+		found, err := safeSearchAll(
+			ctx, "BatchPost", collection_path, searcher, items, client)
+		if err != nil {
+			return nil, dbError(
+				"BatchPost", collection_path, "could not search objects", err)
+		}
+		for i, document := range found {
+			if i < 0 || i >= len(items) {
+				return nil, fmt.Errorf(
+					"%s:BatchPost - SearchAll returned index %d of %d items",
+					collection_path, i, len(items))
+			}
+			if len(document) == 0 {
+				delete(found, i)
+			}
+		}
+		return found, nil
+	}
+	g := NewQueryGroup()
+	g.Workers = db.searchWorkers()
+	for i, obj := range items {
+		if results[i].Err != nil {
+			continue
+		}
+		obj := obj
+		g.Add(strconv.Itoa(i), func(ctx context.Context) (interface{}, error) {
+			return safeSearch(ctx, "BatchPost", collection_path, obj, client)
+		})
+	}
+	searched, err := g.Execute(ctx)
+	if err != nil {
+		return nil, err
+	}
+	found := map[int][]string{}
+	for name, result := range searched {
+		i, _ := strconv.Atoi(name)
+		if result.Err != nil {
+			results[i].Err = result.Err
+			continue
+		}
+		if document, _ := result.Value.([]string); len(document) > 0 {
+			found[i] = document
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,267 @@
+package rest2firestore
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+)
+
+// bulkUser is a testUser found with SearchAll, one "in" query per 30
+// emails, and keyed by email within a batch.
+type bulkUser struct {
+	Email string `firestore:"email"`
+
+	collection []string
+	// found, when set, replaces the result of SearchAll.
+	found map[int][]string
+	// searches, when set, counts the calls of SearchAll.
+	searches *atomic.Int64
+}
+
+func (u *bulkUser) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	result := &bulkUser{collection: u.collection}
+	return result, doc.DataTo(result)
+}
+
+func (u *bulkUser) Serialize() {
+}
+
+func (u *bulkUser) SearchAll(ctx context.Context, client *firestore.Client,
+	objs []Object) (map[int][]string, error) {
+	if u.searches != nil {
+		u.searches.Add(1)
+	}
+	if u.found != nil {
+		return u.found, nil
+	}
+	indices := map[string][]int{}
+	var emails []interface{}
+	for i, obj := range objs {
+		email := Underlying(obj).(*bulkUser).Email
+		if len(indices[email]) == 0 {
+			emails = append(emails, email)
+		}
+		indices[email] = append(indices[email], i)
+	}
+	found := map[int][]string{}
+	for len(emails) > 0 {
+		chunk := emails[:min(30, len(emails))]
+		emails = emails[len(chunk):]
+		docs, err := client.Collection(path.Join(u.collection...)).
+			Where("email", "in", chunk).Documents(ctx).GetAll()
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			email, _ := doc.DataAt("email")
+			for _, i := range indices[email.(string)] {
+				found[i] = strings.Split(documentRefPath(doc.Ref), "/")
+			}
+		}
+	}
+	return found, nil
+}
+
+func (u *bulkUser) BatchKey() (string, bool) {
+	return u.Email, u.Email != ""
+}
+
+func TestBatchPostOutOfRangeIndex(t *testing.T) {
+	db := NewFirestoreDb(nil)
+	searcher := &bulkUser{found: map[int][]string{2: {"users", "u1"}}}
+	_, err := db.BatchPost(context.Background(),
+		[]Object{AdaptV2(searcher), AdaptV2(&bulkUser{})}, []string{"users"})
+	if err == nil || !strings.Contains(err.Error(), "index 2 of 2") {
+		t.Errorf("BatchPost: %v, want an out of range index error", err)
+	}
+}
+
+// testBatchPostDuplicates posts a, b, a, c, b where a exists, and checks
+// that each result is for its own object and that b is created once.
+func testBatchPostDuplicates(t *testing.T, db *FirestoreDb,
+	collection []string, newObj func(email string) Object,
+	emailOf func(Object) string) {
+	ctx := context.Background()
+	if _, err := db.Put(ctx, newObj("a"), append(collection, "a")); err != nil {
+		t.Fatal(err)
+	}
+	emails := []string{"a", "b", "a", "c", "b"}
+	var objs []Object
+	for _, email := range emails {
+		objs = append(objs, newObj(email))
+	}
+	results, err := db.BatchPost(ctx, objs, collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := map[string]int{}
+	for i, result := range results {
+		if result.Err != nil {
+			t.Fatalf("result %d: %v", i, result.Err)
+		}
+		if got := emailOf(result.Obj); got != emails[i] {
+			t.Errorf("result %d is for %q, want %q", i, got, emails[i])
+		}
+		if result.Created {
+			created[emails[i]]++
+		}
+	}
+	if created["a"] != 0 || created["b"] != 1 || created["c"] != 1 {
+		t.Errorf("created %v, want a 0, b 1 and c 1", created)
+	}
+	refs, err := db.client.Collection(collection[0]).DocumentRefs(ctx).
+		GetAll()
+	if err != nil || len(refs) != 3 {
+		t.Errorf("%d documents after BatchPost, %v, want 3", len(refs), err)
+	}
+}
+
+func TestBatchPostDuplicatesQuerySearcher(t *testing.T) {
+	db := emulatorDb(t)
+	collection := testCollection("users")
+	testBatchPostDuplicates(t, db, collection, func(email string) Object {
+		return userAt(collection, email, "")
+	}, func(obj Object) string {
+		return Underlying(obj).(*testUser).Email
+	})
+}
+
+func TestBatchPostDuplicatesBulkSearcher(t *testing.T) {
+	db := emulatorDb(t)
+	collection := testCollection("users")
+	testBatchPostDuplicates(t, db, collection, func(email string) Object {
+		return AdaptV2(&bulkUser{Email: email, collection: collection})
+	}, func(obj Object) string {
+		return Underlying(obj).(*bulkUser).Email
+	})
+}
+
+func TestBatchPostBulkSearcherSearchesOnce(t *testing.T) {
+	db := emulatorDb(t)
+	ctx := context.Background()
+	collection := testCollection("users")
+	searches := &atomic.Int64{}
+	newUser := func(i int) Object {
+		return AdaptV2(&bulkUser{Email: strconv.Itoa(i) + "@example.com",
+			collection: collection, searches: searches})
+	}
+	const users, copies, existing = 20, 3, 5
+	for i := 0; i < existing; i++ {
+		if _, err := db.Put(ctx, newUser(i),
+			append(collection, strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var objs []Object
+	for n := 0; n < copies; n++ {
+		for i := 0; i < users; i++ {
+			objs = append(objs, newUser(i))
+		}
+	}
+	searches.Store(0)
+	results, err := db.BatchPost(ctx, objs, collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := 0
+	for i, result := range results {
+		if result.Err != nil {
+			t.Fatalf("result %d: %v", i, result.Err)
+		}
+		if result.Created {
+			created++
+		}
+	}
+	if n := searches.Load(); n != 1 {
+		t.Errorf("SearchAll called %d times, want 1", n)
+	}
+	if created != users-existing {
+		t.Errorf("%d created, want %d", created, users-existing)
+	}
+	refs, err := db.client.Collection(collection[0]).DocumentRefs(ctx).
+		GetAll()
+	if err != nil || len(refs) != users {
+		t.Errorf("%d documents after BatchPost, %v, want %d",
+			len(refs), err, users)
+	}
+}
+
+const benchmark_items = 10000
+
+// benchmarkImport seeds an emulator collection with benchmark_items users
+// and returns objects for all of them, every other one already stored.
+func benchmarkImport(b *testing.B, newObj func(collection []string,
+	email string) Object) (*FirestoreDb, string, []ObjectV2) {
+	db := emulatorDb(b)
+	ctx := context.Background()
+	collection := testCollection("users")
+	writer := db.client.BulkWriter(ctx)
+	objs := make([]ObjectV2, benchmark_items)
+	for i := range objs {
+		email := strconv.Itoa(i) + "@example.com"
+		objs[i] = AdaptLegacy(newObj(collection, email))
+		if i%2 == 0 {
+			ref := db.client.Collection(collection[0]).Doc(strconv.Itoa(i))
+			_, err := writer.Set(ref, map[string]interface{}{"email": email})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	writer.End()
+	b.ResetTimer()
+	return db, collection[0], objs
+}
+
+func newTestUser(collection []string, email string) Object {
+	return userAt(collection, email, "")
+}
+
+func BenchmarkSearchSequential(b *testing.B) {
+	db, collection_path, objs := benchmarkImport(b, newTestUser)
+	ctx := context.Background()
+	for n := 0; n < b.N; n++ {
+		for _, obj := range objs {
+			_, err := safeSearch(ctx, "BatchPost", collection_path, obj,
+				db.client)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkSearchConcurrent(b *testing.B) {
+	db, collection_path, objs := benchmarkImport(b, newTestUser)
+	benchmarkSearchAll(b, db, collection_path, objs)
+}
+
+func BenchmarkSearchBulk(b *testing.B) {
+	db, collection_path, objs := benchmarkImport(b,
+		func(collection []string, email string) Object {
+			return AdaptV2(&bulkUser{Email: email, collection: collection})
+		})
+	benchmarkSearchAll(b, db, collection_path, objs)
+}
+
+func benchmarkSearchAll(b *testing.B, db *FirestoreDb,
+	collection_path string, objs []ObjectV2) {
+	ctx := context.Background()
+	for n := 0; n < b.N; n++ {
+		results := make([]BatchResult, len(objs))
+		found, err := db.searchAll(ctx, db.client, collection_path, objs,
+			results)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(found) != benchmark_items/2 {
+			b.Fatalf("found %d, want %d", len(found), benchmark_items/2)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var ErrBackendUnavailable = errors.New("firestore backend unavailable")
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerDb wraps a Db with a circuit breaker. After Threshold consecutive
+// Unavailable errors every call fails fast with ErrBackendUnavailable until
+// Cooldown has passed, then a single probe call decides whether to close
+// the breaker again.
+//
+// Reads fail while it is open just as writes do; RetryAfter tells callers
+// when to retry. Calls cancelled or timed out by the caller are not counted
+// either way.
+type BreakerDb struct {
+	db        Db
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int
+	opened_at time.Time
+	probing   bool
+}
+
+var _ Db = &BreakerDb{}
+
+func NewBreakerDb(db Db, threshold int, cooldown time.Duration) *BreakerDb {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &BreakerDb{
+		db:        db,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+func (b *BreakerDb) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// RetryAfter reports how long callers should wait before the breaker lets
+// a probe through. It is zero unless the breaker is open.
+func (b *BreakerDb) RetryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BreakerOpen {
+		return 0
+	}
+	remaining := b.cooldown - b.now().Sub(b.opened_at)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+func (b *BreakerDb) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.opened_at) < b.cooldown {
+			return ErrBackendUnavailable
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return nil
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrBackendUnavailable
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record counts the outcome of a call that allow let through. A call
+// ended by its caller's context says nothing about the backend, so it
+// leaves the breaker as it was, and a half-open breaker probes again.
+func (b *BreakerDb) record(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err != nil && (ctx.Err() != nil || errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)) {
+		return
+	}
+	if status.Code(err) != codes.Unavailable {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.opened_at = b.now()
+	}
+}
+
+func (b *BreakerDb) List(
+	ctx context.Context, obj Object, collection []string) ([]Object, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	objs, err := b.db.List(ctx, obj, collection)
+	b.record(ctx, err)
+	return objs, err
+}
+
+func (b *BreakerDb) ListWithQuery(ctx context.Context, obj Object,
+	collection []string, q *ListQuery) ([]Object, string, error) {
+	if err := b.allow(); err != nil {
+		return nil, "", err
+	}
+	objs, cursor, err := b.db.ListWithQuery(ctx, obj, collection, q)
+	b.record(ctx, err)
+	return objs, cursor, err
+}
+
+func (b *BreakerDb) ListGroup(ctx context.Context, obj Object,
+	collection_id string) ([]Object, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	objs, err := b.db.ListGroup(ctx, obj, collection_id)
+	b.record(ctx, err)
+	return objs, err
+}
+
+func (b *BreakerDb) Clear(
+	ctx context.Context, dummy Object, collection []string) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.db.Clear(ctx, dummy, collection)
+	b.record(ctx, err)
+	return err
+}
+
+func (b *BreakerDb) Post(
+	ctx context.Context, obj Object, collection []string) (Object, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	result, err := b.db.Post(ctx, obj, collection)
+	b.record(ctx, err)
+	return result, err
+}
+
+func (b *BreakerDb) FindOrCreate(
+	ctx context.Context, obj Object, collection []string) (
+	Object, bool, error) {
+	if err := b.allow(); err != nil {
+		return nil, false, err
+	}
+	result, created, err := b.db.FindOrCreate(ctx, obj, collection)
+	b.record(ctx, err)
+	return result, created, err
+}
+
+func (b *BreakerDb) Put(
+	ctx context.Context, obj Object, collection []string) (Object, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	result, err := b.db.Put(ctx, obj, collection)
+	b.record(ctx, err)
+	return result, err
+}
+
+func (b *BreakerDb) Patch(ctx context.Context, obj Object) (Object, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	result, err := b.db.Patch(ctx, obj)
+	b.record(ctx, err)
+	return result, err
+}
+
+func (b *BreakerDb) PatchFields(ctx context.Context, dummy Object,
+	document []string, fields map[string]interface{}) (Object, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	result, err := b.db.PatchFields(ctx, dummy, document, fields)
+	b.record(ctx, err)
+	return result, err
+}
+
+func (b *BreakerDb) Get(
+	ctx context.Context, dummy Object, document []string) (Object, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	result, err := b.db.Get(ctx, dummy, document)
+	b.record(ctx, err)
+	return result, err
+}
+
+func (b *BreakerDb) Delete(
+	ctx context.Context, dummy Object, document []string) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := b.db.Delete(ctx, dummy, document)
+	b.record(ctx, err)
+	return err
+}
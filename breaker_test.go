@@ -0,0 +1,150 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// flakyDb is a MemoryDb whose Get fails with err, calling during first.
+type flakyDb struct {
+	*MemoryDb
+	err    error
+	calls  int
+	during func()
+}
+
+func (f *flakyDb) Get(
+	ctx context.Context, dummy Object, document []string) (Object, error) {
+	f.calls++
+	if f.during != nil {
+		f.during()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.MemoryDb.Get(ctx, dummy, document)
+}
+
+func TestBreakerStates(t *testing.T) {
+	ctx := context.Background()
+	document := []string{"users", "u1"}
+	dummy := AdaptV2(&testUser{})
+	flaky := &flakyDb{MemoryDb: NewMemoryDb()}
+	if _, err := flaky.Put(ctx, AdaptV2(&testUser{}), document); err != nil {
+		t.Fatal(err)
+	}
+	breaker := NewBreakerDb(flaky, 2, time.Minute)
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+	get := func() error {
+		_, err := breaker.Get(ctx, dummy, document)
+		return err
+	}
+
+	flaky.err = status.Error(codes.Unavailable, "down")
+	for i := 0; i < 2; i++ {
+		if state := breaker.State(); state != BreakerClosed {
+			t.Fatalf("before failure %d: %v, want closed", i+1, state)
+		}
+		if err := get(); status.Code(err) != codes.Unavailable {
+			t.Fatalf("failure %d: %v, want Unavailable", i+1, err)
+		}
+	}
+	if state := breaker.State(); state != BreakerOpen {
+		t.Fatalf("after 2 failures: %v, want open", state)
+	}
+	if got := breaker.RetryAfter(); got != time.Minute {
+		t.Errorf("RetryAfter %v, want 1m", got)
+	}
+	calls := flaky.calls
+	if err := get(); !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("read while open: %v, want ErrBackendUnavailable", err)
+	}
+	_, err := breaker.Put(ctx, AdaptV2(&testUser{}), document)
+	if !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("write while open: %v, want ErrBackendUnavailable", err)
+	}
+	if flaky.calls != calls {
+		t.Errorf("open breaker let %d calls through", flaky.calls-calls)
+	}
+
+	// A failed probe opens the breaker again.
+	now = now.Add(time.Minute)
+	var probe_state BreakerState
+	flaky.during = func() { probe_state = breaker.State() }
+	if err := get(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("failed probe: %v, want Unavailable", err)
+	}
+	if probe_state != BreakerHalfOpen {
+		t.Errorf("during probe: %v, want half-open", probe_state)
+	}
+	if state := breaker.State(); state != BreakerOpen {
+		t.Fatalf("after failed probe: %v, want open", state)
+	}
+
+	// A successful one closes it.
+	now = now.Add(time.Minute)
+	flaky.err = nil
+	if err := get(); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if probe_state != BreakerHalfOpen {
+		t.Errorf("during probe: %v, want half-open", probe_state)
+	}
+	if state := breaker.State(); state != BreakerClosed {
+		t.Errorf("after probe: %v, want closed", state)
+	}
+	if err := get(); err != nil {
+		t.Errorf("read once closed: %v", err)
+	}
+}
+
+func TestBreakerIgnoresCallerCancellation(t *testing.T) {
+	document := []string{"users", "u1"}
+	dummy := AdaptV2(&testUser{})
+	flaky := &flakyDb{MemoryDb: NewMemoryDb()}
+	breaker := NewBreakerDb(flaky, 2, time.Minute)
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Cancellation neither counts as a failure nor resets the count.
+	flaky.err = status.Error(codes.Unavailable, "down")
+	breaker.Get(context.Background(), dummy, document)
+	flaky.err = context.Canceled
+	breaker.Get(cancelled, dummy, document)
+	flaky.err = status.Error(codes.Unavailable, "down")
+	breaker.Get(context.Background(), dummy, document)
+	if state := breaker.State(); state != BreakerOpen {
+		t.Fatalf("after 2 failures around a cancellation: %v, want open",
+			state)
+	}
+
+	// A probe cut short by its caller leaves the breaker half-open, and
+	// the next call probes again.
+	now = now.Add(time.Minute)
+	flaky.err = status.Error(codes.DeadlineExceeded, "caller deadline")
+	_, err := breaker.Get(cancelled, dummy, document)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("cancelled probe: %v", err)
+	}
+	if state := breaker.State(); state != BreakerHalfOpen {
+		t.Fatalf("after a cancelled probe: %v, want half-open", state)
+	}
+	flaky.err = status.Error(codes.Unavailable, "down")
+	calls := flaky.calls
+	if _, err := breaker.Get(context.Background(), dummy,
+		document); status.Code(err) != codes.Unavailable {
+		t.Fatalf("second probe: %v, want Unavailable", err)
+	}
+	if flaky.calls != calls+1 || breaker.State() != BreakerOpen {
+		t.Errorf("second probe: %d calls, %v, want 1 call and open",
+			flaky.calls-calls, breaker.State())
+	}
+}
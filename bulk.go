@@ -0,0 +1,97 @@
+package rest2firestore
+
+import (
+	"context"
+
+	"cloud.google.com/go/firestore"
+)
+
+const DefaultBatchSize = 500
+
+// bulkWriter queues writes on a BulkWriter and waits for them every
+// BatchSize documents. The writer is only started on the first write.
+type bulkWriter struct {
+	ctx    context.Context
+	op     string
+	client *firestore.Client
+	size   int
+	writer *firestore.BulkWriter
+	jobs   []bulkJob
+}
+
+type bulkJob struct {
+	job   *firestore.BulkWriterJob
+	ref   *firestore.DocumentRef
+	doing string
+}
+
+func (db *FirestoreDb) newBulkWriter(
+	ctx context.Context, op string, client *firestore.Client) *bulkWriter {
+	return &bulkWriter{ctx: ctx, op: op, client: client, size: db.batchSize()}
+}
+
+func (db *FirestoreDb) batchSize() int {
+	if db.BatchSize <= 0 {
+		return DefaultBatchSize
+	}
+	return db.BatchSize
+}
+
+func (b *bulkWriter) delete(ref *firestore.DocumentRef) error {
+	return b.queue(ref, "could not delete object",
+		func(w *firestore.BulkWriter) (*firestore.BulkWriterJob, error) {
+			return w.Delete(ref)
+		})
+}
+
+func (b *bulkWriter) set(ref *firestore.DocumentRef, data interface{}) error {
+	return b.queue(ref, "could not write object",
+		func(w *firestore.BulkWriter) (*firestore.BulkWriterJob, error) {
+			return w.Set(ref, data)
+		})
+}
+
+func (b *bulkWriter) create(
+	ref *firestore.DocumentRef, data interface{}) error {
+	return b.queue(ref, "could not create object",
+		func(w *firestore.BulkWriter) (*firestore.BulkWriterJob, error) {
+			return w.Create(ref, data)
+		})
+}
+
+func (b *bulkWriter) queue(ref *firestore.DocumentRef, doing string,
+	write func(*firestore.BulkWriter) (*firestore.BulkWriterJob, error)) error {
+	if b.writer == nil {
+		b.writer = b.client.BulkWriter(b.ctx)
+	}
+	job, err := write(b.writer)
+	if err != nil {
+		return dbError(b.op, documentRefPath(ref), "could not queue write", err)
+	}
+	b.jobs = append(b.jobs, bulkJob{job: job, ref: ref, doing: doing})
+	if len(b.jobs) >= b.size {
+		return b.flush()
+	}
+	return nil
+}
+
+func (b *bulkWriter) flush() error {
+	if len(b.jobs) == 0 {
+		return nil
+	}
+	b.writer.Flush()
+	jobs := b.jobs
+	b.jobs = nil
+	for _, job := range jobs {
+		if _, err := job.job.Results(); err != nil {
+			return dbError(b.op, documentRefPath(job.ref), job.doing, err)
+		}
+	}
+	return nil
+}
+
+func (b *bulkWriter) close() {
+	if b.writer != nil {
+		b.writer.End()
+	}
+}
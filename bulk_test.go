@@ -0,0 +1,112 @@
+package rest2firestore
+
+import (
+	"context"
+	"os"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// emulatorCreds authenticates to the emulator as the owner, like the
+// client does when it dials FIRESTORE_EMULATOR_HOST itself.
+type emulatorCreds struct{}
+
+func (emulatorCreds) GetRequestMetadata(ctx context.Context,
+	uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer owner"}, nil
+}
+
+func (emulatorCreds) RequireTransportSecurity() bool {
+	return false
+}
+
+// countingEmulatorDb is emulatorDb with a count of the RPCs the client
+// sends.
+func countingEmulatorDb(t testing.TB) (*FirestoreDb, *atomic.Int64) {
+	t.Helper()
+	addr := os.Getenv("FIRESTORE_EMULATOR_HOST")
+	if addr == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+	rpcs := &atomic.Int64{}
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(emulatorCreds{}),
+		grpc.WithChainUnaryInterceptor(func(ctx context.Context,
+			method string, req, reply interface{}, cc *grpc.ClientConn,
+			invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			rpcs.Add(1)
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}),
+		grpc.WithChainStreamInterceptor(func(ctx context.Context,
+			desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+			streamer grpc.Streamer, opts ...grpc.CallOption) (
+			grpc.ClientStream, error) {
+			rpcs.Add(1)
+			return streamer(ctx, desc, cc, method, opts...)
+		}))
+	if err != nil {
+		t.Fatalf("could not dial the emulator: %v", err)
+	}
+	client, err := firestore.NewClient(context.Background(),
+		"rest2firestore-test", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("could not connect to the emulator: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return NewFirestoreDb(client), rpcs
+}
+
+func TestClearBatchesDeletes(t *testing.T) {
+	db, rpcs := countingEmulatorDb(t)
+	ctx := context.Background()
+	collection := testCollection("authors")
+	const authors, posts = 30, 100
+	writer := db.client.BulkWriter(ctx)
+	for i := 0; i < authors; i++ {
+		author := path.Join(collection[0], "a"+strconv.Itoa(i))
+		_, err := writer.Set(db.client.Doc(author), testAuthor{Name: "author"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < posts; j++ {
+			post := db.client.Doc(path.Join(author, "posts", strconv.Itoa(j)))
+			if _, err := writer.Set(post, testPost{Title: "post"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	writer.End()
+
+	rpcs.Store(0)
+	if err := db.Clear(ctx, AdaptV2(&testAuthor{}), collection); err != nil {
+		t.Fatal(err)
+	}
+	documents := int64(authors * (posts + 1))
+	if n := rpcs.Load(); n > documents/5 {
+		t.Errorf("Clear of %d documents sent %d RPCs, want at most %d",
+			documents, n, documents/5)
+	}
+
+	refs, err := db.client.Collection(collection[0]).DocumentRefs(ctx).
+		GetAll()
+	if err != nil || len(refs) != 0 {
+		t.Errorf("%d authors left after Clear, %v", len(refs), err)
+	}
+	for i := 0; i < authors; i++ {
+		author := path.Join(collection[0], "a"+strconv.Itoa(i))
+		refs, err := db.client.Collection(path.Join(author, "posts")).
+			DocumentRefs(ctx).GetAll()
+		if err != nil || len(refs) != 0 {
+			t.Fatalf("%d posts left below %s after Clear, %v",
+				len(refs), author, err)
+		}
+	}
+}
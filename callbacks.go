@@ -0,0 +1,132 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+
+	"cloud.google.com/go/firestore"
+)
+
+var ErrCallbackPanic = errors.New("callback panicked")
+
+const maxPanicStack = 4096
+
+// CallbackPanicError is returned in place of a panic raised by user code
+// the Db calls into, such as an Object's Deserialize or Search.
+type CallbackPanicError struct {
+	Op       string
+	Callback string
+	Path     string
+	Value    interface{}
+	Stack    []byte
+}
+
+func (e *CallbackPanicError) Error() string {
+	return fmt.Sprintf("%s:%s - %s panicked: %v",
+		e.Path, e.Op, e.Callback, e.Value)
+}
+
+func (e *CallbackPanicError) Unwrap() error {
+	return ErrCallbackPanic
+}
+
+var (
+	panic_counts_mu sync.Mutex
+	panic_counts    = map[string]int64{}
+)
+
+// PanicCounts returns how many panics were recovered per callback, keyed
+// by "Op/Callback".
+func PanicCounts() map[string]int64 {
+	panic_counts_mu.Lock()
+	defer panic_counts_mu.Unlock()
+	counts := make(map[string]int64, len(panic_counts))
+	for key, count := range panic_counts {
+		counts[key] = count
+	}
+	return counts
+}
+
+func recoverCallback(op, callback, path string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	stack := debug.Stack()
+	if len(stack) > maxPanicStack {
+		stack = stack[:maxPanicStack]
+	}
+	panic_err := &CallbackPanicError{
+		Op: op, Callback: callback, Path: path, Value: r, Stack: stack}
+	panic_counts_mu.Lock()
+	panic_counts[op+"/"+callback]++
+	panic_counts_mu.Unlock()
+	log.Printf("%v\n%s", panic_err, stack)
+	*err = panic_err
+}
+
+func safeDeserializeList(op, path string, obj ObjectV2,
+	docs []*firestore.DocumentSnapshot) (objs []ObjectV2, err error) {
+	defer recoverCallback(op, "DeserializeList", path, &err)
+	return deserializeList(obj, docs)
+}
+
+func safePostprocessList(op, path string, obj ObjectV2, objs []ObjectV2) (
+	result []ObjectV2, err error) {
+	defer recoverCallback(op, "PostprocessList", path, &err)
+	return postprocessList(obj, objs)
+}
+
+func safeDeserialize(op, path string, obj ObjectV2,
+	doc *firestore.DocumentSnapshot) (result ObjectV2, err error) {
+	defer recoverCallback(op, "Deserialize", path, &err)
+	return obj.Deserialize(doc)
+}
+
+func safeSerialize(op, path string, obj ObjectV2) (err error) {
+	defer recoverCallback(op, "Serialize", path, &err)
+	obj.Serialize()
+	return nil
+}
+
+func safeValidate(op, path string, obj ObjectV2) (err error) {
+	defer recoverCallback(op, "Validate", path, &err)
+	return validate(obj)
+}
+
+func safeSearch(ctx context.Context, op, path string, obj ObjectV2,
+	client *firestore.Client) (document []string, err error) {
+	defer recoverCallback(op, "Search", path, &err)
+	return search(ctx, obj, client)
+}
+
+func safeSearchQuery(op, path string, obj ObjectV2,
+	client *firestore.Client) (query firestore.Query, ok bool, err error) {
+	defer recoverCallback(op, "SearchQuery", path, &err)
+	query, ok = searchQuery(obj, client)
+	return query, ok, nil
+}
+
+func safeSearchAll(ctx context.Context, op, path string,
+	searcher BulkSearcher, objs []ObjectV2, client *firestore.Client) (
+	found map[int][]string, err error) {
+	defer recoverCallback(op, "SearchAll", path, &err)
+	return searcher.SearchAll(ctx, client, adaptV2List(objs))
+}
+
+func safeBatchKey(op, path string, obj ObjectV2) (
+	key string, ok bool, err error) {
+	defer recoverCallback(op, "BatchKey", path, &err)
+	key, ok = batchKey(obj)
+	return key, ok, nil
+}
+
+func safeSubcollections(op, path string, obj ObjectV2) (
+	result []Subcollection, err error) {
+	defer recoverCallback(op, "Subcollections", path, &err)
+	return subcollections(obj), nil
+}
@@ -0,0 +1,224 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// panicObj panics in every callback with the callback's name.
+type panicObj struct{}
+
+func (p *panicObj) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	panic("Deserialize")
+}
+
+func (p *panicObj) Serialize() {
+	panic("Serialize")
+}
+
+func (p *panicObj) Validate() error {
+	panic("Validate")
+}
+
+func (p *panicObj) Search(ctx context.Context, client *firestore.Client) (
+	[]string, error) {
+	panic("Search")
+}
+
+func (p *panicObj) SearchQuery(client *firestore.Client) (
+	firestore.Query, bool) {
+	panic("SearchQuery")
+}
+
+func (p *panicObj) SearchAll(ctx context.Context, client *firestore.Client,
+	objs []Object) (map[int][]string, error) {
+	panic("SearchAll")
+}
+
+func (p *panicObj) BatchKey() (string, bool) {
+	panic("BatchKey")
+}
+
+func (p *panicObj) DeserializeList(docs []*firestore.DocumentSnapshot) (
+	[]ObjectV2, error) {
+	panic("DeserializeList")
+}
+
+func (p *panicObj) PostprocessList(objs []ObjectV2) ([]ObjectV2, error) {
+	panic("PostprocessList")
+}
+
+func (p *panicObj) Subcollections() []Subcollection {
+	panic("Subcollections")
+}
+
+func checkPanicError(t *testing.T, err error, op, callback, path string) {
+	t.Helper()
+	var panic_err *CallbackPanicError
+	if !errors.As(err, &panic_err) || !errors.Is(err, ErrCallbackPanic) {
+		t.Fatalf("%v, want a CallbackPanicError", err)
+	}
+	if panic_err.Op != op || panic_err.Callback != callback ||
+		panic_err.Path != path || panic_err.Value != callback {
+		t.Errorf("%+v, want op %s, callback %s, path %s and its name as value",
+			panic_err, op, callback, path)
+	}
+	if len(panic_err.Stack) == 0 || len(panic_err.Stack) > maxPanicStack ||
+		!strings.Contains(string(panic_err.Stack), "panicObj") {
+		t.Errorf("stack of %d bytes without the panicking method",
+			len(panic_err.Stack))
+	}
+	if want := path + ":" + op + " - " + callback + " panicked: " +
+		callback; err.Error() != want {
+		t.Errorf("error %q, want %q", err, want)
+	}
+}
+
+func TestSafeCallbacks(t *testing.T) {
+	obj := &panicObj{}
+	ctx := context.Background()
+	calls := map[string]func() error{
+		"DeserializeList": func() error {
+			_, err := safeDeserializeList("Test", "things", obj, nil)
+			return err
+		},
+		"PostprocessList": func() error {
+			_, err := safePostprocessList("Test", "things", obj, nil)
+			return err
+		},
+		"Deserialize": func() error {
+			_, err := safeDeserialize("Test", "things", obj, nil)
+			return err
+		},
+		"Serialize": func() error {
+			return safeSerialize("Test", "things", obj)
+		},
+		"Validate": func() error {
+			return safeValidate("Test", "things", obj)
+		},
+		"Search": func() error {
+			_, err := safeSearch(ctx, "Test", "things", obj, nil)
+			return err
+		},
+		"SearchQuery": func() error {
+			_, _, err := safeSearchQuery("Test", "things", obj, nil)
+			return err
+		},
+		"SearchAll": func() error {
+			_, err := safeSearchAll(ctx, "Test", "things", obj, nil, nil)
+			return err
+		},
+		"BatchKey": func() error {
+			_, _, err := safeBatchKey("Test", "things", obj)
+			return err
+		},
+		"Subcollections": func() error {
+			_, err := safeSubcollections("Test", "things", obj)
+			return err
+		},
+	}
+	for callback, call := range calls {
+		t.Run(callback, func(t *testing.T) {
+			before := PanicCounts()["Test/"+callback]
+			checkPanicError(t, call(), "Test", callback, "things")
+			if n := PanicCounts()["Test/"+callback]; n != before+1 {
+				t.Errorf("PanicCounts went from %d to %d, want one more",
+					before, n)
+			}
+		})
+	}
+}
+
+func TestHookPanic(t *testing.T) {
+	err := runHook("Put", "BeforeUpdate", "users/u1", func() error {
+		panic("BeforeUpdate")
+	})
+	var panic_err *CallbackPanicError
+	if !errors.As(err, &panic_err) || panic_err.Callback != "BeforeUpdate" ||
+		panic_err.Op != "Put" || panic_err.Path != "users/u1" {
+		t.Errorf("runHook: %v, want a CallbackPanicError for the hook", err)
+	}
+}
+
+func TestMemoryDbContainsPanics(t *testing.T) {
+	db := NewMemoryDb()
+	ctx := context.Background()
+	_, err := db.Put(ctx, AdaptV2(&panicObj{}), []string{"things", "t1"})
+	checkPanicError(t, err, "Put", "Validate", "things/t1")
+	if _, err := db.Put(ctx, AdaptV2(&testUser{Email: "a@example.com"}),
+		[]string{"things", "t1"}); err != nil {
+		t.Fatalf("Put after a contained panic: %v", err)
+	}
+	_, err = db.Get(ctx, AdaptV2(&panicObj{}), []string{"things", "t1"})
+	checkPanicError(t, err, "Get", "Deserialize", "things/t1")
+	_, err = db.List(ctx, AdaptV2(&panicObj{}), []string{"things"})
+	checkPanicError(t, err, "List", "DeserializeList", "things")
+}
+
+// watchUser panics in Deserialize for documents named "bad".
+type watchUser struct {
+	Name string `firestore:"name"`
+}
+
+func (u *watchUser) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	result := &watchUser{}
+	if err := doc.DataTo(result); err != nil {
+		return nil, err
+	}
+	if result.Name == "bad" {
+		panic("bad document")
+	}
+	return result, nil
+}
+
+func (u *watchUser) Serialize() {
+}
+
+func TestWatchSurvivesPanic(t *testing.T) {
+	db := emulatorDb(t)
+	collection := testCollection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	events, err := db.Watch(ctx, AdaptV2(&watchUser{}), collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() ChangeEvent {
+		t.Helper()
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("the watch stopped")
+			}
+			return event
+		case <-ctx.Done():
+			t.Fatal("no event")
+		}
+		return ChangeEvent{}
+	}
+	for _, name := range []string{"bad", "good"} {
+		_, err := db.Put(context.Background(), AdaptV2(&watchUser{Name: name}),
+			append(collection, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		event := next()
+		if name == "bad" {
+			if !errors.Is(event.Err, ErrCallbackPanic) || event.Obj != nil ||
+				event.Document[len(event.Document)-1] != "bad" {
+				t.Errorf("event for the bad document: %+v", event)
+			}
+			continue
+		}
+		if event.Err != nil || Underlying(event.Obj).(*watchUser).Name != name {
+			t.Errorf("event after the panic: %+v, want %s", event, name)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package rest2firestore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// Struct fields can carry schema hints for the compatibility checker:
+//
+//	Status string `firestore:"status" r2f:"required,default=new,enum=new|done"`
+const schemaTag = "r2f"
+
+type ChangeKind string
+
+const (
+	FieldAdded       ChangeKind = "field_added"
+	FieldRemoved     ChangeKind = "field_removed"
+	FieldRenamed     ChangeKind = "field_renamed"
+	FieldTypeChanged ChangeKind = "type_changed"
+	FieldWidened     ChangeKind = "type_widened"
+	RequiredAdded    ChangeKind = "required_added"
+	EnumValueRemoved ChangeKind = "enum_value_removed"
+)
+
+type CompatChange struct {
+	Field    string     `json:"field"`
+	Kind     ChangeKind `json:"kind"`
+	Old      string     `json:"old,omitempty"`
+	New      string     `json:"new,omitempty"`
+	Breaking bool       `json:"breaking"`
+}
+
+type FieldFailure struct {
+	Document string `json:"document"`
+	Field    string `json:"field,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+type CompatReport struct {
+	Changes  []CompatChange `json:"changes"`
+	Failures []FieldFailure `json:"failures,omitempty"`
+}
+
+func (r CompatReport) Breaking() bool {
+	for _, change := range r.Changes {
+		if change.Breaking {
+			return true
+		}
+	}
+	return len(r.Failures) > 0
+}
+
+// CompatRules lists change kinds to accept as non-breaking. Additions and
+// widenings are accepted by default; everything else is breaking unless
+// allowed here.
+type CompatRules struct {
+	Allow          map[ChangeKind]bool
+	DisallowWiden  bool
+	DisallowAdding bool
+}
+
+func (rules CompatRules) breaking(kind ChangeKind) bool {
+	switch kind {
+	case FieldAdded:
+		return rules.DisallowAdding
+	case FieldWidened:
+		return rules.DisallowWiden
+	}
+	return !rules.Allow[kind]
+}
+
+type schemaField struct {
+	name     string
+	stored   string
+	typ      reflect.Type
+	required bool
+	fallback bool
+	enum     []string
+}
+
+func schemaOf(t reflect.Type) ([]schemaField, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%s: prototype is not a struct", t)
+	}
+	var fields []schemaField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		stored := strings.Split(field.Tag.Get("firestore"), ",")[0]
+		if field.PkgPath != "" || stored == "-" {
+			continue
+		}
+		if stored == "" {
+			stored = field.Name
+		}
+		f := schemaField{name: field.Name, stored: stored, typ: field.Type}
+		for _, option := range strings.Split(field.Tag.Get(schemaTag), ",") {
+			switch {
+			case option == "required":
+				f.required = true
+			case strings.HasPrefix(option, "default="):
+				f.fallback = true
+			case strings.HasPrefix(option, "enum="):
+				f.enum = strings.Split(strings.TrimPrefix(option, "enum="), "|")
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func isStructType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && t != reflect.TypeOf(time.Time{}) &&
+		t != reflect.TypeOf(latlng.LatLng{})
+}
+
+func typeRank(t reflect.Type) (family string, width int) {
+	switch t.Kind() {
+	case reflect.Int8, reflect.Uint8:
+		return "number", 8
+	case reflect.Int16, reflect.Uint16:
+		return "number", 16
+	case reflect.Int32, reflect.Uint32:
+		return "number", 32
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return "number", 64
+	case reflect.Float32:
+		return "number", 65
+	case reflect.Float64:
+		return "number", 66
+	}
+	return t.String(), 0
+}
+
+func compareSchemas(prefix string, old_type, new_type reflect.Type,
+	rules CompatRules, report *CompatReport) error {
+	old_fields, err := schemaOf(old_type)
+	if err != nil {
+		return err
+	}
+	new_fields, err := schemaOf(new_type)
+	if err != nil {
+		return err
+	}
+	add := func(change CompatChange) {
+		change.Field = prefix + change.Field
+		change.Breaking = rules.breaking(change.Kind)
+		report.Changes = append(report.Changes, change)
+	}
+	by_name := map[string]schemaField{}
+	for _, f := range new_fields {
+		by_name[f.name] = f
+	}
+	seen := map[string]bool{}
+	for _, old := range old_fields {
+		f, ok := by_name[old.name]
+		if !ok {
+			add(CompatChange{Field: old.stored, Kind: FieldRemoved,
+				Old: old.typ.String()})
+			continue
+		}
+		seen[f.name] = true
+		if f.stored != old.stored {
+			add(CompatChange{Field: old.stored, Kind: FieldRenamed,
+				Old: old.stored, New: f.stored})
+		}
+		switch {
+		case isStructType(old.typ) && isStructType(f.typ):
+			err := compareSchemas(
+				prefix+f.stored+".", old.typ, f.typ, rules, report)
+			if err != nil {
+				return err
+			}
+		case old.typ != f.typ:
+			old_family, old_width := typeRank(old.typ)
+			new_family, new_width := typeRank(f.typ)
+			kind := FieldTypeChanged
+			if old_family == new_family && new_width > old_width {
+				kind = FieldWidened
+			}
+			add(CompatChange{Field: f.stored, Kind: kind,
+				Old: old.typ.String(), New: f.typ.String()})
+		}
+		if f.required && !old.required && !f.fallback {
+			add(CompatChange{Field: f.stored, Kind: RequiredAdded})
+		}
+		if len(old.enum) > 0 {
+			allowed := map[string]bool{}
+			for _, value := range f.enum {
+				allowed[value] = true
+			}
+			for _, value := range old.enum {
+				if len(f.enum) > 0 && !allowed[value] {
+					add(CompatChange{Field: f.stored, Kind: EnumValueRemoved,
+						Old: value})
+				}
+			}
+		}
+	}
+	for _, f := range new_fields {
+		if seen[f.name] {
+			continue
+		}
+		add(CompatChange{Field: f.stored, Kind: FieldAdded, New: f.typ.String()})
+		if f.required && !f.fallback {
+			add(CompatChange{Field: f.stored, Kind: RequiredAdded})
+		}
+	}
+	return nil
+}
+
+// CheckCompatibility compares the stored schema of two versions of an
+// Object implementation and reports every change, flagging the ones that
+// break reading old documents or old readers of new documents.
+func CheckCompatibility(
+	old_proto, new_proto Object, rules CompatRules) (CompatReport, error) {
+	report := CompatReport{}
+	err := compareSchemas("", reflect.TypeOf(Underlying(old_proto)),
+		reflect.TypeOf(Underlying(new_proto)), rules, &report)
+	if err != nil {
+		return CompatReport{}, err
+	}
+	sort.SliceStable(report.Changes, func(i, j int) bool {
+		return report.Changes[i].Field < report.Changes[j].Field
+	})
+	return report, nil
+}
+
+func valueFits(value interface{}, t reflect.Type) bool {
+	if value == nil {
+		return true
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch value.(type) {
+	case int64:
+		family, _ := typeRank(t)
+		return family == "number"
+	case float64:
+		return t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64
+	case string:
+		return t.Kind() == reflect.String
+	case bool:
+		return t.Kind() == reflect.Bool
+	case time.Time:
+		return t == reflect.TypeOf(time.Time{})
+	case []byte:
+		return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8
+	case []interface{}:
+		return t.Kind() == reflect.Slice || t.Kind() == reflect.Array
+	case map[string]interface{}:
+		return t.Kind() == reflect.Map || t.Kind() == reflect.Struct
+	}
+	return true
+}
+
+// SampleCompatibility reads up to sample documents from collection and
+// tries to deserialize each one with new_proto, reporting documents that
+// fail and stored fields the new schema cannot hold.
+func (db *FirestoreDb) SampleCompatibility(ctx context.Context,
+	new_proto Object, collection []string, sample int) (CompatReport, error) {
+	collection_path, err := getCollectionPath(collection, db.allow_reserved)
+	if err != nil {
+		return CompatReport{}, err
+	}
+	fields, err := schemaOf(reflect.TypeOf(Underlying(new_proto)))
+	if err != nil {
+		return CompatReport{}, err
+	}
+	by_stored := map[string]schemaField{}
+	for _, f := range fields {
+		by_stored[f.stored] = f
+	}
+	query := db.nextClient().Collection(collection_path).Query
+	if sample > 0 {
+		query = query.Limit(sample)
+	}
+	docs, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return CompatReport{}, fmt.Errorf(
+			"%s:SampleCompatibility - could not sample: %w", collection_path, err)
+	}
+	report := CompatReport{}
+	for _, doc := range docs {
+		_, err := safeDeserialize(
+			"SampleCompatibility", collection_path, AdaptLegacy(new_proto), doc)
+		if err != nil {
+			report.Failures = append(report.Failures, FieldFailure{
+				Document: doc.Ref.ID, Reason: err.Error()})
+		}
+		data := doc.Data()
+		keys := make([]string, 0, len(data))
+		for key := range data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			f, ok := by_stored[key]
+			if !ok {
+				report.Failures = append(report.Failures, FieldFailure{
+					Document: doc.Ref.ID, Field: key,
+					Reason: "dropped: no field in new schema"})
+				continue
+			}
+			if !valueFits(data[key], f.typ) {
+				report.Failures = append(report.Failures, FieldFailure{
+					Document: doc.Ref.ID, Field: key,
+					Reason: fmt.Sprintf("%T does not fit %s", data[key], f.typ)})
+			}
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,170 @@
+package rest2firestore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+)
+
+// schemaProto is an Object whose model is a new T, for comparing schemas
+// without a Deserialize per version.
+type schemaProto[T any] struct{}
+
+func (s *schemaProto[T]) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	return s, nil
+}
+
+func (s *schemaProto[T]) Serialize() {
+}
+
+func (s *schemaProto[T]) stored() interface{} {
+	return new(T)
+}
+
+func protoOf[T any]() Object {
+	return AdaptV2(&schemaProto[T]{})
+}
+
+type compatAddress struct {
+	City string `firestore:"city"`
+}
+
+type compatV1 struct {
+	Name    string        `firestore:"name"`
+	Age     int32         `firestore:"age"`
+	Note    string        `firestore:"note"`
+	Status  string        `firestore:"status" r2f:"enum=new|open|done"`
+	Score   string        `firestore:"score"`
+	Address compatAddress `firestore:"address"`
+}
+
+type compatAddressV2 struct {
+	City int `firestore:"city"`
+}
+
+type compatV2 struct {
+	Name     string          `firestore:"full_name"`
+	Age      int64           `firestore:"age"`
+	Status   string          `firestore:"status" r2f:"enum=new|done"`
+	Score    float64         `firestore:"score"`
+	Address  compatAddressV2 `firestore:"address"`
+	Email    string          `firestore:"email" r2f:"required"`
+	Country  string          `firestore:"country" r2f:"required,default=NZ"`
+	Nickname string          `firestore:"nickname"`
+}
+
+func TestCheckCompatibility(t *testing.T) {
+	report, err := CheckCompatibility(
+		protoOf[compatV1](), protoOf[compatV2](), CompatRules{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CompatChange{
+		{Field: "address.city", Kind: FieldTypeChanged,
+			Old: "string", New: "int", Breaking: true},
+		{Field: "age", Kind: FieldWidened, Old: "int32", New: "int64"},
+		{Field: "country", Kind: FieldAdded, New: "string"},
+		{Field: "email", Kind: FieldAdded, New: "string"},
+		{Field: "email", Kind: RequiredAdded, Breaking: true},
+		{Field: "name", Kind: FieldRenamed,
+			Old: "name", New: "full_name", Breaking: true},
+		{Field: "nickname", Kind: FieldAdded, New: "string"},
+		{Field: "note", Kind: FieldRemoved, Old: "string", Breaking: true},
+		{Field: "score", Kind: FieldTypeChanged,
+			Old: "string", New: "float64", Breaking: true},
+		{Field: "status", Kind: EnumValueRemoved, Old: "open", Breaking: true},
+	}
+	if !reflect.DeepEqual(report.Changes, want) {
+		t.Errorf("changes\n%+v\nwant\n%+v", report.Changes, want)
+	}
+	if !report.Breaking() {
+		t.Error("report is not breaking")
+	}
+
+	// Rules move kinds across the line in both directions.
+	report, err = CheckCompatibility(protoOf[compatV1](), protoOf[compatV2](),
+		CompatRules{DisallowWiden: true, DisallowAdding: true,
+			Allow: map[ChangeKind]bool{FieldRenamed: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range report.Changes {
+		switch change.Kind {
+		case FieldWidened, FieldAdded:
+			if !change.Breaking {
+				t.Errorf("%s %s allowed despite the rules", change.Field,
+					change.Kind)
+			}
+		case FieldRenamed:
+			if change.Breaking {
+				t.Errorf("%s %s breaking despite Allow", change.Field,
+					change.Kind)
+			}
+		}
+	}
+
+	report, err = CheckCompatibility(
+		protoOf[compatV1](), protoOf[compatV1](), CompatRules{})
+	if err != nil || len(report.Changes) != 0 || report.Breaking() {
+		t.Errorf("unchanged schema: %+v, %v, want no changes", report, err)
+	}
+	if _, err := CheckCompatibility(protoOf[compatV1](), protoOf[string](),
+		CompatRules{}); err == nil {
+		t.Error("CheckCompatibility of a non-struct prototype succeeded")
+	}
+}
+
+type sampleUser struct {
+	Email string `firestore:"email"`
+	Age   int64  `firestore:"age"`
+}
+
+func (u *sampleUser) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	result := &sampleUser{}
+	return result, doc.DataTo(result)
+}
+
+func (u *sampleUser) Serialize() {
+}
+
+func TestSampleCompatibility(t *testing.T) {
+	db := emulatorDb(t)
+	collection := testCollection("users")
+	docs := map[string]map[string]interface{}{
+		"fits":    {"email": "a@example.com", "age": int64(3)},
+		"dropped": {"email": "b@example.com", "legacy": true},
+		"misfit":  {"email": "c@example.com", "age": "old"},
+	}
+	for id, data := range docs {
+		_, err := db.Put(context.Background(), NewRawObject(data),
+			append(collection, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := db.SampleCompatibility(context.Background(),
+		AdaptV2(&sampleUser{}), collection, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	by_document := map[string][]string{}
+	for _, failure := range report.Failures {
+		by_document[failure.Document] = append(
+			by_document[failure.Document], failure.Field)
+	}
+	want := map[string][]string{
+		"dropped": {"legacy"},
+		// DataTo fails on the whole document, then the field misfits.
+		"misfit": {"", "age"},
+	}
+	if !reflect.DeepEqual(by_document, want) {
+		t.Errorf("failures %+v, want fields %v", report.Failures, want)
+	}
+	if !report.Breaking() {
+		t.Error("a sample with failures is not breaking")
+	}
+}
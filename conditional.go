@@ -0,0 +1,214 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var ErrPreconditionFailed = errors.New("document changed since it was read")
+
+var ErrInvalidETag = errors.New("malformed ETag")
+
+// Metadata is what Firestore records about a document besides its data.
+type Metadata struct {
+	CreateTime time.Time
+	UpdateTime time.Time
+}
+
+func metadataOf(doc *firestore.DocumentSnapshot) Metadata {
+	return Metadata{CreateTime: doc.CreateTime, UpdateTime: doc.UpdateTime}
+}
+
+// ETag is the HTTP entity tag of a document version.
+func (m Metadata) ETag() string {
+	return `"` + strconv.FormatInt(m.UpdateTime.UnixNano(), 36) + `"`
+}
+
+// ParseETag returns the update time an ETag was made from.
+func ParseETag(etag string) (time.Time, error) {
+	etag = strings.TrimPrefix(etag, "W/")
+	nanos, err := strconv.ParseInt(strings.Trim(etag, `"`), 36, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: %w", etag, ErrInvalidETag)
+	}
+	return time.Unix(0, nanos).UTC(), nil
+}
+
+// ConditionalDb is the optional capability of a Db to make writes
+// conditional on the document being unchanged since it was read. The *If
+// operations fail with ErrPreconditionFailed when the document's update
+// time is no longer last_update, or the document is gone.
+type ConditionalDb interface {
+	GetWithMetadata(ctx context.Context, dummy Object, document []string) (
+		Object, Metadata, error)
+	PutIf(ctx context.Context, obj Object, document []string,
+		last_update time.Time) (Object, Metadata, error)
+	PatchFieldsIf(ctx context.Context, dummy Object, document []string,
+		fields map[string]interface{}, last_update time.Time) (
+		Object, Metadata, error)
+	DeleteIf(ctx context.Context, dummy Object, document []string,
+		last_update time.Time) error
+}
+
+var _ ConditionalDb = &FirestoreDb{}
+
+func preconditionFailed(op, document_path string) error {
+	return fmt.Errorf("%s:%s - %w", document_path, op, ErrPreconditionFailed)
+}
+
+func (db *FirestoreDb) GetWithMetadata(ctx context.Context, dummy Object,
+	document []string) (Object, Metadata, error) {
+	result, meta, err := db.getWithMetadata(ctx, AdaptLegacy(dummy), document)
+	return AdaptV2(result), meta, err
+}
+
+// PutIf is Put, checked and written in one transaction.
+func (db *FirestoreDb) PutIf(ctx context.Context, obj Object,
+	document []string, last_update time.Time) (Object, Metadata, error) {
+	o := AdaptLegacy(obj)
+	if _, _, err := getDocumentPath(document, db.allow_reserved); err != nil {
+		return nil, Metadata{}, err
+	}
+	document_path := path.Join(document...)
+	if err := db.checkAppendOnly("Put", document); err != nil {
+		return nil, Metadata{}, err
+	}
+	err := db.injectAncestorKeys(o, document[:len(document)-1])
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	if err := db.beforeUpdate(ctx, "Put", document, o); err != nil {
+		return nil, Metadata{}, err
+	}
+	if err := safeValidate("Put", document_path, o); err != nil {
+		return nil, Metadata{}, err
+	}
+	if err := safeSerialize("Put", document_path, o); err != nil {
+		return nil, Metadata{}, err
+	}
+	client := db.clientFor(document_path)
+	ref := client.Doc(document_path)
+	err = client.RunTransaction(ctx,
+		func(ctx context.Context, tx *firestore.Transaction) error {
+			doc, err := tx.Get(ref)
+			if status.Code(err) == codes.NotFound ||
+				(err == nil && !doc.UpdateTime.Equal(last_update)) {
+				return preconditionFailed("Put", document_path)
+			}
+			if err != nil {
+				return err
+			}
+			return tx.Set(ref, storedValue(o))
+		})
+	if errors.Is(err, ErrPreconditionFailed) {
+		return nil, Metadata{}, err
+	}
+	if err != nil {
+		return nil, Metadata{}, dbError(
+			"Put", document_path, "could not write object", err)
+	}
+	result, meta, err := db.getWithMetadata(ctx, o, document)
+	return AdaptV2(result), meta, err
+}
+
+// PatchFieldsIf is PatchFields with an update time precondition.
+func (db *FirestoreDb) PatchFieldsIf(ctx context.Context, dummy Object,
+	document []string, fields map[string]interface{},
+	last_update time.Time) (Object, Metadata, error) {
+	if _, _, err := getDocumentPath(document, db.allow_reserved); err != nil {
+		return nil, Metadata{}, err
+	}
+	document_path := path.Join(document...)
+	if err := db.checkAppendOnly("PatchFields", document); err != nil {
+		return nil, Metadata{}, err
+	}
+	fields, err := db.beforePatchFields(ctx, "PatchFields", document, fields)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	updates, err := fieldUpdates(document_path, fields, db.allow_reserved)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	if len(updates) == 0 {
+		result, meta, err :=
+			db.getWithMetadata(ctx, AdaptLegacy(dummy), document)
+		if errors.Is(err, ErrNotFound) ||
+			(err == nil && !meta.UpdateTime.Equal(last_update)) {
+			return nil, Metadata{}, preconditionFailed(
+				"PatchFields", document_path)
+		}
+		return AdaptV2(result), meta, err
+	}
+	_, err = db.clientFor(document_path).Doc(document_path).Update(
+		ctx, updates, firestore.LastUpdateTime(last_update))
+	switch status.Code(err) {
+	case codes.OK:
+	case codes.FailedPrecondition, codes.NotFound:
+		return nil, Metadata{}, preconditionFailed("PatchFields", document_path)
+	default:
+		return nil, Metadata{}, dbError(
+			"PatchFields", document_path, "could not update object", err)
+	}
+	result, meta, err :=
+		db.getWithMetadata(ctx, AdaptLegacy(dummy), document)
+	return AdaptV2(result), meta, err
+}
+
+// DeleteIf is Delete with an update time precondition. The document is
+// deleted first, on the condition, so a failed precondition leaves the
+// whole tree in place; its subcollections are cleared after it, and an
+// interrupted DeleteIf can leave some of them to a later Delete. In a
+// collection with a trash the condition is checked by a read just before
+// the move, which is not atomic with it.
+func (db *FirestoreDb) DeleteIf(ctx context.Context, dummy Object,
+	document []string, last_update time.Time) error {
+	obj := AdaptLegacy(dummy)
+	if err := db.prototypes.check(obj); err != nil {
+		return err
+	}
+	if _, _, err := getDocumentPath(document, db.allow_reserved); err != nil {
+		return err
+	}
+	document_path := path.Join(document...)
+	w := db.newTreeWalk(false)
+	if err := w.visit(document_path); err != nil {
+		return err
+	}
+	if err := db.checkAppendOnly("Delete", document); err != nil {
+		return err
+	}
+	if err := db.beforeDelete(ctx, "Delete", document); err != nil {
+		return err
+	}
+	if retention, ok := db.trashRetention(document); ok {
+		_, meta, err := db.getWithMetadata(ctx, obj, document)
+		if errors.Is(err, ErrNotFound) ||
+			(err == nil && !meta.UpdateTime.Equal(last_update)) {
+			return preconditionFailed("Delete", document_path)
+		}
+		if err != nil {
+			return err
+		}
+		return db.moveToTrash(ctx, document, retention)
+	}
+	_, err := db.clientFor(document_path).Doc(document_path).Delete(
+		ctx, firestore.LastUpdateTime(last_update))
+	switch status.Code(err) {
+	case codes.OK:
+	case codes.FailedPrecondition, codes.NotFound:
+		return preconditionFailed("Delete", document_path)
+	default:
+		return dbError("Delete", document_path, "could not delete object", err)
+	}
+	return db.clearSubcollections(ctx, w, obj, document, 0)
+}
@@ -0,0 +1,103 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeleteIfStaleETag(t *testing.T) {
+	db := emulatorDb(t)
+	collection := testCollection("authors")
+	author := append(collection, "a1")
+	post := append(author, "posts", "p1")
+	ctx := context.Background()
+	put := func(obj Object, document []string) {
+		t.Helper()
+		if _, err := db.Put(ctx, obj, document); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(AdaptV2(&testAuthor{Name: "old"}), author)
+	put(AdaptV2(&testPost{Title: "kept"}), post)
+	_, stale, err := db.GetWithMetadata(ctx, AdaptV2(&testAuthor{}), author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(AdaptV2(&testAuthor{Name: "new"}), author)
+	err = db.DeleteIf(ctx, AdaptV2(&testAuthor{}), author, stale.UpdateTime)
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("DeleteIf with a stale ETag: %v, want ErrPreconditionFailed",
+			err)
+	}
+	for _, document := range [][]string{author, post} {
+		if _, err := db.Get(ctx, AdaptV2(&testPost{}), document); err != nil {
+			t.Errorf("%v after a failed DeleteIf: %v", document, err)
+		}
+	}
+
+	_, fresh, err := db.GetWithMetadata(ctx, AdaptV2(&testAuthor{}), author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteIf(ctx, AdaptV2(&testAuthor{}), author, fresh.UpdateTime)
+	if err != nil {
+		t.Fatalf("DeleteIf with a fresh ETag: %v", err)
+	}
+	for _, document := range [][]string{author, post} {
+		if _, err := db.Get(ctx, AdaptV2(&testPost{}), document); !errors.Is(
+			err, ErrNotFound) {
+			t.Errorf("%v after DeleteIf: %v, want ErrNotFound", document, err)
+		}
+	}
+}
+
+func TestRouterPreconditions(t *testing.T) {
+	db := emulatorDb(t)
+	collection := testCollection("users")
+	router := NewRouter(db).RegisterResource(collection[0],
+		AdaptV2(&testUser{}))
+	router.RequireIfMatch = true
+	target := "/" + collection[0] + "/u1"
+	_, err := db.Put(context.Background(),
+		AdaptV2(&testUser{Email: "a@example.com"}), append(collection, "u1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, body := serve(router, http.MethodGet, target, "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET: status %d, ETag %q: %s", w.Code, etag, body)
+	}
+
+	request := func(method, if_match, body string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if if_match != "" {
+			req.Header.Set("If-Match", if_match)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	for _, method := range []string{
+		http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		if code := request(method, "", `{"name": "x"}`); code !=
+			http.StatusPreconditionRequired {
+			t.Errorf("%s without If-Match: status %d, want 428", method, code)
+		}
+	}
+	if code := request(http.MethodPut, etag,
+		`{"email": "a@example.com", "name": "b"}`); code != http.StatusOK {
+		t.Fatalf("PUT with the current ETag: status %d", code)
+	}
+	if code := request(http.MethodDelete, etag, ""); code !=
+		http.StatusPreconditionFailed {
+		t.Errorf("DELETE with a stale ETag: status %d, want 412", code)
+	}
+	if code := request(http.MethodGet, "", ""); code != http.StatusOK {
+		t.Errorf("GET after a refused DELETE: status %d, want 200", code)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"time"
 
 	"cloud.google.com/go/firestore"
 )
@@ -16,7 +17,8 @@ type Object interface {
 	PostprocessList(objs []Object) ([]Object, error)
 	Deserialize(doc *firestore.DocumentSnapshot) (Object, error)
 	Serialize()
-	Search(client *firestore.Client) (document []string, err error)
+	Search(ctx context.Context, client *firestore.Client) (
+		document []string, err error)
 	Subcollections() []Subcollection
 }
 
@@ -26,45 +28,94 @@ type Subcollection struct {
 }
 
 type Db interface {
-	List(obj Object, collection []string) ([]Object, error)
-	Clear(dummy Object, collection []string) error
-	Post(obj Object, collection []string) (Object, error)
-	Put(obj Object, collection []string) (Object, error)
-	Patch(obj Object) (Object, error)
-	Get(dummy Object, document []string) (Object, error)
-	Delete(dummy Object, document []string) error
+	List(ctx context.Context, obj Object, collection []string) (
+		[]Object, error)
+	ListWithQuery(ctx context.Context, obj Object, collection []string,
+		q *ListQuery) ([]Object, string, error)
+	ListGroup(ctx context.Context, obj Object, collection_id string) (
+		[]Object, error)
+	Clear(ctx context.Context, dummy Object, collection []string) error
+	Post(ctx context.Context, obj Object, collection []string) (Object, error)
+	FindOrCreate(ctx context.Context, obj Object, collection []string) (
+		Object, bool, error)
+	Put(ctx context.Context, obj Object, collection []string) (Object, error)
+	Patch(ctx context.Context, obj Object) (Object, error)
+	PatchFields(ctx context.Context, dummy Object, document []string,
+		fields map[string]interface{}) (Object, error)
+	Get(ctx context.Context, dummy Object, document []string) (Object, error)
+	Delete(ctx context.Context, dummy Object, document []string) error
 }
 
 type FirestoreDb struct {
-	client *firestore.Client
+	client         *firestore.Client
+	pool           *clientPool
+	allow_reserved bool
+	trash          map[string]time.Duration
+	ancestors      map[string]ancestorSpec
+	append_only    map[string]bool
+	history        map[string][]HistorySource
+	backend        *BackendCapabilities
+	fallbacks      map[Capability]bool
+	hooks          []hookEntry
+	prototypes     *prototypeChecks
+
+	MaxTreeDepth     int
+	MaxTreeDocuments int
+	TreeProgress     func(TreeStats)
+
+	// BatchSize is how many deletes Clear and Delete queue before waiting
+	// for them, and how many documents Walk reads at once. Zero means
+	// DefaultBatchSize.
+	BatchSize int
+	// Now replaces time.Now for timestamps the Db records itself.
+	Now func() time.Time
+	// Flags resolves dynamic behaviour per operation; nil keeps defaults.
+	Flags FlagProvider
+	// SearchWorkers bounds the concurrent Searches and creates of
+	// BatchPost. Zero means DefaultSearchWorkers.
+	SearchWorkers int
+	// PITRWindow is how far back GetAt reads from Firestore itself. Zero
+	// means DefaultPITRWindow; set it to 7 days when PITR is enabled.
+	PITRWindow time.Duration
 }
 
 var _ Db = &FirestoreDb{}
 
-func getCollectionPath(collection []string) (string, error) {
+func getCollectionPath(collection []string, allow_reserved bool) (
+	string, error) {
 	collection_path := path.Join(collection...)
 	if len(collection) == 0 || len(collection)%2 != 1 {
 		return "", fmt.Errorf(
-			"%s: collection path levels should be odd.", collection_path)
+			"%s: collection path levels should be odd: %w",
+			collection_path, ErrInvalidPath)
+	}
+	if !allow_reserved && isReservedPath(collection) {
+		return "", fmt.Errorf("%s: %w", collection_path, ErrReservedPath)
 	}
 	return collection_path, nil
 }
 
-func getDocumentPath(document []string) (
+func getDocumentPath(document []string, allow_reserved bool) (
 	collection_path string, document_id string, err error) {
 	if len(document) <= 1 {
 		collection_path = ""
 		document_id = ""
 		err = fmt.Errorf(
-			"%s: document path levels should be greater than 1.",
-			path.Join(document...))
+			"%s: document path levels should be greater than 1: %w",
+			path.Join(document...), ErrInvalidPath)
 		return
 	}
 	collection_path = path.Join(document[:len(document)-1]...)
 	document_id = document[len(document)-1]
 	if len(document)%2 != 0 {
 		err = fmt.Errorf(
-			"%s: collection path levels should be odd.", collection_path)
+			"%s: collection path levels should be odd: %w",
+			collection_path, ErrInvalidPath)
+		return
+	}
+	if !allow_reserved && isReservedPath(document) {
+		err = fmt.Errorf(
+			"%s: %w", path.Join(document...), ErrReservedPath)
 		return
 	}
 	return collection_path, document_id, nil
@@ -75,164 +126,459 @@ func (db *FirestoreDb) Client() *firestore.Client {
 }
 
 func (db *FirestoreDb) Close() {
+	if db.pool != nil {
+		db.pool.close()
+		return
+	}
 	db.client.Close()
 }
 
-func (db *FirestoreDb) List(obj Object, collection []string) ([]Object, error) {
-	ctx := context.Background()
-	collection_path, err := getCollectionPath(collection)
+func (db *FirestoreDb) List(
+	ctx context.Context, obj Object, collection []string) ([]Object, error) {
+	objs, _, err := db.ListWithQuery(ctx, obj, collection, nil)
+	return objs, err
+}
+
+// ListWithQuery lists the documents of collection matching q, or all of
+// them when q is nil. The returned cursor is empty unless a page was cut
+// short by q.Limit; pass it back as q.Cursor for the next page.
+func (db *FirestoreDb) ListWithQuery(ctx context.Context, obj Object,
+	collection []string, q *ListQuery) ([]Object, string, error) {
+	client := db.nextClient()
+	documents := func(query firestore.Query) *firestore.DocumentIterator {
+		return query.Documents(ctx)
+	}
+	objs, cursor, err :=
+		db.list(client, documents, AdaptLegacy(obj), collection, q)
+	return adaptV2List(objs), cursor, err
+}
+
+// list runs its query through documents, so that it can be read inside a
+// transaction as well.
+func (db *FirestoreDb) list(client *firestore.Client,
+	documents func(firestore.Query) *firestore.DocumentIterator,
+	obj ObjectV2, collection []string, q *ListQuery) (
+	[]ObjectV2, string, error) {
+	collection_path, err := getCollectionPath(collection, db.allow_reserved)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	docs, err := db.client.Collection(collection_path).Documents(ctx).GetAll()
+	query := client.Collection(collection_path).Query
+	if q != nil {
+		if query, err = q.apply(client, query, collection_path); err != nil {
+			return nil, "", err
+		}
+	}
+	docs, err := documents(query).GetAll()
 	if err != nil {
-		return nil, fmt.Errorf(
-			"%s:List - could not list objects: %v", collection_path, err)
+		return nil, "", dbError(
+			"List", collection_path, "could not list objects", err)
 	}
 	if len(docs) == 0 {
-		return nil, nil
+		return nil, "", nil
+	}
+	cursor := ""
+	if q != nil && q.Limit > 0 && len(docs) == q.Limit {
+		if cursor, err = q.cursor(docs[len(docs)-1]); err != nil {
+			return nil, "", fmt.Errorf(
+				"%s:List - could not build cursor: %w", collection_path, err)
+		}
 	}
-	objs, err := obj.DeserializeList(docs)
+	objs, err := safeDeserializeList("List", collection_path, obj, docs)
 	if err != nil {
-		return nil, fmt.Errorf(
-			"%s:List - could not deserialize list: %v", collection_path, err)
+		return nil, "", fmt.Errorf(
+			"%s:List - could not deserialize list: %w", collection_path, err)
 	}
-	return obj.PostprocessList(objs)
+	objs, err = safePostprocessList("List", collection_path, obj, objs)
+	return objs, cursor, err
 }
 
-func (db *FirestoreDb) Clear(dummy Object, collection []string) error {
-	ctx := context.Background()
-	collection_path, err := getCollectionPath(collection)
-	if err != nil {
+func (db *FirestoreDb) Clear(
+	ctx context.Context, dummy Object, collection []string) error {
+	obj := AdaptLegacy(dummy)
+	if err := db.prototypes.check(obj); err != nil {
 		return err
 	}
-	docs, err := db.client.Collection(collection_path).Documents(ctx).GetAll()
+	return db.clear(ctx, db.newTreeWalk(false), obj, collection, 0)
+}
+
+func (db *FirestoreDb) clear(ctx context.Context,
+	w *treeWalk, dummy ObjectV2, collection []string, depth int) error {
+	collection_path, err := getCollectionPath(collection, db.allow_reserved)
 	if err != nil {
 		return err
 	}
-	for _, doc := range docs {
-		obj, err := db.Get(dummy, append(collection, doc.Ref.ID))
-		if err != nil {
-			return err
+	if err := w.enter(collection_path, depth); err != nil {
+		return err
+	}
+	// DocumentRefs, unlike Documents, also yields phantom parents: missing
+	// documents that still have subcollections to clear. It reads no field
+	// data.
+	client := db.nextClient()
+	refs, err := client.Collection(collection_path).DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return dbError("Clear", collection_path, "could not list objects", err)
+	}
+	w.width(len(refs))
+	batch := db.newBulkWriter(ctx, "Clear", client)
+	defer batch.close()
+	for _, ref := range refs {
+		if err := ctx.Err(); err != nil {
+			return dbError("Clear", collection_path, "interrupted", err)
 		}
-		err = db.Delete(obj, append(collection, doc.Ref.ID))
-		if err != nil {
+		document := append(collection[:len(collection):len(collection)], ref.ID)
+		if err := db.deleteTree(ctx, w, batch, dummy, document, depth); err != nil {
 			return err
 		}
 	}
-	return nil
+	return batch.flush()
 }
 
-func (db *FirestoreDb) Post(obj Object, collection []string) (Object, error) {
-	ctx := context.Background()
-	existing_document, err := obj.Search(db.client)
+func (db *FirestoreDb) Post(
+	ctx context.Context, obj Object, collection []string) (Object, error) {
+	result, _, err := db.FindOrCreate(ctx, obj, collection)
+	return result, err
+}
+
+// FindOrCreate returns the document obj.Search finds, or creates one when
+// it finds none, reporting whether it created. The search and the create
+// are only atomic for objects implementing QuerySearcher; with Search
+// alone two concurrent callers can both create.
+func (db *FirestoreDb) FindOrCreate(
+	ctx context.Context, obj Object, collection []string) (
+	Object, bool, error) {
+	result, _, created, err := db.FindOrCreatePath(ctx, obj, collection)
+	return result, created, err
+}
+
+// FindOrCreatePath is FindOrCreate that also returns the document.
+func (db *FirestoreDb) FindOrCreatePath(
+	ctx context.Context, obj Object, collection []string) (
+	Object, []string, bool, error) {
+	result, document, created, err :=
+		db.findOrCreate(ctx, AdaptLegacy(obj), collection)
 	if err != nil {
-		return nil, err
+		return nil, nil, false, err
+	}
+	err = db.afterPost(ctx, "Post", document, result, created)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return AdaptV2(result), document, created, nil
+}
+
+func (db *FirestoreDb) findOrCreate(
+	ctx context.Context, obj ObjectV2, collection []string) (
+	ObjectV2, []string, bool, error) {
+	if err := db.injectAncestorKeys(obj, collection); err != nil {
+		return nil, nil, false, err
+	}
+	client := db.nextClient()
+	query, ok, err :=
+		safeSearchQuery("Post", path.Join(collection...), obj, client)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if ok && db.flag(ctx, FlagTransactionalWrites, true) {
+		return db.findOrCreateTx(ctx, client, query, obj, collection)
+	}
+	existing_document, err :=
+		safeSearch(ctx, "Post", path.Join(collection...), obj, client)
+	if err != nil {
+		return nil, nil, false, err
 	}
 	if len(existing_document) > 0 {
-		return db.Get(obj, existing_document)
+		result, err := db.get(ctx, obj, existing_document)
+		return result, existing_document, false, err
 	}
-	collection_path, err := getCollectionPath(collection)
+	result, document, err := db.create(ctx, client, obj, collection)
+	return result, document, true, err
+}
+
+// create adds obj to collection without searching first.
+func (db *FirestoreDb) create(ctx context.Context, client *firestore.Client,
+	obj ObjectV2, collection []string) (ObjectV2, []string, error) {
+	collection_path, err := getCollectionPath(collection, db.allow_reserved)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if err := db.beforeCreate(ctx, "Post", collection, obj); err != nil {
+		return nil, nil, err
+	}
+	if err := safeValidate("Post", collection_path, obj); err != nil {
+		return nil, nil, err
+	}
+	if err := safeSerialize("Post", collection_path, obj); err != nil {
+		return nil, nil, err
 	}
-	obj.Serialize()
-	doc, _, err := db.client.Collection(collection_path).Add(ctx, obj)
+	doc, _, err := client.Collection(collection_path).Add(
+		ctx, storedValue(obj))
 	if err != nil {
-		return nil, fmt.Errorf(
-			"%s:Post - could not create object: %v", collection_path, err)
+		return nil, nil, dbError(
+			"Post", collection_path, "could not create object", err)
 	}
-	return db.Get(obj, append(collection, doc.ID))
+	document := append(collection[:len(collection):len(collection)], doc.ID)
+	result, err := db.get(ctx, obj, document)
+	return result, document, err
 }
 
-func (db *FirestoreDb) Patch(obj Object) (Object, error) {
-	ctx := context.Background()
-	existing_document, err := obj.Search(db.client)
+func (db *FirestoreDb) Patch(ctx context.Context, obj Object) (Object, error) {
+	result, err := db.patch(ctx, AdaptLegacy(obj))
+	return AdaptV2(result), err
+}
+
+func (db *FirestoreDb) patch(ctx context.Context, obj ObjectV2) (
+	ObjectV2, error) {
+	search_client := db.nextClient()
+	query, ok, err := safeSearchQuery("Patch", "", obj, search_client)
+	if err != nil {
+		return nil, err
+	}
+	if ok && db.flag(ctx, FlagTransactionalWrites, true) {
+		return db.patchTx(ctx, search_client, query, obj)
+	}
+	existing_document, err :=
+		safeSearch(ctx, "Patch", "", obj, search_client)
 	if err != nil {
 		return nil, err
 	}
 	if len(existing_document) == 0 {
-		return nil, fmt.Errorf(
-			"%s:Patch - could not find object: %v", obj)
+		return nil, dbError("Patch", "", "could not find object", ErrNotFound)
 	}
-	collection_path, document_id, err := getDocumentPath(existing_document)
+	collection_path, document_id, err :=
+		getDocumentPath(existing_document, db.allow_reserved)
 	if err != nil {
 		return nil, err
 	}
-	doc := db.client.Doc(path.Join(collection_path, document_id))
-	if _, err := doc.Get(ctx); err != nil {
-		return nil, fmt.Errorf("%s:Patch - no object found: %v", err)
+	document_path := path.Join(collection_path, document_id)
+	if err := db.checkAppendOnly("Patch", existing_document); err != nil {
+		return nil, err
 	}
-	obj.Serialize()
-	if _, err := doc.Set(ctx, obj); err != nil {
-		return nil, fmt.Errorf("%s:Patch - could not update object: %v", err)
+	err = db.beforeUpdate(ctx, "Patch", existing_document, obj)
+	if err != nil {
+		return nil, err
+	}
+	if err := safeValidate("Patch", document_path, obj); err != nil {
+		return nil, err
 	}
-	return db.Get(obj, existing_document)
+	if err := safeSerialize("Patch", document_path, obj); err != nil {
+		return nil, err
+	}
+	client := db.clientFor(document_path)
+	doc := client.Doc(document_path)
+	// The existence check and the write share a transaction, so a document
+	// deleted in between is not recreated.
+	err = client.RunTransaction(ctx,
+		func(ctx context.Context, tx *firestore.Transaction) error {
+			if _, err := tx.Get(doc); err != nil {
+				return err
+			}
+			return tx.Set(doc, storedValue(obj))
+		})
+	if err != nil {
+		return nil, dbError(
+			"Patch", document_path, "could not update object", err)
+	}
+	return db.get(ctx, obj, existing_document)
 }
 
-func (db *FirestoreDb) Put(obj Object, doc_path []string) (Object, error) {
-	ctx := context.Background()
-	obj.Serialize()
-	_, err := db.client.Doc(path.Join(doc_path...)).Set(ctx, obj)
-	if err != nil {
+func (db *FirestoreDb) Put(
+	ctx context.Context, obj Object, doc_path []string) (Object, error) {
+	result, err := db.put(ctx, AdaptLegacy(obj), doc_path)
+	return AdaptV2(result), err
+}
+
+func (db *FirestoreDb) put(
+	ctx context.Context, obj ObjectV2, doc_path []string) (ObjectV2, error) {
+	if _, _, err := getDocumentPath(doc_path, db.allow_reserved); err != nil {
+		return nil, err
+	}
+	document_path := path.Join(doc_path...)
+	if err := db.checkAppendOnly("Put", doc_path); err != nil {
 		return nil, err
 	}
-	return db.Get(obj, doc_path)
+	if err := db.injectAncestorKeys(obj, doc_path[:len(doc_path)-1]); err != nil {
+		return nil, err
+	}
+	if err := db.beforeUpdate(ctx, "Put", doc_path, obj); err != nil {
+		return nil, err
+	}
+	if err := safeValidate("Put", document_path, obj); err != nil {
+		return nil, err
+	}
+	if err := safeSerialize("Put", document_path, obj); err != nil {
+		return nil, err
+	}
+	_, err := db.clientFor(document_path).Doc(document_path).Set(
+		ctx, storedValue(obj))
+	if err != nil {
+		return nil, dbError("Put", document_path, "could not write object", err)
+	}
+	return db.get(ctx, obj, doc_path)
 }
 
-func (db *FirestoreDb) Merge(
+func (db *FirestoreDb) Merge(ctx context.Context,
 	obj Object, doc_path []string, props []string) (Object, error) {
-	ctx := context.Background()
-	_, err := db.client.Doc(
-		path.Join(doc_path...)).Set(ctx, obj, firestore.Merge(props))
-	if err != nil {
+	if _, _, err := getDocumentPath(doc_path, db.allow_reserved); err != nil {
 		return nil, err
 	}
-	return db.Get(obj, doc_path)
+	if err := db.checkAppendOnly("Merge", doc_path); err != nil {
+		return nil, err
+	}
+	o := AdaptLegacy(obj)
+	document_path := path.Join(doc_path...)
+	if err := db.injectAncestorKeys(o, doc_path[:len(doc_path)-1]); err != nil {
+		return nil, err
+	}
+	if err := db.beforeUpdate(ctx, "Merge", doc_path, o); err != nil {
+		return nil, err
+	}
+	if err := safeValidate("Merge", document_path, o); err != nil {
+		return nil, err
+	}
+	if err := safeSerialize("Merge", document_path, o); err != nil {
+		return nil, err
+	}
+	_, err := db.clientFor(document_path).Doc(
+		document_path).Set(ctx, storedValue(o), firestore.Merge(props))
+	if err != nil {
+		return nil, dbError("Merge", document_path, "could not merge object", err)
+	}
+	result, err := db.get(ctx, o, doc_path)
+	return AdaptV2(result), err
+}
+
+func (db *FirestoreDb) Get(
+	ctx context.Context, obj Object, document []string) (Object, error) {
+	result, err := db.get(ctx, AdaptLegacy(obj), document)
+	return AdaptV2(result), err
+}
+
+func (db *FirestoreDb) get(
+	ctx context.Context, obj ObjectV2, document []string) (ObjectV2, error) {
+	result, _, err := db.getWithMetadata(ctx, obj, document)
+	return result, err
 }
 
-func (db *FirestoreDb) Get(obj Object, document []string) (Object, error) {
-	ctx := context.Background()
-	collection_path, document_id, err := getDocumentPath(document)
+func (db *FirestoreDb) getWithMetadata(ctx context.Context, obj ObjectV2,
+	document []string) (ObjectV2, Metadata, error) {
+	collection_path, document_id, err :=
+		getDocumentPath(document, db.allow_reserved)
 	if err != nil {
-		return nil, err
+		return nil, Metadata{}, err
+	}
+	document_path := path.Join(collection_path, document_id)
+	doc, err := db.clientFor(document_path).Doc(document_path).Get(ctx)
+	if err != nil {
+		return nil, Metadata{}, dbError(
+			"Get", document_path, "could not get object", err)
 	}
-	doc, err := db.client.Collection(collection_path).Doc(document_id).Get(ctx)
+	result, err := safeDeserialize("Get", document_path, obj, doc)
 	if err != nil {
-		return nil, fmt.Errorf(
-			"%s/%s:Get - could not get object: %v", collection_path, document_id, err)
+		return nil, Metadata{}, err
+	}
+	result, err = db.afterGet(ctx, "Get", document, result)
+	return result, metadataOf(doc), err
+}
+
+func (db *FirestoreDb) Delete(
+	ctx context.Context, dummy Object, document []string) error {
+	obj := AdaptLegacy(dummy)
+	if err := db.prototypes.check(obj); err != nil {
+		return err
 	}
-	return obj.Deserialize(doc)
+	return db.delete(ctx, db.newTreeWalk(false), obj, document, 0)
 }
 
-func (db *FirestoreDb) Delete(dummy Object, document []string) error {
-	ctx := context.Background()
-	collection_path, document_id, err := getDocumentPath(document)
+func (db *FirestoreDb) delete(ctx context.Context, w *treeWalk,
+	dummy ObjectV2, document []string, depth int) error {
+	collection_path, document_id, err :=
+		getDocumentPath(document, db.allow_reserved)
 	if err != nil {
-		return nil
+		return err
 	}
 	document_path := path.Join(collection_path, document_id)
-	doc := db.client.Doc(document_path)
-	subcollections := dummy.Subcollections()
+	batch := db.newBulkWriter(ctx, "Delete", db.clientFor(document_path))
+	defer batch.close()
+	if err := db.deleteTree(ctx, w, batch, dummy, document, depth); err != nil {
+		return err
+	}
+	return batch.flush()
+}
+
+// deleteTree clears the subcollections of document depth first, then
+// queues document itself on batch. Each subcollection is flushed before
+// its parent is queued.
+func (db *FirestoreDb) deleteTree(ctx context.Context, w *treeWalk,
+	batch *bulkWriter, dummy ObjectV2, document []string, depth int) error {
+	document_path := path.Join(document...)
+	if err := w.visit(document_path); err != nil {
+		return err
+	}
+	if err := db.checkAppendOnly("Delete", document); err != nil {
+		return err
+	}
+	if !w.dry_run {
+		if err := db.beforeDelete(ctx, batch.op, document); err != nil {
+			return err
+		}
+	}
+	if retention, ok := db.trashRetention(document); ok && !w.dry_run {
+		return db.moveToTrash(ctx, document, retention)
+	}
+	if err := db.clearSubcollections(ctx, w, dummy, document, depth); err != nil {
+		return err
+	}
+	if w.dry_run {
+		return nil
+	}
+	return batch.delete(batch.client.Doc(document_path))
+}
+
+func (db *FirestoreDb) clearSubcollections(ctx context.Context, w *treeWalk,
+	dummy ObjectV2, document []string, depth int) error {
+	document_path := path.Join(document...)
+	subcollections, err := safeSubcollections("Delete", document_path, dummy)
+	if err != nil {
+		return err
+	}
 	for _, subcollection := range subcollections {
-		err = db.Clear(subcollection.Obj, append(document, subcollection.Name))
+		if !db.allow_reserved && isReservedName(subcollection.Name) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return dbError("Delete", document_path, "interrupted", err)
+		}
+		err = db.clear(ctx, w, AdaptLegacy(subcollection.Obj),
+			append(document, subcollection.Name), depth+1)
 		if err != nil {
 			return err
 		}
 	}
-	if _, err := doc.Delete(ctx); err != nil {
-		return fmt.Errorf("%s:Delete - could not delete object: %v", document_path, err)
-	}
 	return nil
 }
 
+// NewFirestoreDb wraps an existing client. The caller keeps ownership of
+// the client unless it calls Close.
+func NewFirestoreDb(client *firestore.Client) *FirestoreDb {
+	return &FirestoreDb{
+		client:     client,
+		prototypes: &prototypeChecks{},
+	}
+}
+
+func (db *FirestoreDb) now() time.Time {
+	if db.Now != nil {
+		return db.Now()
+	}
+	return time.Now()
+}
+
 func CreateFirestoreDb(ctx context.Context) *FirestoreDb {
 	client, err :=
 		firestore.NewClient(ctx, os.Getenv("GOOGLE_CLOUD_PROJECT"))
 	if err != nil {
 		log.Fatalf("Failed to connect to firestore: %v", err)
 	}
-	return &FirestoreDb{
-		client: client,
-	}
+	return NewFirestoreDb(client)
 }
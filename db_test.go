@@ -0,0 +1,172 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+)
+
+// testUser is unique by email: through a QuerySearcher on FirestoreDb and
+// through Matches on MemoryDb.
+type testUser struct {
+	Email string `firestore:"email" json:"email"`
+	Name  string `firestore:"name" json:"name"`
+	Age   int64  `firestore:"age" json:"age"`
+
+	// collection is where SearchQuery looks; it is not stored.
+	collection []string
+}
+
+func (u *testUser) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	result := &testUser{collection: u.collection}
+	if err := doc.DataTo(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (u *testUser) Serialize() {
+}
+
+func (u *testUser) SearchQuery(client *firestore.Client) (
+	firestore.Query, bool) {
+	if u.Email == "" || len(u.collection) == 0 {
+		return firestore.Query{}, false
+	}
+	return client.Collection(path.Join(u.collection...)).
+		Where("email", "==", u.Email), true
+}
+
+func (u *testUser) Matches(other Object) bool {
+	o, ok := Underlying(other).(*testUser)
+	return ok && u.Email != "" && o.Email == u.Email
+}
+
+// emulatorDb connects to the emulator at FIRESTORE_EMULATOR_HOST, skipping
+// the test when there is none.
+func emulatorDb(t testing.TB) *FirestoreDb {
+	t.Helper()
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+	client, err := firestore.NewClient(
+		context.Background(), "rest2firestore-test")
+	if err != nil {
+		t.Fatalf("could not connect to the emulator: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return NewFirestoreDb(client)
+}
+
+// testCollection is a collection no other test uses, so tests can share
+// an emulator.
+func testCollection(name string) []string {
+	return []string{name + "_" + randomID()[:8]}
+}
+
+func testFindOrCreateRace(t *testing.T, db PathPoster, collection []string) {
+	const racers = 16
+	var wg sync.WaitGroup
+	documents := make([][]string, racers)
+	created := make([]bool, racers)
+	errs := make([]error, racers)
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := &testUser{Email: "a@example.com", collection: collection}
+			_, documents[i], created[i], errs[i] = db.FindOrCreatePath(
+				context.Background(), AdaptV2(user), collection)
+		}(i)
+	}
+	wg.Wait()
+	n := 0
+	for i := 0; i < racers; i++ {
+		if errs[i] != nil {
+			t.Fatalf("racer %d: %v", i, errs[i])
+		}
+		if created[i] {
+			n++
+		}
+		if path.Join(documents[i]...) != path.Join(documents[0]...) {
+			t.Errorf("racer %d got %v, racer 0 got %v",
+				i, documents[i], documents[0])
+		}
+	}
+	if n != 1 {
+		t.Errorf("%d racers created, want 1", n)
+	}
+}
+
+func TestFindOrCreateRaceMemory(t *testing.T) {
+	testFindOrCreateRace(t, NewMemoryDb(), []string{"users"})
+}
+
+func TestFindOrCreateRace(t *testing.T) {
+	db := emulatorDb(t)
+	collection := testCollection("users")
+	var mu sync.Mutex
+	after_posts, creations := 0, 0
+	db.AddHooks(collection[0], Hooks{
+		AfterPost: func(ctx context.Context, document []string, obj Object,
+			created bool) error {
+			mu.Lock()
+			defer mu.Unlock()
+			after_posts++
+			if created {
+				creations++
+			}
+			return nil
+		},
+	})
+	testFindOrCreateRace(t, db, collection)
+	if after_posts != 16 || creations != 1 {
+		t.Errorf("AfterPost ran %d times with %d creations, want 16 and 1",
+			after_posts, creations)
+	}
+}
+
+func TestClearCancelled(t *testing.T) {
+	db := emulatorDb(t)
+	collection := testCollection("users")
+	const users = 50
+	for i := 0; i < users; i++ {
+		user := AdaptV2(&testUser{Email: strconv.Itoa(i) + "@example.com"})
+		_, err := db.Put(context.Background(), user,
+			append(collection, "u"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	deletes := 0
+	db.AddHooks(collection[0], Hooks{
+		BeforeDelete: func(ctx context.Context, document []string) error {
+			if deletes++; deletes == 10 {
+				cancel()
+			}
+			return nil
+		},
+	})
+	err := db.Clear(ctx, AdaptV2(&testUser{}), collection)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Clear: %v, want context.Canceled", err)
+	}
+	if deletes != 10 {
+		t.Errorf("BeforeDelete ran %d times, want 10", deletes)
+	}
+	objs, err := db.List(context.Background(), AdaptV2(&testUser{}),
+		collection)
+	if err != nil || len(objs) == 0 {
+		t.Errorf("List after a cancelled Clear: %d objects, %v, want some",
+			len(objs), err)
+	}
+}
@@ -0,0 +1,92 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrNotFound         = errors.New("document not found")
+	ErrAlreadyExists    = errors.New("document already exists")
+	ErrConflict         = errors.New("conflicting concurrent write")
+	ErrInvalidPath      = errors.New("invalid path")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrDeadlineExceeded = errors.New("deadline exceeded")
+)
+
+// DbError is what Db operations return for failures. errors.Is matches
+// it against the sentinel for the Firestore status code it wraps, so
+// errors.Is(err, ErrNotFound) holds for a Get of a missing document while
+// status.Code(err) keeps working.
+type DbError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *DbError) Error() string {
+	return fmt.Sprintf("%s:%s - %v", e.Path, e.Op, e.Err)
+}
+
+func (e *DbError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DbError) Is(target error) bool {
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return target == ErrDeadlineExceeded
+	}
+	switch status.Code(e.Err) {
+	case codes.NotFound:
+		return target == ErrNotFound
+	case codes.AlreadyExists:
+		return target == ErrAlreadyExists
+	case codes.Aborted:
+		return target == ErrConflict
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return target == ErrPermissionDenied
+	case codes.DeadlineExceeded:
+		return target == ErrDeadlineExceeded
+	}
+	return false
+}
+
+// dbError wraps err, prefixed with what the operation was doing.
+func dbError(op, path, doing string, err error) error {
+	return &DbError{Op: op, Path: path, Err: fmt.Errorf("%s: %w", doing, err)}
+}
+
+// HTTPStatus maps an error from this package to the HTTP status a REST
+// handler should answer with.
+func HTTPStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrNotInTrash),
+		errors.Is(err, ErrOutsideRetention):
+		return http.StatusNotFound
+	case errors.Is(err, ErrAlreadyExists), errors.Is(err, ErrConflict),
+		errors.Is(err, ErrAppendOnly), errors.Is(err, ErrFrozen):
+		return http.StatusConflict
+	case errors.Is(err, ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrInvalidPath), errors.Is(err, ErrInvalidQuery),
+		errors.Is(err, ErrInvalidETag):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrPermissionDenied), errors.Is(err, ErrReservedPath):
+		return http.StatusForbidden
+	case errors.Is(err, ErrDeadlineExceeded),
+		errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrBackendUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrUnsupportedByBackend):
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
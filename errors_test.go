@@ -0,0 +1,100 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDbErrorIs(t *testing.T) {
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{status.Error(codes.NotFound, "gone"), ErrNotFound},
+		{status.Error(codes.AlreadyExists, "taken"), ErrAlreadyExists},
+		{status.Error(codes.Aborted, "contention"), ErrConflict},
+		{status.Error(codes.PermissionDenied, "no"), ErrPermissionDenied},
+		{status.Error(codes.Unauthenticated, "who"), ErrPermissionDenied},
+		{status.Error(codes.DeadlineExceeded, "slow"), ErrDeadlineExceeded},
+		{context.DeadlineExceeded, ErrDeadlineExceeded},
+	}
+	sentinels := []error{ErrNotFound, ErrAlreadyExists, ErrConflict,
+		ErrPermissionDenied, ErrDeadlineExceeded}
+	for _, test := range tests {
+		err := fmt.Errorf("outer: %w",
+			dbError("Get", "users/u1", "could not get object", test.err))
+		for _, sentinel := range sentinels {
+			if got := errors.Is(err, sentinel); got != (sentinel == test.want) {
+				t.Errorf("errors.Is(%v, %v) = %v", err, sentinel, got)
+			}
+		}
+		if test.err != context.DeadlineExceeded &&
+			status.Code(errors.Unwrap(errors.Unwrap(err))) !=
+				status.Code(test.err) {
+			t.Errorf("%v lost its status code", err)
+		}
+	}
+	err := dbError("Get", "users/u1", "could not get object",
+		status.Error(codes.Internal, "boom"))
+	for _, sentinel := range sentinels {
+		if errors.Is(err, sentinel) {
+			t.Errorf("errors.Is(%v, %v) = true", err, sentinel)
+		}
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, http.StatusOK},
+		{ErrNotFound, http.StatusNotFound},
+		{ErrNotInTrash, http.StatusNotFound},
+		{ErrOutsideRetention, http.StatusNotFound},
+		{ErrAlreadyExists, http.StatusConflict},
+		{ErrConflict, http.StatusConflict},
+		{ErrAppendOnly, http.StatusConflict},
+		{ErrFrozen, http.StatusConflict},
+		{ErrPreconditionFailed, http.StatusPreconditionFailed},
+		{ErrInvalidPath, http.StatusBadRequest},
+		{ErrInvalidQuery, http.StatusBadRequest},
+		{ErrInvalidETag, http.StatusBadRequest},
+		{ErrPermissionDenied, http.StatusForbidden},
+		{ErrReservedPath, http.StatusForbidden},
+		{ErrDeadlineExceeded, http.StatusGatewayTimeout},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{ErrBackendUnavailable, http.StatusServiceUnavailable},
+		{ErrUnsupportedByBackend, http.StatusNotImplemented},
+		{errors.New("anything else"), http.StatusInternalServerError},
+		{dbError("Get", "users/u1", "could not get object",
+			status.Error(codes.NotFound, "gone")), http.StatusNotFound},
+		{fmt.Errorf("wrapped: %w", ErrInvalidPath), http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if got := HTTPStatus(test.err); got != test.want {
+			t.Errorf("HTTPStatus(%v) = %d, want %d", test.err, got, test.want)
+		}
+	}
+}
+
+func TestGetMissingIsNotFound(t *testing.T) {
+	db := emulatorDb(t)
+	document := append(testCollection("users"), "missing")
+	_, err := db.Get(context.Background(), AdaptV2(&testUser{}), document)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a missing document: %v, want ErrNotFound", err)
+	}
+	var db_err *DbError
+	if !errors.As(err, &db_err) || status.Code(errors.Unwrap(db_err.Err)) !=
+		codes.NotFound {
+		t.Errorf("Get of a missing document: %#v, want a NotFound DbError",
+			err)
+	}
+}
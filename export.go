@@ -0,0 +1,184 @@
+package rest2firestore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+)
+
+// ExportRecord is one line of an export: the path of a document below the
+// exported collection, such as "alice" or "alice/posts/p1", and its data
+// in the canonical JSON mapping of EncodeValue.
+type ExportRecord struct {
+	Path string                 `json:"path"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// exportObject reads documents as raw data while following the
+// subcollections its prototype declares.
+type exportObject struct {
+	proto          ObjectV2
+	allow_reserved bool
+	data           map[string]interface{}
+}
+
+func (e exportObject) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	return exportObject{proto: e.proto, allow_reserved: e.allow_reserved,
+		data: doc.Data()}, nil
+}
+
+func (e exportObject) Serialize() {
+}
+
+func (e exportObject) Subcollections() []Subcollection {
+	var subs []Subcollection
+	for _, sub := range subcollections(e.proto) {
+		if !e.allow_reserved && isReservedName(sub.Name) {
+			continue
+		}
+		subs = append(subs, Subcollection{Name: sub.Name, Obj: AdaptV2(
+			exportObject{proto: AdaptLegacy(sub.Obj),
+				allow_reserved: e.allow_reserved})})
+	}
+	return subs
+}
+
+// Export writes every document of collection, and of the subcollections
+// obj declares below it, to w as newline-delimited ExportRecords. The
+// data is written as stored, without going through obj's Deserialize. The
+// tree limits apply as for Clear.
+func (db *FirestoreDb) Export(ctx context.Context, obj Object,
+	collection []string, w io.Writer) error {
+	proto := AdaptLegacy(obj)
+	if err := db.prototypes.check(proto); err != nil {
+		return err
+	}
+	collection_path, err := getCollectionPath(collection, db.allow_reserved)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	root := exportObject{proto: proto, allow_reserved: db.allow_reserved}
+	return db.walkCollection(ctx, db.newTreeWalk(false),
+		db.clientFor(collection_path), root, collection, 0,
+		func(document []string, obj Object) error {
+			document_path := path.Join(document...)
+			data, err := EncodeValue(
+				AdaptLegacy(obj).(exportObject).data, ValueOptions{})
+			if err != nil {
+				return fmt.Errorf("%s:Export - %w", document_path, err)
+			}
+			record := ExportRecord{
+				Path: path.Join(document[len(collection):]...),
+				Data: data.(map[string]interface{}),
+			}
+			if err := encoder.Encode(record); err != nil {
+				return fmt.Errorf("%s:Export - could not write record: %w",
+					document_path, err)
+			}
+			return nil
+		})
+}
+
+// Import writes the ExportRecords read from r below collection, BatchSize
+// at a time, overwriting documents that exist. In collections declared
+// append-only it only creates, so a record for an existing entry fails the
+// Import. Every record must lie in a subcollection obj declares. Validate
+// and hooks are not run. Numbers without a fraction or exponent are
+// restored as integers; Export writes every float with one.
+func (db *FirestoreDb) Import(ctx context.Context, obj Object,
+	collection []string, r io.Reader) error {
+	proto := AdaptLegacy(obj)
+	if err := db.prototypes.check(proto); err != nil {
+		return err
+	}
+	collection_path, err := getCollectionPath(collection, db.allow_reserved)
+	if err != nil {
+		return err
+	}
+	client := db.clientFor(collection_path)
+	batch := db.newBulkWriter(ctx, "Import", client)
+	defer batch.close()
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	for n := 1; ; n++ {
+		if err := ctx.Err(); err != nil {
+			return dbError("Import", collection_path, "interrupted", err)
+		}
+		var record ExportRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s:Import - record %d: %w",
+				collection_path, n, err)
+		}
+		document, err := db.importPath(proto, collection, record.Path)
+		if err != nil {
+			return fmt.Errorf("%s:Import - record %d: %w",
+				collection_path, n, err)
+		}
+		data, err := DecodeValue(client, record.Data)
+		if err != nil {
+			return fmt.Errorf("%s:Import - record %d: %w",
+				collection_path, n, err)
+		}
+		ref := client.Doc(path.Join(document...))
+		if ref == nil {
+			return fmt.Errorf("%s:Import - record %d: %s: %w",
+				collection_path, n, record.Path, ErrInvalidPath)
+		}
+		// Entries of append-only collections are never overwritten.
+		write := batch.set
+		if db.checkAppendOnly("Import", document) != nil {
+			write = batch.create
+		}
+		if err := write(ref, data); err != nil {
+			return err
+		}
+	}
+	return batch.flush()
+}
+
+// importPath resolves the path of a record below collection, checking
+// that each subcollection on the way is one proto declares.
+func (db *FirestoreDb) importPath(proto ObjectV2, collection []string,
+	record_path string) ([]string, error) {
+	segments := strings.Split(record_path, "/")
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, fmt.Errorf("%q: empty path segment: %w",
+				record_path, ErrInvalidPath)
+		}
+	}
+	document := append(collection[:len(collection):len(collection)],
+		segments...)
+	if _, _, err := getDocumentPath(document, db.allow_reserved); err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(segments); i += 2 {
+		subs, err := safeSubcollections("Import", record_path, proto)
+		if err != nil {
+			return nil, err
+		}
+		var next ObjectV2
+		for _, sub := range subs {
+			if sub.Name == segments[i] {
+				next = AdaptLegacy(sub.Obj)
+			}
+		}
+		if next == nil {
+			return nil, fmt.Errorf("%s: undeclared subcollection %s: %w",
+				record_path, segments[i], ErrInvalidPath)
+		}
+		proto = next
+	}
+	return document, nil
+}
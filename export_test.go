@@ -0,0 +1,86 @@
+package rest2firestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+func TestImportInvalidPath(t *testing.T) {
+	db := NewFirestoreDb(nil)
+	for _, record_path := range []string{"", "a/posts", "a//p1", "/a"} {
+		record := `{"path": "` + record_path + `", "data": {"title": "x"}}`
+		err := db.Import(context.Background(), AdaptV2(&testAuthor{}),
+			[]string{"authors"}, strings.NewReader(record))
+		if !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Import of %q: %v, want ErrInvalidPath", record_path, err)
+		}
+	}
+	err := db.Import(context.Background(), AdaptV2(&testAuthor{}),
+		[]string{"authors"}, strings.NewReader(
+			`{"path": "a/comments/c1", "data": {}}`))
+	if !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("Import into an undeclared subcollection: %v, "+
+			"want ErrInvalidPath", err)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	db := emulatorDb(t)
+	ctx := context.Background()
+	source, target := testCollection("authors"), testCollection("authors")
+	data := map[string]interface{}{
+		"name":      "Ann",
+		"float":     2.0,
+		"int":       int64(2),
+		"geo":       &latlng.LatLng{Latitude: 1.5, Longitude: -0.25},
+		"timestamp": time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC),
+		"bytes":     []byte("hello"),
+		"ref":       db.client.Doc("users/u1"),
+		"list":      []interface{}{1.5, int64(3)},
+	}
+	documents := []string{"a1", "a1/posts/p1"}
+	for _, document := range documents {
+		ref := db.client.Doc(path.Join(source[0], document))
+		if _, err := ref.Set(ctx, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var exported bytes.Buffer
+	err := db.Export(ctx, AdaptV2(&testAuthor{}), source, &exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Import(ctx, AdaptV2(&testAuthor{}), target,
+		&exported); err != nil {
+		t.Fatal(err)
+	}
+	for _, document := range documents {
+		doc, err := db.client.Doc(path.Join(target[0], document)).Get(ctx)
+		if err != nil {
+			t.Fatalf("%s after Import: %v", document, err)
+		}
+		got := doc.Data()
+		ref, ok := got["ref"].(*firestore.DocumentRef)
+		if !ok || documentRefPath(ref) != "users/u1" {
+			t.Errorf("%s: ref imported as %#v", document, got["ref"])
+		}
+		delete(got, "ref")
+		want := make(map[string]interface{}, len(data))
+		for key, value := range data {
+			want[key] = value
+		}
+		delete(want, "ref")
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s imported as\n%#v\nwant\n%#v", document, got, want)
+		}
+	}
+}
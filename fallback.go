@@ -0,0 +1,186 @@
+package rest2firestore
+
+import (
+	"context"
+	"log"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// PathMapper maps a logical document path onto one physical location.
+type PathMapper func(document []string) []string
+
+// FallbackReader looks a document up in several locations, for use while
+// documents are being moved between paths. Mappers are tried in order and
+// the first one is the primary location. With Parallel all locations are
+// read at once, but the answer is the one a sequential read would give. List is not supported: a listing
+// cannot be merged across locations without reading all of them.
+//
+// With Repair, a document served from a fallback location is written back
+// to the primary one in the background, within RepairTimeout. Failed
+// repairs are counted and passed to OnRepairError, or logged without it.
+type FallbackReader struct {
+	db            Db
+	mappers       []PathMapper
+	Parallel      bool
+	Repair        bool
+	RepairTimeout time.Duration
+	OnRepairError func(primary []string, err error)
+
+	hits            []int64
+	misses          int64
+	repair_failures int64
+}
+
+const DefaultRepairTimeout = 30 * time.Second
+
+func NewFallbackReader(db Db, mappers ...PathMapper) *FallbackReader {
+	return &FallbackReader{
+		db:      db,
+		mappers: mappers,
+		hits:    make([]int64, len(mappers)),
+	}
+}
+
+// Get returns the document and the index of the mapper whose location
+// served it.
+func (r *FallbackReader) Get(
+	ctx context.Context, dummy Object, document []string) (
+	Object, int, error) {
+	var obj Object
+	var location int
+	var err error
+	if r.Parallel {
+		obj, location, err = r.getParallel(ctx, dummy, document)
+	} else {
+		obj, location, err = r.getSequential(ctx, dummy, document)
+	}
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			atomic.AddInt64(&r.misses, 1)
+		}
+		return nil, -1, err
+	}
+	atomic.AddInt64(&r.hits[location], 1)
+	if location > 0 && r.Repair {
+		go r.repair(obj, r.mappers[0](document))
+	}
+	return obj, location, nil
+}
+
+func (r *FallbackReader) getSequential(
+	ctx context.Context, dummy Object, document []string) (
+	Object, int, error) {
+	var last_err error
+	for i, mapper := range r.mappers {
+		obj, err := r.db.Get(ctx, dummy, mapper(document))
+		if err == nil {
+			return obj, i, nil
+		}
+		if status.Code(err) != codes.NotFound {
+			return nil, -1, err
+		}
+		last_err = err
+	}
+	return nil, -1, last_err
+}
+
+type fallbackResult struct {
+	obj      Object
+	location int
+	err      error
+}
+
+// getParallel starts every lookup at once but answers like getSequential:
+// a location only wins once every location before it found nothing, so a
+// fallback never beats a primary that has the document.
+func (r *FallbackReader) getParallel(
+	ctx context.Context, dummy Object, document []string) (
+	Object, int, error) {
+	// The lookups still running once the answer is known are cancelled.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan fallbackResult, len(r.mappers))
+	for i, mapper := range r.mappers {
+		go func(i int, mapper PathMapper) {
+			obj, err := r.db.Get(ctx, dummy, mapper(document))
+			results <- fallbackResult{obj: obj, location: i, err: err}
+		}(i, mapper)
+	}
+	done := make([]*fallbackResult, len(r.mappers))
+	next := 0
+	for range r.mappers {
+		result := <-results
+		done[result.location] = &result
+		for ; next < len(done) && done[next] != nil; next++ {
+			if err := done[next].err; err == nil {
+				return done[next].obj, next, nil
+			} else if status.Code(err) != codes.NotFound {
+				return nil, -1, err
+			}
+		}
+	}
+	return nil, -1, done[len(done)-1].err
+}
+
+// repair runs after Get has returned, so it does not use the caller's
+// context.
+func (r *FallbackReader) repair(obj Object, primary []string) {
+	timeout := r.RepairTimeout
+	if timeout <= 0 {
+		timeout = DefaultRepairTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := r.db.Put(ctx, obj, primary)
+	if err == nil {
+		return
+	}
+	atomic.AddInt64(&r.repair_failures, 1)
+	if r.OnRepairError != nil {
+		r.OnRepairError(primary, err)
+		return
+	}
+	log.Printf("%s:FallbackReader - could not repair: %v",
+		path.Join(primary...), err)
+}
+
+// RepairFailures reports how many repairs have failed.
+func (r *FallbackReader) RepairFailures() int64 {
+	return atomic.LoadInt64(&r.repair_failures)
+}
+
+// GetMulti applies Get to each document, so every element gets the same
+// fallback treatment and its own error.
+func (r *FallbackReader) GetMulti(
+	ctx context.Context, dummy Object, documents [][]string) (
+	[]Object, []int, []error) {
+	objs := make([]Object, len(documents))
+	locations := make([]int, len(documents))
+	errs := make([]error, len(documents))
+	var wg sync.WaitGroup
+	for i, document := range documents {
+		wg.Add(1)
+		go func(i int, document []string) {
+			defer wg.Done()
+			objs[i], locations[i], errs[i] = r.Get(ctx, dummy, document)
+		}(i, document)
+	}
+	wg.Wait()
+	return objs, locations, errs
+}
+
+// HitCounts reports how many reads each location served, and how many
+// reads found the document nowhere.
+func (r *FallbackReader) HitCounts() (hits []int64, misses int64) {
+	hits = make([]int64, len(r.hits))
+	for i := range hits {
+		hits[i] = atomic.LoadInt64(&r.hits[i])
+	}
+	return hits, atomic.LoadInt64(&r.misses)
+}
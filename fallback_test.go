@@ -0,0 +1,151 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowDb is a MemoryDb whose Gets of some collections wait: for delay, or
+// until their context is done when delay is negative.
+type slowDb struct {
+	*MemoryDb
+	delays map[string]time.Duration
+
+	mu        sync.Mutex
+	cancelled []string
+}
+
+func (s *slowDb) Get(
+	ctx context.Context, dummy Object, document []string) (Object, error) {
+	switch delay := s.delays[document[0]]; {
+	case delay < 0:
+		<-ctx.Done()
+		s.mu.Lock()
+		s.cancelled = append(s.cancelled, document[0])
+		s.mu.Unlock()
+		return nil, ctx.Err()
+	case delay > 0:
+		time.Sleep(delay)
+	}
+	return s.MemoryDb.Get(ctx, dummy, document)
+}
+
+func under(collection string) PathMapper {
+	return func(document []string) []string {
+		return append([]string{collection}, document...)
+	}
+}
+
+func TestFallbackReader(t *testing.T) {
+	ctx := context.Background()
+	dummy := AdaptV2(&testUser{})
+	for _, parallel := range []bool{false, true} {
+		db := NewMemoryDb()
+		put := func(collection, name string) {
+			t.Helper()
+			_, err := db.Put(ctx, AdaptV2(&testUser{Name: name}),
+				[]string{collection, "u1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		put("new", "primary")
+		put("old", "fallback")
+		repaired := make(chan error, 1)
+		r := NewFallbackReader(db, under("new"), under("old"))
+		r.Parallel, r.Repair = parallel, true
+		r.OnRepairError = func(primary []string, err error) {
+			repaired <- err
+		}
+
+		obj, location, err := r.Get(ctx, dummy, []string{"u1"})
+		if err != nil || location != 0 || nameOf(t, obj) != "primary" {
+			t.Errorf("parallel %v: primary hit served %v from %d, %v",
+				parallel, obj, location, err)
+		}
+
+		if err := db.Delete(ctx, dummy, []string{"new", "u1"}); err != nil {
+			t.Fatal(err)
+		}
+		obj, location, err = r.Get(ctx, dummy, []string{"u1"})
+		if err != nil || location != 1 || nameOf(t, obj) != "fallback" {
+			t.Errorf("parallel %v: fallback hit served %v from %d, %v",
+				parallel, obj, location, err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			repair, err := db.Get(ctx, dummy, []string{"new", "u1"})
+			if err == nil {
+				if nameOf(t, repair) != "fallback" {
+					t.Errorf("parallel %v: repaired to %q", parallel,
+						nameOf(t, repair))
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("parallel %v: primary not repaired", parallel)
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		_, location, err = r.Get(ctx, dummy, []string{"missing"})
+		if !errors.Is(err, ErrNotFound) || location != -1 {
+			t.Errorf("parallel %v: total miss: %d, %v, want ErrNotFound",
+				parallel, location, err)
+		}
+		hits, misses := r.HitCounts()
+		if hits[0] != 1 || hits[1] != 1 || misses != 1 {
+			t.Errorf("parallel %v: hits %v, misses %d", parallel, hits, misses)
+		}
+		select {
+		case err := <-repaired:
+			t.Errorf("parallel %v: repair failed: %v", parallel, err)
+		default:
+		}
+	}
+}
+
+func TestFallbackReaderParallelOrder(t *testing.T) {
+	ctx := context.Background()
+	dummy := AdaptV2(&testUser{})
+	db := &slowDb{MemoryDb: NewMemoryDb(), delays: map[string]time.Duration{
+		"new": 50 * time.Millisecond, "stuck": -1}}
+	for _, collection := range []string{"new", "old"} {
+		_, err := db.Put(ctx, AdaptV2(&testUser{Name: collection}),
+			[]string{collection, "u1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := NewFallbackReader(db, under("new"), under("old"), under("stuck"))
+	r.Parallel, r.Repair = true, true
+
+	// old answers first, but the slower primary holds the document.
+	obj, location, err := r.Get(ctx, dummy, []string{"u1"})
+	if err != nil || location != 0 || nameOf(t, obj) != "new" {
+		t.Errorf("served %v from %d, %v, want the primary", obj, location, err)
+	}
+	// The losing lookup sees its cancellation after Get returns.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		db.mu.Lock()
+		cancelled := db.cancelled
+		db.mu.Unlock()
+		if len(cancelled) > 0 {
+			if len(cancelled) != 1 || cancelled[0] != "stuck" {
+				t.Errorf("cancelled lookups %v, want [stuck]", cancelled)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the stuck lookup was not cancelled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if r.RepairFailures() != 0 {
+		t.Errorf("%d repairs failed", r.RepairFailures())
+	}
+}
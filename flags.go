@@ -0,0 +1,218 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// FlagTransactionalWrites gates the transactional Post and Patch used for
+// QuerySearcher objects. It defaults to on.
+const FlagTransactionalWrites = "transactional_writes"
+
+var ErrUnknownFlag = errors.New("unknown flag")
+
+// FlagProvider decides dynamic Db behaviour per operation. ctx is the
+// operation's context, so providers can target by Principal.
+type FlagProvider interface {
+	Evaluate(ctx context.Context, flag string) (bool, error)
+}
+
+type principalKey struct{}
+
+// WithPrincipal tags ctx with the caller the operation runs for.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+func Principal(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}
+
+var (
+	flag_fallbacks_mu sync.Mutex
+	flag_fallbacks    = map[string]int64{}
+)
+
+// FlagFallbacks returns how often each flag fell back to its default
+// because the provider failed.
+func FlagFallbacks() map[string]int64 {
+	flag_fallbacks_mu.Lock()
+	defer flag_fallbacks_mu.Unlock()
+	counts := make(map[string]int64, len(flag_fallbacks))
+	for flag, count := range flag_fallbacks {
+		counts[flag] = count
+	}
+	return counts
+}
+
+func (db *FirestoreDb) flag(ctx context.Context, flag string, def bool) bool {
+	if db.Flags == nil {
+		return def
+	}
+	on, err := db.Flags.Evaluate(ctx, flag)
+	if err != nil {
+		flag_fallbacks_mu.Lock()
+		flag_fallbacks[flag]++
+		flag_fallbacks_mu.Unlock()
+		return def
+	}
+	return on
+}
+
+// FlagRule turns a flag on for everyone when Enabled, for the listed
+// principals, and for Percent of all other principals. Bucketing hashes
+// the flag and principal, so a principal keeps its answer as Percent
+// grows.
+type FlagRule struct {
+	Enabled    bool     `firestore:"enabled"`
+	Percent    int      `firestore:"percent"`
+	Principals []string `firestore:"principals"`
+}
+
+func (r FlagRule) evaluate(flag, principal string) bool {
+	if r.Enabled {
+		return true
+	}
+	for _, allowed := range r.Principals {
+		if allowed == principal {
+			return true
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(flag + "/" + principal))
+	return int(h.Sum32()%100) < r.Percent
+}
+
+// MemoryFlags is a FlagProvider holding rules in memory. Flags without a
+// rule fail with ErrUnknownFlag, so the Db falls back to the default.
+type MemoryFlags struct {
+	mu    sync.RWMutex
+	rules map[string]FlagRule
+}
+
+var _ FlagProvider = &MemoryFlags{}
+
+func NewMemoryFlags() *MemoryFlags {
+	return &MemoryFlags{rules: map[string]FlagRule{}}
+}
+
+func (f *MemoryFlags) Set(flag string, rule FlagRule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules[flag] = rule
+}
+
+func (f *MemoryFlags) Remove(flag string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.rules, flag)
+}
+
+// retain removes every rule not named in keep.
+func (f *MemoryFlags) retain(keep map[string]bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for flag := range f.rules {
+		if !keep[flag] {
+			delete(f.rules, flag)
+		}
+	}
+}
+
+func (f *MemoryFlags) Evaluate(ctx context.Context, flag string) (bool, error) {
+	f.mu.RLock()
+	rule, ok := f.rules[flag]
+	f.mu.RUnlock()
+	if !ok {
+		return false, fmt.Errorf("%s: %w", flag, ErrUnknownFlag)
+	}
+	return rule.evaluate(flag, Principal(ctx)), nil
+}
+
+// WatchFlags keeps a MemoryFlags in sync with collection, one document
+// per flag named by its ID and holding a FlagRule, until ctx is done. A
+// failed listener is logged and started again, backing off from a second
+// up to a minute while it keeps failing. collection must be a valid, and
+// unless allowed, unreserved collection path.
+func (db *FirestoreDb) WatchFlags(
+	ctx context.Context, collection []string) (*MemoryFlags, error) {
+	collection_path, err := getCollectionPath(collection, db.allow_reserved)
+	if err != nil {
+		return nil, err
+	}
+	flags := NewMemoryFlags()
+	go func() {
+		backoff := flag_watch_min_backoff
+		for {
+			synced, err := db.watchFlags(ctx, collection_path, flags)
+			if ctx.Err() != nil || err == iterator.Done {
+				return
+			}
+			if synced {
+				backoff = flag_watch_min_backoff
+			}
+			log.Printf("%s:WatchFlags - could not watch flags, "+
+				"retrying in %v: %v", collection_path, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > flag_watch_max_backoff {
+				backoff = flag_watch_max_backoff
+			}
+		}
+	}()
+	return flags, nil
+}
+
+const (
+	flag_watch_min_backoff = time.Second
+	flag_watch_max_backoff = time.Minute
+)
+
+// watchFlags applies the snapshots of one listener to flags until it
+// fails. The first snapshot holds every flag, so flags removed while no
+// listener ran are dropped then. synced reports whether it got that far.
+func (db *FirestoreDb) watchFlags(ctx context.Context,
+	collection_path string, flags *MemoryFlags) (synced bool, err error) {
+	client := db.clientFor(collection_path)
+	snapshots := client.Collection(collection_path).Snapshots(ctx)
+	defer snapshots.Stop()
+	for {
+		snapshot, err := snapshots.Next()
+		if err != nil {
+			return synced, err
+		}
+		present := map[string]bool{}
+		for _, change := range snapshot.Changes {
+			flag := change.Doc.Ref.ID
+			if change.Kind == firestore.DocumentRemoved {
+				flags.Remove(flag)
+				continue
+			}
+			present[flag] = true
+			var rule FlagRule
+			if err := change.Doc.DataTo(&rule); err != nil {
+				log.Printf("%s/%s:WatchFlags - could not decode flag: %v",
+					collection_path, flag, err)
+				flags.Remove(flag)
+				continue
+			}
+			flags.Set(flag, rule)
+		}
+		if !synced {
+			flags.retain(present)
+			synced = true
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFlagBucketing(t *testing.T) {
+	const principals = 1000
+	previous := map[string]bool{}
+	for _, percent := range []int{0, 10, 50, 90, 100} {
+		rule := FlagRule{Percent: percent}
+		on := 0
+		for i := 0; i < principals; i++ {
+			principal := "user" + strconv.Itoa(i)
+			got := rule.evaluate("beta", principal)
+			if got != rule.evaluate("beta", principal) {
+				t.Fatalf("%s got different answers at %d%%", principal, percent)
+			}
+			// Growing Percent only ever turns principals on.
+			if previous[principal] && !got {
+				t.Errorf("%s turned off when Percent grew to %d", principal,
+					percent)
+			}
+			previous[principal] = got
+			if got {
+				on++
+			}
+		}
+		if low, high := principals*(percent-5)/100,
+			principals*(percent+5)/100; on < low || on > high {
+			t.Errorf("%d%% turned on %d of %d principals", percent, on,
+				principals)
+		}
+	}
+	// Buckets depend on the flag too.
+	same := 0
+	for i := 0; i < principals; i++ {
+		principal := "user" + strconv.Itoa(i)
+		rule := FlagRule{Percent: 50}
+		if rule.evaluate("a", principal) == rule.evaluate("b", principal) {
+			same++
+		}
+	}
+	if same > principals*6/10 {
+		t.Errorf("flags a and b agree for %d of %d principals", same,
+			principals)
+	}
+}
+
+func TestFlagRuleOverrides(t *testing.T) {
+	rule := FlagRule{Principals: []string{"alice"}}
+	if !rule.evaluate("beta", "alice") || rule.evaluate("beta", "bob") {
+		t.Errorf("listed principals are not the only ones on at 0%%")
+	}
+	rule = FlagRule{Enabled: true}
+	if !rule.evaluate("beta", "bob") {
+		t.Errorf("Enabled did not turn the flag on")
+	}
+}
+
+func TestFlagLiveFlip(t *testing.T) {
+	flags := NewMemoryFlags()
+	db := NewFirestoreDb(nil)
+	db.Flags = flags
+	ctx := WithPrincipal(context.Background(), "alice")
+	flags.Set("beta", FlagRule{Enabled: true})
+	if !db.flag(ctx, "beta", false) {
+		t.Fatalf("beta is off after enabling it")
+	}
+	flags.Set("beta", FlagRule{})
+	if db.flag(ctx, "beta", true) {
+		t.Errorf("beta is still on after disabling it")
+	}
+	flags.Set("beta", FlagRule{Principals: []string{"alice"}})
+	if !db.flag(ctx, "beta", false) ||
+		db.flag(WithPrincipal(ctx, "bob"), "beta", false) {
+		t.Errorf("beta is not on for alice alone")
+	}
+}
+
+type failingFlags struct{}
+
+func (failingFlags) Evaluate(ctx context.Context, flag string) (bool, error) {
+	return false, errors.New("provider down")
+}
+
+func TestFlagFallback(t *testing.T) {
+	ctx := context.Background()
+	db := NewFirestoreDb(nil)
+	if !db.flag(ctx, "fallback_none", true) {
+		t.Errorf("a Db without a provider did not use the default")
+	}
+	counted := func(flag string) int64 { return FlagFallbacks()[flag] }
+	for _, provider := range []FlagProvider{failingFlags{}, NewMemoryFlags()} {
+		db.Flags = provider
+		flag := "fallback_" + randomID()[:8]
+		for _, def := range []bool{true, false} {
+			if got := db.flag(ctx, flag, def); got != def {
+				t.Errorf("%T: flag = %v, want the default %v", provider, got,
+					def)
+			}
+		}
+		if got := counted(flag); got != 2 {
+			t.Errorf("%T: FlagFallbacks counted %d, want 2", provider, got)
+		}
+	}
+	if _, err := NewMemoryFlags().Evaluate(ctx, "missing"); !errors.Is(
+		err, ErrUnknownFlag) {
+		t.Errorf("Evaluate of a missing flag = %v, want ErrUnknownFlag", err)
+	}
+}
+
+func TestWatchFlagsValidatesCollection(t *testing.T) {
+	db := NewFirestoreDb(nil)
+	ctx := context.Background()
+	for _, test := range []struct {
+		collection []string
+		want       error
+	}{
+		{nil, ErrInvalidPath},
+		{[]string{"flags", "f1"}, ErrInvalidPath},
+		{[]string{ReservedPrefix + "flags"}, ErrReservedPath},
+	} {
+		flags, err := db.WatchFlags(ctx, test.collection)
+		if !errors.Is(err, test.want) || flags != nil {
+			t.Errorf("WatchFlags(%q) = %v, %v, want %v", test.collection,
+				flags, err, test.want)
+		}
+	}
+}
+
+// waitForFlag polls flags until flag evaluates to want, or to an error
+// when unknown is set.
+func waitForFlag(t *testing.T, flags *MemoryFlags, flag string, want,
+	unknown bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		on, err := flags.Evaluate(context.Background(), flag)
+		if unknown && errors.Is(err, ErrUnknownFlag) ||
+			!unknown && err == nil && on == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is %v, %v, want %v", flag, on, err, want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWatchFlags(t *testing.T) {
+	db := emulatorDb(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	collection := testCollection("flags")
+	beta := db.Client().Doc(path.Join(append(collection, "beta")...))
+	if _, err := beta.Set(ctx, FlagRule{Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	flags, err := db.WatchFlags(ctx, collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForFlag(t, flags, "beta", true, false)
+
+	// Each write flips the rule while the watch runs.
+	if _, err := beta.Set(ctx, FlagRule{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForFlag(t, flags, "beta", false, false)
+	if _, err := beta.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitForFlag(t, flags, "beta", false, true)
+}
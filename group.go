@@ -0,0 +1,145 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrQueryGroupFailed = errors.New("query group failed")
+
+type QueryFunc func(ctx context.Context) (interface{}, error)
+
+type QueryResult struct {
+	Value interface{}
+	Err   error
+}
+
+type namedQuery struct {
+	name     string
+	run      QueryFunc
+	required bool
+}
+
+// QueryGroup runs independent reads concurrently. Execute succeeds when
+// every required query succeeds and, if Quorum is set, at least Quorum
+// queries succeed in total. Workers is the number of goroutines running
+// the queries, zero meaning one per query, and Timeout is a deadline
+// shared by all queries; queries not started by then fail with it.
+type QueryGroup struct {
+	Workers int
+	Timeout time.Duration
+	Quorum  int
+
+	queries []namedQuery
+	// err is the first registration error, returned by Execute.
+	err error
+}
+
+func NewQueryGroup() *QueryGroup {
+	return &QueryGroup{}
+}
+
+// Add registers an optional query; its failure is recorded but does not
+// fail the group by itself. A name already in the group makes Execute fail
+// without running anything.
+func (g *QueryGroup) Add(name string, run QueryFunc) *QueryGroup {
+	return g.add(namedQuery{name: name, run: run})
+}
+
+func (g *QueryGroup) Require(name string, run QueryFunc) *QueryGroup {
+	return g.add(namedQuery{name: name, run: run, required: true})
+}
+
+func (g *QueryGroup) add(query namedQuery) *QueryGroup {
+	for _, other := range g.queries {
+		if other.name == query.name && g.err == nil {
+			g.err = fmt.Errorf("%s:QueryGroup - query added twice", query.name)
+		}
+	}
+	g.queries = append(g.queries, query)
+	return g
+}
+
+// ListFunc adapts ListWithQuery; the result value is the []Object.
+func ListFunc(db Db, obj Object, collection []string, q *ListQuery) QueryFunc {
+	return func(ctx context.Context) (interface{}, error) {
+		objs, _, err := db.ListWithQuery(ctx, obj, collection, q)
+		return objs, err
+	}
+}
+
+func GetFunc(db Db, dummy Object, document []string) QueryFunc {
+	return func(ctx context.Context) (interface{}, error) {
+		return db.Get(ctx, dummy, document)
+	}
+}
+
+// Execute runs the group and returns every query's result by name, along
+// with an error wrapping ErrQueryGroupFailed when the group failed.
+// Queries still running at the deadline see their context cancelled.
+func (g *QueryGroup) Execute(ctx context.Context) (
+	map[string]QueryResult, error) {
+	if g.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.Timeout)
+		defer cancel()
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+	workers := g.Workers
+	if workers <= 0 || workers > len(g.queries) {
+		workers = len(g.queries)
+	}
+	indexes := make(chan int, len(g.queries))
+	for i := range g.queries {
+		indexes <- i
+	}
+	close(indexes)
+	ordered := make([]QueryResult, len(g.queries))
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := ctx.Err(); err != nil {
+					ordered[i].Err = err
+					continue
+				}
+				ordered[i].Value, ordered[i].Err = g.queries[i].run(ctx)
+			}
+		}()
+	}
+	wg.Wait()
+	results := make(map[string]QueryResult, len(g.queries))
+	for i, query := range g.queries {
+		results[query.name] = ordered[i]
+	}
+	var failed []string
+	succeeded := 0
+	for _, query := range g.queries {
+		if err := results[query.name].Err; err != nil {
+			if query.required {
+				failed = append(failed, fmt.Sprintf("%s: %v", query.name, err))
+			}
+			continue
+		}
+		succeeded++
+	}
+	sort.Strings(failed)
+	if len(failed) > 0 {
+		return results, fmt.Errorf("%w: required queries failed: %s",
+			ErrQueryGroupFailed, strings.Join(failed, "; "))
+	}
+	if g.Quorum > 0 && succeeded < g.Quorum {
+		return results, fmt.Errorf("%w: %d of %d queries succeeded, quorum %d",
+			ErrQueryGroupFailed, succeeded, len(g.queries), g.Quorum)
+	}
+	return results, nil
+}
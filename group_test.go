@@ -0,0 +1,119 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func constQuery(value interface{}, err error) QueryFunc {
+	return func(ctx context.Context) (interface{}, error) {
+		return value, err
+	}
+}
+
+func TestQueryGroupAllSucceed(t *testing.T) {
+	db := NewMemoryDb()
+	user, err := db.Put(context.Background(),
+		AdaptV2(&testUser{Email: "a@example.com"}), []string{"users", "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := NewQueryGroup().
+		Require("user", GetFunc(db, AdaptV2(&testUser{}),
+			[]string{"users", "u1"})).
+		Add("count", constQuery(3, nil)).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := results["user"].Value.(Object)
+	if !ok || Underlying(got).(*testUser).Email !=
+		Underlying(user).(*testUser).Email {
+		t.Errorf("user result %v, want %v", results["user"].Value, user)
+	}
+	if results["count"].Value != 3 {
+		t.Errorf("count result %v, want 3", results["count"].Value)
+	}
+}
+
+func TestQueryGroupOptionalFailure(t *testing.T) {
+	failed := errors.New("failed")
+	results, err := NewQueryGroup().
+		Require("a", constQuery(1, nil)).
+		Add("b", constQuery(nil, failed)).
+		Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Execute: %v, want success", err)
+	}
+	if !errors.Is(results["b"].Err, failed) {
+		t.Errorf("optional result error %v, want %v", results["b"].Err, failed)
+	}
+	g := NewQueryGroup().
+		Add("a", constQuery(1, nil)).
+		Add("b", constQuery(nil, failed))
+	g.Quorum = 2
+	if _, err := g.Execute(context.Background()); !errors.Is(
+		err, ErrQueryGroupFailed) {
+		t.Errorf("Execute below quorum: %v, want ErrQueryGroupFailed", err)
+	}
+}
+
+func TestQueryGroupRequiredFailure(t *testing.T) {
+	failed := errors.New("failed")
+	results, err := NewQueryGroup().
+		Require("a", constQuery(nil, failed)).
+		Add("b", constQuery(2, nil)).
+		Execute(context.Background())
+	if !errors.Is(err, ErrQueryGroupFailed) {
+		t.Errorf("Execute: %v, want ErrQueryGroupFailed", err)
+	}
+	if !errors.Is(results["a"].Err, failed) || results["b"].Value != 2 {
+		t.Errorf("results %v, want a failed and b = 2", results)
+	}
+}
+
+func TestQueryGroupDeadline(t *testing.T) {
+	var started atomic.Int64
+	blocking := func(ctx context.Context) (interface{}, error) {
+		started.Add(1)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	g := NewQueryGroup()
+	g.Workers = 2
+	g.Timeout = 20 * time.Millisecond
+	for _, name := range []string{"a", "b", "c", "d"} {
+		g.Require(name, blocking)
+	}
+	results, err := g.Execute(context.Background())
+	if !errors.Is(err, ErrQueryGroupFailed) {
+		t.Errorf("Execute: %v, want ErrQueryGroupFailed", err)
+	}
+	for name, result := range results {
+		if !errors.Is(result.Err, context.DeadlineExceeded) {
+			t.Errorf("%s: %v, want context.DeadlineExceeded", name, result.Err)
+		}
+	}
+	if n := started.Load(); n != 2 {
+		t.Errorf("%d queries started, want the 2 workers'", n)
+	}
+}
+
+func TestQueryGroupDuplicateName(t *testing.T) {
+	var ran atomic.Int64
+	run := func(ctx context.Context) (interface{}, error) {
+		ran.Add(1)
+		return nil, nil
+	}
+	_, err := NewQueryGroup().Add("a", run).Require("a", run).
+		Execute(context.Background())
+	if err == nil {
+		t.Error("Execute with a duplicate name succeeded")
+	}
+	if ran.Load() != 0 {
+		t.Errorf("%d queries ran, want 0", ran.Load())
+	}
+}
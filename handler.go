@@ -0,0 +1,549 @@
+package rest2firestore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+const DefaultMaxBodyBytes = 1 << 20
+
+type route struct {
+	pattern []string
+	proto   Object
+	// raw is set for the routes of RegisterRawResource.
+	raw *RawOptions
+}
+
+// Router serves the REST surface of the resources registered on it:
+//
+//	GET    /{collection}       List, with a ListQuery from the URL
+//	POST   /{collection}       Post; 201 when a document was created, with
+//	                           its Location when the Db is a PathPoster
+//	GET    /{collection}/{id}  Get
+//	PUT    /{collection}/{id}  Put
+//	PATCH  /{collection}/{id}  PatchFields with the fields of the body
+//	DELETE /{collection}/{id}  Delete; 204
+//
+// Bodies are the JSON encoding of the resource's model type, except for
+// PATCH, whose fields are in the canonical mapping of DecodeValue. Errors are
+// {"error": message} with the status from HTTPStatus. When the Db is a
+// ConditionalDb, documents carry an ETag and writes honour If-Match. To
+// mount it below a prefix, wrap it in http.StripPrefix. Collections without
+// a model can be served as RawObjects with RegisterRawResource.
+//
+// When the Db is a PointInTimeDb and Admin is set,
+// GET /{collection}/{id}:asOf?time=<RFC3339> returns the document as it
+// was at that time, as {"source": ..., "time": ..., "object": ...}.
+type Router struct {
+	Db           Db
+	MaxBodyBytes int64
+	// Admin authorizes the admin endpoints, such as :asOf. They are not
+	// served while it is nil, and get 403 when it returns an error.
+	Admin func(req *http.Request) error
+	// RequireIfMatch answers PUT, PATCH and DELETE of a document without
+	// an If-Match header with 428 when the Db is a ConditionalDb.
+	RequireIfMatch bool
+
+	routes []route
+}
+
+var _ http.Handler = &Router{}
+
+func NewRouter(db Db) *Router {
+	return &Router{Db: db, MaxBodyBytes: DefaultMaxBodyBytes}
+}
+
+// RegisterResource serves the collections matching pattern, such as
+// "users/{user}/posts", with proto as their prototype. Every subcollection
+// proto declares is registered below it in turn. Like http.ServeMux, it
+// panics on an invalid pattern and on one already registered, whatever
+// its parameters are named.
+func (r *Router) RegisterResource(pattern string, proto Object) *Router {
+	segments := routePattern("RegisterResource", pattern)
+	if err := CheckSubcollections(proto); err != nil {
+		panic(fmt.Sprintf("rest2firestore: RegisterResource: %v", err))
+	}
+	r.register(segments, proto, nil)
+	return r
+}
+
+func routePattern(op, pattern string) []string {
+	segments := strings.Split(strings.Trim(pattern, "/"), "/")
+	if _, err := getCollectionPath(segments, false); err != nil {
+		panic(fmt.Sprintf("rest2firestore: %s: %v", op, err))
+	}
+	return segments
+}
+
+func (r *Router) register(segments []string, proto Object, raw *RawOptions) {
+	for _, existing := range r.routes {
+		if normalizePattern(existing.pattern) == normalizePattern(segments) {
+			panic(fmt.Sprintf("rest2firestore: RegisterResource: %s "+
+				"conflicts with %s", strings.Join(segments, "/"),
+				strings.Join(existing.pattern, "/")))
+		}
+	}
+	r.routes = append(r.routes,
+		route{pattern: segments, proto: proto, raw: raw})
+	id := "{" + segments[len(segments)-1] + "_id}"
+	for _, sub := range subcollections(AdaptLegacy(proto)) {
+		child := append(segments[:len(segments):len(segments)], id, sub.Name)
+		r.register(child, sub.Obj, nil)
+	}
+}
+
+// normalizePattern names every parameter {}, so patterns differing only in
+// parameter names compare equal.
+func normalizePattern(pattern []string) string {
+	normalized := make([]string, len(pattern))
+	for i, part := range pattern {
+		if isPatternParam(part) {
+			part = "{}"
+		}
+		normalized[i] = part
+	}
+	return strings.Join(normalized, "/")
+}
+
+func (rt route) match(segments []string) bool {
+	if len(segments) < len(rt.pattern) || len(segments) > len(rt.pattern)+1 {
+		return false
+	}
+	return matchPattern(rt.pattern, segments[:len(rt.pattern)])
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	for _, rt := range r.routes {
+		if !rt.match(segments) {
+			continue
+		}
+		if rt.raw != nil && !rt.raw.allow(w, req) {
+			return
+		}
+		if len(segments) == len(rt.pattern) {
+			r.serveCollection(w, req, rt, segments)
+		} else {
+			r.serveDocument(w, req, rt, segments)
+		}
+		return
+	}
+	writeError(w, http.StatusNotFound, "no resource at "+req.URL.Path)
+}
+
+func (r *Router) serveCollection(w http.ResponseWriter, req *http.Request,
+	rt route, collection []string) {
+	ctx, proto := req.Context(), rt.proto
+	switch req.Method {
+	case http.MethodGet:
+		q, err := ParseListQuery(req.URL.Query(), proto)
+		if err != nil {
+			writeDbError(w, err)
+			return
+		}
+		objs, cursor, err := r.Db.ListWithQuery(ctx, proto, collection, q)
+		if err != nil {
+			writeDbError(w, err)
+			return
+		}
+		items := make([]interface{}, 0, len(objs))
+		for _, obj := range objs {
+			items = append(items, rt.view(obj))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"items": items, "next": cursor})
+	case http.MethodPost:
+		obj, ok := r.decode(w, req, proto, r.bodyLimit(rt))
+		if !ok {
+			return
+		}
+		var result Object
+		var document []string
+		var created bool
+		var err error
+		if poster, ok := r.Db.(PathPoster); ok {
+			result, document, created, err =
+				poster.FindOrCreatePath(ctx, obj, collection)
+		} else {
+			result, created, err = r.Db.FindOrCreate(ctx, obj, collection)
+		}
+		if err != nil {
+			writeDbError(w, err)
+			return
+		}
+		code := http.StatusOK
+		if created {
+			code = http.StatusCreated
+			if len(document) > 0 {
+				w.Header().Set("Location", location(req, document))
+			}
+		}
+		writeJSON(w, code, rt.view(result))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, req.Method+" not allowed")
+	}
+}
+
+// location is the URL of the created document, relative to the request's
+// so that it holds below http.StripPrefix too.
+func location(req *http.Request, document []string) string {
+	id := url.PathEscape(document[len(document)-1])
+	if strings.HasSuffix(req.URL.Path, "/") {
+		return id
+	}
+	return url.PathEscape(document[len(document)-2]) + "/" + id
+}
+
+func (r *Router) serveDocument(w http.ResponseWriter, req *http.Request,
+	rt route, document []string) {
+	id, as_of := strings.CutSuffix(document[len(document)-1], ":asOf")
+	if as_of {
+		r.serveAsOf(w, req, rt,
+			append(document[:len(document)-1:len(document)-1], id))
+		return
+	}
+	ctx, proto := req.Context(), rt.proto
+	conditional, _ := r.Db.(ConditionalDb)
+	var last_update *time.Time
+	if etag := req.Header.Get("If-Match"); etag != "" && etag != "*" {
+		t, err := ParseETag(etag)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid If-Match: "+err.Error())
+			return
+		}
+		if conditional == nil {
+			writeDbError(w, fmt.Errorf("%T: %w", r.Db, ErrUnsupportedByBackend))
+			return
+		}
+		last_update = &t
+	}
+	if r.RequireIfMatch && conditional != nil &&
+		req.Header.Get("If-Match") == "" && req.Method != http.MethodGet {
+		writeError(w, http.StatusPreconditionRequired, "If-Match is required")
+		return
+	}
+	var result Object
+	var meta Metadata
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		if conditional != nil {
+			result, meta, err = conditional.GetWithMetadata(ctx, proto, document)
+		} else {
+			result, err = r.Db.Get(ctx, proto, document)
+		}
+	case http.MethodPut:
+		obj, ok := r.decode(w, req, proto, r.bodyLimit(rt))
+		if !ok {
+			return
+		}
+		if last_update != nil {
+			result, meta, err =
+				conditional.PutIf(ctx, obj, document, *last_update)
+		} else {
+			result, err = r.Db.Put(ctx, obj, document)
+		}
+	case http.MethodPatch:
+		var body map[string]interface{}
+		decoder := json.NewDecoder(
+			http.MaxBytesReader(w, req.Body, r.bodyLimit(rt)))
+		decoder.UseNumber()
+		if err := decoder.Decode(&body); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if body == nil {
+			writeError(w, http.StatusBadRequest,
+				"invalid body: expected a JSON object")
+			return
+		}
+		var fields interface{}
+		if fields, err = DecodeValue(rt.client(), body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		patch, _ := fields.(map[string]interface{})
+		if last_update != nil {
+			result, meta, err = conditional.PatchFieldsIf(
+				ctx, proto, document, patch, *last_update)
+		} else {
+			result, err = r.Db.PatchFields(ctx, proto, document, patch)
+		}
+	case http.MethodDelete:
+		if last_update != nil {
+			err = conditional.DeleteIf(ctx, proto, document, *last_update)
+		} else {
+			err = r.Db.Delete(ctx, proto, document)
+		}
+		if err != nil {
+			writeDbError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, req.Method+" not allowed")
+		return
+	}
+	if err != nil {
+		writeDbError(w, err)
+		return
+	}
+	if meta.UpdateTime.IsZero() && conditional != nil {
+		// Unconditional writes report no metadata, so it is read back. The
+		// write stands if that read fails; only the ETag is missing.
+		reread, reread_meta, err :=
+			conditional.GetWithMetadata(ctx, proto, document)
+		if err == nil {
+			result, meta = reread, reread_meta
+		}
+	}
+	if !meta.UpdateTime.IsZero() {
+		w.Header().Set("ETag", meta.ETag())
+	}
+	writeJSON(w, http.StatusOK, rt.view(result))
+}
+
+type jsonDecoder interface {
+	decodeJSON(decoder *json.Decoder) (ObjectV2, error)
+}
+
+// decode reads the body into a new value of proto's model type.
+func (r *Router) decode(w http.ResponseWriter, req *http.Request,
+	proto Object, limit int64) (Object, bool) {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, limit))
+	if typed, ok := AdaptLegacy(proto).(jsonDecoder); ok {
+		obj, err := typed.decodeJSON(decoder)
+		if err != nil {
+			writeBodyError(w, err)
+			return nil, false
+		}
+		return AdaptV2(obj), true
+	}
+	obj, err := newObject(proto)
+	if err != nil {
+		writeDbError(w, err)
+		return nil, false
+	}
+	if err := decoder.Decode(model(obj)); err != nil {
+		writeBodyError(w, err)
+		return nil, false
+	}
+	return obj, true
+}
+
+// writeBodyError reports a body that could not be read: 413 when it was
+// larger than MaxBodyBytes, 400 otherwise.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var too_large *http.MaxBytesError
+	if errors.As(err, &too_large) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf(
+			"body larger than %d bytes", too_large.Limit))
+		return
+	}
+	writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+}
+
+// model returns the value behind obj that JSON encodes, looking through
+// adapters but, unlike Underlying, not into a RawObject.
+func model(obj Object) interface{} {
+	var value interface{} = AdaptLegacy(obj)
+	if adapted, ok := value.(legacyObject); ok {
+		value = adapted.obj
+	}
+	if holder, ok := value.(storedHolder); ok {
+		return holder.stored()
+	}
+	return value
+}
+
+func newObject(proto Object) (Object, error) {
+	value := model(proto)
+	if raw, ok := value.(*RawObject); ok {
+		return &RawObject{Client: raw.Client}, nil
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil, fmt.Errorf("%T: resource prototypes must be pointers", value)
+	}
+	fresh := reflect.New(v.Elem().Type()).Interface()
+	if obj, ok := fresh.(Object); ok {
+		return obj, nil
+	}
+	return AdaptV2(fresh.(ObjectV2)), nil
+}
+
+// ParseListQuery reads a ListQuery from URL parameters: limit, offset,
+// cursor, fields (comma separated), sort (comma separated, "-" for
+// descending) and, for each filter.<field> parameter, an equality filter
+// on field. Filter values are converted to the type of the field in
+// proto's model. A RawObject has no field types, so its filter values are
+// read as JSON in the canonical mapping of DecodeValue, and values that
+// are not JSON are strings. Other parameters are ignored, and each may
+// only be given once.
+func ParseListQuery(values url.Values, proto Object) (*ListQuery, error) {
+	q := &ListQuery{}
+	for key, list := range values {
+		if len(list) > 1 {
+			return nil, fmt.Errorf("%s given %d times: %w",
+				key, len(list), ErrInvalidQuery)
+		}
+		value := list[0]
+		var err error
+		switch key {
+		case "limit":
+			q.Limit, err = strconv.Atoi(value)
+		case "offset":
+			q.Offset, err = strconv.Atoi(value)
+		case "cursor":
+			q.Cursor = value
+		case "fields":
+			q.Select = strings.Split(value, ",")
+		case "sort":
+			for _, field := range strings.Split(value, ",") {
+				q.OrderBy = append(q.OrderBy, Order{
+					Path: strings.TrimPrefix(field, "-"),
+					Desc: strings.HasPrefix(field, "-")})
+			}
+		default:
+			field := strings.TrimPrefix(key, "filter.")
+			if field == key {
+				continue
+			}
+			var typed interface{}
+			if typed, err = filterValue(proto, field, value); err == nil {
+				q.Filters = append(q.Filters,
+					Filter{Path: field, Op: "==", Value: typed})
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s=%s: %w", key, value, ErrInvalidQuery)
+		}
+	}
+	return q, nil
+}
+
+var time_type = reflect.TypeOf(time.Time{})
+
+// filterValue parses value as the field at field_path in proto's model,
+// following its firestore tags.
+func filterValue(proto Object, field_path, value string) (
+	interface{}, error) {
+	if raw, ok := model(proto).(*RawObject); ok {
+		return rawFilterValue(raw.Client, value)
+	}
+	t := reflect.TypeOf(model(proto))
+	for _, name := range strings.Split(field_path, ".") {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("%s is not a struct field", name)
+		}
+		field, ok := storedFieldType(t, name)
+		if !ok {
+			return nil, fmt.Errorf("no field %s", name)
+		}
+		t = field.Type
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == time_type {
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		return parsed, err
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return value, nil
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return strconv.ParseInt(value, 10, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		// Firestore stores integers as int64.
+		parsed, err := strconv.ParseUint(value, 10, 63)
+		return int64(parsed), err
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(value, 64)
+	}
+	return nil, fmt.Errorf("cannot filter on %s, a %s", field_path, t)
+}
+
+// rawFilterValue decodes value as DecodeValue does a field of a JSON body,
+// so filter.age=30 matches the number 30 and filter.name=ann, which is not
+// JSON, the string "ann".
+func rawFilterValue(client *firestore.Client, value string) (
+	interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	var parsed interface{}
+	if err := decoder.Decode(&parsed); err != nil {
+		return value, nil
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return value, nil
+	}
+	return DecodeValue(client, parsed)
+}
+
+// storedFieldType is storedField for a struct type.
+func storedFieldType(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		stored := strings.Split(field.Tag.Get("firestore"), ",")[0]
+		if stored == "" {
+			stored = field.Name
+		}
+		if field.PkgPath == "" && stored == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		writeDbError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	data, _ := json.Marshal(map[string]string{"error": message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// writeDbError reports err with its HTTPStatus. Server errors are only
+// logged, and the client gets the status text, so that they do not leak
+// paths or backend details.
+func writeDbError(w http.ResponseWriter, err error) {
+	code := HTTPStatus(err)
+	if code >= http.StatusInternalServerError {
+		log.Printf("rest2firestore: %d: %v", code, err)
+		writeError(w, code, http.StatusText(code))
+		return
+	}
+	writeError(w, code, err.Error())
+}
@@ -0,0 +1,361 @@
+package rest2firestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRouterPostLocation(t *testing.T) {
+	db := NewMemoryDb()
+	db.NewID = func() string { return "u1" }
+	router := NewRouter(db).RegisterResource("users", AdaptV2(&testUser{}))
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api", router))
+	post := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/users",
+			strings.NewReader(`{"email": "a@example.com"}`)))
+		return w
+	}
+
+	w := post()
+	if w.Code != http.StatusCreated {
+		t.Fatalf("first POST: status %d, want 201: %s", w.Code, w.Body)
+	}
+	location, err := httptest.NewRequest(http.MethodPost, "/api/users", nil).
+		URL.Parse(w.Header().Get("Location"))
+	if err != nil || location.Path != "/api/users/u1" {
+		t.Errorf("Location %q resolves to %v, want /api/users/u1",
+			w.Header().Get("Location"), location)
+	}
+
+	w = post()
+	if w.Code != http.StatusOK {
+		t.Errorf("second POST: status %d, want 200: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Location"); got != "" {
+		t.Errorf("second POST: Location %q, want none", got)
+	}
+}
+
+func TestRouterVerbs(t *testing.T) {
+	router := NewRouter(NewMemoryDb()).
+		RegisterResource("users", AdaptV2(&testUser{}))
+	check := func(method, target, body string, want int) []byte {
+		t.Helper()
+		w, got := serve(router, method, target, body)
+		if w.Code != want {
+			t.Errorf("%s %s: status %d, want %d: %s", method, target, w.Code,
+				want, got)
+		}
+		return got
+	}
+	user := func(body []byte) map[string]interface{} {
+		t.Helper()
+		value, _ := decodeJSON(t, body).(map[string]interface{})
+		return value
+	}
+
+	check(http.MethodPut, "/users/u1",
+		`{"email": "a@example.com", "name": "Ann"}`, http.StatusOK)
+	body := check(http.MethodGet, "/users/u1", "", http.StatusOK)
+	if got := user(body)["name"]; got != "Ann" {
+		t.Errorf("GET returned name %v, want Ann", got)
+	}
+	check(http.MethodPost, "/users", `{"email": "b@example.com"}`,
+		http.StatusCreated)
+	body = check(http.MethodPatch, "/users/u1", `{"age": 30}`, http.StatusOK)
+	if got := user(body); got["age"] != json.Number("30") ||
+		got["name"] != "Ann" {
+		t.Errorf("PATCH returned %s, want age 30 and name Ann", body)
+	}
+	body = check(http.MethodGet, "/users?filter.age=30", "", http.StatusOK)
+	items, _ := user(body)["items"].([]interface{})
+	if len(items) != 1 {
+		t.Errorf("filtered GET returned %s, want u1 alone", body)
+	}
+	check(http.MethodDelete, "/users/u1", "", http.StatusNoContent)
+	check(http.MethodGet, "/users/u1", "", http.StatusNotFound)
+
+	// Bodies that are not the object asked for.
+	check(http.MethodPut, "/users/u1", `{"email": `, http.StatusBadRequest)
+	check(http.MethodPost, "/users", `[1]`, http.StatusBadRequest)
+	check(http.MethodPatch, "/users/u2", `null`, http.StatusBadRequest)
+	check(http.MethodPatch, "/users/u2", `[]`, http.StatusBadRequest)
+	check(http.MethodPatch, "/users/u2", `{"age": {"$bytes": "!"}}`,
+		http.StatusBadRequest)
+
+	w, _ := serve(router, http.MethodPut, "/users", "")
+	if w.Code != http.StatusMethodNotAllowed ||
+		w.Header().Get("Allow") != "GET, POST" {
+		t.Errorf("PUT on a collection: status %d, Allow %q", w.Code,
+			w.Header().Get("Allow"))
+	}
+	w, _ = serve(router, http.MethodPost, "/users/u1", "")
+	if w.Code != http.StatusMethodNotAllowed ||
+		w.Header().Get("Allow") != "GET, PUT, PATCH, DELETE" {
+		t.Errorf("POST on a document: status %d, Allow %q", w.Code,
+			w.Header().Get("Allow"))
+	}
+	check(http.MethodGet, "/things", "", http.StatusNotFound)
+}
+
+// errorDb fails every Get with err.
+type errorDb struct {
+	Db
+	err error
+}
+
+func (d errorDb) Get(
+	ctx context.Context, obj Object, document []string) (Object, error) {
+	return nil, d.err
+}
+
+func TestRouterErrorMapping(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want int
+	}{
+		{dbError("Get", "users/u1", "could not get object",
+			status.Error(codes.NotFound, "gone")), http.StatusNotFound},
+		{dbError("Get", "users/u1", "could not get object",
+			status.Error(codes.PermissionDenied, "no")), http.StatusForbidden},
+		{ErrReservedPath, http.StatusForbidden},
+		{ErrPreconditionFailed, http.StatusPreconditionFailed},
+		{ErrBackendUnavailable, http.StatusServiceUnavailable},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{errors.New("boom"), http.StatusInternalServerError},
+	} {
+		router := NewRouter(errorDb{NewMemoryDb(), test.err}).
+			RegisterResource("users", AdaptV2(&testUser{}))
+		w, body := serve(router, http.MethodGet, "/users/u1", "")
+		// Server errors are logged, not shown to the client.
+		message := test.err.Error()
+		if test.want >= http.StatusInternalServerError {
+			message = http.StatusText(test.want)
+		}
+		got, _ := decodeJSON(t, body).(map[string]interface{})
+		if w.Code != test.want || got["error"] != message {
+			t.Errorf("%v: status %d, body %s, want %d and %q", test.err,
+				w.Code, body, test.want, message)
+		}
+	}
+}
+
+// versionedDb is a ConditionalDb over a MemoryDb, versioning documents
+// with a counter in place of update times.
+type versionedDb struct {
+	*MemoryDb
+	mu       sync.Mutex
+	versions map[string]int64
+}
+
+func newVersionedDb() *versionedDb {
+	return &versionedDb{MemoryDb: NewMemoryDb(), versions: map[string]int64{}}
+}
+
+var _ ConditionalDb = &versionedDb{}
+
+func (d *versionedDb) bump(document []string) Metadata {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.versions[path.Join(document...)]++
+	return Metadata{UpdateTime: time.Unix(0, d.versions[path.Join(document...)])}
+}
+
+func (d *versionedDb) check(document []string, last_update time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.versions[path.Join(document...)] != last_update.UnixNano() {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+func (d *versionedDb) Put(
+	ctx context.Context, obj Object, document []string) (Object, error) {
+	result, err := d.MemoryDb.Put(ctx, obj, document)
+	if err == nil {
+		d.bump(document)
+	}
+	return result, err
+}
+
+func (d *versionedDb) GetWithMetadata(ctx context.Context, dummy Object,
+	document []string) (Object, Metadata, error) {
+	result, err := d.Get(ctx, dummy, document)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return result, Metadata{
+		UpdateTime: time.Unix(0, d.versions[path.Join(document...)])}, err
+}
+
+func (d *versionedDb) PutIf(ctx context.Context, obj Object,
+	document []string, last_update time.Time) (Object, Metadata, error) {
+	if err := d.check(document, last_update); err != nil {
+		return nil, Metadata{}, err
+	}
+	result, err := d.MemoryDb.Put(ctx, obj, document)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	return result, d.bump(document), nil
+}
+
+func (d *versionedDb) PatchFieldsIf(ctx context.Context, dummy Object,
+	document []string, fields map[string]interface{},
+	last_update time.Time) (Object, Metadata, error) {
+	if err := d.check(document, last_update); err != nil {
+		return nil, Metadata{}, err
+	}
+	result, err := d.PatchFields(ctx, dummy, document, fields)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	return result, d.bump(document), nil
+}
+
+func (d *versionedDb) DeleteIf(ctx context.Context, dummy Object,
+	document []string, last_update time.Time) error {
+	if err := d.check(document, last_update); err != nil {
+		return err
+	}
+	return d.Delete(ctx, dummy, document)
+}
+
+func TestRouterIfMatch(t *testing.T) {
+	router := NewRouter(newVersionedDb()).
+		RegisterResource("users", AdaptV2(&testUser{}))
+	request := func(method, body, if_match string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/users/u1", strings.NewReader(body))
+		if if_match != "" {
+			req.Header.Set("If-Match", if_match)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	const user = `{"email": "a@example.com"}`
+
+	w := request(http.MethodPut, user, "")
+	first := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || first == "" {
+		t.Fatalf("unconditional PUT: status %d, ETag %q", w.Code, first)
+	}
+	if w := request(http.MethodGet, "", ""); w.Header().Get("ETag") != first {
+		t.Errorf("GET ETag %q, want the PUT's %q", w.Header().Get("ETag"),
+			first)
+	}
+	w = request(http.MethodPut, user, first)
+	second := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || second == first || second == "" {
+		t.Errorf("PUT with a fresh ETag: status %d, ETag %q after %q",
+			w.Code, second, first)
+	}
+	for _, method := range []string{
+		http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		if w := request(method, user, first); w.Code !=
+			http.StatusPreconditionFailed {
+			t.Errorf("%s with a stale ETag: status %d, want 412", method,
+				w.Code)
+		}
+		if w := request(method, user, `"not an etag!"`); w.Code !=
+			http.StatusBadRequest {
+			t.Errorf("%s with a malformed ETag: status %d, want 400", method,
+				w.Code)
+		}
+	}
+	w = request(http.MethodPatch, `{"age": 3}`, second)
+	third := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || third == second {
+		t.Errorf("PATCH with a fresh ETag: status %d, ETag %q", w.Code, third)
+	}
+	if w := request(http.MethodPut, user, "*"); w.Code != http.StatusOK {
+		t.Errorf("PUT with If-Match *: status %d, want 200", w.Code)
+	}
+
+	router.RequireIfMatch = true
+	if w := request(http.MethodPut, user, ""); w.Code !=
+		http.StatusPreconditionRequired {
+		t.Errorf("PUT without If-Match: status %d, want 428", w.Code)
+	}
+	w = request(http.MethodGet, "", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("GET without If-Match: status %d, want 200", w.Code)
+	}
+	if w := request(http.MethodDelete, "", w.Header().Get("ETag")); w.Code !=
+		http.StatusNoContent {
+		t.Errorf("DELETE with a fresh ETag: status %d, want 204", w.Code)
+	}
+
+	// A Db that cannot honour If-Match says so rather than ignoring it.
+	router = NewRouter(NewMemoryDb()).
+		RegisterResource("users", AdaptV2(&testUser{}))
+	if w := request(http.MethodPut, user, first); w.Code !=
+		http.StatusNotImplemented {
+		t.Errorf("If-Match on a MemoryDb: status %d, want 501", w.Code)
+	}
+}
+
+func TestRawResourceFilters(t *testing.T) {
+	router := NewRouter(NewMemoryDb()).
+		RegisterRawResource("things", RawOptions{Writable: true})
+	for id, body := range map[string]string{
+		"t1": `{"age": 30, "name": "ann",
+			"at": {"$timestamp": "2024-01-02T03:04:05Z"}}`,
+		"t2": `{"age": "30", "name": "true"}`,
+		"t3": `{"age": 30.5, "name": "bob"}`,
+	} {
+		if w, body := serve(router, http.MethodPut, "/things/"+id,
+			body); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: status %d: %s", id, w.Code, body)
+		}
+	}
+	for _, test := range []struct {
+		query string
+		want  []string
+	}{
+		{"filter.age=30", []string{"t1"}},
+		{"filter.age=" + url.QueryEscape(`"30"`), []string{"t2"}},
+		{"filter.age=30.5", []string{"t3"}},
+		{"filter.name=ann", []string{"t1"}},
+		{"filter.name=true", nil},
+		{"filter.name=" + url.QueryEscape(`"true"`), []string{"t2"}},
+		{"filter.at=" + url.QueryEscape(
+			`{"$timestamp": "2024-01-02T03:04:05Z"}`), []string{"t1"}},
+	} {
+		w, body := serve(router, http.MethodGet, "/things?"+test.query, "")
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d: %s", test.query, w.Code, body)
+			continue
+		}
+		var got []string
+		list, _ := decodeJSON(t, body).(map[string]interface{})
+		items, _ := list["items"].([]interface{})
+		for _, item := range items {
+			got = append(got, item.(map[string]interface{})["$id"].(string))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s matched %v, want %v", test.query, got, test.want)
+		}
+	}
+	w, body := serve(router, http.MethodGet, "/things?filter.at="+
+		url.QueryEscape(`{"$timestamp": "yesterday"}`), "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("filter on a malformed timestamp: status %d: %s", w.Code, body)
+	}
+}
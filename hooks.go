@@ -0,0 +1,229 @@
+package rest2firestore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Hooks are called around the operations of FirestoreDb, and of the TxDb
+// of its transactions, on the documents of a collection. Any of them may
+// be nil. An error from a hook aborts the operation and is returned
+// wrapped, so errors.Is still matches it; a panic is recovered like one
+// from an Object. Hooks run inside a transaction may run again when it is
+// retried.
+type Hooks struct {
+	// BeforeCreate may change obj before it is validated and added to
+	// collection by Post, FindOrCreate or BatchPost. It only runs once the
+	// search found nothing; for a QuerySearcher that is inside the
+	// create's transaction.
+	BeforeCreate func(ctx context.Context, collection []string,
+		obj Object) error
+	// AfterPost sees the object Post, FindOrCreate or BatchPost returns
+	// from document, with created reporting whether it was created rather
+	// than found. For a QuerySearcher the indicator is exact, so side
+	// effects of a creation belong behind it. Its error is returned, but
+	// the document stays written; in a TxDb it runs before the commit.
+	AfterPost func(ctx context.Context, document []string, obj Object,
+		created bool) error
+	// BeforeUpdate may change obj before it is validated and written over
+	// document by Put, PutIf, Merge or Patch.
+	BeforeUpdate func(ctx context.Context, document []string,
+		obj Object) error
+	// BeforePatchFields may change fields before PatchFields or
+	// PatchFieldsIf applies them.
+	BeforePatchFields func(ctx context.Context, document []string,
+		fields map[string]interface{}) error
+	// AfterGet sees every object read back by document: by Get, and by
+	// the writes that return what they wrote. It may return a different
+	// object. Lists do not pass through it.
+	AfterGet func(ctx context.Context, document []string,
+		obj Object) (Object, error)
+	// BeforeDelete is called for every document Delete, DeleteIf or Clear
+	// removes, those of subcollections included, before it is removed or
+	// moved to the trash. PlanDelete and PlanClear do not call it.
+	BeforeDelete func(ctx context.Context, document []string) error
+}
+
+var hooks_mu sync.RWMutex
+
+type hookEntry struct {
+	// pattern is nil for hooks on every collection.
+	pattern []string
+	hooks   Hooks
+}
+
+// AddHooks registers hooks for documents in the collections matching
+// pattern, such as "users/{user}/posts", where a segment in braces matches
+// any ID, or in all collections when pattern is empty. Hooks for all
+// collections run first, then in the order they were added. It panics on
+// an invalid pattern.
+func (db *FirestoreDb) AddHooks(pattern string, hooks Hooks) {
+	entry := hookEntry{hooks: hooks}
+	if pattern = strings.Trim(pattern, "/"); pattern != "" {
+		entry.pattern = strings.Split(pattern, "/")
+		if _, err := getCollectionPath(entry.pattern, true); err != nil {
+			panic(fmt.Sprintf("rest2firestore: AddHooks: %v", err))
+		}
+	}
+	hooks_mu.Lock()
+	defer hooks_mu.Unlock()
+	// Copied, so copies of db made before do not share the new entry.
+	db.hooks = append(db.hooks[:len(db.hooks):len(db.hooks)], entry)
+}
+
+func (db *FirestoreDb) hooksFor(collection []string) []Hooks {
+	hooks_mu.RLock()
+	defer hooks_mu.RUnlock()
+	if len(db.hooks) == 0 || len(collection) == 0 {
+		return nil
+	}
+	var global, matched []Hooks
+	for _, entry := range db.hooks {
+		switch {
+		case entry.pattern == nil:
+			global = append(global, entry.hooks)
+		case matchPattern(entry.pattern, collection):
+			matched = append(matched, entry.hooks)
+		}
+	}
+	return append(global, matched...)
+}
+
+// matchPattern reports whether segments match pattern, where a segment in
+// braces matches any ID.
+func matchPattern(pattern, segments []string) bool {
+	if len(pattern) != len(segments) {
+		return false
+	}
+	for i, part := range pattern {
+		if !isPatternParam(part) && part != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func isPatternParam(part string) bool {
+	return strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}")
+}
+
+func runHook(op, hook, path string, fn func() error) (err error) {
+	defer recoverCallback(op, hook, path, &err)
+	if err := fn(); err != nil {
+		return fmt.Errorf("%s:%s - %s: %w", path, op, hook, err)
+	}
+	return nil
+}
+
+func (db *FirestoreDb) beforeCreate(ctx context.Context, op string,
+	collection []string, obj ObjectV2) error {
+	collection_path := path.Join(collection...)
+	for _, hooks := range db.hooksFor(collection) {
+		if hooks.BeforeCreate == nil {
+			continue
+		}
+		err := runHook(op, "BeforeCreate", collection_path, func() error {
+			return hooks.BeforeCreate(ctx, collection, AdaptV2(obj))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *FirestoreDb) afterPost(ctx context.Context, op string,
+	document []string, obj ObjectV2, created bool) error {
+	document_path := path.Join(document...)
+	for _, hooks := range db.hooksFor(document[:len(document)-1]) {
+		if hooks.AfterPost == nil {
+			continue
+		}
+		err := runHook(op, "AfterPost", document_path, func() error {
+			return hooks.AfterPost(ctx, document, AdaptV2(obj), created)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *FirestoreDb) beforeUpdate(ctx context.Context, op string,
+	document []string, obj ObjectV2) error {
+	document_path := path.Join(document...)
+	for _, hooks := range db.hooksFor(document[:len(document)-1]) {
+		if hooks.BeforeUpdate == nil {
+			continue
+		}
+		err := runHook(op, "BeforeUpdate", document_path, func() error {
+			return hooks.BeforeUpdate(ctx, document, AdaptV2(obj))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// beforePatchFields returns fields as the hooks left them, allocating the
+// map if it was nil so that hooks can add to it.
+func (db *FirestoreDb) beforePatchFields(ctx context.Context, op string,
+	document []string, fields map[string]interface{}) (
+	map[string]interface{}, error) {
+	document_path := path.Join(document...)
+	for _, hooks := range db.hooksFor(document[:len(document)-1]) {
+		if hooks.BeforePatchFields == nil {
+			continue
+		}
+		if fields == nil {
+			fields = map[string]interface{}{}
+		}
+		err := runHook(op, "BeforePatchFields", document_path, func() error {
+			return hooks.BeforePatchFields(ctx, document, fields)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
+
+func (db *FirestoreDb) afterGet(ctx context.Context, op string,
+	document []string, obj ObjectV2) (ObjectV2, error) {
+	document_path := path.Join(document...)
+	for _, hooks := range db.hooksFor(document[:len(document)-1]) {
+		if hooks.AfterGet == nil {
+			continue
+		}
+		err := runHook(op, "AfterGet", document_path, func() error {
+			result, err := hooks.AfterGet(ctx, document, AdaptV2(obj))
+			obj = AdaptLegacy(result)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
+func (db *FirestoreDb) beforeDelete(ctx context.Context, op string,
+	document []string) error {
+	document_path := path.Join(document...)
+	for _, hooks := range db.hooksFor(document[:len(document)-1]) {
+		if hooks.BeforeDelete == nil {
+			continue
+		}
+		err := runHook(op, "BeforeDelete", document_path, func() error {
+			return hooks.BeforeDelete(ctx, document)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
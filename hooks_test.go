@@ -0,0 +1,89 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestHooksOrderAndPatterns(t *testing.T) {
+	db := emulatorDb(t)
+	collection := testCollection("users")
+	var calls []string
+	record := func(name string) Hooks {
+		return Hooks{
+			BeforeUpdate: func(ctx context.Context, document []string,
+				obj Object) error {
+				calls = append(calls, name)
+				Underlying(obj).(*testUser).Name = name
+				return nil
+			},
+		}
+	}
+	db.AddHooks(collection[0], record("first"))
+	db.AddHooks(collection[0]+"/{user}/posts", record("posts"))
+	db.AddHooks("{collection}", record("second"))
+	db.AddHooks("", record("global"))
+	want := []string{"global", "first", "second"}
+	document := append(collection, "u1")
+	for _, op := range []string{"Put", "Merge"} {
+		calls = nil
+		user := AdaptV2(&testUser{Email: "a@example.com", Name: "caller"})
+		var err error
+		if op == "Put" {
+			_, err = db.Put(context.Background(), user, document)
+		} else {
+			_, err = db.Merge(context.Background(), user, document,
+				[]string{"name"})
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", op, err)
+		}
+		if !reflect.DeepEqual(calls, want) {
+			t.Errorf("%s ran BeforeUpdate hooks %v, want %v", op, calls, want)
+		}
+		got, err := db.Get(context.Background(), AdaptV2(&testUser{}), document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := Underlying(got).(*testUser).Name; name != "second" {
+			t.Errorf("%s stored name %q, want the last hook's %q",
+				op, name, "second")
+		}
+	}
+}
+
+func TestHookErrorAbortsWrite(t *testing.T) {
+	db := emulatorDb(t)
+	collection := testCollection("users")
+	document := append(collection, "u1")
+	_, err := db.Put(context.Background(),
+		AdaptV2(&testUser{Email: "a@example.com", Name: "before"}), document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := errors.New("refused")
+	db.AddHooks(collection[0], Hooks{
+		BeforeUpdate: func(ctx context.Context, document []string,
+			obj Object) error {
+			return refused
+		},
+	})
+	user := AdaptV2(&testUser{Email: "a@example.com", Name: "after"})
+	if _, err := db.Put(context.Background(), user, document); !errors.Is(
+		err, refused) {
+		t.Errorf("Put: %v, want the hook's error", err)
+	}
+	_, err = db.Merge(context.Background(), user, document, []string{"name"})
+	if !errors.Is(err, refused) {
+		t.Errorf("Merge: %v, want the hook's error", err)
+	}
+	got, err := db.Get(context.Background(), AdaptV2(&testUser{}), document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := Underlying(got).(*testUser).Name; name != "before" {
+		t.Errorf("stored name %q after aborted writes, want %q", name, "before")
+	}
+}
@@ -0,0 +1,67 @@
+package rest2firestore
+
+import (
+	"context"
+	"strings"
+)
+
+// Locator is the optional capability of a Db to find the document obj's
+// Search, or for MemoryDb its Matcher, points at without reading it. It
+// fails with ErrNotFound when there is none. Wrappers use it to learn the
+// document a Patch will write.
+type Locator interface {
+	Locate(ctx context.Context, obj Object) ([]string, error)
+}
+
+// PathPoster is the optional capability of a Db to return the document
+// FindOrCreate found or created along with it. Router uses it for the
+// Location of a created document.
+type PathPoster interface {
+	FindOrCreatePath(ctx context.Context, obj Object, collection []string) (
+		Object, []string, bool, error)
+}
+
+var (
+	_ Locator    = &FirestoreDb{}
+	_ Locator    = &MemoryDb{}
+	_ PathPoster = &FirestoreDb{}
+	_ PathPoster = &MemoryDb{}
+)
+
+func (db *FirestoreDb) Locate(
+	ctx context.Context, obj Object) ([]string, error) {
+	o := AdaptLegacy(obj)
+	var document []string
+	client := db.nextClient()
+	query, ok, err := safeSearchQuery("Locate", "", o, client)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		docs, err := query.Limit(1).Documents(ctx).GetAll()
+		if err != nil {
+			return nil, dbError("Locate", "", "could not search object", err)
+		}
+		if len(docs) > 0 {
+			document = strings.Split(documentRefPath(docs[0].Ref), "/")
+		}
+	} else if document, err = safeSearch(
+		ctx, "Locate", "", o, client); err != nil {
+		return nil, err
+	}
+	if len(document) == 0 {
+		return nil, dbError("Locate", "", "could not find object", ErrNotFound)
+	}
+	if _, _, err := getDocumentPath(document, db.allow_reserved); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+func (m *MemoryDb) Locate(ctx context.Context, obj Object) ([]string, error) {
+	document := m.find(AdaptLegacy(obj), "")
+	if document == nil {
+		return nil, dbError("Locate", "", "could not find object", ErrNotFound)
+	}
+	return document, nil
+}
@@ -0,0 +1,867 @@
+package rest2firestore
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Matcher is MemoryDb's stand-in for Search, which cannot run against
+// memory: Post uses the first document of the collection that obj Matches,
+// Patch the first of those stored with obj's type.
+type Matcher interface {
+	Matches(other Object) bool
+}
+
+// MemoryDb is a Db held in a map keyed by document path, for unit tests of
+// code that depends on Db. It shares FirestoreDb's path validation,
+// callbacks and Delete semantics: only declared subcollections are
+// deleted. Stored objects are shallow copies of what was written. Each
+// write also encodes its object as Firestore would, server timestamps
+// included, and reads pass that snapshot to Deserialize, so CreateTime and
+// UpdateTime only change with writes.
+//
+// It is not a full stand-in for FirestoreDb. These FirestoreDb features are
+// not available on it: hooks, the trash, append-only collections, ancestor
+// keys, and conditional writes, since it is not a ConditionalDb.
+type MemoryDb struct {
+	// NewID generates document IDs for Post. The default mimics Firestore's
+	// 20 character random IDs.
+	NewID func() string
+
+	mu sync.RWMutex
+	// post_mu serialises FindOrCreate, so its match and create are atomic.
+	post_mu sync.Mutex
+	docs    map[string]ObjectV2
+	// snaps holds the snapshot of each of docs as written.
+	snaps      map[string]*firestore.DocumentSnapshot
+	snapshots  memorySnapshots
+	prototypes *prototypeChecks
+}
+
+var _ Db = &MemoryDb{}
+
+func NewMemoryDb() *MemoryDb {
+	return &MemoryDb{NewID: randomID, docs: map[string]ObjectV2{},
+		snaps:      map[string]*firestore.DocumentSnapshot{},
+		prototypes: &prototypeChecks{}}
+}
+
+const id_alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+func randomID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = id_alphabet[int(b[i])%len(id_alphabet)]
+	}
+	return string(b)
+}
+
+func cloneValue(value interface{}) interface{} {
+	if raw, ok := value.(*RawObject); ok {
+		data := make(map[string]interface{}, len(raw.Data))
+		for key, item := range raw.Data {
+			data[key] = item
+		}
+		return &RawObject{ID: raw.ID, Data: data, Client: raw.Client}
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.IsNil() ||
+		v.Elem().Kind() != reflect.Struct {
+		return value
+	}
+	clone := reflect.New(v.Elem().Type())
+	clone.Elem().Set(v.Elem())
+	return clone.Interface()
+}
+
+// cloner is an ObjectV2 wrapper that knows how to copy what it stores.
+type cloner interface {
+	clone() ObjectV2
+}
+
+func cloneObject(obj ObjectV2) ObjectV2 {
+	if c, ok := obj.(cloner); ok {
+		return c.clone()
+	}
+	if adapted, ok := obj.(legacyObject); ok {
+		return legacyObject{obj: cloneValue(adapted.obj).(Object)}
+	}
+	return cloneValue(obj).(ObjectV2)
+}
+
+// store writes a copy of obj at document_path along with its snapshot.
+// CreateTime is kept over overwrites. Callers hold mu.
+func (m *MemoryDb) store(ctx context.Context, op, document_path string,
+	obj ObjectV2) error {
+	clone := cloneObject(obj)
+	docs, err := m.snapshots.encode(ctx, op, []string{document_path},
+		[]interface{}{storedValue(clone)})
+	if err != nil {
+		return err
+	}
+	if previous, ok := m.snaps[document_path]; ok {
+		docs[0].CreateTime = previous.CreateTime
+	}
+	m.docs[document_path] = clone
+	m.snaps[document_path] = docs[0]
+	return nil
+}
+
+func memoryNotFound(op, document_path string) error {
+	return dbError(op, document_path, "could not get object",
+		status.Error(codes.NotFound, "document not found"))
+}
+
+// children returns the IDs of the documents directly in collection_path,
+// sorted. Callers hold mu.
+func (m *MemoryDb) children(collection_path string) []string {
+	prefix := collection_path + "/"
+	var ids []string
+	for document_path := range m.docs {
+		id := strings.TrimPrefix(document_path, prefix)
+		if id != document_path && !strings.Contains(id, "/") {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (m *MemoryDb) Count(
+	ctx context.Context, collection []string) (int64, error) {
+	collection_path, err := getCollectionPath(collection, false)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int64(len(m.children(collection_path))), nil
+}
+
+// find returns the first document of collection_path that obj Matches.
+// Patch has no collection, so with collection_path empty it looks at every
+// document stored with the same type as obj.
+func (m *MemoryDb) find(obj ObjectV2, collection_path string) []string {
+	value := storedValue(obj)
+	matcher, ok := value.(Matcher)
+	if !ok {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var paths []string
+	if collection_path != "" {
+		for _, id := range m.children(collection_path) {
+			paths = append(paths, collection_path+"/"+id)
+		}
+	} else {
+		kind := reflect.TypeOf(value)
+		for document_path, stored := range m.docs {
+			if reflect.TypeOf(storedValue(stored)) == kind &&
+				!isReservedPath(strings.Split(document_path, "/")) {
+				paths = append(paths, document_path)
+			}
+		}
+		sort.Strings(paths)
+	}
+	for _, document_path := range paths {
+		if matcher.Matches(AdaptV2(cloneObject(m.docs[document_path]))) {
+			return strings.Split(document_path, "/")
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDb) List(
+	ctx context.Context, obj Object, collection []string) ([]Object, error) {
+	objs, _, err := m.ListWithQuery(ctx, obj, collection, nil)
+	return objs, err
+}
+
+func (m *MemoryDb) ListWithQuery(ctx context.Context, obj Object,
+	collection []string, q *ListQuery) ([]Object, string, error) {
+	proto := AdaptLegacy(obj)
+	collection_path, err := getCollectionPath(collection, false)
+	if err != nil {
+		return nil, "", err
+	}
+	if q != nil {
+		if err := q.validate(collection_path); err != nil {
+			return nil, "", err
+		}
+	}
+	m.mu.RLock()
+	var ids []string
+	var objs []ObjectV2
+	snaps := map[string]*firestore.DocumentSnapshot{}
+	for _, id := range m.children(collection_path) {
+		document_path := collection_path + "/" + id
+		stored := m.docs[document_path]
+		if q == nil || q.matches(stored) {
+			ids = append(ids, id)
+			objs = append(objs, stored)
+			snaps[id] = m.snaps[document_path]
+		}
+	}
+	m.mu.RUnlock()
+	cursor := ""
+	if q != nil {
+		ids, _, cursor, err = q.page(collection_path, ids, objs)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	if len(ids) == 0 {
+		return nil, "", nil
+	}
+	paths := make([]string, len(ids))
+	docs := make([]*firestore.DocumentSnapshot, len(ids))
+	for i, id := range ids {
+		paths[i] = collection_path + "/" + id
+		docs[i] = snaps[id]
+	}
+	if q != nil {
+		if docs, err = m.project(ctx, q, paths, docs); err != nil {
+			return nil, "", err
+		}
+	}
+	result, err := m.deserializeList("List", collection_path, proto, docs)
+	return adaptV2List(result), cursor, err
+}
+
+// deserializeList reads docs back through proto the way FirestoreDb reads
+// a query.
+func (m *MemoryDb) deserializeList(op, path string, proto ObjectV2,
+	docs []*firestore.DocumentSnapshot) ([]ObjectV2, error) {
+	objs, err := safeDeserializeList(op, path, proto, docs)
+	if err != nil {
+		return nil, err
+	}
+	return safePostprocessList(op, path, proto, objs)
+}
+
+func (m *MemoryDb) ListGroup(
+	ctx context.Context, obj Object, collection_id string) ([]Object, error) {
+	return m.listGroup(ctx, obj, "", collection_id)
+}
+
+func (m *MemoryDb) ListGroupUnder(ctx context.Context, obj Object,
+	parent []string, collection_id string) ([]Object, error) {
+	collection_path, document_id, err := getDocumentPath(parent, false)
+	if err != nil {
+		return nil, err
+	}
+	return m.listGroup(ctx, obj, path.Join(collection_path, document_id)+"/",
+		collection_id)
+}
+
+func (m *MemoryDb) listGroup(ctx context.Context, obj Object,
+	prefix, collection_id string) ([]Object, error) {
+	proto := AdaptLegacy(obj)
+	if err := checkCollectionID(collection_id, false); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	var paths []string
+	for document_path := range m.docs {
+		document := strings.Split(document_path, "/")
+		if document[len(document)-2] == collection_id &&
+			strings.HasPrefix(document_path, prefix) &&
+			!isReservedPath(document) {
+			paths = append(paths, document_path)
+		}
+	}
+	sort.Strings(paths)
+	docs := make([]*firestore.DocumentSnapshot, 0, len(paths))
+	for _, document_path := range paths {
+		docs = append(docs, m.snaps[document_path])
+	}
+	m.mu.RUnlock()
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	objs, err := m.deserializeList("ListGroup", collection_id, proto, docs)
+	return adaptV2List(objs), err
+}
+
+func (m *MemoryDb) Clear(
+	ctx context.Context, dummy Object, collection []string) error {
+	obj := AdaptLegacy(dummy)
+	if err := m.prototypes.check(obj); err != nil {
+		return err
+	}
+	return m.clear(ctx, obj, collection)
+}
+
+func (m *MemoryDb) clear(
+	ctx context.Context, dummy ObjectV2, collection []string) error {
+	collection_path, err := getCollectionPath(collection, false)
+	if err != nil {
+		return err
+	}
+	m.mu.RLock()
+	ids := m.children(collection_path)
+	m.mu.RUnlock()
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return dbError("Clear", collection_path, "interrupted", err)
+		}
+		document := append(collection[:len(collection):len(collection)], id)
+		if err := m.delete(ctx, dummy, document); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDb) Post(
+	ctx context.Context, obj Object, collection []string) (Object, error) {
+	result, _, err := m.FindOrCreate(ctx, obj, collection)
+	return result, err
+}
+
+func (m *MemoryDb) FindOrCreate(
+	ctx context.Context, obj Object, collection []string) (
+	Object, bool, error) {
+	result, _, created, err := m.FindOrCreatePath(ctx, obj, collection)
+	return result, created, err
+}
+
+// FindOrCreatePath is FindOrCreate that also returns the document. The
+// match and the create are atomic.
+func (m *MemoryDb) FindOrCreatePath(
+	ctx context.Context, obj Object, collection []string) (
+	Object, []string, bool, error) {
+	o := AdaptLegacy(obj)
+	collection_path, err := getCollectionPath(collection, false)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	m.post_mu.Lock()
+	defer m.post_mu.Unlock()
+	if existing := m.find(o, collection_path); existing != nil {
+		result, err := m.Get(ctx, obj, existing)
+		return result, existing, false, err
+	}
+	if err := safeValidate("Post", collection_path, o); err != nil {
+		return nil, nil, false, err
+	}
+	if err := safeSerialize("Post", collection_path, o); err != nil {
+		return nil, nil, false, err
+	}
+	document := append(collection[:len(collection):len(collection)], m.NewID())
+	m.mu.Lock()
+	err = m.store(ctx, "Post", path.Join(document...), o)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	result, err := m.Get(ctx, obj, document)
+	return result, document, true, err
+}
+
+func (m *MemoryDb) Put(
+	ctx context.Context, obj Object, document []string) (Object, error) {
+	o := AdaptLegacy(obj)
+	if _, _, err := getDocumentPath(document, false); err != nil {
+		return nil, err
+	}
+	document_path := path.Join(document...)
+	if err := safeValidate("Put", document_path, o); err != nil {
+		return nil, err
+	}
+	if err := safeSerialize("Put", document_path, o); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	err := m.store(ctx, "Put", document_path, o)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return m.Get(ctx, obj, document)
+}
+
+func (m *MemoryDb) Patch(ctx context.Context, obj Object) (Object, error) {
+	o := AdaptLegacy(obj)
+	existing := m.find(o, "")
+	if existing == nil {
+		return nil, dbError("Patch", "", "could not find object", ErrNotFound)
+	}
+	document_path := path.Join(existing...)
+	if err := safeValidate("Patch", document_path, o); err != nil {
+		return nil, err
+	}
+	if err := safeSerialize("Patch", document_path, o); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	if _, ok := m.docs[document_path]; !ok {
+		m.mu.Unlock()
+		return nil, memoryNotFound("Patch", document_path)
+	}
+	err := m.store(ctx, "Patch", document_path, o)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return m.Get(ctx, obj, existing)
+}
+
+func (m *MemoryDb) PatchFields(ctx context.Context, dummy Object,
+	document []string, fields map[string]interface{}) (Object, error) {
+	if _, _, err := getDocumentPath(document, false); err != nil {
+		return nil, err
+	}
+	document_path := path.Join(document...)
+	updates, err := fieldUpdates(document_path, fields, false)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	stored, ok := m.docs[document_path]
+	if !ok {
+		m.mu.Unlock()
+		return nil, memoryNotFound("PatchFields", document_path)
+	}
+	patched := cloneObject(stored)
+	for _, update := range updates {
+		err := setMemoryField(
+			storedValue(patched), update.FieldPath, update.Value)
+		if err != nil {
+			m.mu.Unlock()
+			return nil, dbError(
+				"PatchFields", document_path, "could not update object", err)
+		}
+	}
+	err = m.store(ctx, "PatchFields", document_path, patched)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return m.Get(ctx, dummy, document)
+}
+
+func (m *MemoryDb) Get(
+	ctx context.Context, dummy Object, document []string) (Object, error) {
+	if _, _, err := getDocumentPath(document, false); err != nil {
+		return nil, err
+	}
+	document_path := path.Join(document...)
+	m.mu.RLock()
+	doc, ok := m.snaps[document_path]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, memoryNotFound("Get", document_path)
+	}
+	result, err :=
+		safeDeserialize("Get", document_path, AdaptLegacy(dummy), doc)
+	return AdaptV2(result), err
+}
+
+func (m *MemoryDb) Delete(
+	ctx context.Context, dummy Object, document []string) error {
+	obj := AdaptLegacy(dummy)
+	if err := m.prototypes.check(obj); err != nil {
+		return err
+	}
+	return m.delete(ctx, obj, document)
+}
+
+func (m *MemoryDb) delete(
+	ctx context.Context, dummy ObjectV2, document []string) error {
+	if _, _, err := getDocumentPath(document, false); err != nil {
+		return err
+	}
+	document_path := path.Join(document...)
+	subcollections, err := safeSubcollections("Delete", document_path, dummy)
+	if err != nil {
+		return err
+	}
+	for _, subcollection := range subcollections {
+		if isReservedName(subcollection.Name) {
+			continue
+		}
+		err := m.clear(ctx, AdaptLegacy(subcollection.Obj),
+			append(document[:len(document):len(document)], subcollection.Name))
+		if err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	delete(m.docs, document_path)
+	delete(m.snaps, document_path)
+	m.mu.Unlock()
+	return nil
+}
+
+// memoryField reads a dotted field path from a stored object, matching
+// struct fields by their firestore tag.
+func memoryField(obj ObjectV2, field_path string) (interface{}, bool) {
+	var value interface{} = storedValue(obj)
+	for _, name := range strings.Split(field_path, ".") {
+		if data, ok := value.(map[string]interface{}); ok {
+			if value, ok = data[name]; !ok {
+				return nil, false
+			}
+			continue
+		}
+		field, ok := storedField(value, name)
+		if !ok {
+			return nil, false
+		}
+		value = field.Interface()
+	}
+	return value, true
+}
+
+// compareValues orders numbers, strings, booleans and times the way
+// Firestore does within one type. ok is false for values of different or
+// unordered types.
+func compareValues(a, b interface{}) (result int, ok bool) {
+	sign := func(less, greater bool) int {
+		if less {
+			return -1
+		}
+		if greater {
+			return 1
+		}
+		return 0
+	}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if isNumberValue(va) && isNumberValue(vb) {
+		fa, fb := numberValue(va), numberValue(vb)
+		return sign(fa < fb, fa > fb), true
+	}
+	switch a := a.(type) {
+	case string:
+		if b, is := b.(string); is {
+			return sign(a < b, a > b), true
+		}
+	case bool:
+		if b, is := b.(bool); is {
+			return sign(!a && b, a && !b), true
+		}
+	case time.Time:
+		if b, is := b.(time.Time); is {
+			return sign(a.Before(b), a.After(b)), true
+		}
+	}
+	return 0, false
+}
+
+func isNumberValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
+		reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func numberValue(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return float64(v.Uint())
+	}
+	return float64(v.Int())
+}
+
+func equalValues(a, b interface{}) bool {
+	if result, ok := compareValues(a, b); ok {
+		return result == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func containsValue(list, value interface{}) bool {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return false
+	}
+	for i := 0; i < v.Len(); i++ {
+		if equalValues(v.Index(i).Interface(), value) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(list, values interface{}) bool {
+	v := reflect.ValueOf(values)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return false
+	}
+	for i := 0; i < v.Len(); i++ {
+		if containsValue(list, v.Index(i).Interface()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f Filter) matches(obj ObjectV2) bool {
+	value, ok := memoryField(obj, f.Path)
+	if !ok {
+		return false
+	}
+	switch f.Op {
+	case "==":
+		return equalValues(value, f.Value)
+	case "!=":
+		return !equalValues(value, f.Value)
+	case "in":
+		return containsValue(f.Value, value)
+	case "not-in":
+		return !containsValue(f.Value, value)
+	case "array-contains":
+		return containsValue(value, f.Value)
+	case "array-contains-any":
+		return containsAny(value, f.Value)
+	}
+	result, ok := compareValues(value, f.Value)
+	if !ok {
+		return false
+	}
+	switch f.Op {
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	}
+	return result >= 0
+}
+
+// matches also drops documents missing an ordered field, as Firestore
+// does.
+func (q *ListQuery) matches(obj ObjectV2) bool {
+	for _, filter := range q.Filters {
+		if !filter.matches(obj) {
+			return false
+		}
+	}
+	for _, order := range q.OrderBy {
+		if _, ok := memoryField(obj, order.Path); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// position is a document's ordering values followed by its ID.
+func (q *ListQuery) position(obj ObjectV2, id string) []interface{} {
+	values := make([]interface{}, 0, len(q.OrderBy)+1)
+	for _, order := range q.OrderBy {
+		value, _ := memoryField(obj, order.Path)
+		values = append(values, value)
+	}
+	return append(values, id)
+}
+
+func (q *ListQuery) comparePositions(a, b []interface{}) int {
+	for i := range a {
+		if i >= len(b) {
+			return 0
+		}
+		result, _ := compareValues(a[i], b[i])
+		if i < len(q.OrderBy) && q.OrderBy[i].Desc {
+			result = -result
+		}
+		if result != 0 {
+			return result
+		}
+	}
+	return 0
+}
+
+// page sorts, positions and limits matching documents in memory the way
+// apply does in a firestore query.
+func (q *ListQuery) page(collection_path string, ids []string,
+	objs []ObjectV2) ([]string, []ObjectV2, string, error) {
+	positions := make([][]interface{}, len(ids))
+	order := make([]int, len(ids))
+	for i := range ids {
+		positions[i] = q.position(objs[i], ids[i])
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return q.comparePositions(positions[order[i]], positions[order[j]]) < 0
+	})
+	var after []interface{}
+	if q.Cursor != "" {
+		values, err := decodeCursor(nil, q.Cursor)
+		if err != nil || len(values) != len(q.OrderBy)+1 {
+			return nil, nil, "", fmt.Errorf("%s:List - malformed cursor: %w",
+				collection_path, ErrInvalidQuery)
+		}
+		after = values
+	} else if len(q.StartAfter) > 0 {
+		after = q.StartAfter
+	}
+	var page_ids []string
+	var page []ObjectV2
+	skipped := 0
+	for _, i := range order {
+		if after != nil && q.comparePositions(positions[i], after) <= 0 {
+			continue
+		}
+		if skipped < q.Offset {
+			skipped++
+			continue
+		}
+		if q.Limit > 0 && len(page) == q.Limit {
+			break
+		}
+		page_ids = append(page_ids, ids[i])
+		page = append(page, objs[i])
+	}
+	cursor := ""
+	if q.Limit > 0 && len(page) == q.Limit {
+		id := page_ids[len(page_ids)-1]
+		last := q.position(page[len(page)-1], id)
+		var err error
+		cursor, err = encodeCursor(last[:len(last)-1], id)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf(
+				"%s:List - could not build cursor: %w", collection_path, err)
+		}
+	}
+	return page_ids, page, cursor, nil
+}
+
+// project re-encodes docs with only the top-level fields Select keeps. A
+// nested path keeps its whole top-level field.
+func (m *MemoryDb) project(ctx context.Context, q *ListQuery,
+	paths []string, docs []*firestore.DocumentSnapshot) (
+	[]*firestore.DocumentSnapshot, error) {
+	if len(q.Select) == 0 {
+		return docs, nil
+	}
+	keep := map[string]bool{}
+	for _, field := range q.selected() {
+		keep[strings.SplitN(field, ".", 2)[0]] = true
+	}
+	values := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		data := doc.Data()
+		for name := range data {
+			if !keep[name] {
+				delete(data, name)
+			}
+		}
+		values[i] = data
+	}
+	projected, err := m.snapshots.encode(ctx, "List", paths, values)
+	if err != nil {
+		return nil, err
+	}
+	for i, doc := range projected {
+		doc.CreateTime, doc.UpdateTime = docs[i].CreateTime, docs[i].UpdateTime
+	}
+	return projected, nil
+}
+
+// setMemoryField applies one PatchFields update to a stored value. Nested
+// maps are copied before they are changed, since clones share them.
+func setMemoryField(
+	value interface{}, field_path []string, update interface{}) error {
+	if update == firestore.ServerTimestamp {
+		update = time.Now().UTC()
+	}
+	if data, ok := value.(map[string]interface{}); ok {
+		return setMapField(data, field_path, update)
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("%T cannot be patched", value)
+	}
+	field, ok := storedField(value, field_path[0])
+	if !ok || !field.CanSet() {
+		return fmt.Errorf("%T has no field %s", value, field_path[0])
+	}
+	if len(field_path) > 1 {
+		switch {
+		case field.Kind() == reflect.Ptr &&
+			field.Type().Elem().Kind() == reflect.Struct:
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			return setMemoryField(field.Interface(), field_path[1:], update)
+		case field.Kind() == reflect.Struct:
+			return setMemoryField(
+				field.Addr().Interface(), field_path[1:], update)
+		}
+		data, ok := field.Interface().(map[string]interface{})
+		if !ok && !field.IsZero() {
+			return fmt.Errorf("%s is not a map", field_path[0])
+		}
+		copied := make(map[string]interface{}, len(data)+1)
+		for key, item := range data {
+			copied[key] = item
+		}
+		if err := setMapField(copied, field_path[1:], update); err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(copied))
+		return nil
+	}
+	u := reflect.ValueOf(update)
+	switch {
+	case update == firestore.Delete || !u.IsValid():
+		field.Set(reflect.Zero(field.Type()))
+	case u.Type().AssignableTo(field.Type()):
+		field.Set(u)
+	case isNumberValue(u) && isNumberValue(field):
+		field.Set(u.Convert(field.Type()))
+	default:
+		return fmt.Errorf("cannot set %s, a %s, to %T",
+			field_path[0], field.Type(), update)
+	}
+	return nil
+}
+
+func setMapField(data map[string]interface{}, field_path []string,
+	update interface{}) error {
+	name := field_path[0]
+	if len(field_path) == 1 {
+		if update == firestore.Delete {
+			delete(data, name)
+		} else {
+			data[name] = update
+		}
+		return nil
+	}
+	child, ok := data[name].(map[string]interface{})
+	if !ok && data[name] != nil {
+		return fmt.Errorf("%s is not a map", name)
+	}
+	copied := make(map[string]interface{}, len(child)+1)
+	for key, item := range child {
+		copied[key] = item
+	}
+	if err := setMapField(copied, field_path[1:], update); err != nil {
+		return err
+	}
+	data[name] = copied
+	return nil
+}
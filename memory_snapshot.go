@@ -0,0 +1,250 @@
+package rest2firestore
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	memory_project     = "memory"
+	memory_read_header = "x-memory-read"
+)
+
+// memorySnapshots turns stored objects into real DocumentSnapshots, so
+// that MemoryDb reads go through Deserialize like those of FirestoreDb.
+// MemoryDb encodes each object once, when it is written, by writing it to
+// an in-process Firestore server and reading it back; the server only
+// keeps it for that encoding.
+type memorySnapshots struct {
+	once   sync.Once
+	client *firestore.Client
+	server *memoryServer
+	err    error
+}
+
+func (s *memorySnapshots) start() (*firestore.Client, error) {
+	s.once.Do(func() {
+		s.server = &memoryServer{
+			reads: map[string]map[string]*firestorepb.Document{}}
+		listener := bufconn.Listen(1 << 20)
+		server := grpc.NewServer()
+		firestorepb.RegisterFirestoreServer(server, s.server)
+		go server.Serve(listener)
+		conn, err := grpc.NewClient("passthrough:///"+memory_project,
+			grpc.WithContextDialer(
+				func(ctx context.Context, _ string) (net.Conn, error) {
+					return listener.DialContext(ctx)
+				}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			s.err = err
+			return
+		}
+		s.client, s.err = firestore.NewClient(context.Background(),
+			memory_project, option.WithGRPCConn(conn))
+	})
+	return s.client, s.err
+}
+
+// encode returns a snapshot of each of values as if stored at paths. Server
+// timestamps are set to the time of the call.
+func (s *memorySnapshots) encode(ctx context.Context, op string,
+	paths []string, values []interface{}) (
+	[]*firestore.DocumentSnapshot, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	client, err := s.start()
+	if err != nil {
+		return nil, dbError(op, paths[0], "could not start snapshots", err)
+	}
+	token := randomID()
+	defer s.server.forget(token)
+	ctx = metadata.AppendToOutgoingContext(ctx, memory_read_header, token)
+	refs := make([]*firestore.DocumentRef, len(paths))
+	for i, document_path := range paths {
+		refs[i] = client.Doc(document_path)
+	}
+	err = client.RunTransaction(ctx,
+		func(ctx context.Context, tx *firestore.Transaction) error {
+			for i, ref := range refs {
+				if err := tx.Set(ref, values[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, dbError(op, paths[0], "could not encode object", err)
+	}
+	docs, err := client.GetAll(ctx, refs)
+	if err != nil {
+		return nil, dbError(op, paths[0], "could not get object", err)
+	}
+	return docs, nil
+}
+
+// memoryServer implements the part of the Firestore API that
+// memorySnapshots.encode uses, keeping documents per read token.
+type memoryServer struct {
+	firestorepb.UnimplementedFirestoreServer
+
+	mu    sync.Mutex
+	reads map[string]map[string]*firestorepb.Document
+}
+
+func readToken(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if tokens := md.Get(memory_read_header); len(tokens) == 1 {
+		return tokens[0], nil
+	}
+	return "", status.Error(codes.InvalidArgument, "missing read token")
+}
+
+func (s *memoryServer) forget(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.reads, token)
+}
+
+func (s *memoryServer) BeginTransaction(ctx context.Context,
+	req *firestorepb.BeginTransactionRequest) (
+	*firestorepb.BeginTransactionResponse, error) {
+	token, err := readToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &firestorepb.BeginTransactionResponse{
+		Transaction: []byte(token)}, nil
+}
+
+func (s *memoryServer) Rollback(ctx context.Context,
+	req *firestorepb.RollbackRequest) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, nil
+}
+
+func (s *memoryServer) Commit(ctx context.Context,
+	req *firestorepb.CommitRequest) (*firestorepb.CommitResponse, error) {
+	token, err := readToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := timestamppb.Now()
+	docs := map[string]*firestorepb.Document{}
+	for _, write := range req.Writes {
+		update := write.GetUpdate()
+		if update == nil || write.UpdateMask != nil {
+			return nil, status.Error(codes.Unimplemented, "only sets")
+		}
+		doc := proto.Clone(update).(*firestorepb.Document)
+		doc.CreateTime, doc.UpdateTime = now, now
+		for _, transform := range write.UpdateTransforms {
+			if transform.GetSetToServerValue() !=
+				firestorepb.DocumentTransform_FieldTransform_REQUEST_TIME {
+				return nil, status.Error(codes.Unimplemented,
+					"only server timestamp transforms")
+			}
+			setProtoField(doc, splitServiceFieldPath(transform.FieldPath),
+				&firestorepb.Value{ValueType: &firestorepb.Value_TimestampValue{
+					TimestampValue: now}})
+		}
+		docs[doc.Name] = doc
+	}
+	s.mu.Lock()
+	s.reads[token] = docs
+	s.mu.Unlock()
+	results := make([]*firestorepb.WriteResult, len(req.Writes))
+	for i := range results {
+		results[i] = &firestorepb.WriteResult{UpdateTime: now}
+	}
+	return &firestorepb.CommitResponse{
+		WriteResults: results, CommitTime: now}, nil
+}
+
+func (s *memoryServer) BatchGetDocuments(
+	req *firestorepb.BatchGetDocumentsRequest,
+	stream firestorepb.Firestore_BatchGetDocumentsServer) error {
+	token, err := readToken(stream.Context())
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	docs := s.reads[token]
+	s.mu.Unlock()
+	now := timestamppb.Now()
+	for _, name := range req.Documents {
+		res := &firestorepb.BatchGetDocumentsResponse{ReadTime: now}
+		if doc, ok := docs[name]; ok {
+			res.Result = &firestorepb.BatchGetDocumentsResponse_Found{
+				Found: doc}
+		} else {
+			res.Result = &firestorepb.BatchGetDocumentsResponse_Missing{
+				Missing: name}
+		}
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitServiceFieldPath splits a field path as the client sends it, where
+// components may be quoted in backticks with backslash escapes.
+func splitServiceFieldPath(field_path string) []string {
+	var parts []string
+	var part strings.Builder
+	quoted, escaped := false, false
+	for _, r := range field_path {
+		switch {
+		case escaped:
+			part.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '`':
+			quoted = !quoted
+		case !quoted && r == '.':
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteRune(r)
+		}
+	}
+	return append(parts, part.String())
+}
+
+func setProtoField(doc *firestorepb.Document, field_path []string,
+	value *firestorepb.Value) {
+	if doc.Fields == nil {
+		doc.Fields = map[string]*firestorepb.Value{}
+	}
+	fields := doc.Fields
+	for _, name := range field_path[:len(field_path)-1] {
+		child := fields[name].GetMapValue()
+		if child == nil {
+			child = &firestorepb.MapValue{}
+			fields[name] = &firestorepb.Value{
+				ValueType: &firestorepb.Value_MapValue{MapValue: child}}
+		}
+		if child.Fields == nil {
+			child.Fields = map[string]*firestorepb.Value{}
+		}
+		fields = child.Fields
+	}
+	fields[field_path[len(field_path)-1]] = value
+}
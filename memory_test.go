@@ -0,0 +1,297 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// testAuthor declares a posts subcollection of testPosts.
+type testAuthor struct {
+	Name string `firestore:"name"`
+}
+
+func (a *testAuthor) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	result := &testAuthor{}
+	return result, doc.DataTo(result)
+}
+
+func (a *testAuthor) Serialize() {
+}
+
+func (a *testAuthor) Subcollections() []Subcollection {
+	return []Subcollection{{Name: "posts", Obj: AdaptV2(&testPost{})}}
+}
+
+type testPost struct {
+	Title string `firestore:"title"`
+}
+
+func (p *testPost) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	result := &testPost{}
+	return result, doc.DataTo(result)
+}
+
+func (p *testPost) Serialize() {
+}
+
+// stampedPost records the timestamps of the snapshot it was read from.
+type stampedPost struct {
+	Title string    `firestore:"title"`
+	Stamp time.Time `firestore:"stamp,serverTimestamp"`
+
+	create_time, update_time time.Time
+}
+
+func (p *stampedPost) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	result := &stampedPost{
+		create_time: doc.CreateTime, update_time: doc.UpdateTime}
+	return result, doc.DataTo(result)
+}
+
+func (p *stampedPost) Serialize() {
+}
+
+// dbFactory makes a Db for one test. Every Db it makes must pass the
+// conformance suite.
+type dbFactory func(t *testing.T) Db
+
+var db_factories = []struct {
+	name    string
+	factory dbFactory
+}{
+	{"Memory", func(t *testing.T) Db { return NewMemoryDb() }},
+	{"Firestore", func(t *testing.T) Db { return emulatorDb(t) }},
+}
+
+// forEachDb runs test against a Db from every factory, with a collection
+// no other test uses.
+func forEachDb(t *testing.T, test func(t *testing.T, db Db,
+	collection []string)) {
+	for _, f := range db_factories {
+		t.Run(f.name, func(t *testing.T) {
+			test(t, f.factory(t), testCollection("users"))
+		})
+	}
+}
+
+func userAt(collection []string, email, name string) Object {
+	return AdaptV2(&testUser{Email: email, Name: name, collection: collection})
+}
+
+func nameOf(t *testing.T, obj Object) string {
+	t.Helper()
+	user, ok := Underlying(obj).(*testUser)
+	if !ok {
+		t.Fatalf("got %T, want *testUser", Underlying(obj))
+	}
+	return user.Name
+}
+
+func TestConformancePost(t *testing.T) {
+	forEachDb(t, func(t *testing.T, db Db, collection []string) {
+		ctx := context.Background()
+		poster := db.(PathPoster)
+		_, alice, created, err := poster.FindOrCreatePath(
+			ctx, userAt(collection, "a@example.com", "Alice"), collection)
+		if err != nil || !created {
+			t.Fatalf("first Post: created %v, %v", created, err)
+		}
+		_, bob, _, err := poster.FindOrCreatePath(
+			ctx, userAt(collection, "b@example.com", "Bob"), collection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, again, created, err := poster.FindOrCreatePath(
+			ctx, userAt(collection, "a@example.com", "Other"), collection)
+		if err != nil || created {
+			t.Fatalf("repeated Post: created %v, %v", created, err)
+		}
+		if path.Join(again...) != path.Join(alice...) ||
+			nameOf(t, result) != "Alice" {
+			t.Errorf("repeated Post found %v %q, want %v Alice",
+				again, nameOf(t, result), alice)
+		}
+
+		dummy := AdaptV2(&testUser{})
+		got, err := db.Get(ctx, dummy, bob)
+		if err != nil || nameOf(t, got) != "Bob" {
+			t.Errorf("Get %v: %v", bob, err)
+		}
+		objs, err := db.List(ctx, dummy, collection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, obj := range objs {
+			names = append(names, nameOf(t, obj))
+		}
+		sort.Strings(names)
+		if len(names) != 2 || names[0] != "Alice" || names[1] != "Bob" {
+			t.Errorf("List returned %v, want [Alice Bob]", names)
+		}
+	})
+}
+
+func TestConformanceUpdate(t *testing.T) {
+	forEachDb(t, func(t *testing.T, db Db, collection []string) {
+		ctx := context.Background()
+		dummy := AdaptV2(&testUser{})
+		document := append(collection, "u1")
+		_, err := db.Put(ctx, userAt(collection, "a@example.com", "Alice"),
+			document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := db.Patch(
+			ctx, userAt(collection, "a@example.com", "Alicia"))
+		if err != nil || nameOf(t, result) != "Alicia" {
+			t.Fatalf("Patch: %v", err)
+		}
+		result, err = db.PatchFields(ctx, dummy, document,
+			map[string]interface{}{"age": int64(30)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		user := Underlying(result).(*testUser)
+		if user.Age != 30 || user.Name != "Alicia" ||
+			user.Email != "a@example.com" {
+			t.Errorf("PatchFields returned %+v", user)
+		}
+		got, err := db.Get(ctx, dummy, document)
+		if err != nil || Underlying(got).(*testUser).Age != 30 {
+			t.Errorf("Get after PatchFields: %+v, %v", got, err)
+		}
+	})
+}
+
+func TestConformanceErrors(t *testing.T) {
+	forEachDb(t, func(t *testing.T, db Db, collection []string) {
+		ctx := context.Background()
+		dummy := AdaptV2(&testUser{})
+		missing := append(collection, "missing")
+		if _, err := db.Get(ctx, dummy, missing); !errors.Is(
+			err, ErrNotFound) {
+			t.Errorf("Get of a missing document: %v, want ErrNotFound", err)
+		}
+		_, err := db.PatchFields(ctx, dummy, missing,
+			map[string]interface{}{"age": int64(1)})
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("PatchFields of a missing document: %v, "+
+				"want ErrNotFound", err)
+		}
+		if _, err := db.Patch(ctx, userAt(
+			collection, "nobody@example.com", "")); !errors.Is(
+			err, ErrNotFound) {
+			t.Errorf("Patch matching nothing: %v, want ErrNotFound", err)
+		}
+		if _, err := db.Get(ctx, dummy, collection); !errors.Is(
+			err, ErrInvalidPath) {
+			t.Errorf("Get of a collection: %v, want ErrInvalidPath", err)
+		}
+		if _, err := db.List(ctx, dummy, missing); !errors.Is(
+			err, ErrInvalidPath) {
+			t.Errorf("List of a document: %v, want ErrInvalidPath", err)
+		}
+		if _, err := db.Put(ctx, dummy, nil); !errors.Is(
+			err, ErrInvalidPath) {
+			t.Errorf("Put at an empty path: %v, want ErrInvalidPath", err)
+		}
+	})
+}
+
+func TestConformanceDelete(t *testing.T) {
+	forEachDb(t, func(t *testing.T, db Db, collection []string) {
+		ctx := context.Background()
+		author := append(collection, "a1")
+		post := append(author[:len(author):len(author)], "posts", "p1")
+		if _, err := db.Put(
+			ctx, AdaptV2(&testAuthor{Name: "Ann"}), author); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Put(
+			ctx, AdaptV2(&testPost{Title: "Hello"}), post); err != nil {
+			t.Fatal(err)
+		}
+		other := append(collection, "a2")
+		if _, err := db.Put(
+			ctx, AdaptV2(&testAuthor{Name: "Ben"}), other); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Delete(ctx, AdaptV2(&testAuthor{}), author); err != nil {
+			t.Fatal(err)
+		}
+		for _, document := range [][]string{author, post} {
+			_, err := db.Get(ctx, AdaptV2(&testPost{}), document)
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("%v after Delete: %v, want ErrNotFound", document, err)
+			}
+		}
+		if _, err := db.Get(ctx, AdaptV2(&testAuthor{}), other); err != nil {
+			t.Errorf("sibling after Delete: %v", err)
+		}
+
+		if err := db.Clear(ctx, AdaptV2(&testAuthor{}), collection); err != nil {
+			t.Fatal(err)
+		}
+		objs, err := db.List(ctx, AdaptV2(&testAuthor{}), collection)
+		if err != nil || len(objs) != 0 {
+			t.Errorf("List after Clear: %d objects, %v", len(objs), err)
+		}
+	})
+}
+
+func TestMemoryDbTimestampsStable(t *testing.T) {
+	db := NewMemoryDb()
+	ctx := context.Background()
+	document := []string{"posts", "p1"}
+	dummy := AdaptV2(&stampedPost{})
+	if _, err := db.Put(
+		ctx, AdaptV2(&stampedPost{Title: "a"}), document); err != nil {
+		t.Fatal(err)
+	}
+	read := func() *stampedPost {
+		t.Helper()
+		obj, err := db.Get(ctx, dummy, document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Underlying(obj).(*stampedPost)
+	}
+	first := read()
+	time.Sleep(time.Millisecond)
+	second := read()
+	if first.update_time.IsZero() ||
+		!second.update_time.Equal(first.update_time) ||
+		!second.create_time.Equal(first.create_time) ||
+		!second.Stamp.Equal(first.Stamp) {
+		t.Errorf("two Gets read %+v and %+v", first, second)
+	}
+	objs, err := db.List(ctx, dummy, []string{"posts"})
+	if err != nil || len(objs) != 1 ||
+		!Underlying(objs[0]).(*stampedPost).update_time.Equal(
+			first.update_time) {
+		t.Errorf("List read %v, %v, want the UpdateTime of Get", objs, err)
+	}
+
+	time.Sleep(time.Millisecond)
+	if _, err := db.Put(
+		ctx, AdaptV2(&stampedPost{Title: "b"}), document); err != nil {
+		t.Fatal(err)
+	}
+	third := read()
+	if !third.update_time.After(first.update_time) ||
+		!third.create_time.Equal(first.create_time) {
+		t.Errorf("after an overwrite read %+v, want a later UpdateTime "+
+			"and the first CreateTime %v", third, first.create_time)
+	}
+}
@@ -0,0 +1,341 @@
+package rest2firestore
+
+import (
+	"context"
+
+	"cloud.google.com/go/firestore"
+)
+
+// ObjectV2 is the minimal model interface. Everything else the legacy
+// Object interface requires is an optional capability, detected with a
+// type assertion:
+//
+//	Searcher              - Post finds existing documents instead of always
+//	                        creating
+//	QuerySearcher         - the same, inside the write transaction
+//	BulkSearcher          - one lookup for a whole BatchPost
+//	BatchKeyer            - duplicates within a BatchPost found in memory
+//	ListDeserializer      - custom bulk decoding in List
+//	Postprocessor         - rewrites the result of List
+//	SubcollectionProvider - subcollections cleared by Delete
+//	Validator             - checked before every write
+//
+// Migrating a model: drop the methods you only implemented to satisfy
+// Object, change Deserialize to return ObjectV2, and pass AdaptV2(model)
+// wherever the Db expects an Object. Objects the Db returns for such a
+// prototype are adapters too; AdaptLegacy(result) gives back the model.
+type ObjectV2 interface {
+	Deserialize(doc *firestore.DocumentSnapshot) (ObjectV2, error)
+	Serialize()
+}
+
+type Searcher interface {
+	Search(ctx context.Context, client *firestore.Client) (
+		document []string, err error)
+}
+
+// QuerySearcher lets Post and Patch run the search inside their write
+// transaction, so two concurrent Posts cannot both create. ok is false when
+// obj has nothing to search by.
+type QuerySearcher interface {
+	SearchQuery(client *firestore.Client) (query firestore.Query, ok bool)
+}
+
+// BulkSearcher resolves the existing documents of a whole batch in a few
+// queries, for example one "in" query per 30 keys. The result maps
+// indices into objs to their documents; items with none are left out.
+// BatchPost calls it on the first object of the batch.
+type BulkSearcher interface {
+	SearchAll(ctx context.Context, client *firestore.Client, objs []Object) (
+		map[int][]string, error)
+}
+
+// BatchKeyer names the document an object stands for, so BatchPost can
+// tell duplicates within a batch apart without searching again. Objects
+// with the same non-empty key become one document; ok is false when obj
+// has no key.
+type BatchKeyer interface {
+	BatchKey() (key string, ok bool)
+}
+
+type ListDeserializer interface {
+	DeserializeList(docs []*firestore.DocumentSnapshot) ([]ObjectV2, error)
+}
+
+type Postprocessor interface {
+	PostprocessList(objs []ObjectV2) ([]ObjectV2, error)
+}
+
+type SubcollectionProvider interface {
+	Subcollections() []Subcollection
+}
+
+type Validator interface {
+	Validate() error
+}
+
+type legacyObject struct {
+	obj Object
+}
+
+type v2Object struct {
+	obj ObjectV2
+}
+
+var _ Object = v2Object{}
+var _ ObjectV2 = legacyObject{}
+
+// AdaptLegacy lets a legacy Object be used as an ObjectV2. It undoes
+// AdaptV2.
+func AdaptLegacy(obj Object) ObjectV2 {
+	if obj == nil {
+		return nil
+	}
+	if adapted, ok := obj.(v2Object); ok {
+		return adapted.obj
+	}
+	return legacyObject{obj: obj}
+}
+
+// AdaptV2 lets an ObjectV2 be used wherever an Object is expected, filling
+// in defaults for the capabilities it does not implement. It undoes
+// AdaptLegacy.
+func AdaptV2(obj ObjectV2) Object {
+	if obj == nil {
+		return nil
+	}
+	if adapted, ok := obj.(legacyObject); ok {
+		return adapted.obj
+	}
+	return v2Object{obj: obj}
+}
+
+func adaptLegacyList(objs []Object) []ObjectV2 {
+	if objs == nil {
+		return nil
+	}
+	adapted := make([]ObjectV2, len(objs))
+	for i, obj := range objs {
+		adapted[i] = AdaptLegacy(obj)
+	}
+	return adapted
+}
+
+func adaptV2List(objs []ObjectV2) []Object {
+	if objs == nil {
+		return nil
+	}
+	adapted := make([]Object, len(objs))
+	for i, obj := range objs {
+		adapted[i] = AdaptV2(obj)
+	}
+	return adapted
+}
+
+// storedHolder is an ObjectV2 wrapper that writes another value.
+type storedHolder interface {
+	stored() interface{}
+}
+
+// storedValue is what gets handed to the firestore client for writing.
+func storedValue(obj ObjectV2) interface{} {
+	var value interface{} = obj
+	if adapted, ok := obj.(legacyObject); ok {
+		value = adapted.obj
+	}
+	if holder, ok := value.(storedHolder); ok {
+		return holder.stored()
+	}
+	if raw, ok := value.(*RawObject); ok {
+		return raw.Data
+	}
+	return value
+}
+
+// Underlying returns the model value behind obj, looking through adapters.
+func Underlying(obj Object) interface{} {
+	return storedValue(AdaptLegacy(obj))
+}
+
+func (l legacyObject) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	result, err := l.obj.Deserialize(doc)
+	if err != nil {
+		return nil, err
+	}
+	return AdaptLegacy(result), nil
+}
+
+func (l legacyObject) Serialize() {
+	l.obj.Serialize()
+}
+
+func (l legacyObject) Search(
+	ctx context.Context, client *firestore.Client) ([]string, error) {
+	return l.obj.Search(ctx, client)
+}
+
+func (l legacyObject) SearchQuery(client *firestore.Client) (
+	firestore.Query, bool) {
+	if searcher, ok := l.obj.(QuerySearcher); ok {
+		return searcher.SearchQuery(client)
+	}
+	return firestore.Query{}, false
+}
+
+func (l legacyObject) DeserializeList(docs []*firestore.DocumentSnapshot) (
+	[]ObjectV2, error) {
+	objs, err := l.obj.DeserializeList(docs)
+	if err != nil {
+		return nil, err
+	}
+	return adaptLegacyList(objs), nil
+}
+
+func (l legacyObject) PostprocessList(objs []ObjectV2) ([]ObjectV2, error) {
+	result, err := l.obj.PostprocessList(adaptV2List(objs))
+	if err != nil {
+		return nil, err
+	}
+	return adaptLegacyList(result), nil
+}
+
+func (l legacyObject) Subcollections() []Subcollection {
+	return l.obj.Subcollections()
+}
+
+func (l legacyObject) Validate() error {
+	if validator, ok := l.obj.(Validator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
+
+func deserializeList(obj ObjectV2, docs []*firestore.DocumentSnapshot) (
+	[]ObjectV2, error) {
+	if deserializer, ok := obj.(ListDeserializer); ok {
+		return deserializer.DeserializeList(docs)
+	}
+	objs := make([]ObjectV2, 0, len(docs))
+	for _, doc := range docs {
+		result, err := obj.Deserialize(doc)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, result)
+	}
+	return objs, nil
+}
+
+func postprocessList(obj ObjectV2, objs []ObjectV2) ([]ObjectV2, error) {
+	if postprocessor, ok := obj.(Postprocessor); ok {
+		return postprocessor.PostprocessList(objs)
+	}
+	return objs, nil
+}
+
+func search(ctx context.Context, obj ObjectV2, client *firestore.Client) (
+	[]string, error) {
+	if searcher, ok := obj.(Searcher); ok {
+		return searcher.Search(ctx, client)
+	}
+	return nil, nil
+}
+
+func searchQuery(obj ObjectV2, client *firestore.Client) (
+	firestore.Query, bool) {
+	if searcher, ok := obj.(QuerySearcher); ok {
+		return searcher.SearchQuery(client)
+	}
+	return firestore.Query{}, false
+}
+
+func batchKey(obj ObjectV2) (string, bool) {
+	if adapted, ok := obj.(legacyObject); ok {
+		if keyer, ok := adapted.obj.(BatchKeyer); ok {
+			return keyer.BatchKey()
+		}
+		return "", false
+	}
+	if keyer, ok := obj.(BatchKeyer); ok {
+		return keyer.BatchKey()
+	}
+	return "", false
+}
+
+func bulkSearcher(obj ObjectV2) (BulkSearcher, bool) {
+	if adapted, ok := obj.(legacyObject); ok {
+		searcher, ok := adapted.obj.(BulkSearcher)
+		return searcher, ok
+	}
+	searcher, ok := obj.(BulkSearcher)
+	return searcher, ok
+}
+
+func subcollections(obj ObjectV2) []Subcollection {
+	if provider, ok := obj.(SubcollectionProvider); ok {
+		return provider.Subcollections()
+	}
+	return nil
+}
+
+func validate(obj ObjectV2) error {
+	if validator, ok := obj.(Validator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
+
+func (v v2Object) DeserializeList(docs []*firestore.DocumentSnapshot) (
+	[]Object, error) {
+	objs, err := deserializeList(v.obj, docs)
+	if err != nil {
+		return nil, err
+	}
+	return adaptV2List(objs), nil
+}
+
+func (v v2Object) SerializeList(objects []Object) {
+	for _, obj := range objects {
+		obj.Serialize()
+	}
+}
+
+func (v v2Object) PostprocessList(objs []Object) ([]Object, error) {
+	result, err := postprocessList(v.obj, adaptLegacyList(objs))
+	if err != nil {
+		return nil, err
+	}
+	return adaptV2List(result), nil
+}
+
+func (v v2Object) Deserialize(doc *firestore.DocumentSnapshot) (
+	Object, error) {
+	result, err := v.obj.Deserialize(doc)
+	if err != nil {
+		return nil, err
+	}
+	return AdaptV2(result), nil
+}
+
+func (v v2Object) Serialize() {
+	v.obj.Serialize()
+}
+
+func (v v2Object) Search(
+	ctx context.Context, client *firestore.Client) ([]string, error) {
+	return search(ctx, v.obj, client)
+}
+
+func (v v2Object) SearchQuery(client *firestore.Client) (
+	firestore.Query, bool) {
+	return searchQuery(v.obj, client)
+}
+
+func (v v2Object) Subcollections() []Subcollection {
+	return subcollections(v.obj)
+}
+
+func (v v2Object) Validate() error {
+	return validate(v.obj)
+}
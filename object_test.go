@@ -0,0 +1,242 @@
+package rest2firestore
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+)
+
+// legacyUser implements the whole legacy Object interface.
+type legacyUser struct {
+	Email string `firestore:"email"`
+	Name  string `firestore:"name"`
+
+	collection []string
+	listed     bool
+	rank       int
+}
+
+var _ Object = &legacyUser{}
+
+func (u *legacyUser) DeserializeList(docs []*firestore.DocumentSnapshot) (
+	[]Object, error) {
+	objs := make([]Object, 0, len(docs))
+	for _, doc := range docs {
+		obj, err := u.Deserialize(doc)
+		if err != nil {
+			return nil, err
+		}
+		obj.(*legacyUser).listed = true
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+func (u *legacyUser) SerializeList(objects []Object) {
+}
+
+func (u *legacyUser) PostprocessList(objs []Object) ([]Object, error) {
+	sort.Slice(objs, func(i, j int) bool {
+		return objs[i].(*legacyUser).Email < objs[j].(*legacyUser).Email
+	})
+	for i, obj := range objs {
+		obj.(*legacyUser).rank = i + 1
+	}
+	return objs, nil
+}
+
+func (u *legacyUser) Deserialize(doc *firestore.DocumentSnapshot) (
+	Object, error) {
+	result := &legacyUser{collection: u.collection}
+	return result, doc.DataTo(result)
+}
+
+func (u *legacyUser) Serialize() {
+	u.Email = strings.ToLower(u.Email)
+}
+
+func (u *legacyUser) Search(ctx context.Context, client *firestore.Client) (
+	[]string, error) {
+	return nil, nil
+}
+
+func (u *legacyUser) SearchQuery(client *firestore.Client) (
+	firestore.Query, bool) {
+	return client.Collection(path.Join(u.collection...)).
+		Where("email", "==", strings.ToLower(u.Email)), true
+}
+
+func (u *legacyUser) Matches(other Object) bool {
+	o, ok := Underlying(other).(*legacyUser)
+	return ok && o.Email == strings.ToLower(u.Email)
+}
+
+func (u *legacyUser) Subcollections() []Subcollection {
+	return nil
+}
+
+// v2User implements ObjectV2 and the same optional capabilities.
+type v2User struct {
+	Email string `firestore:"email"`
+	Name  string `firestore:"name"`
+
+	collection []string
+	rank       int
+}
+
+func (u *v2User) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	result := &v2User{collection: u.collection}
+	return result, doc.DataTo(result)
+}
+
+func (u *v2User) Serialize() {
+	u.Email = strings.ToLower(u.Email)
+}
+
+func (u *v2User) PostprocessList(objs []ObjectV2) ([]ObjectV2, error) {
+	sort.Slice(objs, func(i, j int) bool {
+		return objs[i].(*v2User).Email < objs[j].(*v2User).Email
+	})
+	for i, obj := range objs {
+		obj.(*v2User).rank = i + 1
+	}
+	return objs, nil
+}
+
+func (u *v2User) SearchQuery(client *firestore.Client) (
+	firestore.Query, bool) {
+	return client.Collection(path.Join(u.collection...)).
+		Where("email", "==", strings.ToLower(u.Email)), true
+}
+
+func (u *v2User) Matches(other Object) bool {
+	o, ok := Underlying(other).(*v2User)
+	return ok && o.Email == strings.ToLower(u.Email)
+}
+
+// adaptedModel is what a conformance test needs to know of a model.
+type adaptedModel struct {
+	name  string
+	proto func(collection []string, email, name string) Object
+	// fields reads a result back, failing when its type is wrong.
+	fields func(t *testing.T, obj Object) (email, name string, rank int)
+	// listed reports whether the model's own DeserializeList ran.
+	listed func(obj Object) bool
+}
+
+var adapted_models = []adaptedModel{{
+	name: "legacy",
+	proto: func(collection []string, email, name string) Object {
+		return &legacyUser{Email: email, Name: name, collection: collection}
+	},
+	fields: func(t *testing.T, obj Object) (string, string, int) {
+		t.Helper()
+		// A legacy prototype gets legacy Objects back, not adapters.
+		u, ok := obj.(*legacyUser)
+		if !ok {
+			t.Fatalf("got %T, want *legacyUser", obj)
+		}
+		return u.Email, u.Name, u.rank
+	},
+	listed: func(obj Object) bool { return obj.(*legacyUser).listed },
+}, {
+	name: "v2",
+	proto: func(collection []string, email, name string) Object {
+		return AdaptV2(&v2User{Email: email, Name: name, collection: collection})
+	},
+	fields: func(t *testing.T, obj Object) (string, string, int) {
+		t.Helper()
+		u, ok := AdaptLegacy(obj).(*v2User)
+		if !ok || Underlying(obj) != u {
+			t.Fatalf("got %T, want an adapted *v2User", obj)
+		}
+		return u.Email, u.Name, u.rank
+	},
+	listed: func(obj Object) bool { return true },
+}}
+
+func TestAdapterConformance(t *testing.T) {
+	for _, model := range adapted_models {
+		t.Run(model.name, func(t *testing.T) {
+			forEachDb(t, func(t *testing.T, db Db, collection []string) {
+				testAdapterConformance(t, db, collection, model)
+			})
+		})
+	}
+}
+
+func testAdapterConformance(t *testing.T, db Db, collection []string,
+	model adaptedModel) {
+	ctx := context.Background()
+	document := append(collection, "a")
+	_, err := db.Put(ctx, model.proto(collection, "A@Example.com", "a"),
+		document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Get(ctx, model.proto(collection, "", ""), document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Serialize ran before the write.
+	if email, name, _ := model.fields(t, got); email != "a@example.com" ||
+		name != "a" {
+		t.Errorf("Get = %s, %s, want a@example.com, a", email, name)
+	}
+
+	posted, err := db.Post(ctx, model.proto(collection, "b@example.com", "b"),
+		collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email, name, _ := model.fields(t, posted); email != "b@example.com" ||
+		name != "b" {
+		t.Errorf("Post = %s, %s, want b@example.com, b", email, name)
+	}
+	found, err := db.Post(ctx,
+		model.proto(collection, "B@example.com", "other"), collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, name, _ := model.fields(t, found); name != "b" {
+		t.Errorf("second Post returned %q, want the existing b", name)
+	}
+
+	objs, err := db.List(ctx, model.proto(collection, "", ""), collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 2 {
+		t.Fatalf("List returned %d objects, want 2", len(objs))
+	}
+	for i, obj := range objs {
+		email, _, rank := model.fields(t, obj)
+		want := []string{"a@example.com", "b@example.com"}[i]
+		if email != want || rank != i+1 || !model.listed(obj) {
+			t.Errorf("List[%d] = %s, rank %d, listed %v, want %s, rank %d",
+				i, email, rank, model.listed(obj), want, i+1)
+		}
+	}
+}
+
+func TestAdaptersUndoEachOther(t *testing.T) {
+	legacy := &legacyUser{}
+	if got := storedValue(AdaptLegacy(legacy)); got != legacy {
+		t.Errorf("storedValue = %T, want *legacyUser", got)
+	}
+	if got := AdaptV2(AdaptLegacy(legacy)); got != Object(legacy) {
+		t.Errorf("AdaptV2(AdaptLegacy(x)) = %T, want x", got)
+	}
+	v2 := &v2User{}
+	if got := AdaptLegacy(AdaptV2(v2)); got != ObjectV2(v2) {
+		t.Errorf("AdaptLegacy(AdaptV2(y)) = %T, want y", got)
+	}
+	if got := Underlying(AdaptV2(v2)); got != v2 {
+		t.Errorf("Underlying = %T, want *v2User", got)
+	}
+}
@@ -0,0 +1,87 @@
+package rest2firestore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+)
+
+// fieldUpdates turns a PatchFields map into updates sorted by path. Keys
+// are dot-separated field paths; nested maps are merged key by key rather
+// than replacing the field, and an empty map sets an empty map.
+func fieldUpdates(document_path string, fields map[string]interface{},
+	allow_reserved bool) ([]firestore.Update, error) {
+	var updates []firestore.Update
+	var flatten func(prefix []string, fields map[string]interface{}) error
+	flatten = func(prefix []string, fields map[string]interface{}) error {
+		for key, value := range fields {
+			field_path := append(prefix[:len(prefix):len(prefix)],
+				strings.Split(key, ".")...)
+			for _, name := range field_path {
+				if name == "" {
+					return fmt.Errorf("%s:PatchFields - empty name in %q: %w",
+						document_path, key, ErrInvalidPath)
+				}
+			}
+			if !allow_reserved && isReservedName(field_path[0]) {
+				return fmt.Errorf("%s:PatchFields - field %s: %w",
+					document_path, key, ErrReservedPath)
+			}
+			if nested, ok := value.(map[string]interface{}); ok &&
+				len(nested) > 0 {
+				if err := flatten(field_path, nested); err != nil {
+					return err
+				}
+				continue
+			}
+			updates = append(updates,
+				firestore.Update{FieldPath: field_path, Value: value})
+		}
+		return nil
+	}
+	if err := flatten(nil, fields); err != nil {
+		return nil, err
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return strings.Join(updates[i].FieldPath, ".") <
+			strings.Join(updates[j].FieldPath, ".")
+	})
+	return updates, nil
+}
+
+// PatchFields changes only the given fields of an existing document and
+// returns the result. Keys are field paths such as "address.city"; a
+// value of firestore.Delete removes the field. Validate is not run, as the
+// object is never seen whole.
+func (db *FirestoreDb) PatchFields(ctx context.Context, dummy Object,
+	document []string, fields map[string]interface{}) (Object, error) {
+	if _, _, err := getDocumentPath(document, db.allow_reserved); err != nil {
+		return nil, err
+	}
+	document_path := path.Join(document...)
+	if err := db.checkAppendOnly("PatchFields", document); err != nil {
+		return nil, err
+	}
+	fields, err := db.beforePatchFields(ctx, "PatchFields", document, fields)
+	if err != nil {
+		return nil, err
+	}
+	updates, err := fieldUpdates(document_path, fields, db.allow_reserved)
+	if err != nil {
+		return nil, err
+	}
+	if len(updates) == 0 {
+		return db.Get(ctx, dummy, document)
+	}
+	_, err = db.clientFor(document_path).Doc(document_path).Update(
+		ctx, updates)
+	if err != nil {
+		return nil, dbError(
+			"PatchFields", document_path, "could not update object", err)
+	}
+	return db.Get(ctx, dummy, document)
+}
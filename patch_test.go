@@ -0,0 +1,153 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+)
+
+type patchAddress struct {
+	City string `firestore:"city"`
+	Zip  string `firestore:"zip"`
+}
+
+type patchUser struct {
+	Name    string                 `firestore:"name"`
+	Age     int64                  `firestore:"age"`
+	Address patchAddress           `firestore:"address"`
+	Tags    map[string]interface{} `firestore:"tags"`
+}
+
+func (u *patchUser) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	result := &patchUser{}
+	return result, doc.DataTo(result)
+}
+
+func (u *patchUser) Serialize() {
+}
+
+func TestFieldUpdates(t *testing.T) {
+	updates, err := fieldUpdates("users/u1", map[string]interface{}{
+		"name":         "a",
+		"address.city": "Paris",
+		"tags":         map[string]interface{}{"b": 1, "a": firestore.Delete},
+		"empty":        map[string]interface{}{},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []firestore.Update{
+		{FieldPath: []string{"address", "city"}, Value: "Paris"},
+		{FieldPath: []string{"empty"}, Value: map[string]interface{}{}},
+		{FieldPath: []string{"name"}, Value: "a"},
+		{FieldPath: []string{"tags", "a"}, Value: firestore.Delete},
+		{FieldPath: []string{"tags", "b"}, Value: 1},
+	}
+	if !reflect.DeepEqual(updates, want) {
+		t.Errorf("fieldUpdates = %+v, want %+v", updates, want)
+	}
+	for _, test := range []struct {
+		fields map[string]interface{}
+		want   error
+	}{
+		{map[string]interface{}{"address..city": 1}, ErrInvalidPath},
+		{map[string]interface{}{"a": map[string]interface{}{"": 1}},
+			ErrInvalidPath},
+		{map[string]interface{}{ReservedPrefix + "meta.x": 1},
+			ErrReservedPath},
+	} {
+		if _, err := fieldUpdates("users/u1", test.fields, false); !errors.Is(
+			err, test.want) {
+			t.Errorf("fieldUpdates(%v) = %v, want %v", test.fields, err,
+				test.want)
+		}
+	}
+	if _, err := fieldUpdates("users/u1", map[string]interface{}{
+		ReservedPrefix + "meta": 1}, true); err != nil {
+		t.Errorf("fieldUpdates with reserved access: %v", err)
+	}
+}
+
+func TestPatchFieldsNested(t *testing.T) {
+	forEachDb(t, func(t *testing.T, db Db, collection []string) {
+		ctx := context.Background()
+		document := append(collection, "u1")
+		_, err := db.Put(ctx, AdaptV2(&patchUser{
+			Name:    "Ann",
+			Age:     30,
+			Address: patchAddress{City: "Oslo", Zip: "0150"},
+		}), document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch := func(fields map[string]interface{}) *patchUser {
+			t.Helper()
+			result, err := db.PatchFields(
+				ctx, AdaptV2(&patchUser{}), document, fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return Underlying(result).(*patchUser)
+		}
+
+		// Field paths and nested maps change single keys.
+		user := patch(map[string]interface{}{
+			"address.city": "Paris",
+			"tags":         map[string]interface{}{"a": "x"},
+		})
+		want := &patchUser{Name: "Ann", Age: 30,
+			Address: patchAddress{City: "Paris", Zip: "0150"},
+			Tags:    map[string]interface{}{"a": "x"}}
+		if !reflect.DeepEqual(user, want) {
+			t.Errorf("PatchFields = %+v, want %+v", user, want)
+		}
+		user = patch(map[string]interface{}{
+			"tags": map[string]interface{}{"b": "y"},
+		})
+		want.Tags = map[string]interface{}{"a": "x", "b": "y"}
+		if !reflect.DeepEqual(user, want) {
+			t.Errorf("PatchFields of a nested map = %+v, want %+v", user, want)
+		}
+
+		// Delete sentinels remove fields at any depth.
+		user = patch(map[string]interface{}{
+			"name":   firestore.Delete,
+			"tags.a": firestore.Delete,
+		})
+		want.Name = ""
+		want.Tags = map[string]interface{}{"b": "y"}
+		if !reflect.DeepEqual(user, want) {
+			t.Errorf("PatchFields with deletes = %+v, want %+v", user, want)
+		}
+		got, err := db.Get(ctx, AdaptV2(&patchUser{}), document)
+		if err != nil || !reflect.DeepEqual(Underlying(got), want) {
+			t.Errorf("Get after PatchFields = %+v, %v, want %+v",
+				Underlying(got), err, want)
+		}
+	})
+}
+
+func TestPatchFieldsMissing(t *testing.T) {
+	forEachDb(t, func(t *testing.T, db Db, collection []string) {
+		ctx := context.Background()
+		missing := append(collection, "missing")
+		_, err := db.PatchFields(ctx, AdaptV2(&patchUser{}), missing,
+			map[string]interface{}{"address.city": "Paris"})
+		if !errors.Is(err, ErrNotFound) ||
+			!strings.Contains(err.Error(), "missing") {
+			t.Errorf("PatchFields of a missing document = %v, want "+
+				"ErrNotFound", err)
+		}
+		// PatchFields never creates the document.
+		if _, err := db.Get(ctx, AdaptV2(&patchUser{}), missing); !errors.Is(
+			err, ErrNotFound) {
+			t.Errorf("Get after the failed PatchFields = %v, want ErrNotFound",
+				err)
+		}
+	})
+}
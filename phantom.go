@@ -0,0 +1,127 @@
+package rest2firestore
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// PhantomParent is a document path that does not exist but has documents
+// in subcollections below it.
+type PhantomParent struct {
+	Path           []string
+	Subcollections []string
+}
+
+func subcollectionIDs(ctx context.Context, ref *firestore.DocumentRef) (
+	[]string, error) {
+	var ids []string
+	collections := ref.Collections(ctx)
+	for {
+		collection, err := collections.Next()
+		if err == iterator.Done {
+			return ids, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, collection.ID)
+	}
+}
+
+// GetOrPhantom is Get, except that a missing document with non-empty
+// subcollections is reported as a PhantomParent instead of NotFound.
+func (db *FirestoreDb) GetOrPhantom(
+	ctx context.Context, dummy Object, document []string) (
+	Object, *PhantomParent, error) {
+	obj, err := db.Get(ctx, dummy, document)
+	if status.Code(err) != codes.NotFound {
+		return obj, nil, err
+	}
+	document_path := path.Join(document...)
+	ids, list_err := subcollectionIDs(
+		ctx, db.clientFor(document_path).Doc(document_path))
+	if list_err != nil {
+		return nil, nil, fmt.Errorf(
+			"%s:Get - could not list subcollections: %w", document_path, list_err)
+	}
+	if len(ids) == 0 {
+		return nil, nil, err
+	}
+	return nil, &PhantomParent{Path: document, Subcollections: ids}, nil
+}
+
+// FindPhantoms reports the phantom parents directly inside collection. It
+// reads the documents BatchSize at a time.
+func (db *FirestoreDb) FindPhantoms(
+	ctx context.Context, collection []string) ([]PhantomParent, error) {
+	collection_path, err := getCollectionPath(collection, db.allow_reserved)
+	if err != nil {
+		return nil, err
+	}
+	client := db.nextClient()
+	refs, err := client.Collection(collection_path).DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf(
+			"%s:FindPhantoms - could not list documents: %w", collection_path, err)
+	}
+	var phantoms []PhantomParent
+	size := db.batchSize()
+	for start := 0; start < len(refs); start += size {
+		end := start + size
+		if end > len(refs) {
+			end = len(refs)
+		}
+		batch := refs[start:end]
+		docs, err := client.GetAll(ctx, batch)
+		if err != nil {
+			return nil, fmt.Errorf("%s:FindPhantoms - could not read: %w",
+				collection_path, err)
+		}
+		for i, doc := range docs {
+			if doc.Exists() {
+				continue
+			}
+			ref := batch[i]
+			ids, err := subcollectionIDs(ctx, ref)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"%s:FindPhantoms - could not list subcollections: %w",
+					documentRefPath(ref), err)
+			}
+			if len(ids) > 0 {
+				phantoms = append(phantoms, PhantomParent{
+					Path:           append(append([]string{}, collection...), ref.ID),
+					Subcollections: ids,
+				})
+			}
+		}
+	}
+	return phantoms, nil
+}
+
+// MaterializePhantom writes an empty document at a phantom parent's path.
+// It fails with ErrAlreadyExists if the document exists by then.
+func (db *FirestoreDb) MaterializePhantom(
+	ctx context.Context, document []string) error {
+	if _, _, err := getDocumentPath(document, db.allow_reserved); err != nil {
+		return err
+	}
+	document_path := path.Join(document...)
+	_, err := db.clientFor(document_path).Doc(document_path).Create(
+		ctx, map[string]interface{}{})
+	if status.Code(err) == codes.AlreadyExists {
+		return fmt.Errorf("%s:MaterializePhantom - %w",
+			document_path, ErrAlreadyExists)
+	}
+	if err != nil {
+		return fmt.Errorf("%s:MaterializePhantom - could not write: %w",
+			document_path, err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// phantomTree puts authors a1 and a4, and posts below a1, a2 and a3, so
+// a2 and a3 are phantom parents.
+func phantomTree(t *testing.T, db *FirestoreDb) []string {
+	t.Helper()
+	ctx := context.Background()
+	collection := testCollection("authors")
+	put := func(obj Object, document ...string) {
+		t.Helper()
+		if _, err := db.Put(ctx, obj, document); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(AdaptV2(&testAuthor{Name: "Ann"}), append(collection, "a1")...)
+	put(AdaptV2(&testAuthor{Name: "Dan"}), append(collection, "a4")...)
+	for _, author := range []string{"a1", "a2", "a3"} {
+		put(AdaptV2(&testPost{Title: author}),
+			append(collection, author, "posts", "p1")...)
+	}
+	return collection
+}
+
+func TestGetOrPhantom(t *testing.T) {
+	db := emulatorDb(t)
+	ctx := context.Background()
+	collection := phantomTree(t, db)
+	get := func(id string) (Object, *PhantomParent, error) {
+		return db.GetOrPhantom(ctx, AdaptV2(&testAuthor{}),
+			append(collection, id))
+	}
+
+	obj, phantom, err := get("a1")
+	if err != nil || phantom != nil ||
+		Underlying(obj).(*testAuthor).Name != "Ann" {
+		t.Errorf("GetOrPhantom(a1) = %v, %v, %v, want Ann", obj, phantom, err)
+	}
+	obj, phantom, err = get("a2")
+	want := &PhantomParent{Path: append(collection, "a2"),
+		Subcollections: []string{"posts"}}
+	if err != nil || obj != nil || !reflect.DeepEqual(phantom, want) {
+		t.Errorf("GetOrPhantom(a2) = %v, %+v, %v, want %+v",
+			obj, phantom, err, want)
+	}
+	_, phantom, err = get("a9")
+	if status.Code(err) != codes.NotFound || phantom != nil {
+		t.Errorf("GetOrPhantom(a9) = %+v, %v, want NotFound", phantom, err)
+	}
+}
+
+func TestDeletePhantomSubtree(t *testing.T) {
+	db := emulatorDb(t)
+	ctx := context.Background()
+	collection := phantomTree(t, db)
+	phantom := append(collection, "a2")
+	if err := db.Delete(ctx, AdaptV2(&testAuthor{}), phantom); err != nil {
+		t.Fatal(err)
+	}
+	posts, err := db.List(ctx, AdaptV2(&testPost{}), append(phantom, "posts"))
+	if err != nil || len(posts) != 0 {
+		t.Errorf("Delete left %d posts below the phantom, %v", len(posts), err)
+	}
+	_, got, err := db.GetOrPhantom(ctx, AdaptV2(&testAuthor{}), phantom)
+	if status.Code(err) != codes.NotFound || got != nil {
+		t.Errorf("GetOrPhantom after Delete = %+v, %v, want NotFound",
+			got, err)
+	}
+	// The rest of the tree is untouched.
+	posts, err = db.List(ctx, AdaptV2(&testPost{}),
+		append(collection, "a3", "posts"))
+	if err != nil || len(posts) != 1 {
+		t.Errorf("Delete of a2 left %d posts below a3, %v, want 1",
+			len(posts), err)
+	}
+}
+
+func TestFindPhantoms(t *testing.T) {
+	db := emulatorDb(t)
+	// Batches of two split the four authors and their phantoms.
+	db.BatchSize = 2
+	ctx := context.Background()
+	collection := phantomTree(t, db)
+	phantoms, err := db.FindPhantoms(ctx, collection)
+	want := []PhantomParent{
+		{Path: append(collection, "a2"), Subcollections: []string{"posts"}},
+		{Path: append(collection, "a3"), Subcollections: []string{"posts"}},
+	}
+	if err != nil || !reflect.DeepEqual(phantoms, want) {
+		t.Errorf("FindPhantoms = %+v, %v, want %+v", phantoms, err, want)
+	}
+
+	a3 := append(collection, "a3")
+	if err := db.MaterializePhantom(ctx, a3); err != nil {
+		t.Fatal(err)
+	}
+	phantoms, err = db.FindPhantoms(ctx, collection)
+	if err != nil || !reflect.DeepEqual(phantoms, want[:1]) {
+		t.Errorf("FindPhantoms after materializing a3 = %+v, %v, want %+v",
+			phantoms, err, want[:1])
+	}
+	if err := db.MaterializePhantom(ctx, a3); !errors.Is(
+		err, ErrAlreadyExists) {
+		t.Errorf("second MaterializePhantom = %v, want ErrAlreadyExists", err)
+	}
+	if _, err := db.FindPhantoms(ctx, []string{"authors", "a1"}); !errors.Is(
+		err, ErrInvalidPath) {
+		t.Errorf("FindPhantoms of a document = %v, want ErrInvalidPath", err)
+	}
+}
@@ -0,0 +1,122 @@
+package rest2firestore
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// clientPool spreads operations over several clients. Operations on the
+// same document path always hash to the same client so writes to one
+// document stay ordered; bulk operations are spread round-robin. A
+// transaction or a listener picks its client once and keeps it.
+type clientPool struct {
+	clients []*firestore.Client
+	counts  []int64
+	next    uint64
+}
+
+func (p *clientPool) forPath(document_path string) int {
+	h := fnv.New32a()
+	h.Write([]byte(document_path))
+	i := int(h.Sum32() % uint32(len(p.clients)))
+	atomic.AddInt64(&p.counts[i], 1)
+	return i
+}
+
+func (p *clientPool) roundRobin() int {
+	i := int(atomic.AddUint64(&p.next, 1) % uint64(len(p.clients)))
+	atomic.AddInt64(&p.counts[i], 1)
+	return i
+}
+
+func (p *clientPool) close() {
+	for _, client := range p.clients {
+		client.Close()
+	}
+}
+
+func (db *FirestoreDb) clientFor(document_path string) *firestore.Client {
+	if db.pool == nil {
+		return db.client
+	}
+	return db.pool.clients[db.pool.forPath(document_path)]
+}
+
+func (db *FirestoreDb) nextClient() *firestore.Client {
+	if db.pool == nil {
+		return db.client
+	}
+	return db.pool.clients[db.pool.roundRobin()]
+}
+
+// PoolStats returns the number of operations routed to each pooled
+// client, or nil when pooling is disabled.
+func (db *FirestoreDb) PoolStats() []int64 {
+	if db.pool == nil {
+		return nil
+	}
+	counts := make([]int64, len(db.pool.counts))
+	for i := range counts {
+		counts[i] = atomic.LoadInt64(&db.pool.counts[i])
+	}
+	return counts
+}
+
+// Ping checks that every client reaches Firestore by reading a document
+// that need not exist.
+func (db *FirestoreDb) Ping(ctx context.Context) error {
+	clients := []*firestore.Client{db.client}
+	if db.pool != nil {
+		clients = db.pool.clients
+	}
+	ping_path := InternalCollection("ping") + "/ping"
+	for i, client := range clients {
+		_, err := client.Doc(ping_path).Get(ctx)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return dbError("Ping", ping_path,
+				"client "+strconv.Itoa(i)+" could not read", err)
+		}
+	}
+	return nil
+}
+
+// NewPooledFirestoreDb wraps existing clients of one project in a pool.
+// Close closes all of them.
+func NewPooledFirestoreDb(clients []*firestore.Client) *FirestoreDb {
+	if len(clients) == 1 {
+		return NewFirestoreDb(clients[0])
+	}
+	return &FirestoreDb{
+		client: clients[0],
+		pool: &clientPool{
+			clients: clients,
+			counts:  make([]int64, len(clients)),
+		},
+		prototypes: &prototypeChecks{},
+	}
+}
+
+func CreatePooledFirestoreDb(ctx context.Context, size int) *FirestoreDb {
+	if size <= 1 {
+		return CreateFirestoreDb(ctx)
+	}
+	clients := make([]*firestore.Client, size)
+	for i := range clients {
+		client, err :=
+			firestore.NewClient(ctx, os.Getenv("GOOGLE_CLOUD_PROJECT"))
+		if err != nil {
+			(&clientPool{clients: clients[:i]}).close()
+			log.Fatalf("Failed to connect to firestore: %v", err)
+		}
+		clients[i] = client
+	}
+	return NewPooledFirestoreDb(clients)
+}
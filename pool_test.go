@@ -0,0 +1,165 @@
+package rest2firestore
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// offlineClients makes clients on a connection to nowhere: they build refs
+// and fail every RPC.
+func offlineClients(t testing.TB, n int) []*firestore.Client {
+	t.Helper()
+	clients := make([]*firestore.Client, n)
+	for i := range clients {
+		conn, err := grpc.NewClient("localhost:1",
+			grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients[i], err = firestore.NewClient(context.Background(),
+			memory_project, option.WithGRPCConn(conn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { clients[i].Close() })
+	}
+	return clients
+}
+
+func TestPoolAffinity(t *testing.T) {
+	const size, paths = 4, 200
+	db := NewPooledFirestoreDb(offlineClients(t, size))
+	used := map[*firestore.Client]bool{}
+	for i := 0; i < paths; i++ {
+		document_path := "users/u" + strconv.Itoa(i)
+		client := db.clientFor(document_path)
+		for n := 0; n < 3; n++ {
+			if db.clientFor(document_path) != client {
+				t.Fatalf("%s moved to another client", document_path)
+			}
+		}
+		used[client] = true
+	}
+	if len(used) != size {
+		t.Errorf("%d paths used %d of %d clients", paths, len(used), size)
+	}
+	for i := 0; i < 2*size; i++ {
+		db.nextClient()
+	}
+	var total int64
+	for i, count := range db.PoolStats() {
+		if count < 2 {
+			t.Errorf("client %d ran %d operations, want at least 2", i, count)
+		}
+		total += count
+	}
+	if total != 4*paths+2*size {
+		t.Errorf("PoolStats add up to %d, want %d", total, 4*paths+2*size)
+	}
+}
+
+func TestPingFailsOffline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 200*time.Millisecond)
+	defer cancel()
+	db := NewPooledFirestoreDb(offlineClients(t, 2))
+	if err := db.Ping(ctx); err == nil {
+		t.Errorf("Ping of unreachable clients succeeded")
+	}
+}
+
+// emulatorPool is emulatorDb with size clients.
+func emulatorPool(t testing.TB, size int) *FirestoreDb {
+	t.Helper()
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+	clients := make([]*firestore.Client, size)
+	for i := range clients {
+		client, err := firestore.NewClient(
+			context.Background(), "rest2firestore-test")
+		if err != nil {
+			t.Fatalf("could not connect to the emulator: %v", err)
+		}
+		t.Cleanup(func() { client.Close() })
+		clients[i] = client
+	}
+	return NewPooledFirestoreDb(clients)
+}
+
+func TestPoolPingAndTransaction(t *testing.T) {
+	db := emulatorPool(t, 3)
+	ctx := context.Background()
+	if err := db.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	document := append(testCollection("users"), "u1")
+	for i := 0; i < 6; i++ {
+		err := db.RunTransaction(ctx, func(tx Db) error {
+			_, err := tx.Put(ctx, AdaptV2(&testUser{Age: int64(i)}), document)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("transaction %d: %v", i, err)
+		}
+	}
+	got, err := db.Get(ctx, AdaptV2(&testUser{}), document)
+	if err != nil || Underlying(got).(*testUser).Age != 5 {
+		t.Errorf("Get after the transactions: %v, %v", got, err)
+	}
+}
+
+func benchmarkPoolBatchPost(b *testing.B, size int) {
+	db := emulatorPool(b, size)
+	ctx := context.Background()
+	const batch = 500
+	for n := 0; n < b.N; n++ {
+		collection := testCollection("users")
+		objs := make([]Object, batch)
+		for i := range objs {
+			objs[i] = AdaptV2(&bulkUser{
+				Email: strconv.Itoa(i) + "@example.com", collection: collection})
+		}
+		if _, err := db.BatchPost(ctx, objs, collection); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPoolBatchPost1(b *testing.B) { benchmarkPoolBatchPost(b, 1) }
+func BenchmarkPoolBatchPost4(b *testing.B) { benchmarkPoolBatchPost(b, 4) }
+
+func benchmarkPoolGet(b *testing.B, size int) {
+	db := emulatorPool(b, size)
+	ctx := context.Background()
+	collection := testCollection("users")
+	const documents = 100
+	for i := 0; i < documents; i++ {
+		_, err := db.Put(ctx, AdaptV2(&testUser{Age: int64(i)}),
+			append(collection, strconv.Itoa(i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			_, err := db.Get(ctx, AdaptV2(&testUser{}),
+				append(collection, strconv.Itoa(i%documents)))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkPoolGet1(b *testing.B) { benchmarkPoolGet(b, 1) }
+func BenchmarkPoolGet4(b *testing.B) { benchmarkPoolGet(b, 4) }
@@ -0,0 +1,214 @@
+package rest2firestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+
+	"cloud.google.com/go/firestore"
+)
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+var query_operators = map[string]bool{
+	"<": true, "<=": true, "==": true, "!=": true, ">": true, ">=": true,
+	"array-contains": true, "array-contains-any": true,
+	"in": true, "not-in": true,
+}
+
+type Filter struct {
+	Path  string
+	Op    string
+	Value interface{}
+}
+
+type Order struct {
+	Path string
+	Desc bool
+}
+
+// ListQuery narrows and pages a List. StartAfter holds one value per
+// OrderBy entry. Cursor, as returned by ListWithQuery, resumes after the
+// last document of the previous page and takes precedence over StartAfter.
+// Offset skips documents after that position; Firestore still bills for
+// them, so prefer cursors for deep pages. Select limits the fields read,
+// leaving the rest zero; OrderBy paths are always read.
+type ListQuery struct {
+	Filters    []Filter
+	OrderBy    []Order
+	Limit      int
+	Offset     int
+	StartAfter []interface{}
+	Cursor     string
+	Select     []string
+}
+
+func (q *ListQuery) validate(collection_path string) error {
+	for _, filter := range q.Filters {
+		if filter.Path == "" {
+			return fmt.Errorf("%s:List - filter with empty path: %w",
+				collection_path, ErrInvalidQuery)
+		}
+		if !query_operators[filter.Op] {
+			return fmt.Errorf("%s:List - invalid operator %q on %s: %w",
+				collection_path, filter.Op, filter.Path, ErrInvalidQuery)
+		}
+	}
+	for _, order := range q.OrderBy {
+		if order.Path == "" {
+			return fmt.Errorf("%s:List - order with empty path: %w",
+				collection_path, ErrInvalidQuery)
+		}
+	}
+	if q.Limit < 0 {
+		return fmt.Errorf("%s:List - negative limit %d: %w",
+			collection_path, q.Limit, ErrInvalidQuery)
+	}
+	if q.Offset < 0 {
+		return fmt.Errorf("%s:List - negative offset %d: %w",
+			collection_path, q.Offset, ErrInvalidQuery)
+	}
+	for _, field := range q.Select {
+		if field == "" {
+			return fmt.Errorf("%s:List - empty select path: %w",
+				collection_path, ErrInvalidQuery)
+		}
+	}
+	if len(q.StartAfter) > len(q.OrderBy) {
+		return fmt.Errorf("%s:List - %d StartAfter values for %d orders: %w",
+			collection_path, len(q.StartAfter), len(q.OrderBy), ErrInvalidQuery)
+	}
+	return nil
+}
+
+// apply builds the firestore query. Document ID is always the last order,
+// so a cursor names a unique position even when ordering values tie.
+func (q *ListQuery) apply(client *firestore.Client, base firestore.Query,
+	collection_path string) (firestore.Query, error) {
+	if err := q.validate(collection_path); err != nil {
+		return base, err
+	}
+	query := base
+	for _, filter := range q.Filters {
+		query = query.Where(filter.Path, filter.Op, filter.Value)
+	}
+	for _, order := range q.OrderBy {
+		direction := firestore.Asc
+		if order.Desc {
+			direction = firestore.Desc
+		}
+		query = query.OrderBy(order.Path, direction)
+	}
+	query = query.OrderBy(firestore.DocumentID, firestore.Asc)
+	if q.Cursor != "" {
+		values, err := decodeCursor(client, q.Cursor)
+		if err != nil || len(values) != len(q.OrderBy)+1 {
+			return base, fmt.Errorf("%s:List - malformed cursor: %w",
+				collection_path, ErrInvalidQuery)
+		}
+		query = query.StartAfter(values...)
+	} else if len(q.StartAfter) > 0 {
+		query = query.StartAfter(q.StartAfter...)
+	}
+	if q.Offset > 0 {
+		query = query.Offset(q.Offset)
+	}
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+	if len(q.Select) > 0 {
+		query = query.Select(q.selected()...)
+	}
+	return query, nil
+}
+
+// selected is Select plus the OrderBy paths that cursors are built from.
+func (q *ListQuery) selected() []string {
+	fields := append([]string{}, q.Select...)
+	seen := map[string]bool{}
+	for _, field := range fields {
+		seen[field] = true
+	}
+	for _, order := range q.OrderBy {
+		if !seen[order.Path] {
+			seen[order.Path] = true
+			fields = append(fields, order.Path)
+		}
+	}
+	return fields
+}
+
+type encodedCursor struct {
+	Values []interface{} `json:"v"`
+	ID     string        `json:"id"`
+}
+
+// cursor encodes the ordering values of doc, the last of a full page.
+func (q *ListQuery) cursor(doc *firestore.DocumentSnapshot) (string, error) {
+	values := make([]interface{}, 0, len(q.OrderBy))
+	for _, order := range q.OrderBy {
+		value, err := doc.DataAt(order.Path)
+		if err != nil {
+			return "", err
+		}
+		values = append(values, value)
+	}
+	return encodeCursor(values, doc.Ref.ID)
+}
+
+func encodeCursor(values []interface{}, id string) (string, error) {
+	encoded, err := EncodeValue(values, ValueOptions{})
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(encodedCursor{
+		Values: encoded.([]interface{}),
+		ID:     id,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor returns the ordering values followed by the document ID.
+// Integers are kept as int64 so large values resume exactly.
+func decodeCursor(client *firestore.Client, cursor string) (
+	[]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var encoded encodedCursor
+	if err := decoder.Decode(&encoded); err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, 0, len(encoded.Values)+1)
+	for _, value := range encoded.Values {
+		decoded, err := DecodeValue(client, value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, decoded)
+	}
+	return append(values, encoded.ID), nil
+}
+
+// ListPage reads one page of size documents of collection in document ID
+// order. Pass the returned token back to read the next page. The token is
+// empty once a page comes back short, so the last page may be empty.
+func ListPage(ctx context.Context, db Db, obj Object, collection []string,
+	size int, token string) ([]Object, string, error) {
+	if size <= 0 {
+		return nil, "", fmt.Errorf("%s:ListPage - page size %d: %w",
+			path.Join(collection...), size, ErrInvalidQuery)
+	}
+	return db.ListWithQuery(
+		ctx, obj, collection, &ListQuery{Limit: size, Cursor: token})
+}
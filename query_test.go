@@ -0,0 +1,71 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestListWithQueryPages(t *testing.T) {
+	forEachDb(t, func(t *testing.T, db Db, collection []string) {
+		ctx := context.Background()
+		for i := 1; i <= 6; i++ {
+			name := "n" + strconv.Itoa(i)
+			if i == 6 {
+				name = "zed"
+			}
+			user := &testUser{Email: name + "@example.com", Name: name,
+				Age: int64(i * 10)}
+			_, err := db.Put(ctx, AdaptV2(user), append(collection, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		q := &ListQuery{
+			Filters: []Filter{
+				{Path: "age", Op: ">=", Value: int64(20)},
+				{Path: "name", Op: "in",
+					Value: []interface{}{"n1", "n2", "n3", "n4", "n5"}},
+			},
+			OrderBy: []Order{{Path: "age", Desc: true}},
+			Limit:   2,
+		}
+		dummy := AdaptV2(&testUser{})
+		var pages [][]int64
+		for page := 0; page < 3; page++ {
+			objs, cursor, err := db.ListWithQuery(ctx, dummy, collection, q)
+			if err != nil {
+				t.Fatalf("page %d: %v", page+1, err)
+			}
+			var ages []int64
+			for _, obj := range objs {
+				ages = append(ages, Underlying(obj).(*testUser).Age)
+			}
+			pages = append(pages, ages)
+			if cursor == "" {
+				break
+			}
+			next := *q
+			next.Cursor = cursor
+			q = &next
+		}
+		if len(pages) < 2 || len(pages[0]) != 2 || len(pages[1]) != 2 ||
+			pages[0][0] != 50 || pages[0][1] != 40 ||
+			pages[1][0] != 30 || pages[1][1] != 20 ||
+			(len(pages) == 3 && len(pages[2]) != 0) {
+			t.Errorf("pages %v, want [[50 40] [30 20]] and maybe []", pages)
+		}
+
+		_, _, err := db.ListWithQuery(ctx, dummy, collection, &ListQuery{
+			Filters: []Filter{{Path: "age", Op: "~", Value: 1}}})
+		if !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("invalid operator: %v, want ErrInvalidQuery", err)
+		}
+		_, _, err = db.ListWithQuery(ctx, dummy, collection, &ListQuery{
+			Filters: []Filter{{Op: "==", Value: 1}}})
+		if !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("empty filter path: %v, want ErrInvalidQuery", err)
+		}
+	})
+}
@@ -0,0 +1,185 @@
+package rest2firestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"cloud.google.com/go/firestore"
+)
+
+// RawObject exposes a document as a plain map, for collections that have
+// no model of their own. Data holds Firestore values; JSON encoding applies
+// the canonical mapping of EncodeValue and DecodeValue. Client is only
+// needed to decode "$ref" values from JSON. A RawObject is never found by
+// Search, so Post always creates, and it declares no subcollections.
+type RawObject struct {
+	ID     string
+	Data   map[string]interface{}
+	Client *firestore.Client
+}
+
+var _ Object = &RawObject{}
+
+func NewRawObject(data map[string]interface{}) *RawObject {
+	return &RawObject{Data: data}
+}
+
+func (r *RawObject) DeserializeList(docs []*firestore.DocumentSnapshot) (
+	[]Object, error) {
+	objs := make([]Object, 0, len(docs))
+	for _, doc := range docs {
+		obj, err := r.Deserialize(doc)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+func (r *RawObject) SerializeList(objects []Object) {
+}
+
+func (r *RawObject) PostprocessList(objs []Object) ([]Object, error) {
+	return objs, nil
+}
+
+func (r *RawObject) Deserialize(doc *firestore.DocumentSnapshot) (
+	Object, error) {
+	return &RawObject{ID: doc.Ref.ID, Data: doc.Data(), Client: r.Client}, nil
+}
+
+func (r *RawObject) Serialize() {
+	if r.Data == nil {
+		r.Data = map[string]interface{}{}
+	}
+}
+
+func (r *RawObject) Search(
+	ctx context.Context, client *firestore.Client) ([]string, error) {
+	return nil, nil
+}
+
+func (r *RawObject) Subcollections() []Subcollection {
+	return nil
+}
+
+// raw_id_key holds the document ID next to the fields in the JSON form of
+// a RawObject, so list items can be told apart. A stored top-level field
+// of that name is shadowed by it.
+const raw_id_key = "$id"
+
+func (r *RawObject) MarshalJSON() ([]byte, error) {
+	encoded, err := EncodeValue(r.Data, ValueOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if r.ID != "" {
+		fields, _ := encoded.(map[string]interface{})
+		if fields == nil {
+			fields = map[string]interface{}{}
+		}
+		fields[raw_id_key] = r.ID
+		encoded = fields
+	}
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON keeps numbers without a fraction or exponent as integers.
+// An "$id" field sets ID rather than being stored.
+func (r *RawObject) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value map[string]interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	if id, ok := value[raw_id_key].(string); ok {
+		r.ID = id
+		delete(value, raw_id_key)
+	}
+	decoded, err := DecodeValue(r.Client, value)
+	if err != nil {
+		return err
+	}
+	r.Data, _ = decoded.(map[string]interface{})
+	return nil
+}
+
+// RawOptions are the guardrails of a resource served by
+// RegisterRawResource.
+type RawOptions struct {
+	// Writable allows POST, PUT, PATCH and DELETE. Without it the resource
+	// is read-only and other methods get 405.
+	Writable bool
+	// Redact lists top-level fields that are left out of every response.
+	Redact []string
+	// MaxBodyBytes replaces the Router's limit for this resource when set.
+	MaxBodyBytes int64
+	// Authorize, when set, sees every request first; an error rejects it
+	// with 403.
+	Authorize func(req *http.Request) error
+	// Client decodes "$ref" values in bodies.
+	Client *firestore.Client
+}
+
+// RegisterRawResource serves the collections matching pattern as
+// RawObjects, without a model, next to the resources of RegisterResource.
+// Bodies and responses are documents in the canonical mapping of
+// EncodeValue, and responses carry the document ID as "$id". It panics
+// like RegisterResource.
+func (r *Router) RegisterRawResource(pattern string, opts RawOptions) *Router {
+	segments := routePattern("RegisterRawResource", pattern)
+	r.register(segments, &RawObject{Client: opts.Client}, &opts)
+	return r
+}
+
+// allow applies the guardrails to req, reporting whether it may go on.
+func (opts *RawOptions) allow(w http.ResponseWriter, req *http.Request) bool {
+	if opts.Authorize != nil {
+		if err := opts.Authorize(req); err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return false
+		}
+	}
+	if !opts.Writable && req.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "resource is read-only")
+		return false
+	}
+	return true
+}
+
+func (r *Router) bodyLimit(rt route) int64 {
+	if rt.raw != nil && rt.raw.MaxBodyBytes > 0 {
+		return rt.raw.MaxBodyBytes
+	}
+	return r.MaxBodyBytes
+}
+
+func (rt route) client() *firestore.Client {
+	if rt.raw != nil {
+		return rt.raw.Client
+	}
+	return nil
+}
+
+// view is what rt responds with for obj: its model, redacted for a raw
+// resource.
+func (rt route) view(obj Object) interface{} {
+	value := model(obj)
+	raw, ok := value.(*RawObject)
+	if !ok || rt.raw == nil || len(rt.raw.Redact) == 0 {
+		return value
+	}
+	data := make(map[string]interface{}, len(raw.Data))
+	for key, item := range raw.Data {
+		data[key] = item
+	}
+	for _, field := range rt.raw.Redact {
+		delete(data, field)
+	}
+	return &RawObject{ID: raw.ID, Data: data, Client: raw.Client}
+}
@@ -0,0 +1,159 @@
+package rest2firestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/option"
+)
+
+// rawDocument holds every Firestore value type in the canonical mapping.
+const rawDocument = `{
+	"string": "2024-01-01T00:00:00Z",
+	"int": 42,
+	"float": 2.0,
+	"bool": true,
+	"null": null,
+	"timestamp": {"$timestamp": "2024-01-02T03:04:05.123456Z"},
+	"bytes": {"$bytes": "aGVsbG8="},
+	"geo": {"$geopoint": {"latitude": 1.5, "longitude": -0.25}},
+	"point": {"latitude": 1, "longitude": 2},
+	"ref": {"$ref": "users/u2"},
+	"array": [1, "two", {"$bytes": "AA=="}],
+	"map": {"nested": {"deep": 1.25}},
+	"secret": "hidden"
+}`
+
+func decodeJSON(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	return value
+}
+
+func serve(router http.Handler, method, target, body string) (
+	*httptest.ResponseRecorder, []byte) {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(
+		method, target, strings.NewReader(body)))
+	return w, w.Body.Bytes()
+}
+
+func TestRawResourceRoundTrip(t *testing.T) {
+	// The client is never dialled; it only builds the DocumentRefs.
+	client, err := firestore.NewClient(context.Background(), memory_project,
+		option.WithoutAuthentication(), option.WithEndpoint("localhost:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	router := NewRouter(NewMemoryDb()).
+		RegisterResource("users", AdaptV2(&testUser{})).
+		RegisterRawResource("things", RawOptions{
+			Writable: true, Redact: []string{"secret"}, Client: client})
+
+	w, _ := serve(router, http.MethodPut, "/things/t1", rawDocument)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT: status %d: %s", w.Code, w.Body)
+	}
+	want := decodeJSON(t, []byte(rawDocument)).(map[string]interface{})
+	delete(want, "secret")
+	want["$id"] = "t1"
+	w, body := serve(router, http.MethodGet, "/things/t1", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: status %d: %s", w.Code, body)
+	}
+	if got := decodeJSON(t, body); !reflect.DeepEqual(got, want) {
+		t.Errorf("GET returned\n%s\nwant\n%v", body, want)
+	}
+	w, body = serve(router, http.MethodGet, "/things", "")
+	items, _ := decodeJSON(t, body).(map[string]interface{})["items"].([]interface{})
+	if w.Code != http.StatusOK || len(items) != 1 ||
+		!reflect.DeepEqual(items[0], want) {
+		t.Errorf("List returned %d: %s", w.Code, body)
+	}
+
+	// Typed resources on the same router are unaffected.
+	w, body = serve(router, http.MethodPost, "/users",
+		`{"email": "a@example.com"}`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("typed POST: status %d: %s", w.Code, body)
+	}
+}
+
+func TestRawObjectJSONID(t *testing.T) {
+	data, err := json.Marshal(&RawObject{
+		ID: "t1", Data: map[string]interface{}{"n": int64(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); got != `{"$id":"t1","n":1}` {
+		t.Errorf("MarshalJSON = %s, want the ID next to the fields", got)
+	}
+	var raw RawObject
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"n": int64(1)}
+	if raw.ID != "t1" || !reflect.DeepEqual(raw.Data, want) {
+		t.Errorf("UnmarshalJSON = %q, %v, want %q, %v",
+			raw.ID, raw.Data, "t1", want)
+	}
+}
+
+func TestRawResourceGuardrails(t *testing.T) {
+	db := NewMemoryDb()
+	denied := errors.New("admins only")
+	router := NewRouter(db).
+		RegisterRawResource("things", RawOptions{}).
+		RegisterRawResource("admin", RawOptions{
+			Writable: true, MaxBodyBytes: 16,
+			Authorize: func(req *http.Request) error {
+				if req.Header.Get("X-Admin") == "" {
+					return denied
+				}
+				return nil
+			}})
+
+	for _, method := range []string{
+		http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		target := "/things/t1"
+		if method == http.MethodPost {
+			target = "/things"
+		}
+		w, body := serve(router, method, target, `{}`)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s on a read-only resource: status %d: %s",
+				method, w.Code, body)
+		}
+	}
+	if w, body := serve(router, http.MethodGet, "/things", ""); w.Code !=
+		http.StatusOK {
+		t.Errorf("GET on a read-only resource: status %d: %s", w.Code, body)
+	}
+
+	if w, _ := serve(router, http.MethodGet, "/admin", ""); w.Code !=
+		http.StatusForbidden {
+		t.Errorf("unauthorized GET: status %d, want 403", w.Code)
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/admin/a1",
+		strings.NewReader(`{"field": "longer than sixteen bytes"}`))
+	req.Header.Set("X-Admin", "1")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized PUT: status %d, want 413: %s", w.Code, w.Body)
+	}
+}
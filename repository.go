@@ -0,0 +1,179 @@
+package rest2firestore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+)
+
+// structObject stores a plain struct through its firestore tags. The
+// optional capabilities are taken from the struct or its pointer.
+type structObject[T any] struct {
+	value *T
+}
+
+var _ ObjectV2 = structObject[struct{}]{}
+var _ cloner = structObject[struct{}]{}
+
+func (s structObject[T]) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	value := new(T)
+	if err := doc.DataTo(value); err != nil {
+		return nil, err
+	}
+	return structObject[T]{value: value}, nil
+}
+
+func (s structObject[T]) Serialize() {
+}
+
+func (s structObject[T]) stored() interface{} {
+	return s.value
+}
+
+func (s structObject[T]) clone() ObjectV2 {
+	value := *s.value
+	return structObject[T]{value: &value}
+}
+
+func (s structObject[T]) decodeJSON(decoder *json.Decoder) (ObjectV2, error) {
+	value := new(T)
+	if err := decoder.Decode(value); err != nil {
+		return nil, err
+	}
+	return structObject[T]{value: value}, nil
+}
+
+func (s structObject[T]) Validate() error {
+	if validator, ok := interface{}(s.value).(Validator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
+
+func (s structObject[T]) Search(
+	ctx context.Context, client *firestore.Client) ([]string, error) {
+	if searcher, ok := interface{}(s.value).(Searcher); ok {
+		return searcher.Search(ctx, client)
+	}
+	return nil, nil
+}
+
+func (s structObject[T]) SearchQuery(client *firestore.Client) (
+	firestore.Query, bool) {
+	if searcher, ok := interface{}(s.value).(QuerySearcher); ok {
+		return searcher.SearchQuery(client)
+	}
+	return firestore.Query{}, false
+}
+
+func (s structObject[T]) Subcollections() []Subcollection {
+	if provider, ok := interface{}(s.value).(SubcollectionProvider); ok {
+		return provider.Subcollections()
+	}
+	return nil
+}
+
+// Repository is typed access through a Db to documents stored as the
+// struct type T, read and written with its firestore tags. T needs none of
+// the Object methods; it may still implement Validator, Searcher,
+// QuerySearcher, SubcollectionProvider or Matcher, on T or *T.
+type Repository[T any] struct {
+	db    Db
+	proto Object
+}
+
+func NewRepository[T any](db Db) *Repository[T] {
+	proto := AdaptV2(structObject[T]{value: new(T)})
+	return &Repository[T]{db: db, proto: proto}
+}
+
+// Object wraps value for the untyped Db API.
+func (r *Repository[T]) Object(value T) Object {
+	return AdaptV2(structObject[T]{value: &value})
+}
+
+func (r *Repository[T]) value(op string, obj Object) (T, error) {
+	s, ok := AdaptLegacy(obj).(structObject[T])
+	if !ok || s.value == nil {
+		var zero T
+		return zero, fmt.Errorf("%s - Db returned %T, not %T",
+			op, Underlying(obj), zero)
+	}
+	return *s.value, nil
+}
+
+func (r *Repository[T]) values(op string, objs []Object) ([]T, error) {
+	values := make([]T, 0, len(objs))
+	for _, obj := range objs {
+		value, err := r.value(op, obj)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (r *Repository[T]) List(
+	ctx context.Context, collection []string) ([]T, error) {
+	objs, err := r.db.List(ctx, r.proto, collection)
+	if err != nil {
+		return nil, err
+	}
+	return r.values("List", objs)
+}
+
+func (r *Repository[T]) ListWithQuery(ctx context.Context,
+	collection []string, q *ListQuery) ([]T, string, error) {
+	objs, cursor, err := r.db.ListWithQuery(ctx, r.proto, collection, q)
+	if err != nil {
+		return nil, "", err
+	}
+	values, err := r.values("List", objs)
+	return values, cursor, err
+}
+
+func (r *Repository[T]) Get(ctx context.Context, document []string) (T, error) {
+	obj, err := r.db.Get(ctx, r.proto, document)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return r.value("Get", obj)
+}
+
+func (r *Repository[T]) Post(
+	ctx context.Context, value T, collection []string) (T, error) {
+	obj, err := r.db.Post(ctx, r.Object(value), collection)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return r.value("Post", obj)
+}
+
+func (r *Repository[T]) Put(
+	ctx context.Context, value T, document []string) (T, error) {
+	obj, err := r.db.Put(ctx, r.Object(value), document)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return r.value("Put", obj)
+}
+
+func (r *Repository[T]) Patch(ctx context.Context, value T) (T, error) {
+	obj, err := r.db.Patch(ctx, r.Object(value))
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return r.value("Patch", obj)
+}
+
+func (r *Repository[T]) Delete(ctx context.Context, document []string) error {
+	return r.db.Delete(ctx, r.proto, document)
+}
@@ -0,0 +1,161 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// repoUser is a plain struct: Validator and Matcher are on *repoUser.
+type repoUser struct {
+	Email string `firestore:"email"`
+	Name  string `firestore:"name"`
+}
+
+var errNoEmail = errors.New("email is required")
+
+func (u *repoUser) Validate() error {
+	if u.Email == "" {
+		return errNoEmail
+	}
+	return nil
+}
+
+func (u *repoUser) Matches(other Object) bool {
+	o, ok := Underlying(other).(*repoUser)
+	return ok && o.Email == u.Email
+}
+
+func TestRepositoryCRUD(t *testing.T) {
+	ctx := context.Background()
+	repo := NewRepository[repoUser](NewMemoryDb())
+	collection := []string{"users"}
+
+	put, err := repo.Put(ctx, repoUser{Email: "a@example.com", Name: "a"},
+		append(collection, "a"))
+	if err != nil || put.Name != "a" {
+		t.Fatalf("Put = %+v, %v", put, err)
+	}
+	got, err := repo.Get(ctx, append(collection, "a"))
+	if err != nil || got != put {
+		t.Errorf("Get = %+v, %v, want %+v", got, err, put)
+	}
+
+	posted, err := repo.Post(ctx, repoUser{Email: "b@example.com", Name: "b"},
+		collection)
+	if err != nil || posted.Name != "b" {
+		t.Fatalf("Post = %+v, %v", posted, err)
+	}
+	// *repoUser's Matches finds the existing document.
+	found, err := repo.Post(ctx,
+		repoUser{Email: "b@example.com", Name: "other"}, collection)
+	if err != nil || found.Name != "b" {
+		t.Errorf("second Post = %+v, %v, want the existing b", found, err)
+	}
+
+	patched, err := repo.Patch(ctx, repoUser{Email: "a@example.com",
+		Name: "renamed"})
+	if err != nil || patched.Name != "renamed" {
+		t.Errorf("Patch = %+v, %v, want renamed", patched, err)
+	}
+
+	users, err := repo.List(ctx, collection)
+	want := []repoUser{
+		{Email: "a@example.com", Name: "renamed"},
+		{Email: "b@example.com", Name: "b"},
+	}
+	if err != nil || !sameUsers(users, want) {
+		t.Errorf("List = %+v, %v, want %+v", users, err, want)
+	}
+	users, _, err = repo.ListWithQuery(ctx, collection, nil)
+	if err != nil || !sameUsers(users, want) {
+		t.Errorf("ListWithQuery = %+v, %v, want %+v", users, err, want)
+	}
+
+	if err := repo.Delete(ctx, append(collection, "a")); err != nil {
+		t.Fatal(err)
+	}
+	got, err = repo.Get(ctx, append(collection, "a"))
+	if !errors.Is(err, ErrNotFound) || got != (repoUser{}) {
+		t.Errorf("Get after Delete = %+v, %v, want ErrNotFound", got, err)
+	}
+}
+
+// sameUsers compares users in any order, as List of Post's random IDs is.
+func sameUsers(got, want []repoUser) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := map[repoUser]int{}
+	for _, user := range got {
+		seen[user]++
+	}
+	for _, user := range want {
+		seen[user]--
+	}
+	for _, n := range seen {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRepositoryValidator(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemoryDb()
+	repo := NewRepository[repoUser](db)
+	document := []string{"users", "a"}
+	if _, err := repo.Put(ctx, repoUser{Name: "a"}, document); !errors.Is(
+		err, errNoEmail) {
+		t.Errorf("Put of an invalid user = %v, want errNoEmail", err)
+	}
+	if _, err := repo.Post(ctx, repoUser{Name: "a"},
+		document[:1]); !errors.Is(err, errNoEmail) {
+		t.Errorf("Post of an invalid user = %v, want errNoEmail", err)
+	}
+	if _, err := repo.Get(ctx, document); !errors.Is(err, ErrNotFound) {
+		t.Errorf("an invalid user was stored: %v", err)
+	}
+	// The Validator is reached through the untyped API too.
+	if _, err := db.Put(ctx, repo.Object(repoUser{}), document); !errors.Is(
+		err, errNoEmail) {
+		t.Errorf("Db.Put of an invalid user = %v, want errNoEmail", err)
+	}
+}
+
+// wrongTypeDb returns another model from Get, and an empty one from List.
+type wrongTypeDb struct {
+	Db
+}
+
+func (d wrongTypeDb) Get(
+	ctx context.Context, obj Object, document []string) (Object, error) {
+	return AdaptV2(&testUser{}), nil
+}
+
+func (d wrongTypeDb) List(
+	ctx context.Context, obj Object, collection []string) ([]Object, error) {
+	return []Object{AdaptV2(structObject[repoUser]{})}, nil
+}
+
+func TestRepositoryTypeMismatch(t *testing.T) {
+	ctx := context.Background()
+	repo := NewRepository[repoUser](wrongTypeDb{NewMemoryDb()})
+	got, err := repo.Get(ctx, []string{"users", "a"})
+	if err == nil || got != (repoUser{}) {
+		t.Fatalf("Get = %+v, %v, want a type error", got, err)
+	}
+	want := "Get - Db returned *rest2firestore.testUser, " +
+		"not rest2firestore.repoUser"
+	if err.Error() != want {
+		t.Errorf("Get = %q, want %q", err, want)
+	}
+	users, err := repo.List(ctx, []string{"users"})
+	if err == nil || users != nil ||
+		!strings.HasPrefix(err.Error(), "List - Db returned") {
+		t.Errorf("List of an empty object = %+v, %v, want a type error",
+			users, err)
+	}
+}
@@ -0,0 +1,151 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ReservedPrefix marks collections owned by this package. User-originated
+// paths whose collection IDs start with it are rejected with
+// ErrReservedPath.
+var ReservedPrefix = "_r2f_"
+
+var ErrReservedPath = errors.New("path is in the reserved namespace")
+
+func InternalCollection(name string) string {
+	if isReservedName(name) {
+		return name
+	}
+	return ReservedPrefix + strings.TrimLeft(name, "_")
+}
+
+func isReservedName(collection_id string) bool {
+	return ReservedPrefix != "" && strings.HasPrefix(collection_id, ReservedPrefix)
+}
+
+func isReservedPath(segments []string) bool {
+	for i := 0; i < len(segments); i += 2 {
+		if isReservedName(segments[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithReservedAccess returns a FirestoreDb sharing the same client that is
+// allowed to read and write reserved collections. It is meant for admin
+// tooling only.
+func (db *FirestoreDb) WithReservedAccess() *FirestoreDb {
+	clone := *db
+	clone.allow_reserved = true
+	return &clone
+}
+
+// MigrateInternalCollections moves the named top-level collections, along
+// with every subcollection beneath them, under their reserved names.
+func (db *FirestoreDb) MigrateInternalCollections(
+	ctx context.Context, names ...string) error {
+	client := db.nextClient()
+	for _, name := range names {
+		target := InternalCollection(name)
+		if name == target {
+			continue
+		}
+		err := moveCollectionTree(
+			ctx, client.Collection(name), client.Collection(target))
+		if err != nil {
+			return fmt.Errorf(
+				"%s:MigrateInternalCollections - could not move to %s: %w",
+				name, target, err)
+		}
+	}
+	return nil
+}
+
+func moveCollectionTree(
+	ctx context.Context, src, dst *firestore.CollectionRef) error {
+	refs, err := src.DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if err := moveDocumentTree(ctx, ref, dst.Doc(ref.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func moveDocumentTree(
+	ctx context.Context, src, dst *firestore.DocumentRef) error {
+	doc, err := src.Get(ctx)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return err
+	}
+	exists := doc != nil && doc.Exists()
+	if exists {
+		if _, err := dst.Set(ctx, doc.Data()); err != nil {
+			return err
+		}
+	}
+	if err := moveSubcollections(ctx, src, dst); err != nil {
+		return err
+	}
+	if exists {
+		if _, err := src.Delete(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func moveSubcollections(
+	ctx context.Context, src, dst *firestore.DocumentRef) error {
+	collections := src.Collections(ctx)
+	for {
+		collection, err := collections.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = moveCollectionTree(ctx, collection, dst.Collection(collection.ID))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// deleteDocumentTree queues the deletes of ref and of every document below
+// it on batch, finding subcollections as they are stored.
+func deleteDocumentTree(ctx context.Context, batch *bulkWriter,
+	ref *firestore.DocumentRef) error {
+	collections := ref.Collections(ctx)
+	for {
+		collection, err := collections.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		refs, err := collection.DocumentRefs(ctx).GetAll()
+		if err != nil {
+			return err
+		}
+		for _, child := range refs {
+			if err := deleteDocumentTree(ctx, batch, child); err != nil {
+				return err
+			}
+		}
+	}
+	return batch.delete(ref)
+}
@@ -0,0 +1,303 @@
+// Package testutil holds assertion helpers for tests of code built on
+// rest2firestore. They only use the public Db interface, so they work the
+// same against FirestoreDb and any other implementation.
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1919yuan/rest2firestore"
+)
+
+type compareOptions struct {
+	ignore           map[string]bool
+	time_tolerance   time.Duration
+	nil_equals_empty bool
+}
+
+type Option func(*compareOptions)
+
+// IgnoreFields skips the named fields at any depth. Names match either the
+// Go field name or its firestore tag.
+func IgnoreFields(names ...string) Option {
+	return func(o *compareOptions) {
+		for _, name := range names {
+			o.ignore[name] = true
+		}
+	}
+}
+
+func TimeTolerance(d time.Duration) Option {
+	return func(o *compareOptions) {
+		o.time_tolerance = d
+	}
+}
+
+func NilEqualsEmpty() Option {
+	return func(o *compareOptions) {
+		o.nil_equals_empty = true
+	}
+}
+
+func newCompareOptions(opts []Option) *compareOptions {
+	o := &compareOptions{ignore: map[string]bool{}}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func AssertObjectEqual(
+	t testing.TB, want, got rest2firestore.Object, opts ...Option) {
+	t.Helper()
+	o := newCompareOptions(opts)
+	var mismatches []string
+	diff("", reflect.ValueOf(rest2firestore.Underlying(want)),
+		reflect.ValueOf(rest2firestore.Underlying(got)), o, &mismatches)
+	if len(mismatches) > 0 {
+		t.Errorf("objects differ:\n%s", strings.Join(mismatches, "\n"))
+	}
+}
+
+// AssertDocExists reads document through db and checks that every field in
+// want_fields matches the stored value. Fields not listed are ignored.
+func AssertDocExists(t testing.TB, db rest2firestore.Db,
+	dummy rest2firestore.Object, document []string,
+	want_fields map[string]interface{}, opts ...Option) {
+	t.Helper()
+	obj, err := db.Get(context.Background(), dummy, document)
+	if err != nil {
+		t.Errorf("%s: document not readable: %v", strings.Join(document, "/"),
+			err)
+		return
+	}
+	got_fields := objectFields(reflect.ValueOf(rest2firestore.Underlying(obj)))
+	o := newCompareOptions(opts)
+	var mismatches []string
+	for _, key := range sortedKeys(reflect.ValueOf(want_fields)) {
+		name := key.String()
+		got, ok := got_fields[name]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("%s: missing", name))
+			continue
+		}
+		diff(name, reflect.ValueOf(want_fields[name]), got, o, &mismatches)
+	}
+	if len(mismatches) > 0 {
+		t.Errorf("%s: document differs:\n%s", strings.Join(document, "/"),
+			strings.Join(mismatches, "\n"))
+	}
+}
+
+func AssertCollectionCount(t testing.TB, db rest2firestore.Db,
+	dummy rest2firestore.Object, collection []string, n int) {
+	t.Helper()
+	objs, err := db.List(context.Background(), dummy, collection)
+	if err != nil {
+		t.Errorf("%s: collection not listable: %v",
+			strings.Join(collection, "/"), err)
+		return
+	}
+	if len(objs) != n {
+		t.Errorf("%s: want %d documents, got %d",
+			strings.Join(collection, "/"), n, len(objs))
+	}
+}
+
+func fieldName(field reflect.StructField) string {
+	tag := strings.Split(field.Tag.Get("firestore"), ",")[0]
+	if tag != "" && tag != "-" {
+		return tag
+	}
+	return field.Name
+}
+
+func objectFields(v reflect.Value) map[string]reflect.Value {
+	v = indirect(v)
+	fields := map[string]reflect.Value{}
+	if v.Kind() != reflect.Struct {
+		return fields
+	}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		fields[fieldName(field)] = v.Field(i)
+	}
+	return fields
+}
+
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+func isEmpty(v reflect.Value) bool {
+	if !v.IsValid() {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	}
+	return false
+}
+
+func isNumber(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
+		reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return float64(v.Uint())
+	}
+	return float64(v.Int())
+}
+
+func sortedKeys(m reflect.Value) []reflect.Value {
+	keys := m.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+	})
+	return keys
+}
+
+func format(v reflect.Value) string {
+	if !v.IsValid() {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%#v", v.Interface())
+}
+
+func join(parent, child string) string {
+	if parent == "" {
+		return child
+	}
+	return parent + "." + child
+}
+
+// diff appends one line per mismatching leaf, addressed by its field path.
+func diff(path string, want, got reflect.Value, o *compareOptions,
+	out *[]string) {
+	mismatch := func() {
+		label := path
+		if label == "" {
+			label = "(root)"
+		}
+		*out = append(*out, fmt.Sprintf("%s: want %s, got %s",
+			label, format(want), format(got)))
+	}
+	want = indirect(want)
+	got = indirect(got)
+	if !want.IsValid() || !got.IsValid() {
+		if want.IsValid() == got.IsValid() {
+			return
+		}
+		if o.nil_equals_empty && isEmpty(want) && isEmpty(got) {
+			return
+		}
+		mismatch()
+		return
+	}
+	if isNumber(want) && isNumber(got) {
+		if toFloat(want) != toFloat(got) {
+			mismatch()
+		}
+		return
+	}
+	if want.Type() != got.Type() {
+		mismatch()
+		return
+	}
+	if want_time, ok := want.Interface().(time.Time); ok {
+		delta := want_time.Sub(got.Interface().(time.Time))
+		if delta < 0 {
+			delta = -delta
+		}
+		if delta > o.time_tolerance {
+			mismatch()
+		}
+		return
+	}
+	switch want.Kind() {
+	case reflect.Struct:
+		for i := 0; i < want.NumField(); i++ {
+			field := want.Type().Field(i)
+			if field.PkgPath != "" || o.ignore[field.Name] ||
+				o.ignore[fieldName(field)] {
+				continue
+			}
+			diff(join(path, fieldName(field)), want.Field(i), got.Field(i), o,
+				out)
+		}
+	case reflect.Map:
+		if want.IsNil() != got.IsNil() &&
+			!(o.nil_equals_empty && want.Len() == 0 && got.Len() == 0) {
+			mismatch()
+			return
+		}
+		for _, key := range sortedKeys(want) {
+			name := fmt.Sprint(key.Interface())
+			if o.ignore[name] {
+				continue
+			}
+			diff(join(path, name), want.MapIndex(key), got.MapIndex(key), o, out)
+		}
+		for _, key := range sortedKeys(got) {
+			name := fmt.Sprint(key.Interface())
+			if !o.ignore[name] && !want.MapIndex(key).IsValid() {
+				*out = append(*out, fmt.Sprintf("%s: unexpected %s",
+					join(path, name), format(got.MapIndex(key))))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if want.Kind() == reflect.Slice && want.IsNil() != got.IsNil() &&
+			!(o.nil_equals_empty && want.Len() == 0 && got.Len() == 0) {
+			mismatch()
+			return
+		}
+		n := want.Len()
+		if got.Len() > n {
+			n = got.Len()
+		}
+		for i := 0; i < n; i++ {
+			item_path := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= want.Len():
+				*out = append(*out, fmt.Sprintf("%s: unexpected %s",
+					item_path, format(got.Index(i))))
+			case i >= got.Len():
+				*out = append(*out, fmt.Sprintf("%s: missing %s",
+					item_path, format(want.Index(i))))
+			default:
+				diff(item_path, want.Index(i), got.Index(i), o, out)
+			}
+		}
+	default:
+		if !reflect.DeepEqual(want.Interface(), got.Interface()) {
+			mismatch()
+		}
+	}
+}
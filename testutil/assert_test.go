@@ -0,0 +1,125 @@
+package testutil
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type address struct {
+	City string `firestore:"city"`
+}
+
+type profile struct {
+	Name    string            `firestore:"name"`
+	Age     int               `firestore:"age"`
+	Seen    time.Time         `firestore:"seen"`
+	Home    *address          `firestore:"home"`
+	Tags    []string          `firestore:"tags"`
+	Extra   map[string]string `firestore:"extra"`
+	Version int64
+	secret  string
+}
+
+func TestDiff(t *testing.T) {
+	seen := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		want, got interface{}
+		opts      []Option
+		lines     []string
+	}{{
+		name: "equal",
+		want: &profile{Name: "a", Seen: seen, Home: &address{City: "x"}},
+		got:  &profile{Name: "a", Seen: seen, Home: &address{City: "x"}},
+	}, {
+		name:  "nested field",
+		want:  &profile{Home: &address{City: "x"}},
+		got:   &profile{Home: &address{City: "y"}},
+		lines: []string{`home.city: want "x", got "y"`},
+	}, {
+		name:  "numbers of different types",
+		want:  map[string]interface{}{"n": 1, "m": 2.5},
+		got:   map[string]interface{}{"n": int64(1), "m": 2},
+		lines: []string{`m: want 2.5, got 2`},
+	}, {
+		name: "ignore by tag and by Go name",
+		want: &profile{Name: "a", Version: 1, secret: "s"},
+		got:  &profile{Name: "b", Version: 2},
+		opts: []Option{IgnoreFields("name", "Version")},
+	}, {
+		name:  "ignore map keys",
+		want:  map[string]int{"kept": 1, "skipped": 1},
+		got:   map[string]int{"kept": 2, "skipped": 2, "other": 2},
+		opts:  []Option{IgnoreFields("skipped", "other")},
+		lines: []string{`kept: want 1, got 2`},
+	}, {
+		name: "time within tolerance",
+		want: &profile{Seen: seen},
+		got:  &profile{Seen: seen.Add(-time.Second)},
+		opts: []Option{TimeTolerance(time.Second)},
+	}, {
+		name: "time beyond tolerance",
+		want: &profile{Seen: seen},
+		got:  &profile{Seen: seen.Add(2 * time.Second)},
+		opts: []Option{TimeTolerance(time.Second)},
+		lines: []string{"seen: want " + format(reflect.ValueOf(seen)) +
+			", got " + format(reflect.ValueOf(seen.Add(2*time.Second)))},
+	}, {
+		name: "nil and empty",
+		want: &profile{},
+		got:  &profile{Tags: []string{}, Extra: map[string]string{}},
+		lines: []string{
+			`tags: want []string(nil), got []string{}`,
+			`extra: want map[string]string(nil), got map[string]string{}`,
+		},
+	}, {
+		name: "nil equals empty",
+		want: &profile{},
+		got:  &profile{Tags: []string{}, Extra: map[string]string{}},
+		opts: []Option{NilEqualsEmpty()},
+	}, {
+		name:  "nil pointer",
+		want:  &profile{},
+		got:   &profile{Home: &address{}},
+		lines: []string{`home: want <nil>, got testutil.address{City:""}`},
+	}, {
+		name: "extra and missing map keys",
+		want: map[string]string{"a": "1", "b": "2"},
+		got:  map[string]string{"b": "2", "c": "3"},
+		lines: []string{
+			`a: want "1", got <nil>`,
+			`c: unexpected "3"`,
+		},
+	}, {
+		name: "extra and missing slice items",
+		want: &profile{Tags: []string{"a", "b", "c"}},
+		got:  &profile{Tags: []string{"a", "x"}},
+		lines: []string{
+			`tags[1]: want "b", got "x"`,
+			`tags[2]: missing "c"`,
+		},
+	}, {
+		name:  "unexpected slice item",
+		want:  []int{1},
+		got:   []int{1, 2},
+		lines: []string{`[1]: unexpected 2`},
+	}, {
+		name:  "type mismatch",
+		want:  map[string]interface{}{"v": "1"},
+		got:   map[string]interface{}{"v": 1},
+		lines: []string{`v: want "1", got 1`},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var lines []string
+			diff("", reflect.ValueOf(test.want), reflect.ValueOf(test.got),
+				newCompareOptions(test.opts), &lines)
+			if !reflect.DeepEqual(lines, test.lines) {
+				t.Errorf("diff gave\n%s\nwant\n%s", strings.Join(lines, "\n"),
+					strings.Join(test.lines, "\n"))
+			}
+		})
+	}
+}
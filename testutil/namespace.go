@@ -0,0 +1,161 @@
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/1919yuan/rest2firestore"
+)
+
+const NamespaceCollection = "tests"
+
+var namespace_seq int64
+
+// NamespacedDb roots every path under tests/{run_id}, so tests sharing one
+// emulator do not see each other's documents. Code under test only sees
+// logical paths. Patch and the Search half of Post locate documents
+// through the object's own queries, so this wrapper cannot scope them.
+// ListGroup is only scoped when db is a ScopedGroupLister.
+type NamespacedDb struct {
+	db   rest2firestore.Db
+	root []string
+
+	mu      sync.Mutex
+	touched map[string]rest2firestore.Object
+}
+
+var _ rest2firestore.Db = &NamespacedDb{}
+
+// Namespace wraps db in a fresh namespace for t and clears every top-level
+// collection written through it when t finishes.
+func Namespace(t testing.TB, db rest2firestore.Db) *NamespacedDb {
+	t.Helper()
+	run_id := fmt.Sprintf("%s-%d-%d",
+		strings.ReplaceAll(t.Name(), "/", "_"), time.Now().UnixNano(),
+		atomic.AddInt64(&namespace_seq, 1))
+	n := &NamespacedDb{
+		db:      db,
+		root:    []string{NamespaceCollection, run_id},
+		touched: map[string]rest2firestore.Object{},
+	}
+	t.Cleanup(func() {
+		if err := n.Teardown(context.Background()); err != nil {
+			t.Errorf("%s: namespace not torn down: %v", n.Root(), err)
+		}
+	})
+	return n
+}
+
+// Root is the physical path of the namespace document.
+func (n *NamespacedDb) Root() string {
+	return strings.Join(n.root, "/")
+}
+
+func (n *NamespacedDb) path(logical []string) []string {
+	physical := make([]string, 0, len(n.root)+len(logical))
+	return append(append(physical, n.root...), logical...)
+}
+
+// touch remembers top-level collections for Teardown. Writes deeper down
+// are cleared through the Subcollections of their top-level ancestor.
+func (n *NamespacedDb) touch(
+	dummy rest2firestore.Object, logical []string, top_level int) {
+	if len(logical) != top_level {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.touched[logical[0]]; !ok {
+		n.touched[logical[0]] = dummy
+	}
+}
+
+// Teardown clears every top-level collection written through n, with the
+// first object written to each as the prototype.
+func (n *NamespacedDb) Teardown(ctx context.Context) error {
+	n.mu.Lock()
+	touched := n.touched
+	n.touched = map[string]rest2firestore.Object{}
+	n.mu.Unlock()
+	for collection, dummy := range touched {
+		err := n.db.Clear(ctx, dummy, n.path([]string{collection}))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *NamespacedDb) List(
+	ctx context.Context, obj rest2firestore.Object, collection []string) (
+	[]rest2firestore.Object, error) {
+	return n.db.List(ctx, obj, n.path(collection))
+}
+
+func (n *NamespacedDb) ListWithQuery(ctx context.Context,
+	obj rest2firestore.Object, collection []string,
+	q *rest2firestore.ListQuery) ([]rest2firestore.Object, string, error) {
+	return n.db.ListWithQuery(ctx, obj, n.path(collection), q)
+}
+
+func (n *NamespacedDb) ListGroup(ctx context.Context,
+	obj rest2firestore.Object, collection_id string) (
+	[]rest2firestore.Object, error) {
+	if scoped, ok := n.db.(rest2firestore.ScopedGroupLister); ok {
+		return scoped.ListGroupUnder(ctx, obj, n.root, collection_id)
+	}
+	return n.db.ListGroup(ctx, obj, collection_id)
+}
+
+func (n *NamespacedDb) Clear(ctx context.Context,
+	dummy rest2firestore.Object, collection []string) error {
+	return n.db.Clear(ctx, dummy, n.path(collection))
+}
+
+func (n *NamespacedDb) Post(
+	ctx context.Context, obj rest2firestore.Object, collection []string) (
+	rest2firestore.Object, error) {
+	n.touch(obj, collection, 1)
+	return n.db.Post(ctx, obj, n.path(collection))
+}
+
+func (n *NamespacedDb) FindOrCreate(ctx context.Context,
+	obj rest2firestore.Object, collection []string) (
+	rest2firestore.Object, bool, error) {
+	n.touch(obj, collection, 1)
+	return n.db.FindOrCreate(ctx, obj, n.path(collection))
+}
+
+func (n *NamespacedDb) Put(
+	ctx context.Context, obj rest2firestore.Object, document []string) (
+	rest2firestore.Object, error) {
+	n.touch(obj, document, 2)
+	return n.db.Put(ctx, obj, n.path(document))
+}
+
+func (n *NamespacedDb) Patch(ctx context.Context, obj rest2firestore.Object) (
+	rest2firestore.Object, error) {
+	return n.db.Patch(ctx, obj)
+}
+
+func (n *NamespacedDb) PatchFields(ctx context.Context,
+	dummy rest2firestore.Object, document []string,
+	fields map[string]interface{}) (rest2firestore.Object, error) {
+	return n.db.PatchFields(ctx, dummy, n.path(document), fields)
+}
+
+func (n *NamespacedDb) Get(
+	ctx context.Context, dummy rest2firestore.Object, document []string) (
+	rest2firestore.Object, error) {
+	return n.db.Get(ctx, dummy, n.path(document))
+}
+
+func (n *NamespacedDb) Delete(ctx context.Context,
+	dummy rest2firestore.Object, document []string) error {
+	return n.db.Delete(ctx, dummy, n.path(document))
+}
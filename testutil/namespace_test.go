@@ -0,0 +1,106 @@
+package testutil
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+	"github.com/1919yuan/rest2firestore"
+)
+
+type author struct {
+	Name string `firestore:"name"`
+}
+
+func (a *author) Deserialize(doc *firestore.DocumentSnapshot) (
+	rest2firestore.ObjectV2, error) {
+	result := &author{}
+	return result, doc.DataTo(result)
+}
+
+func (a *author) Serialize() {
+}
+
+func (a *author) Subcollections() []rest2firestore.Subcollection {
+	return []rest2firestore.Subcollection{
+		{Name: "posts", Obj: rest2firestore.AdaptV2(&post{})}}
+}
+
+type post struct {
+	Title string `firestore:"title"`
+}
+
+func (p *post) Deserialize(doc *firestore.DocumentSnapshot) (
+	rest2firestore.ObjectV2, error) {
+	result := &post{}
+	return result, doc.DataTo(result)
+}
+
+func (p *post) Serialize() {
+}
+
+// testNamespaceIsolation runs the same writes and collection group reads
+// in two namespaces of db at once.
+func testNamespaceIsolation(t *testing.T, db rest2firestore.Db) {
+	ctx := context.Background()
+	namespaces := []*NamespacedDb{Namespace(t, db), Namespace(t, db)}
+	var written, done sync.WaitGroup
+	written.Add(len(namespaces))
+	done.Add(len(namespaces))
+	for _, n := range namespaces {
+		go func(n *NamespacedDb) {
+			defer done.Done()
+			writes := []struct {
+				obj      rest2firestore.ObjectV2
+				document []string
+			}{
+				{&author{Name: "Ann"}, []string{"authors", "a1"}},
+				{&post{Title: "one"}, []string{"authors", "a1", "posts", "p1"}},
+				{&post{Title: "two"}, []string{"authors", "a2", "posts", "p1"}},
+			}
+			for _, write := range writes {
+				_, err := n.Put(
+					ctx, rest2firestore.AdaptV2(write.obj), write.document)
+				if err != nil {
+					t.Errorf("%s: Put %v: %v", n.Root(), write.document, err)
+				}
+			}
+			written.Done()
+			written.Wait()
+			posts, err := n.ListGroup(ctx, rest2firestore.AdaptV2(&post{}),
+				"posts")
+			if err != nil || len(posts) != 2 {
+				t.Errorf("%s: ListGroup returned %d posts, %v, want 2",
+					n.Root(), len(posts), err)
+			}
+			// a2 only has posts, so it is not listed.
+			AssertCollectionCount(t, n, rest2firestore.AdaptV2(&author{}),
+				[]string{"authors"}, 1)
+		}(n)
+	}
+	done.Wait()
+	posts, err := db.ListGroup(ctx, rest2firestore.AdaptV2(&post{}), "posts")
+	if err != nil || len(posts) < 4 {
+		t.Errorf("ListGroup outside the namespaces returned %d posts, %v, "+
+			"want at least 4", len(posts), err)
+	}
+}
+
+func TestNamespaceIsolationMemory(t *testing.T) {
+	testNamespaceIsolation(t, rest2firestore.NewMemoryDb())
+}
+
+func TestNamespaceIsolation(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+	client, err := firestore.NewClient(
+		context.Background(), "rest2firestore-test")
+	if err != nil {
+		t.Fatalf("could not connect to the emulator: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	testNamespaceIsolation(t, rest2firestore.NewFirestoreDb(client))
+}
@@ -0,0 +1,260 @@
+package rest2firestore
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var ErrNotInTrash = errors.New("document is not in the trash")
+
+type TrashEntry struct {
+	Path       []string
+	DeletedAt  time.Time
+	PurgeAfter time.Time
+}
+
+func trashField(name string) string {
+	return ReservedPrefix + name
+}
+
+func (db *FirestoreDb) trashDoc(document_path string) *firestore.DocumentRef {
+	trash_path := path.Join(InternalCollection("trash"),
+		base64.RawURLEncoding.EncodeToString([]byte(document_path)))
+	return db.clientFor(trash_path).Doc(trash_path)
+}
+
+// EnableTrash turns on the recycle bin for every collection with the given
+// collection ID. Delete then moves documents, subcollections included,
+// into the trash, where they can be restored until retention has passed.
+// Deleting the same path twice keeps only the latest copy. The move is not
+// atomic: a Delete that fails part way leaves some of the tree in the
+// trash and the rest in place, and calling Delete again finishes it.
+func (db *FirestoreDb) EnableTrash(
+	collection_id string, retention time.Duration) {
+	if db.trash == nil {
+		db.trash = map[string]time.Duration{}
+	}
+	db.trash[collection_id] = retention
+}
+
+func (db *FirestoreDb) trashRetention(document []string) (time.Duration, bool) {
+	if len(document) < 2 {
+		return 0, false
+	}
+	retention, ok := db.trash[document[len(document)-2]]
+	return retention, ok
+}
+
+// moveToTrash copies document and its subcollections into its trash entry
+// and then deletes it. Firestore cannot do that atomically, so the entry
+// is marked moving until the document is gone. A Delete that failed part
+// way leaves the rest of the tree where it was, and calling it again
+// resumes into the same entry. An entry that is not moving is an older
+// copy, and it is removed with its subcollections first.
+func (db *FirestoreDb) moveToTrash(ctx context.Context, document []string,
+	retention time.Duration) error {
+	document_path := path.Join(document...)
+	src := db.clientFor(document_path).Doc(document_path)
+	dst := db.trashDoc(document_path)
+	doc, err := src.Get(ctx)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return fmt.Errorf(
+			"%s:Delete - could not read object for trash: %w", document_path, err)
+	}
+	exists := doc != nil && doc.Exists()
+	entry, err := dst.Get(ctx)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return fmt.Errorf(
+			"%s:Delete - could not read trash entry: %w", document_path, err)
+	}
+	resuming := false
+	if entry != nil && entry.Exists() {
+		resuming, _ = entry.Data()[trashField("moving")].(bool)
+		if !resuming {
+			if err := db.deleteTrashEntry(ctx, dst); err != nil {
+				return fmt.Errorf(
+					"%s:Delete - could not replace trash entry: %w",
+					document_path, err)
+			}
+		}
+	}
+	// A resumed move whose document is already gone keeps the entry's data.
+	if exists || !resuming {
+		data := map[string]interface{}{}
+		if exists {
+			data = doc.Data()
+		}
+		now := db.now()
+		data[trashField("original_path")] = document_path
+		data[trashField("existed")] = exists
+		data[trashField("deleted_at")] = now
+		data[trashField("purge_after")] = now.Add(retention)
+		data[trashField("moving")] = true
+		if _, err := dst.Set(ctx, data); err != nil {
+			return fmt.Errorf(
+				"%s:Delete - could not write trash entry: %w", document_path, err)
+		}
+	}
+	if err := moveSubcollections(ctx, src, dst); err != nil {
+		return fmt.Errorf(
+			"%s:Delete - could not move subcollections to trash: %w",
+			document_path, err)
+	}
+	if _, err := src.Delete(ctx); err != nil {
+		return fmt.Errorf(
+			"%s:Delete - could not delete object: %w", document_path, err)
+	}
+	_, err = dst.Update(ctx, []firestore.Update{
+		{FieldPath: []string{trashField("moving")}, Value: firestore.Delete}})
+	if err != nil {
+		return fmt.Errorf(
+			"%s:Delete - could not complete trash entry: %w", document_path, err)
+	}
+	return nil
+}
+
+// deleteTrashEntry deletes entry and every document below it.
+func (db *FirestoreDb) deleteTrashEntry(
+	ctx context.Context, entry *firestore.DocumentRef) error {
+	batch := db.newBulkWriter(
+		ctx, "Delete", db.clientFor(documentRefPath(entry)))
+	defer batch.close()
+	if err := deleteDocumentTree(ctx, batch, entry); err != nil {
+		return err
+	}
+	return batch.flush()
+}
+
+// Restore moves a trashed document back to where it was deleted from.
+// Like the other trash operations, only a FirestoreDb obtained from
+// WithReservedAccess may call it.
+func (db *FirestoreDb) Restore(ctx context.Context, document []string) error {
+	return db.RestoreAs(ctx, document, document)
+}
+
+// RestoreAs moves a trashed document and its subcollections to target,
+// which may differ from the original path. It fails with ErrAlreadyExists
+// if target is in use.
+func (db *FirestoreDb) RestoreAs(
+	ctx context.Context, document []string, target []string) error {
+	if !db.allow_reserved {
+		return fmt.Errorf("Restore: %w", ErrReservedPath)
+	}
+	if _, _, err := getDocumentPath(target, db.allow_reserved); err != nil {
+		return err
+	}
+	document_path := path.Join(document...)
+	target_path := path.Join(target...)
+	src := db.trashDoc(document_path)
+	dst := db.clientFor(target_path).Doc(target_path)
+	doc, err := src.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return fmt.Errorf("%s:Restore - %w", document_path, ErrNotInTrash)
+	}
+	if err != nil {
+		return fmt.Errorf(
+			"%s:Restore - could not read trash entry: %w", document_path, err)
+	}
+	if existing, err := dst.Get(ctx); err == nil && existing.Exists() {
+		return fmt.Errorf("%s:Restore - %w", target_path, ErrAlreadyExists)
+	} else if err != nil && status.Code(err) != codes.NotFound {
+		return fmt.Errorf(
+			"%s:Restore - could not check target: %w", target_path, err)
+	}
+	data := doc.Data()
+	existed, _ := data[trashField("existed")].(bool)
+	for key := range data {
+		if strings.HasPrefix(key, ReservedPrefix) {
+			delete(data, key)
+		}
+	}
+	if existed {
+		if _, err := dst.Create(ctx, data); err != nil {
+			if status.Code(err) == codes.AlreadyExists {
+				return fmt.Errorf("%s:Restore - %w", target_path, ErrAlreadyExists)
+			}
+			return fmt.Errorf(
+				"%s:Restore - could not restore object: %w", target_path, err)
+		}
+	}
+	if err := moveSubcollections(ctx, src, dst); err != nil {
+		return fmt.Errorf(
+			"%s:Restore - could not restore subcollections: %w", target_path, err)
+	}
+	if _, err := src.Delete(ctx); err != nil {
+		return fmt.Errorf(
+			"%s:Restore - could not remove trash entry: %w", document_path, err)
+	}
+	return nil
+}
+
+func trashEntry(doc *firestore.DocumentSnapshot) TrashEntry {
+	data := doc.Data()
+	original_path, _ := data[trashField("original_path")].(string)
+	deleted_at, _ := data[trashField("deleted_at")].(time.Time)
+	purge_after, _ := data[trashField("purge_after")].(time.Time)
+	return TrashEntry{
+		Path:       strings.Split(original_path, "/"),
+		DeletedAt:  deleted_at,
+		PurgeAfter: purge_after,
+	}
+}
+
+// ListTrash lists trashed documents. Only a FirestoreDb obtained from
+// WithReservedAccess may call it.
+func (db *FirestoreDb) ListTrash(ctx context.Context) ([]TrashEntry, error) {
+	if !db.allow_reserved {
+		return nil, fmt.Errorf("ListTrash: %w", ErrReservedPath)
+	}
+	docs, err := db.nextClient().Collection(
+		InternalCollection("trash")).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("ListTrash - could not list trash: %w", err)
+	}
+	entries := make([]TrashEntry, 0, len(docs))
+	for _, doc := range docs {
+		entries = append(entries, trashEntry(doc))
+	}
+	return entries, nil
+}
+
+// PurgeTrash permanently deletes trash entries whose retention ended
+// before now, BatchSize documents at a time, and returns how many were
+// purged. When it fails, some of them may be purged already. Only a
+// FirestoreDb obtained from WithReservedAccess may call it.
+func (db *FirestoreDb) PurgeTrash(
+	ctx context.Context, now time.Time) (int, error) {
+	if !db.allow_reserved {
+		return 0, fmt.Errorf("PurgeTrash: %w", ErrReservedPath)
+	}
+	client := db.nextClient()
+	docs, err := client.Collection(InternalCollection("trash")).
+		Where(trashField("purge_after"), "<=", now).Documents(ctx).GetAll()
+	if err != nil {
+		return 0, fmt.Errorf("PurgeTrash - could not list trash: %w", err)
+	}
+	batch := db.newBulkWriter(ctx, "PurgeTrash", client)
+	defer batch.close()
+	for _, doc := range docs {
+		if err := ctx.Err(); err != nil {
+			return 0, fmt.Errorf("PurgeTrash - interrupted: %w", err)
+		}
+		if err := deleteDocumentTree(ctx, batch, doc.Ref); err != nil {
+			return 0, fmt.Errorf("%s:PurgeTrash - could not purge: %w",
+				strings.Join(trashEntry(doc).Path, "/"), err)
+		}
+	}
+	if err := batch.flush(); err != nil {
+		return 0, err
+	}
+	return len(docs), nil
+}
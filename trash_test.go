@@ -0,0 +1,186 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTrashNeedsReservedAccess(t *testing.T) {
+	db := NewFirestoreDb(nil)
+	ctx := context.Background()
+	document := []string{"users", "u1"}
+	if _, err := db.ListTrash(ctx); !errors.Is(err, ErrReservedPath) {
+		t.Errorf("ListTrash: %v, want ErrReservedPath", err)
+	}
+	if err := db.Restore(ctx, document); !errors.Is(err, ErrReservedPath) {
+		t.Errorf("Restore: %v, want ErrReservedPath", err)
+	}
+	err := db.RestoreAs(ctx, document, []string{"users", "u2"})
+	if !errors.Is(err, ErrReservedPath) {
+		t.Errorf("RestoreAs: %v, want ErrReservedPath", err)
+	}
+	if _, err := db.PurgeTrash(ctx, time.Now()); !errors.Is(
+		err, ErrReservedPath) {
+		t.Errorf("PurgeTrash: %v, want ErrReservedPath", err)
+	}
+}
+
+func TestTrashRestoreAndPurge(t *testing.T) {
+	db := emulatorDb(t)
+	ctx := context.Background()
+	collection := testCollection("users")
+	now := time.Now()
+	db.Now = func() time.Time { return now }
+	db.EnableTrash(collection[0], time.Hour)
+	admin := db.WithReservedAccess()
+	dummy := AdaptV2(&testUser{})
+
+	document := append(collection, "u1")
+	user := AdaptV2(&testUser{Email: "a@example.com"})
+	if _, err := db.Put(ctx, user, document); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(ctx, dummy, document); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(ctx, dummy, document); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Delete: %v, want ErrNotFound", err)
+	}
+	if err := admin.Restore(ctx, document); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(ctx, dummy, document); err != nil {
+		t.Fatalf("Get after Restore: %v", err)
+	}
+
+	if err := db.Delete(ctx, dummy, document); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Put(ctx, user, document); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.Restore(ctx, document); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Restore over a new document: %v, want ErrAlreadyExists", err)
+	}
+
+	purged, err := admin.PurgeTrash(ctx, now.Add(time.Minute))
+	if err != nil || purged != 0 {
+		t.Errorf("PurgeTrash before the deadline: %d, %v, want 0", purged, err)
+	}
+	purged, err = admin.PurgeTrash(ctx, now.Add(2*time.Hour))
+	if err != nil || purged < 1 {
+		t.Errorf("PurgeTrash after the deadline: %d, %v, want at least 1",
+			purged, err)
+	}
+	err = admin.RestoreAs(ctx, document, append(collection, "u2"))
+	if !errors.Is(err, ErrNotInTrash) {
+		t.Errorf("Restore after purge: %v, want ErrNotInTrash", err)
+	}
+}
+
+// trashedPosts restores author and returns the titles of its posts.
+func trashedPosts(t *testing.T, db *FirestoreDb, author []string) []string {
+	t.Helper()
+	ctx := context.Background()
+	if err := db.WithReservedAccess().Restore(ctx, author); err != nil {
+		t.Fatal(err)
+	}
+	posts, err := db.List(ctx, AdaptV2(&testPost{}), append(author, "posts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, post := range posts {
+		titles = append(titles, Underlying(post).(*testPost).Title)
+	}
+	sort.Strings(titles)
+	return titles
+}
+
+func TestTrashKeepsLatestCopy(t *testing.T) {
+	db := emulatorDb(t)
+	ctx := context.Background()
+	collection := testCollection("authors")
+	db.EnableTrash(collection[0], time.Hour)
+	author := append(collection, "a1")
+	for _, title := range []string{"old", "new"} {
+		if _, err := db.Put(ctx, AdaptV2(&testAuthor{Name: title}),
+			author); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Put(ctx, AdaptV2(&testPost{Title: title}),
+			append(author, "posts", title)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete(ctx, AdaptV2(&testAuthor{}), author); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The second Delete replaced the first copy, subcollections included.
+	if titles := trashedPosts(t, db, author); !reflect.DeepEqual(
+		titles, []string{"new"}) {
+		t.Errorf("restored posts %q, want only the latest copy's", titles)
+	}
+	got, err := db.Get(ctx, AdaptV2(&testAuthor{}), author)
+	if err != nil || Underlying(got).(*testAuthor).Name != "new" {
+		t.Errorf("restored author %v, %v, want new", got, err)
+	}
+}
+
+func TestTrashResumesMove(t *testing.T) {
+	db := emulatorDb(t)
+	ctx := context.Background()
+	collection := testCollection("authors")
+	db.EnableTrash(collection[0], time.Hour)
+	author := append(collection, "a1")
+	if _, err := db.Put(ctx, AdaptV2(&testAuthor{Name: "Ann"}),
+		author); err != nil {
+		t.Fatal(err)
+	}
+	for _, title := range []string{"p1", "p2"} {
+		if _, err := db.Put(ctx, AdaptV2(&testPost{Title: title}),
+			append(author, "posts", title)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A Delete that failed after moving p1 left this behind.
+	entry := db.trashDoc(path.Join(author...))
+	_, err := entry.Set(ctx, map[string]interface{}{
+		trashField("original_path"): path.Join(author...),
+		trashField("existed"):       true,
+		trashField("moving"):        true,
+		"name":                      "Ann",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := path.Join(append(author, "posts", "p1")...)
+	if _, err := entry.Collection("posts").Doc("p1").Set(ctx,
+		map[string]interface{}{"title": "p1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Client().Doc(moved).Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Delete(ctx, AdaptV2(&testAuthor{}), author); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := entry.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, moving := doc.Data()[trashField("moving")]; moving {
+		t.Errorf("the finished entry is still marked moving")
+	}
+	if titles := trashedPosts(t, db, author); !reflect.DeepEqual(
+		titles, []string{"p1", "p2"}) {
+		t.Errorf("restored posts %q, want p1 and p2", titles)
+	}
+}
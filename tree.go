@@ -0,0 +1,205 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultMaxTreeDepth     = 32
+	DefaultMaxTreeDocuments = 100000
+)
+
+var ErrTreeTooLarge = errors.New("document tree too large")
+
+var ErrSubcollectionCycle = errors.New("subcollection prototypes form a cycle")
+
+// TreeStats describes a recursive Delete, Clear, Walk or Export. Depth counts
+// subcollection levels below the starting point, and MaxWidth is the
+// largest collection visited.
+type TreeStats struct {
+	Path      string
+	Depth     int
+	Documents int
+	MaxWidth  int
+}
+
+type TreeTooLargeError struct {
+	Stats        TreeStats
+	MaxDepth     int
+	MaxDocuments int
+}
+
+func (e *TreeTooLargeError) Error() string {
+	return fmt.Sprintf(
+		"%s: document tree too large (depth %d, max %d; %d documents, max %d)",
+		e.Stats.Path, e.Stats.Depth, e.MaxDepth, e.Stats.Documents,
+		e.MaxDocuments)
+}
+
+func (e *TreeTooLargeError) Unwrap() error {
+	return ErrTreeTooLarge
+}
+
+type treeWalk struct {
+	max_depth     int
+	max_documents int
+	progress      func(TreeStats)
+	dry_run       bool
+	stats         TreeStats
+}
+
+func (db *FirestoreDb) newTreeWalk(dry_run bool) *treeWalk {
+	w := &treeWalk{
+		max_depth:     db.MaxTreeDepth,
+		max_documents: db.MaxTreeDocuments,
+		progress:      db.TreeProgress,
+		dry_run:       dry_run,
+	}
+	if w.max_depth == 0 {
+		w.max_depth = DefaultMaxTreeDepth
+	}
+	if w.max_documents == 0 {
+		w.max_documents = DefaultMaxTreeDocuments
+	}
+	return w
+}
+
+// WithTreeLimits returns a FirestoreDb sharing the same client with
+// different traversal limits. A negative limit disables that check.
+func (db *FirestoreDb) WithTreeLimits(depth, documents int) *FirestoreDb {
+	clone := *db
+	clone.MaxTreeDepth = depth
+	clone.MaxTreeDocuments = documents
+	return &clone
+}
+
+func (w *treeWalk) tooLarge() error {
+	return &TreeTooLargeError{
+		Stats:        w.stats,
+		MaxDepth:     w.max_depth,
+		MaxDocuments: w.max_documents,
+	}
+}
+
+func (w *treeWalk) enter(collection_path string, depth int) error {
+	w.stats.Path = collection_path
+	if depth > w.stats.Depth {
+		w.stats.Depth = depth
+	}
+	if w.max_depth >= 0 && depth > w.max_depth {
+		return w.tooLarge()
+	}
+	return nil
+}
+
+func (w *treeWalk) width(n int) {
+	if n > w.stats.MaxWidth {
+		w.stats.MaxWidth = n
+	}
+}
+
+func (w *treeWalk) visit(document_path string) error {
+	w.stats.Path = document_path
+	w.stats.Documents++
+	if w.max_documents >= 0 && w.stats.Documents > w.max_documents {
+		return w.tooLarge()
+	}
+	if w.progress != nil {
+		w.progress(w.stats)
+	}
+	return nil
+}
+
+// prototypeChecks remembers the prototype types a Db has already found
+// free of cycles. A nil *prototypeChecks checks every time.
+type prototypeChecks struct {
+	checked sync.Map
+}
+
+// CheckSubcollections walks the Subcollections declared by proto and its
+// descendants, failing with ErrSubcollectionCycle if a prototype type
+// declares itself somewhere below.
+func CheckSubcollections(proto Object) error {
+	return walkPrototypes(AdaptLegacy(proto), nil, nil)
+}
+
+func (c *prototypeChecks) check(proto ObjectV2) error {
+	if c == nil {
+		return walkPrototypes(proto, nil, nil)
+	}
+	t := reflect.TypeOf(storedValue(proto))
+	if _, ok := c.checked.Load(t); ok {
+		return nil
+	}
+	err := walkPrototypes(proto, nil, nil)
+	if err == nil {
+		c.checked.Store(t, true)
+	}
+	return err
+}
+
+func walkPrototypes(
+	proto ObjectV2, stack []reflect.Type, names []string) error {
+	t := reflect.TypeOf(storedValue(proto))
+	for _, seen := range stack {
+		if seen == t {
+			return fmt.Errorf("%s: %w", strings.Join(names, "/"),
+				ErrSubcollectionCycle)
+		}
+	}
+	subcollections, err := safeSubcollections(
+		"CheckSubcollections", strings.Join(names, "/"), proto)
+	if err != nil {
+		return err
+	}
+	for _, subcollection := range subcollections {
+		err := walkPrototypes(AdaptLegacy(subcollection.Obj),
+			append(stack, t), append(names, subcollection.Name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TreePlanner is the optional capability of a Db to walk what Delete and
+// Clear would remove without removing it.
+type TreePlanner interface {
+	PlanDelete(ctx context.Context, dummy Object, document []string) (
+		TreeStats, error)
+	PlanClear(ctx context.Context, dummy Object, collection []string) (
+		TreeStats, error)
+}
+
+var _ TreePlanner = &FirestoreDb{}
+
+// PlanDelete walks what Delete would remove without deleting anything.
+func (db *FirestoreDb) PlanDelete(
+	ctx context.Context, dummy Object, document []string) (
+	TreeStats, error) {
+	obj := AdaptLegacy(dummy)
+	if err := db.prototypes.check(obj); err != nil {
+		return TreeStats{}, err
+	}
+	w := db.newTreeWalk(true)
+	err := db.delete(ctx, w, obj, document, 0)
+	return w.stats, err
+}
+
+// PlanClear walks what Clear would remove without deleting anything.
+func (db *FirestoreDb) PlanClear(
+	ctx context.Context, dummy Object, collection []string) (
+	TreeStats, error) {
+	obj := AdaptLegacy(dummy)
+	if err := db.prototypes.check(obj); err != nil {
+		return TreeStats{}, err
+	}
+	w := db.newTreeWalk(true)
+	err := db.clear(ctx, w, obj, collection, 0)
+	return w.stats, err
+}
@@ -0,0 +1,201 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+)
+
+// cyclicNode declares itself as its own subcollection, through child
+// when indirect is set.
+type cyclicNode struct {
+	indirect bool
+}
+
+func (n *cyclicNode) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	return &cyclicNode{}, nil
+}
+
+func (n *cyclicNode) Serialize() {
+}
+
+func (n *cyclicNode) Subcollections() []Subcollection {
+	if n.indirect {
+		return []Subcollection{{Name: "children", Obj: AdaptV2(&cyclicChild{})}}
+	}
+	return []Subcollection{{Name: "children", Obj: AdaptV2(&cyclicNode{})}}
+}
+
+type cyclicChild struct{}
+
+func (c *cyclicChild) Deserialize(doc *firestore.DocumentSnapshot) (
+	ObjectV2, error) {
+	return &cyclicChild{}, nil
+}
+
+func (c *cyclicChild) Serialize() {
+}
+
+func (c *cyclicChild) Subcollections() []Subcollection {
+	return []Subcollection{
+		{Name: "grandchildren", Obj: AdaptV2(&cyclicNode{indirect: true})}}
+}
+
+func TestSelfReferencingPrototype(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		proto Object
+		path  string
+	}{
+		{"self", AdaptV2(&cyclicNode{}), "children"},
+		{"indirect", AdaptV2(&cyclicNode{indirect: true}),
+			"children/grandchildren"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckSubcollections(test.proto)
+			if !errors.Is(err, ErrSubcollectionCycle) {
+				t.Fatalf("CheckSubcollections = %v, want ErrSubcollectionCycle",
+					err)
+			}
+			want := test.path + ": " + ErrSubcollectionCycle.Error()
+			if err.Error() != want {
+				t.Errorf("CheckSubcollections = %q, want %q", err, want)
+			}
+			// Recursive operations fail before touching any backend.
+			ctx := context.Background()
+			document := []string{"nodes", "n1"}
+			for name, db := range map[string]Db{
+				"FirestoreDb": NewFirestoreDb(nil),
+				"MemoryDb":    NewMemoryDb(),
+			} {
+				if err := db.Delete(ctx, test.proto, document); !errors.Is(
+					err, ErrSubcollectionCycle) {
+					t.Errorf("%s.Delete = %v, want ErrSubcollectionCycle",
+						name, err)
+				}
+				if err := db.Clear(ctx, test.proto, document[:1]); !errors.Is(
+					err, ErrSubcollectionCycle) {
+					t.Errorf("%s.Clear = %v, want ErrSubcollectionCycle",
+						name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPrototypeChecksPerDb(t *testing.T) {
+	proto := AdaptLegacy(AdaptV2(&testAuthor{}))
+	checked := func(db *FirestoreDb) bool {
+		_, ok := db.prototypes.checked.Load(
+			reflect.TypeOf(storedValue(proto)))
+		return ok
+	}
+	first, second := NewFirestoreDb(nil), NewFirestoreDb(nil)
+	if err := first.prototypes.check(proto); err != nil {
+		t.Fatal(err)
+	}
+	if !checked(first) || checked(second) {
+		t.Errorf("checked by the first Db %v, by the second %v, want true, "+
+			"false", checked(first), checked(second))
+	}
+	// A Db with other limits shares what its original has checked.
+	if !checked(first.WithTreeLimits(1, 1)) {
+		t.Errorf("WithTreeLimits dropped the checked prototypes")
+	}
+	// The zero FirestoreDb has no cache but still checks.
+	if err := (&FirestoreDb{}).prototypes.check(
+		AdaptLegacy(AdaptV2(&cyclicNode{}))); !errors.Is(
+		err, ErrSubcollectionCycle) {
+		t.Errorf("uncached check = %v, want ErrSubcollectionCycle", err)
+	}
+}
+
+// wideAuthor puts an author with n posts and returns its document.
+func wideAuthor(t *testing.T, db Db, n int) []string {
+	t.Helper()
+	ctx := context.Background()
+	author := append(testCollection("authors"), "a1")
+	if _, err := db.Put(ctx, AdaptV2(&testAuthor{Name: "Ann"}),
+		author); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		_, err := db.Put(ctx, AdaptV2(&testPost{Title: strconv.Itoa(i)}),
+			append(author, "posts", "p"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return author
+}
+
+func TestTreeCountCap(t *testing.T) {
+	db := emulatorDb(t)
+	ctx := context.Background()
+	author := wideAuthor(t, db, 5)
+
+	capped := db.WithTreeLimits(0, 3)
+	stats, err := capped.PlanDelete(ctx, AdaptV2(&testAuthor{}), author)
+	var too_large *TreeTooLargeError
+	if !errors.As(err, &too_large) || !errors.Is(err, ErrTreeTooLarge) {
+		t.Fatalf("PlanDelete = %v, want a TreeTooLargeError", err)
+	}
+	if too_large.Stats.Documents != 4 || too_large.MaxDocuments != 3 ||
+		too_large.MaxDepth != DefaultMaxTreeDepth {
+		t.Errorf("TreeTooLargeError = %+v, want 4 documents of at most 3",
+			too_large)
+	}
+	if stats != too_large.Stats {
+		t.Errorf("PlanDelete stats %+v differ from the error's %+v",
+			stats, too_large.Stats)
+	}
+	err = capped.Delete(ctx, AdaptV2(&testAuthor{}), author)
+	if !errors.As(err, &too_large) {
+		t.Fatalf("Delete = %v, want a TreeTooLargeError", err)
+	}
+	if _, err := db.Get(ctx, AdaptV2(&testAuthor{}), author); err != nil {
+		t.Errorf("the capped Delete removed the author: %v", err)
+	}
+}
+
+func TestTreeLimitOverrides(t *testing.T) {
+	db := emulatorDb(t)
+	ctx := context.Background()
+	author := wideAuthor(t, db, 5)
+
+	// The plan gives the counts to re-run with.
+	stats, err := db.PlanDelete(ctx, AdaptV2(&testAuthor{}), author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 6 || stats.Depth != 1 || stats.MaxWidth != 5 {
+		t.Errorf("PlanDelete = %+v, want 6 documents, depth 1, width 5",
+			stats)
+	}
+	for _, limits := range [][2]int{
+		{stats.Depth, stats.Documents}, {-1, -1}} {
+		author := wideAuthor(t, db, 5)
+		var heartbeats int
+		overridden := db.WithTreeLimits(limits[0], limits[1])
+		overridden.TreeProgress = func(TreeStats) { heartbeats++ }
+		if err := overridden.Delete(
+			ctx, AdaptV2(&testAuthor{}), author); err != nil {
+			t.Fatalf("Delete with limits %v: %v", limits, err)
+		}
+		if heartbeats != 6 {
+			t.Errorf("Delete with limits %v sent %d heartbeats, want 6",
+				limits, heartbeats)
+		}
+		posts, err := db.List(ctx, AdaptV2(&testPost{}),
+			append(author, "posts"))
+		if err != nil || len(posts) != 0 {
+			t.Errorf("Delete with limits %v left %d posts, %v",
+				limits, len(posts), err)
+		}
+	}
+}
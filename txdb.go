@@ -0,0 +1,286 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+)
+
+var ErrNotInTransaction = errors.New("not supported inside a transaction")
+
+// TxDb is the Db that RunTransaction hands to its callback. Firestore
+// requires every read of a transaction to come before its first write, and
+// applies the writes at commit, so writes return the object written rather
+// than reading it back; PatchFields returns no object at all. Searches
+// run inside the transaction for QuerySearchers only. Clear, and Delete of
+// documents with subcollections or a trash, fail with ErrNotInTransaction.
+type TxDb struct {
+	db *FirestoreDb
+	tx *firestore.Transaction
+	// client runs the transaction; every ref it touches is built from it.
+	client *firestore.Client
+}
+
+var _ Db = &TxDb{}
+
+// RunTransaction runs fn with a Db whose operations commit atomically. fn
+// may be called again when the transaction conflicts with another, so it
+// must not have side effects beyond tx.
+func (db *FirestoreDb) RunTransaction(
+	ctx context.Context, fn func(tx Db) error) error {
+	client := db.nextClient()
+	err := client.RunTransaction(ctx,
+		func(ctx context.Context, tx *firestore.Transaction) error {
+			return fn(&TxDb{db: db, tx: tx, client: client})
+		})
+	if err != nil {
+		return dbError("RunTransaction", "", "transaction failed", err)
+	}
+	return nil
+}
+
+func (t *TxDb) List(
+	ctx context.Context, obj Object, collection []string) ([]Object, error) {
+	objs, _, err := t.ListWithQuery(ctx, obj, collection, nil)
+	return objs, err
+}
+
+func (t *TxDb) ListWithQuery(ctx context.Context, obj Object,
+	collection []string, q *ListQuery) ([]Object, string, error) {
+	documents := func(query firestore.Query) *firestore.DocumentIterator {
+		return t.tx.Documents(query)
+	}
+	objs, cursor, err :=
+		t.db.list(t.client, documents, AdaptLegacy(obj), collection, q)
+	return adaptV2List(objs), cursor, err
+}
+
+func (t *TxDb) ListGroup(
+	ctx context.Context, obj Object, collection_id string) ([]Object, error) {
+	documents := func(query firestore.Query) *firestore.DocumentIterator {
+		return t.tx.Documents(query)
+	}
+	return t.db.listGroup(t.client, documents, obj, "", collection_id)
+}
+
+func (t *TxDb) Clear(
+	ctx context.Context, dummy Object, collection []string) error {
+	return fmt.Errorf("%s:Clear - %w", path.Join(collection...),
+		ErrNotInTransaction)
+}
+
+func (t *TxDb) Post(
+	ctx context.Context, obj Object, collection []string) (Object, error) {
+	result, _, err := t.FindOrCreate(ctx, obj, collection)
+	return result, err
+}
+
+func (t *TxDb) FindOrCreate(ctx context.Context, obj Object,
+	collection []string) (Object, bool, error) {
+	o := AdaptLegacy(obj)
+	collection_path, err := getCollectionPath(collection, t.db.allow_reserved)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := t.db.injectAncestorKeys(o, collection); err != nil {
+		return nil, false, err
+	}
+	existing, err := t.search(ctx, "Post", collection_path, o)
+	if err != nil {
+		return nil, false, err
+	}
+	if existing != nil {
+		result, err := t.get(ctx, o, existing)
+		if err != nil {
+			return nil, false, err
+		}
+		err = t.db.afterPost(ctx, "Post", existing, result, false)
+		if err != nil {
+			return nil, false, err
+		}
+		return AdaptV2(result), false, nil
+	}
+	if err := t.db.beforeCreate(ctx, "Post", collection, o); err != nil {
+		return nil, false, err
+	}
+	if err := safeValidate("Post", collection_path, o); err != nil {
+		return nil, false, err
+	}
+	if err := safeSerialize("Post", collection_path, o); err != nil {
+		return nil, false, err
+	}
+	ref := t.client.Collection(collection_path).NewDoc()
+	if err := t.tx.Create(ref, storedValue(o)); err != nil {
+		return nil, false, dbError(
+			"Post", collection_path, "could not create object", err)
+	}
+	document := append(collection[:len(collection):len(collection)], ref.ID)
+	if err := t.db.afterPost(ctx, "Post", document, o, true); err != nil {
+		return nil, false, err
+	}
+	return obj, true, nil
+}
+
+func (t *TxDb) Put(
+	ctx context.Context, obj Object, document []string) (Object, error) {
+	o := AdaptLegacy(obj)
+	if _, _, err := getDocumentPath(document, t.db.allow_reserved); err != nil {
+		return nil, err
+	}
+	document_path := path.Join(document...)
+	if err := t.db.checkAppendOnly("Put", document); err != nil {
+		return nil, err
+	}
+	err := t.db.injectAncestorKeys(o, document[:len(document)-1])
+	if err != nil {
+		return nil, err
+	}
+	if err := t.db.beforeUpdate(ctx, "Put", document, o); err != nil {
+		return nil, err
+	}
+	if err := safeValidate("Put", document_path, o); err != nil {
+		return nil, err
+	}
+	if err := safeSerialize("Put", document_path, o); err != nil {
+		return nil, err
+	}
+	if err := t.tx.Set(
+		t.client.Doc(document_path), storedValue(o)); err != nil {
+		return nil, dbError("Put", document_path, "could not write object", err)
+	}
+	return obj, nil
+}
+
+func (t *TxDb) Patch(ctx context.Context, obj Object) (Object, error) {
+	o := AdaptLegacy(obj)
+	document, err := t.search(ctx, "Patch", "", o)
+	if err != nil {
+		return nil, err
+	}
+	if document == nil {
+		return nil, dbError("Patch", "", "could not find object", ErrNotFound)
+	}
+	if _, _, err := getDocumentPath(document, t.db.allow_reserved); err != nil {
+		return nil, err
+	}
+	if err := t.db.checkAppendOnly("Patch", document); err != nil {
+		return nil, err
+	}
+	if err := t.db.beforeUpdate(ctx, "Patch", document, o); err != nil {
+		return nil, err
+	}
+	document_path := path.Join(document...)
+	if err := safeValidate("Patch", document_path, o); err != nil {
+		return nil, err
+	}
+	if err := safeSerialize("Patch", document_path, o); err != nil {
+		return nil, err
+	}
+	if err := t.tx.Set(
+		t.client.Doc(document_path), storedValue(o)); err != nil {
+		return nil, dbError(
+			"Patch", document_path, "could not update object", err)
+	}
+	return obj, nil
+}
+
+func (t *TxDb) PatchFields(ctx context.Context, dummy Object,
+	document []string, fields map[string]interface{}) (Object, error) {
+	if _, _, err := getDocumentPath(document, t.db.allow_reserved); err != nil {
+		return nil, err
+	}
+	document_path := path.Join(document...)
+	if err := t.db.checkAppendOnly("PatchFields", document); err != nil {
+		return nil, err
+	}
+	fields, err := t.db.beforePatchFields(ctx, "PatchFields", document, fields)
+	if err != nil {
+		return nil, err
+	}
+	updates, err := fieldUpdates(document_path, fields, t.db.allow_reserved)
+	if err != nil || len(updates) == 0 {
+		return nil, err
+	}
+	err = t.tx.Update(t.client.Doc(document_path), updates)
+	if err != nil {
+		return nil, dbError(
+			"PatchFields", document_path, "could not update object", err)
+	}
+	return nil, nil
+}
+
+func (t *TxDb) Get(
+	ctx context.Context, dummy Object, document []string) (Object, error) {
+	if _, _, err := getDocumentPath(document, t.db.allow_reserved); err != nil {
+		return nil, err
+	}
+	result, err := t.get(ctx, AdaptLegacy(dummy), document)
+	return AdaptV2(result), err
+}
+
+func (t *TxDb) get(
+	ctx context.Context, obj ObjectV2, document []string) (ObjectV2, error) {
+	document_path := path.Join(document...)
+	doc, err := t.tx.Get(t.client.Doc(document_path))
+	if err != nil {
+		return nil, dbError("Get", document_path, "could not get object", err)
+	}
+	result, err := safeDeserialize("Get", document_path, obj, doc)
+	if err != nil {
+		return nil, err
+	}
+	return t.db.afterGet(ctx, "Get", document, result)
+}
+
+func (t *TxDb) Delete(
+	ctx context.Context, dummy Object, document []string) error {
+	o := AdaptLegacy(dummy)
+	if _, _, err := getDocumentPath(document, t.db.allow_reserved); err != nil {
+		return err
+	}
+	document_path := path.Join(document...)
+	if _, ok := t.db.trashRetention(document); ok ||
+		len(subcollections(o)) > 0 {
+		return fmt.Errorf("%s:Delete - %w", document_path, ErrNotInTransaction)
+	}
+	if err := t.db.checkAppendOnly("Delete", document); err != nil {
+		return err
+	}
+	if err := t.db.beforeDelete(ctx, "Delete", document); err != nil {
+		return err
+	}
+	if err := t.tx.Delete(t.client.Doc(document_path)); err != nil {
+		return dbError("Delete", document_path, "could not delete object", err)
+	}
+	return nil
+}
+
+// search finds obj's document inside the transaction when obj is a
+// QuerySearcher, and with its plain Search otherwise.
+func (t *TxDb) search(ctx context.Context, op, collection_path string,
+	obj ObjectV2) ([]string, error) {
+	client := t.client
+	query, ok, err := safeSearchQuery(op, collection_path, obj, client)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		document, err := safeSearch(ctx, op, collection_path, obj, client)
+		if len(document) == 0 {
+			return nil, err
+		}
+		return document, err
+	}
+	docs, err := t.tx.Documents(query.Limit(1)).GetAll()
+	if err != nil {
+		return nil, dbError(op, collection_path, "could not search", err)
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	return strings.Split(documentRefPath(docs[0].Ref), "/"), nil
+}
@@ -0,0 +1,131 @@
+package rest2firestore
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// findOrCreateTx runs query and the create in one transaction. When a
+// concurrent Post wins, the retried transaction finds its document, so
+// every caller gets the winning write back.
+func (db *FirestoreDb) findOrCreateTx(ctx context.Context,
+	client *firestore.Client, query firestore.Query, obj ObjectV2,
+	collection []string) (ObjectV2, []string, bool, error) {
+	collection_path, err := getCollectionPath(collection, db.allow_reserved)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	// Without hooks the object is serialized once up front, as the
+	// transaction body may be retried. Hooks only run once the search has
+	// found nothing, so the object is checked after them instead.
+	has_hooks := len(db.hooksFor(collection)) > 0
+	if !has_hooks {
+		if err := safeValidate("Post", collection_path, obj); err != nil {
+			return nil, nil, false, err
+		}
+		if err := safeSerialize("Post", collection_path, obj); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	ref := client.Collection(collection_path).NewDoc()
+	var found *firestore.DocumentRef
+	err = client.RunTransaction(ctx,
+		func(ctx context.Context, tx *firestore.Transaction) error {
+			found = nil
+			docs, err := tx.Documents(query.Limit(1)).GetAll()
+			if err != nil {
+				return err
+			}
+			if len(docs) > 0 {
+				found = docs[0].Ref
+				return nil
+			}
+			if has_hooks {
+				err := db.beforeCreate(ctx, "Post", collection, obj)
+				if err != nil {
+					return err
+				}
+				if err := safeValidate("Post", collection_path, obj); err != nil {
+					return err
+				}
+				if err := safeSerialize("Post", collection_path, obj); err != nil {
+					return err
+				}
+			}
+			return tx.Create(ref, storedValue(obj))
+		})
+	if err != nil {
+		return nil, nil, false, dbError(
+			"Post", collection_path, "could not create object", err)
+	}
+	if found != nil {
+		document := strings.Split(documentRefPath(found), "/")
+		result, err := db.get(ctx, obj, document)
+		return result, document, false, err
+	}
+	document := append(collection[:len(collection):len(collection)], ref.ID)
+	result, err := db.get(ctx, obj, document)
+	return result, document, true, err
+}
+
+// patchTx finds the document with query and overwrites it in one
+// transaction.
+// patchTx runs on client, which built query.
+func (db *FirestoreDb) patchTx(ctx context.Context,
+	client *firestore.Client, query firestore.Query, obj ObjectV2) (
+	ObjectV2, error) {
+	// Serialized once up front: the transaction body may be retried.
+	if err := safeValidate("Patch", "", obj); err != nil {
+		return nil, err
+	}
+	if err := safeSerialize("Patch", "", obj); err != nil {
+		return nil, err
+	}
+	var document []string
+	err := client.RunTransaction(ctx,
+		func(ctx context.Context, tx *firestore.Transaction) error {
+			docs, err := tx.Documents(query.Limit(1)).GetAll()
+			if err != nil {
+				return err
+			}
+			if len(docs) == 0 {
+				return status.Error(codes.NotFound, "no document matches")
+			}
+			document = strings.Split(documentRefPath(docs[0].Ref), "/")
+			if _, _, err := getDocumentPath(
+				document, db.allow_reserved); err != nil {
+				return err
+			}
+			if err := db.checkAppendOnly("Patch", document); err != nil {
+				return err
+			}
+			// Hooks need the document, so they run here, and the object is
+			// checked again after them.
+			if len(db.hooksFor(document[:len(document)-1])) > 0 {
+				err = db.beforeUpdate(ctx, "Patch", document, obj)
+				if err != nil {
+					return err
+				}
+				document_path := path.Join(document...)
+				err = safeValidate("Patch", document_path, obj)
+				if err != nil {
+					return err
+				}
+				err = safeSerialize("Patch", document_path, obj)
+				if err != nil {
+					return err
+				}
+			}
+			return tx.Set(docs[0].Ref, storedValue(obj))
+		})
+	if err != nil {
+		return nil, dbError(
+			"Patch", path.Join(document...), "could not update object", err)
+	}
+	return db.get(ctx, obj, document)
+}
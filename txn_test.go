@@ -0,0 +1,38 @@
+package rest2firestore
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentPostsCreateOne(t *testing.T) {
+	forEachDb(t, func(t *testing.T, db Db, collection []string) {
+		ctx := context.Background()
+		const posts = 20
+		var wg sync.WaitGroup
+		errs := make([]error, posts)
+		for i := 0; i < posts; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = db.Post(ctx,
+					userAt(collection, "a@example.com", "Alice"), collection)
+			}(i)
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil {
+				t.Errorf("Post %d: %v", i, err)
+			}
+		}
+		objs, err := db.List(ctx, AdaptV2(&testUser{}), collection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objs) != 1 {
+			t.Errorf("%d concurrent Posts left %d documents, want 1",
+				posts, len(objs))
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package rest2firestore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// Canonical JSON mapping for Firestore values:
+//
+//	Timestamp   -> {"$timestamp": "<RFC3339Nano in UTC>"}
+//	GeoPoint    -> {"$geopoint": {"latitude": ..., "longitude": ...}}
+//	DocumentRef -> {"$ref": "relative/document/path"}
+//	Bytes       -> {"$bytes": "<standard base64>"}
+//	float64     -> number with a fraction or exponent, such as 3.0
+//	NaN, ±Inf   -> ErrNonFiniteFloat, or null with NonFiniteAsNull
+//
+// DecodeValue applies the inverse. Strings are always read back as strings,
+// whatever they look like, which is why a Timestamp is wrapped rather than
+// a bare RFC3339Nano string: a string field holding a date would otherwise
+// come back as a Timestamp. For the same reason only the tagged form is a
+// GeoPoint, and a plain map with latitude and longitude stays a map.
+
+var ErrNonFiniteFloat = errors.New("NaN and Inf have no JSON encoding")
+
+type ValueOptions struct {
+	NonFiniteAsNull bool
+}
+
+func EncodeValue(v interface{}, opts ValueOptions) (interface{}, error) {
+	switch value := v.(type) {
+	case time.Time:
+		return map[string]interface{}{
+			"$timestamp": value.UTC().Format(time.RFC3339Nano),
+		}, nil
+	case *latlng.LatLng:
+		if value == nil {
+			return nil, nil
+		}
+		return map[string]interface{}{
+			"$geopoint": map[string]interface{}{
+				"latitude":  value.Latitude,
+				"longitude": value.Longitude,
+			},
+		}, nil
+	case *firestore.DocumentRef:
+		if value == nil {
+			return nil, nil
+		}
+		return map[string]interface{}{"$ref": documentRefPath(value)}, nil
+	case []byte:
+		return map[string]interface{}{
+			"$bytes": base64.StdEncoding.EncodeToString(value),
+		}, nil
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			if opts.NonFiniteAsNull {
+				return nil, nil
+			}
+			return nil, ErrNonFiniteFloat
+		}
+		return encodeFloat(value), nil
+	case map[string]interface{}:
+		encoded := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			item_value, err := EncodeValue(item, opts)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			encoded[key] = item_value
+		}
+		return encoded, nil
+	case []interface{}:
+		encoded := make([]interface{}, len(value))
+		for i, item := range value {
+			item_value, err := EncodeValue(item, opts)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			encoded[i] = item_value
+		}
+		return encoded, nil
+	}
+	return v, nil
+}
+
+// encodeFloat keeps whole floats apart from integers once they are JSON.
+func encodeFloat(value float64) json.Number {
+	encoded := strconv.FormatFloat(value, 'g', -1, 64)
+	if !strings.ContainsAny(encoded, ".e") {
+		encoded += ".0"
+	}
+	return json.Number(encoded)
+}
+
+// DecodeValue converts a value produced by EncodeValue (or parsed from
+// JSON) back into its Firestore representation. client is needed to build
+// DocumentRefs and may be nil when no "$ref" values are expected. A
+// json.Number becomes an int64 when it is one, and a float64 otherwise.
+func DecodeValue(client *firestore.Client, v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i, nil
+		}
+		return value.Float64()
+	case map[string]interface{}:
+		if decoded, ok, err := decodeSpecialValue(client, value); ok {
+			return decoded, err
+		}
+		decoded := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			item_value, err := DecodeValue(client, item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			decoded[key] = item_value
+		}
+		return decoded, nil
+	case []interface{}:
+		decoded := make([]interface{}, len(value))
+		for i, item := range value {
+			item_value, err := DecodeValue(client, item)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			decoded[i] = item_value
+		}
+		return decoded, nil
+	}
+	return v, nil
+}
+
+func decodeSpecialValue(client *firestore.Client, value map[string]interface{}) (
+	interface{}, bool, error) {
+	switch len(value) {
+	case 1:
+		if ref, ok := value["$ref"].(string); ok {
+			if client == nil {
+				return nil, true, fmt.Errorf(
+					"%s: cannot decode $ref without a client", ref)
+			}
+			doc := client.Doc(ref)
+			if doc == nil {
+				return nil, true, fmt.Errorf(
+					"%s: $ref is not a document path", ref)
+			}
+			return doc, true, nil
+		}
+		if encoded, ok := value["$timestamp"].(string); ok {
+			t, err := time.Parse(time.RFC3339Nano, encoded)
+			if err != nil {
+				return nil, true, fmt.Errorf("$timestamp: %w", err)
+			}
+			return t.UTC(), true, nil
+		}
+		if encoded, ok := value["$bytes"].(string); ok {
+			decoded, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, true, fmt.Errorf("$bytes: %w", err)
+			}
+			return decoded, true, nil
+		}
+		if encoded, ok := value["$geopoint"]; ok {
+			point, _ := encoded.(map[string]interface{})
+			latitude, lat_ok := jsonFloat(point["latitude"])
+			longitude, lng_ok := jsonFloat(point["longitude"])
+			if len(point) != 2 || !lat_ok || !lng_ok {
+				return nil, true, errors.New(
+					"$geopoint: want latitude and longitude numbers")
+			}
+			return &latlng.LatLng{
+				Latitude: latitude, Longitude: longitude}, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// jsonFloat reads a number parsed from JSON, with or without UseNumber.
+func jsonFloat(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case float64:
+		return value, true
+	case json.Number:
+		f, err := value.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func documentRefPath(ref *firestore.DocumentRef) string {
+	if ref.Path == "" {
+		return ref.ID
+	}
+	if i := strings.Index(ref.Path, "/documents/"); i >= 0 {
+		return ref.Path[i+len("/documents/"):]
+	}
+	return ref.Path
+}
@@ -0,0 +1,129 @@
+package rest2firestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/option"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+func TestValueRoundTrip(t *testing.T) {
+	// The client is never dialled; it only builds the DocumentRefs.
+	client, err := firestore.NewClient(context.Background(), memory_project,
+		option.WithoutAuthentication(), option.WithEndpoint("localhost:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	value := map[string]interface{}{
+		"timestamp": time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.UTC),
+		"geo":       &latlng.LatLng{Latitude: 1.5, Longitude: -0.25},
+		"bytes":     []byte("hello"),
+		"float":     2.0,
+		"small":     1e-7,
+		"int":       int64(42),
+		"string":    "2024-01-01T00:00:00Z",
+		"list":      []interface{}{int64(1), 2.5, []byte{0}},
+		"map":       map[string]interface{}{"nested": true, "null": nil},
+		"point": map[string]interface{}{
+			"latitude": int64(1), "longitude": 2.5},
+	}
+	encoded, err := EncodeValue(value, ValueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"float":2.0`, `"int":42`,
+		`"string":"2024-01-01T00:00:00Z"`,
+		`"timestamp":{"$timestamp":"2024-01-02T03:04:05.123456789Z"}`,
+		`"bytes":{"$bytes":"aGVsbG8="}`,
+		`"geo":{"$geopoint":{"latitude":1.5,"longitude":-0.25}}`,
+		`"point":{"latitude":1,"longitude":2.5}`} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("encoded %s, want it to contain %s", data, want)
+		}
+	}
+	decoded, err := DecodeValue(client, decodeJSON(t, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, value) {
+		t.Errorf("round trip gave\n%#v\nwant\n%#v", decoded, value)
+	}
+
+	ref, err := DecodeValue(client, decodeJSON(t, []byte(
+		`{"$ref": "users/u1/posts/p1"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, ok := ref.(*firestore.DocumentRef)
+	if !ok || documentRefPath(doc) != "users/u1/posts/p1" {
+		t.Fatalf("$ref decoded to %#v", ref)
+	}
+	encoded, err = EncodeValue(doc, ValueOptions{})
+	if err != nil || !reflect.DeepEqual(encoded,
+		map[string]interface{}{"$ref": "users/u1/posts/p1"}) {
+		t.Errorf("DocumentRef encoded to %v, %v", encoded, err)
+	}
+	if _, err := DecodeValue(nil, decodeJSON(t, []byte(
+		`{"$ref": "users/u1"}`))); err == nil {
+		t.Errorf("$ref without a client decoded")
+	}
+	if _, err := DecodeValue(client, decodeJSON(t, []byte(
+		`{"$ref": "users"}`))); err == nil {
+		t.Errorf("$ref to a collection decoded")
+	}
+	if _, err := DecodeValue(nil, decodeJSON(t, []byte(
+		`{"$geopoint": {"latitude": "north", "longitude": 0}}`))); err == nil {
+		t.Errorf("$geopoint with a string latitude decoded")
+	}
+}
+
+func TestNonFiniteFloats(t *testing.T) {
+	for _, f := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		value := map[string]interface{}{"list": []interface{}{f}}
+		if _, err := EncodeValue(value, ValueOptions{}); !errors.Is(
+			err, ErrNonFiniteFloat) {
+			t.Errorf("EncodeValue(%v): %v, want ErrNonFiniteFloat", f, err)
+		}
+		encoded, err := EncodeValue(value, ValueOptions{NonFiniteAsNull: true})
+		if err != nil || !reflect.DeepEqual(encoded,
+			map[string]interface{}{"list": []interface{}{nil}}) {
+			t.Errorf("EncodeValue(%v) with NonFiniteAsNull: %v, %v",
+				f, encoded, err)
+		}
+	}
+}
+
+func TestValueRoundTripEmulator(t *testing.T) {
+	db := emulatorDb(t)
+	collection := testCollection("things")
+	router := NewRouter(db).RegisterRawResource(collection[0],
+		RawOptions{Writable: true, Client: db.client})
+	target := "/" + collection[0] + "/t1"
+	w, _ := serve(router, http.MethodPut, target, rawDocument)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT: status %d: %s", w.Code, w.Body)
+	}
+	w, body := serve(router, http.MethodGet, target, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: status %d: %s", w.Code, body)
+	}
+	want := decodeJSON(t, []byte(rawDocument)).(map[string]interface{})
+	want["$id"] = "t1"
+	if got := decodeJSON(t, body); !reflect.DeepEqual(got, want) {
+		t.Errorf("GET returned\n%s\nwant\n%v", body, want)
+	}
+}
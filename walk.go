@@ -0,0 +1,211 @@
+package rest2firestore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WalkFunc is called by Walk with the full path of every document visited.
+type WalkFunc func(document []string, obj Object) error
+
+func checkCollectionID(collection_id string, allow_reserved bool) error {
+	if collection_id == "" || strings.Contains(collection_id, "/") {
+		return fmt.Errorf("%s: collection ID should be a single path level: %w",
+			collection_id, ErrInvalidPath)
+	}
+	if !allow_reserved && isReservedName(collection_id) {
+		return fmt.Errorf("%s: %w", collection_id, ErrReservedPath)
+	}
+	return nil
+}
+
+// ScopedGroupLister is the optional capability of a Db to list a
+// collection group below one document only. NamespacedDb uses it to keep
+// collection group reads inside its namespace.
+type ScopedGroupLister interface {
+	ListGroupUnder(ctx context.Context, obj Object, parent []string,
+		collection_id string) ([]Object, error)
+}
+
+var (
+	_ ScopedGroupLister = &FirestoreDb{}
+	_ ScopedGroupLister = &MemoryDb{}
+)
+
+// ListGroup lists every document in a collection named collection_id,
+// wherever it sits in the hierarchy. Documents under reserved collections
+// are left out.
+func (db *FirestoreDb) ListGroup(
+	ctx context.Context, obj Object, collection_id string) ([]Object, error) {
+	documents := func(query firestore.Query) *firestore.DocumentIterator {
+		return query.Documents(ctx)
+	}
+	return db.listGroup(db.nextClient(), documents, obj, "", collection_id)
+}
+
+// ListGroupUnder is ListGroup for the documents below parent. The group is
+// still read in full and filtered here.
+func (db *FirestoreDb) ListGroupUnder(ctx context.Context, obj Object,
+	parent []string, collection_id string) ([]Object, error) {
+	collection_path, document_id, err :=
+		getDocumentPath(parent, db.allow_reserved)
+	if err != nil {
+		return nil, err
+	}
+	documents := func(query firestore.Query) *firestore.DocumentIterator {
+		return query.Documents(ctx)
+	}
+	return db.listGroup(db.nextClient(), documents, obj,
+		path.Join(collection_path, document_id)+"/", collection_id)
+}
+
+// listGroup keeps the documents whose path starts with prefix.
+func (db *FirestoreDb) listGroup(client *firestore.Client,
+	documents func(firestore.Query) *firestore.DocumentIterator,
+	obj Object, prefix, collection_id string) ([]Object, error) {
+	if err := checkCollectionID(collection_id, db.allow_reserved); err != nil {
+		return nil, err
+	}
+	o := AdaptLegacy(obj)
+	all, err := documents(client.CollectionGroup(collection_id).Query).GetAll()
+	if err != nil {
+		return nil, dbError(
+			"ListGroup", collection_id, "could not list objects", err)
+	}
+	docs := all[:0]
+	for _, doc := range all {
+		document_path := documentRefPath(doc.Ref)
+		if !strings.HasPrefix(document_path, prefix) {
+			continue
+		}
+		document := strings.Split(document_path, "/")
+		if db.allow_reserved || !isReservedPath(document) {
+			docs = append(docs, doc)
+		}
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	objs, err := safeDeserializeList("ListGroup", collection_id, o, docs)
+	if err != nil {
+		return nil, dbError(
+			"ListGroup", collection_id, "could not deserialize list", err)
+	}
+	objs, err = safePostprocessList("ListGroup", collection_id, o, objs)
+	return adaptV2List(objs), err
+}
+
+// Walk calls fn for the document at document and then, depth first, for
+// every document in the subcollections dummy declares. Documents are read
+// BatchSize at a time, so memory stays bounded however large the tree is.
+// Missing documents are not passed to fn, but their subcollections are
+// still walked. An error from fn stops the walk and is returned as is. The
+// tree limits apply as for Delete, with a TreeTooLargeError past them,
+// and TreeProgress sees every document visited.
+func (db *FirestoreDb) Walk(ctx context.Context, dummy Object,
+	document []string, fn WalkFunc) error {
+	obj := AdaptLegacy(dummy)
+	if err := db.prototypes.check(obj); err != nil {
+		return err
+	}
+	if _, _, err := getDocumentPath(document, db.allow_reserved); err != nil {
+		return err
+	}
+	document_path := path.Join(document...)
+	client := db.clientFor(document_path)
+	doc, err := client.Doc(document_path).Get(ctx)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return dbError("Walk", document_path, "could not get object", err)
+	}
+	return db.walkDocument(
+		ctx, db.newTreeWalk(false), client, obj, document, doc, 0, fn)
+}
+
+func (db *FirestoreDb) walkDocument(ctx context.Context, w *treeWalk,
+	client *firestore.Client, obj ObjectV2, document []string,
+	doc *firestore.DocumentSnapshot, depth int, fn WalkFunc) error {
+	document_path := path.Join(document...)
+	if err := w.visit(document_path); err != nil {
+		return err
+	}
+	if doc != nil && doc.Exists() {
+		result, err := safeDeserialize("Walk", document_path, obj, doc)
+		if err != nil {
+			return dbError(
+				"Walk", document_path, "could not deserialize object", err)
+		}
+		if err := fn(document, AdaptV2(result)); err != nil {
+			return err
+		}
+	}
+	subs, err := safeSubcollections("Walk", document_path, obj)
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		collection := append(document[:len(document):len(document)], sub.Name)
+		err := db.walkCollection(
+			ctx, w, client, AdaptLegacy(sub.Obj), collection, depth+1, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkCollection streams the refs of collection, which include phantom
+// parents, and reads them a batch at a time.
+func (db *FirestoreDb) walkCollection(ctx context.Context, w *treeWalk,
+	client *firestore.Client, obj ObjectV2, collection []string, depth int,
+	fn WalkFunc) error {
+	collection_path, err := getCollectionPath(collection, db.allow_reserved)
+	if err != nil {
+		return err
+	}
+	if err := w.enter(collection_path, depth); err != nil {
+		return err
+	}
+	width := 0
+	size := db.batchSize()
+	refs := client.Collection(collection_path).DocumentRefs(ctx)
+	batch := make([]*firestore.DocumentRef, 0, size)
+	for {
+		ref, err := refs.Next()
+		if err != nil && err != iterator.Done {
+			return dbError(
+				"Walk", collection_path, "could not list objects", err)
+		}
+		if err == nil {
+			batch = append(batch, ref)
+			width++
+			w.width(width)
+		}
+		if len(batch) == size || (err == iterator.Done && len(batch) > 0) {
+			docs, get_err := client.GetAll(ctx, batch)
+			if get_err != nil {
+				return dbError(
+					"Walk", collection_path, "could not get objects", get_err)
+			}
+			for i, doc := range docs {
+				document := append(
+					collection[:len(collection):len(collection)], batch[i].ID)
+				err := db.walkDocument(
+					ctx, w, client, obj, document, doc, depth, fn)
+				if err != nil {
+					return err
+				}
+			}
+			batch = batch[:0]
+		}
+		if err == iterator.Done {
+			return nil
+		}
+	}
+}
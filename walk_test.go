@@ -0,0 +1,65 @@
+package rest2firestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	db := emulatorDb(t)
+	ctx := context.Background()
+	collection := testCollection("authors")
+	author := append(collection, "a1")
+	put := func(obj Object, document ...string) {
+		t.Helper()
+		if _, err := db.Put(ctx, obj, document); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(AdaptV2(&testAuthor{Name: "Ann"}), author...)
+	put(AdaptV2(&testPost{Title: "b"}), append(author, "posts", "p2")...)
+	put(AdaptV2(&testPost{Title: "a"}), append(author, "posts", "p1")...)
+	// a2 is missing, but its posts are still walked.
+	put(AdaptV2(&testPost{Title: "c"}),
+		append(collection, "a2", "posts", "p1")...)
+
+	walk := func(document []string, stop int) ([]string, error) {
+		var visited []string
+		err := db.Walk(ctx, AdaptV2(&testAuthor{}), document,
+			func(document []string, obj Object) error {
+				visited = append(visited, fmt.Sprintf("%s %T",
+					path.Join(document[len(collection):]...), Underlying(obj)))
+				if len(visited) == stop {
+					return errStopWalk
+				}
+				return nil
+			})
+		return visited, err
+	}
+	visited, err := walk(author, 0)
+	want := []string{
+		"a1 *rest2firestore.testAuthor",
+		"a1/posts/p1 *rest2firestore.testPost",
+		"a1/posts/p2 *rest2firestore.testPost",
+	}
+	if err != nil || !reflect.DeepEqual(visited, want) {
+		t.Errorf("Walk visited %q, %v, want %q", visited, err, want)
+	}
+	visited, err = walk(append(collection, "a2"), 0)
+	want = []string{"a2/posts/p1 *rest2firestore.testPost"}
+	if err != nil || !reflect.DeepEqual(visited, want) {
+		t.Errorf("Walk of a missing document visited %q, %v, want %q",
+			visited, err, want)
+	}
+	visited, err = walk(author, 2)
+	if err != errStopWalk || len(visited) != 2 {
+		t.Errorf("Walk stopped after %q, %v, want 2 documents and "+
+			"errStopWalk", visited, err)
+	}
+}
+
+var errStopWalk = errors.New("stop")
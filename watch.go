@@ -0,0 +1,161 @@
+package rest2firestore
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+)
+
+type EventKind string
+
+const (
+	EventAdded    EventKind = "added"
+	EventModified EventKind = "modified"
+	EventRemoved  EventKind = "removed"
+)
+
+// ChangeEvent is a change seen by Watch or WatchDoc. Obj is the document
+// after the change, or its last state for EventRemoved. When the document
+// could not be deserialized, Err is set instead of Obj and the watch goes
+// on. An event with Err but no Document is a listener error, the last one
+// before the channel is closed.
+type ChangeEvent struct {
+	Kind     EventKind
+	Document []string
+	Obj      Object
+	Err      error
+}
+
+func eventKind(kind firestore.DocumentChangeKind) EventKind {
+	switch kind {
+	case firestore.DocumentAdded:
+		return EventAdded
+	case firestore.DocumentRemoved:
+		return EventRemoved
+	}
+	return EventModified
+}
+
+// sendEvent delivers event unless ctx is done first.
+func sendEvent(ctx context.Context, events chan<- ChangeEvent,
+	event ChangeEvent) bool {
+	select {
+	case events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// watchError is the event for an error of a snapshot listener, or nil when
+// the listener only stopped because ctx is done.
+func watchError(ctx context.Context, op, path string, err error) *ChangeEvent {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return &ChangeEvent{Err: dbError(op, path, "listener failed", err)}
+}
+
+// Watch streams the changes to the documents of collection until ctx is
+// done, which closes the channel. The first events are EventAdded for
+// every document already there. A listener error is sent as a last event
+// with Err set; the caller may Watch again to resume.
+func (db *FirestoreDb) Watch(ctx context.Context, obj Object,
+	collection []string) (<-chan ChangeEvent, error) {
+	collection_path, err := getCollectionPath(collection, db.allow_reserved)
+	if err != nil {
+		return nil, err
+	}
+	o := AdaptLegacy(obj)
+	client := db.clientFor(collection_path)
+	events := make(chan ChangeEvent)
+	go func() {
+		defer close(events)
+		it := client.Collection(collection_path).Snapshots(ctx)
+		defer it.Stop()
+		for {
+			snapshot, err := it.Next()
+			if err != nil {
+				if event := watchError(
+					ctx, "Watch", collection_path, err); event != nil {
+					sendEvent(ctx, events, *event)
+				}
+				return
+			}
+			for _, change := range snapshot.Changes {
+				document_path := documentRefPath(change.Doc.Ref)
+				event := ChangeEvent{
+					Kind:     eventKind(change.Kind),
+					Document: strings.Split(document_path, "/"),
+				}
+				result, err :=
+					safeDeserialize("Watch", document_path, o, change.Doc)
+				if err != nil {
+					event.Err = dbError("Watch", document_path,
+						"could not deserialize object", err)
+				} else {
+					event.Obj = AdaptV2(result)
+				}
+				if !sendEvent(ctx, events, event) {
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// WatchDoc is Watch for a single document. A document missing when the
+// watch starts yields EventAdded once it is created.
+func (db *FirestoreDb) WatchDoc(ctx context.Context, obj Object,
+	document []string) (<-chan ChangeEvent, error) {
+	if _, _, err := getDocumentPath(document, db.allow_reserved); err != nil {
+		return nil, err
+	}
+	o := AdaptLegacy(obj)
+	document_path := path.Join(document...)
+	ref := db.clientFor(document_path).Doc(document_path)
+	events := make(chan ChangeEvent)
+	go func() {
+		defer close(events)
+		it := ref.Snapshots(ctx)
+		defer it.Stop()
+		var last *firestore.DocumentSnapshot
+		for {
+			doc, err := it.Next()
+			if err != nil {
+				if event := watchError(
+					ctx, "WatchDoc", document_path, err); event != nil {
+					sendEvent(ctx, events, *event)
+				}
+				return
+			}
+			event := ChangeEvent{Kind: EventModified, Document: document}
+			switch {
+			case !doc.Exists() && last == nil:
+				continue
+			case !doc.Exists():
+				event.Kind = EventRemoved
+				doc, last = last, nil
+			case last == nil:
+				event.Kind = EventAdded
+				last = doc
+			default:
+				last = doc
+			}
+			result, err := safeDeserialize("WatchDoc", document_path, o, doc)
+			if err != nil {
+				event.Err = dbError("WatchDoc", document_path,
+					"could not deserialize object", err)
+			} else {
+				event.Obj = AdaptV2(result)
+			}
+			if !sendEvent(ctx, events, event) {
+				return
+			}
+		}
+	}()
+	return events, nil
+}
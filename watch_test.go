@@ -0,0 +1,128 @@
+package rest2firestore
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// nextEvent waits for the next event, reporting false once events is
+// closed.
+func nextEvent(t *testing.T, events <-chan ChangeEvent) (ChangeEvent, bool) {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		return event, ok
+	case <-time.After(10 * time.Second):
+		t.Fatal("no event and the channel is still open")
+	}
+	return ChangeEvent{}, false
+}
+
+type watchFunc func(ctx context.Context, db *FirestoreDb) (
+	<-chan ChangeEvent, error)
+
+var watch_funcs = map[string]watchFunc{
+	"Watch": func(ctx context.Context, db *FirestoreDb) (
+		<-chan ChangeEvent, error) {
+		return db.Watch(ctx, AdaptV2(&watchUser{}), []string{"users"})
+	},
+	"WatchDoc": func(ctx context.Context, db *FirestoreDb) (
+		<-chan ChangeEvent, error) {
+		return db.WatchDoc(ctx, AdaptV2(&watchUser{}), []string{"users", "u1"})
+	},
+}
+
+func TestWatchCancelClosesChannel(t *testing.T) {
+	for name, watch := range watch_funcs {
+		t.Run(name, func(t *testing.T) {
+			db := NewFirestoreDb(offlineClients(t, 1)[0])
+			ctx, cancel := context.WithCancel(context.Background())
+			events, err := watch(ctx, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cancel()
+			// Cancelling is not a listener error, so no event is sent.
+			if event, ok := nextEvent(t, events); ok {
+				t.Errorf("got %+v after cancelling, want the channel closed",
+					event)
+			}
+		})
+	}
+}
+
+func TestWatchListenerErrorIsLast(t *testing.T) {
+	for name, watch := range watch_funcs {
+		t.Run(name, func(t *testing.T) {
+			client := offlineClients(t, 1)[0]
+			events, err := watch(context.Background(), NewFirestoreDb(client))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A closed connection is a permanent listener error.
+			client.Close()
+			event, ok := nextEvent(t, events)
+			if !ok {
+				t.Fatal("the channel closed without the listener error")
+			}
+			if event.Err == nil || event.Document != nil || event.Obj != nil ||
+				status.Code(event.Err) != codes.Canceled ||
+				!strings.Contains(event.Err.Error(), name+" - listener failed") {
+				t.Errorf("got %+v, want only a listener error", event)
+			}
+			if event, ok := nextEvent(t, events); ok {
+				t.Errorf("got %+v after the listener error, want the channel "+
+					"closed", event)
+			}
+		})
+	}
+}
+
+func TestWatchRemovedCarriesLastState(t *testing.T) {
+	db := emulatorDb(t)
+	collection := testCollection("users")
+	document := append(collection, "u1")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	collection_events, err := db.Watch(ctx, AdaptV2(&watchUser{}), collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc_events, err := db.WatchDoc(ctx, AdaptV2(&watchUser{}), document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"first", "last"} {
+		if _, err := db.Put(ctx, AdaptV2(&watchUser{Name: name}),
+			document); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(ctx, AdaptV2(&watchUser{}), document); err != nil {
+		t.Fatal(err)
+	}
+	for name, events := range map[string]<-chan ChangeEvent{
+		"Watch": collection_events, "WatchDoc": doc_events} {
+		// Watch may see the two writes as one change; skip to the removal.
+		var event ChangeEvent
+		for event.Kind != EventRemoved {
+			var ok bool
+			if event, ok = nextEvent(t, events); !ok {
+				t.Fatalf("%s closed before the removal", name)
+			}
+			if event.Err != nil {
+				t.Fatalf("%s: %v", name, event.Err)
+			}
+		}
+		if event.Obj == nil || Underlying(event.Obj).(*watchUser).Name != "last" ||
+			strings.Join(event.Document, "/") != strings.Join(document, "/") {
+			t.Errorf("%s removal = %+v, want the last state of %v", name,
+				event, document)
+		}
+	}
+}